@@ -0,0 +1,110 @@
+import {
+  ClientMessage,
+  ControlMessage,
+  Envelope,
+  QueryParameters,
+  RECONNECT_CLOSE_CODES,
+  SUBPROTOCOL,
+  TOKEN_SUBPROTOCOL_PREFIX,
+} from "./protocol";
+
+export interface ClientOptions<R = unknown> {
+  /** base URL of the listener endpoint, e.g. wss://log-socket.example.com:10001 */
+  url: string;
+  /** flow references in kind/namespace/name form, more can be subscribed to later */
+  flows: string[];
+  /** token offered as a websocket subprotocol, since browsers cannot set headers of websocket requests */
+  token?: string;
+  /** query parameters of the connection request, records are always wrapped in envelopes */
+  query?: Omit<QueryParameters, "multiplex" | "format"> & { format?: "raw" | "ndjson" };
+  onRecord: (envelope: Envelope<R>) => void;
+  onControl?: (msg: ControlMessage) => void;
+  /** called when the connection is closed, reconnect tells whether reconnecting is expected to succeed */
+  onClose?: (code: number, reason: string, reconnect: boolean) => void;
+  /** constructor of websockets, the global WebSocket by default */
+  WebSocket?: typeof WebSocket;
+}
+
+/**
+ * Client streams the records of flows over a multiplexed connection.
+ * The last sequence number received of each flow is kept in lastSequences, so that callers can resume with the after query parameter.
+ */
+export class Client<R = unknown> {
+  readonly lastSequences = new Map<string, number>();
+  private readonly socket: WebSocket;
+
+  constructor(private readonly opts: ClientOptions<R>) {
+    const WS = opts.WebSocket ?? WebSocket;
+    const protocols = [SUBPROTOCOL];
+    if (opts.token) {
+      protocols.push(TOKEN_SUBPROTOCOL_PREFIX + base64URL(opts.token));
+    }
+    this.socket = new WS(connectionURL(opts), protocols);
+    this.socket.onmessage = (event) => this.handleFrame(event.data);
+    this.socket.onclose = (event) => opts.onClose?.(event.code, event.reason, RECONNECT_CLOSE_CODES.has(event.code));
+  }
+
+  subscribe(flow: string): void {
+    this.send({ action: "subscribe", flow });
+  }
+
+  unsubscribe(flow: string): void {
+    this.send({ action: "unsubscribe", flow });
+  }
+
+  /** acknowledges the records of the flow up to the sequence number, on connections with the ack query parameter */
+  ack(flow: string, sequence: number): void {
+    this.send({ action: "ack", flow, sequence });
+  }
+
+  close(): void {
+    this.socket.close(1000);
+  }
+
+  private send(msg: ClientMessage): void {
+    this.socket.send(JSON.stringify(msg));
+  }
+
+  private handleFrame(data: unknown): void {
+    if (typeof data !== "string") {
+      return;
+    }
+    for (const line of data.split("\n")) {
+      if (line === "") {
+        continue;
+      }
+      const frame = JSON.parse(line);
+      if (Array.isArray(frame)) {
+        frame.forEach((envelope: Envelope<R>) => this.handleRecord(envelope));
+      } else if ("control" in frame) {
+        this.opts.onControl?.(frame as ControlMessage);
+      } else {
+        this.handleRecord(frame as Envelope<R>);
+      }
+    }
+  }
+
+  private handleRecord(envelope: Envelope<R>): void {
+    if (envelope.sequence !== undefined) {
+      this.lastSequences.set(envelope.flow, envelope.sequence);
+    }
+    this.opts.onRecord(envelope);
+  }
+}
+
+function connectionURL(opts: ClientOptions<unknown>): string {
+  const url = new URL("/" + opts.flows.join(","), opts.url);
+  url.searchParams.set("multiplex", "true");
+  for (const [name, value] of Object.entries(opts.query ?? {})) {
+    if (value !== undefined) {
+      url.searchParams.set(name, String(value));
+    }
+  }
+  return url.toString();
+}
+
+function base64URL(s: string): string {
+  let binary = "";
+  new TextEncoder().encode(s).forEach((b) => (binary += String.fromCharCode(b)));
+  return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
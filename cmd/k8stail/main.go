@@ -11,6 +11,7 @@ import (
 	"os"
 	"os/signal"
 	pathpkg "path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,15 +26,33 @@ import (
 
 func main() {
 	var authToken string
+	var clientCertFile string
+	var clientKeyFile string
 	var clusterFlow bool
+	var containerFilter string
+	var format string
+	var levelFilter string
+	var minLevel string
+	var podFilter string
+	var since string
+	var tail int
 	var listenAddr string
 	var svcName string
 	var svcNamespace string
 	var svcPort string
 	var verbosity int
 	pflag.StringVarP(&authToken, "token", "t", "", "token used for authentication")
+	pflag.StringVar(&clientCertFile, "client-cert", "", "PEM file of the client certificate used for authentication instead of a token")
+	pflag.StringVar(&clientKeyFile, "client-key", "", "PEM file of the client certificate's private key")
 	pflag.BoolVarP(&clusterFlow, "clusterflow", "c", false, "stream logs from a cluster flow instead of a regular flow")
+	pflag.StringVar(&containerFilter, "container", "", "only stream records from containers with names matching this regular expression")
+	pflag.StringVarP(&format, "output", "o", "", "format of the streamed records (raw, ndjson, message, protobuf, binary or cloudevents)")
+	pflag.StringVar(&levelFilter, "level", "", "only stream records with levels matching this regular expression")
+	pflag.StringVar(&minLevel, "min-level", "", "only stream records of at least this severity (trace, debug, info, warn, error or fatal), whatever the format of their level")
+	pflag.StringVar(&podFilter, "pod", "", "only stream records from pods with names matching this regular expression")
 	pflag.StringVar(&listenAddr, "listen-addr", "", "address where the service accepts WebSocket listeners")
+	pflag.StringVar(&since, "since", "", "also stream retained records received within this duration (e.g. 5m) or after this RFC 3339 timestamp")
+	pflag.IntVar(&tail, "tail", 0, "also stream up to this many of the most recent retained records")
 	pflag.StringVarP(&svcNamespace, "namespace", "n", "default", "log socket service namespace")
 	pflag.StringVarP(&svcPort, "port", "p", "10001", "log socket service listening port")
 	pflag.StringVarP(&svcName, "service", "s", "log-socket", "name of the service that accepts WebSocket listeners")
@@ -48,23 +67,28 @@ func main() {
 		os.Exit(1)
 	}
 
-	flowRef := pflag.Arg(0)
-	elts := strings.SplitN(flowRef, "/", 2)
-	if len(elts) != 2 {
-		fmt.Fprintf(os.Stderr, "invalid flow reference %q\n", flowRef)
-		pflag.Usage()
-		os.Exit(1)
+	flowKind := internal.FKFlow
+	if clusterFlow {
+		flowKind = internal.FKClusterFlow
 	}
-	flowNamespace, flowName := elts[0], elts[1]
 
-	flowKind := "flow"
-	if clusterFlow {
-		flowKind = "clusterflow"
+	// several flows can be streamed over a single connection by listing them comma-separated in the path
+	// cluster flows can be referenced by name only, the service looks them up in its control namespace
+	var refs []string
+	for _, flowRef := range pflag.Args() {
+		elts := strings.SplitN(flowRef, "/", 2)
+		if len(elts) != 2 && !(flowKind.IsClusterScoped() && len(elts) == 1 && elts[0] != "") {
+			fmt.Fprintf(os.Stderr, "invalid flow reference %q\n", flowRef)
+			pflag.Usage()
+			os.Exit(1)
+		}
+		refs = append(refs, pathpkg.Join(append([]string{string(flowKind)}, elts...)...))
 	}
 
 	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
 
-	path := pathpkg.Join("/", flowKind, flowNamespace, flowName)
+	path := "/" + strings.Join(refs, ",")
 
 	var listenURL *url.URL
 	if listenAddr == "" {
@@ -107,11 +131,38 @@ func main() {
 
 	listenURL.Scheme = "wss"
 
+	query := listenURL.Query()
+	for name, value := range map[string]string{
+		internal.EncodingParam:             format,
+		internal.FilterParamContainerRegex: containerFilter,
+		internal.FilterParamLevel:          levelFilter,
+		internal.FilterParamMinLevel:       minLevel,
+		internal.FilterParamPodRegex:       podFilter,
+		internal.ReplayParamSince:          since,
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if tail > 0 {
+		query.Set(internal.ReplayParamTail, strconv.Itoa(tail))
+	}
+	listenURL.RawQuery = query.Encode()
+
 	if dialer.TLSClientConfig == nil {
 		dialer.TLSClientConfig = &tls.Config{}
 	}
 	dialer.TLSClientConfig.InsecureSkipVerify = true
 
+	if clientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+		if err != nil {
+			log.Event(logs, "failed to load client certificate", log.Error(err), log.Fields{"cert": clientCertFile, "key": clientKeyFile})
+			os.Exit(2)
+		}
+		dialer.TLSClientConfig.Certificates = append(dialer.TLSClientConfig.Certificates, cert)
+	}
+
 	wsConn, _, err := dialer.DialContext(context.Background(), listenURL.String(), http.Header{internal.AuthHeaderKey: []string{authToken}})
 	if err != nil {
 		log.Event(logs, "failed to open websocket connection", log.Error(err), log.Fields{"url": listenURL})
@@ -120,26 +171,33 @@ func main() {
 
 	log.Event(logs, "successfully connected to service", log.V(1), log.Fields{"addr": wsConn.UnderlyingConn().RemoteAddr()})
 
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt)
 
 	go func() {
-		// TODO: defer exit
 		for {
 			msgTyp, reader, err := wsConn.NextReader()
 			if err != nil {
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) {
+					log.Event(logs, "connection closed by service", log.Fields{"code": closeErr.Code, "reason": closeErr.Text})
+					if closeErr.Code == websocket.CloseNormalClosure || closeErr.Code == websocket.CloseGoingAway {
+						os.Exit(0)
+					}
+					os.Exit(3)
+				}
 				log.Event(logs, "failed to get next reader for websocket connection", log.Error(err))
-				return
+				os.Exit(2)
 			}
 			switch msgTyp {
-			case websocket.BinaryMessage:
+			case websocket.BinaryMessage, websocket.TextMessage:
 				data, err := io.ReadAll(reader)
 				if err != nil {
 					log.Event(logs, "failed to read record data", log.V(1), log.Error(err))
 					continue
 				}
 				log.Event(logs, "new record", log.V(2), log.Fields{"data": data})
-				fmt.Println(string(data))
+				fmt.Println(strings.TrimSuffix(string(data), "\n"))
 			}
 		}
 	}()
@@ -0,0 +1,98 @@
+// kubectl-tail_flow is the log-socket client packaged as a kubectl plugin, invoked as kubectl tail-flow
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/banzaicloud/log-socket/internal"
+	"github.com/banzaicloud/log-socket/internal/cli"
+	"github.com/banzaicloud/log-socket/log"
+)
+
+func main() {
+	var clusterFlow bool
+	var connOpts cli.ConnectOptions
+	var kubeconfig string
+	var kubeContext string
+	var namespace string
+	var selector string
+	var tailOpts cli.TailOptions
+	var verbosity int
+	pflag.BoolVarP(&clusterFlow, "clusterflow", "c", false, "stream logs from a cluster flow instead of a regular flow")
+	pflag.StringVar(&kubeconfig, "kubeconfig", "", "path to the kubeconfig file")
+	pflag.StringVar(&kubeContext, "context", "", "name of the kubeconfig context to use")
+	pflag.StringVarP(&namespace, "namespace", "n", "", "namespace of the flow (defaults to the namespace of the kubeconfig context)")
+	pflag.StringVar(&selector, "service-selector", cli.DefaultServiceSelector, "label selector of the log socket service")
+	pflag.IntVarP(&verbosity, "verbosity", "v", verbosity, "log verbosity level")
+	connOpts.AddAuthFlags(pflag.CommandLine)
+	tailOpts.AddFlags(pflag.CommandLine)
+	pflag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: kubectl tail-flow [-n namespace] <name>... [flags]")
+		pflag.PrintDefaults()
+	}
+	pflag.Parse()
+
+	var logs log.Sink = log.WithVerbosityFilter(log.NewWriterSink(os.Stderr), verbosity)
+
+	if pflag.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "no flow name specified")
+		pflag.Usage()
+		os.Exit(1)
+	}
+	if err := tailOpts.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		pflag.Usage()
+		os.Exit(1)
+	}
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{CurrentContext: kubeContext})
+	cfg, err := clientConfig.ClientConfig()
+	if err != nil {
+		log.Event(logs, "failed to get kubeconfig", log.Error(err))
+		os.Exit(2)
+	}
+	if namespace == "" {
+		if namespace, _, err = clientConfig.Namespace(); err != nil {
+			log.Event(logs, "failed to get namespace from kubeconfig", log.Error(err))
+			os.Exit(2)
+		}
+	}
+	connOpts.Kubeconfig = cfg
+
+	kind := internal.FKFlow
+	if clusterFlow {
+		kind = internal.FKClusterFlow
+	}
+	refs := make([]string, 0, pflag.NArg())
+	for _, name := range pflag.Args() {
+		ref := path.Join(string(kind), namespace, name)
+		if _, err := internal.ParseFlowReference(ref, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid flow name %q: %s\n", name, err)
+			os.Exit(1)
+		}
+		refs = append(refs, ref)
+	}
+
+	if connOpts.ListenAddr == "" {
+		if err := cli.DiscoverService(context.Background(), cfg, selector, &connOpts); err != nil {
+			log.Event(logs, "failed to discover log socket service", log.Error(err))
+			os.Exit(2)
+		}
+		log.Event(logs, "discovered log socket service", log.V(1), log.Fields{
+			"listenAddr": connOpts.ListenAddr,
+			"namespace":  connOpts.ServiceNamespace,
+			"name":       connOpts.ServiceName,
+			"port":       connOpts.ServicePort,
+		})
+	}
+
+	os.Exit(cli.Tail(refs, connOpts, tailOpts, logs))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/pflag"
+
+	"github.com/banzaicloud/log-socket/internal/cli"
+	"github.com/banzaicloud/log-socket/log"
+)
+
+func loadgenCommand(name string, args []string) int {
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	var opts cli.LoadgenOptions
+	var verbosity int
+	opts.AddFlags(flags)
+	flags.IntVarP(&verbosity, "verbosity", "v", verbosity, "log verbosity level")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s <kind>/<namespace>/<name> [flags]\n", filepath.Base(os.Args[0]), name)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return 0
+		}
+		return 1
+	}
+
+	var logs log.Sink = log.WithVerbosityFilter(log.NewWriterSink(os.Stderr), verbosity)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "expected a single flow reference")
+		flags.Usage()
+		return 1
+	}
+	if err := opts.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flags.Usage()
+		return 1
+	}
+
+	return cli.Loadgen(flags.Arg(0), opts, logs)
+}
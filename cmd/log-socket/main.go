@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/banzaicloud/log-socket/internal/cli"
+)
+
+type command struct {
+	run     func(name string, args []string) int
+	summary string
+}
+
+var commands = map[string]command{
+	"loadgen": {run: loadgenCommand, summary: "push synthetic records through the ingest endpoint"},
+	"replay":  {run: replayCommand, summary: "push captured NDJSON records through the ingest endpoint"},
+	"tail":    {run: tailCommand, summary: "stream records of flows"},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		if cli.CanPick() {
+			// live records of a flow chosen interactively are streamed
+			os.Exit(tailCommand("tail", []string{"--follow"}))
+		}
+		usage()
+		os.Exit(1)
+	}
+	switch name := os.Args[1]; name {
+	case "help", "-h", "--help":
+		usage()
+	default:
+		cmd, ok := commands[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+			usage()
+			os.Exit(1)
+		}
+		os.Exit(cmd.run(name, os.Args[2:]))
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].summary)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/banzaicloud/log-socket/internal"
+	"github.com/banzaicloud/log-socket/internal/cli"
+	"github.com/banzaicloud/log-socket/log"
+)
+
+func tailCommand(name string, args []string) int {
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	var connOpts cli.ConnectOptions
+	var tailOpts cli.TailOptions
+	var verbosity int
+	connOpts.AddAuthFlags(flags)
+	connOpts.AddServiceFlags(flags)
+	tailOpts.AddFlags(flags)
+	flags.IntVarP(&verbosity, "verbosity", "v", verbosity, "log verbosity level")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s <kind>/<namespace>/<name>... [flags]\n", filepath.Base(os.Args[0]), name)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return 0
+		}
+		return 1
+	}
+
+	var logs log.Sink = log.WithVerbosityFilter(log.NewWriterSink(os.Stderr), verbosity)
+
+	if flags.NArg() < 1 && !cli.CanPick() {
+		fmt.Fprintln(os.Stderr, "no flow reference specified")
+		flags.Usage()
+		return 1
+	}
+	if err := tailOpts.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flags.Usage()
+		return 1
+	}
+
+	if flags.NArg() < 1 {
+		// the flow is chosen among those the user may tail
+		ref, err := cli.PickFlow(context.Background(), connOpts, logs)
+		if err != nil {
+			if !errors.Is(err, cli.ErrPickCanceled) {
+				log.Event(logs, "failed to pick flow", log.Error(err))
+			}
+			return 1
+		}
+		return cli.Tail([]string{ref}, connOpts, tailOpts, logs)
+	}
+
+	refs := make([]string, 0, flags.NArg())
+	for _, ref := range flags.Args() {
+		// cluster flows referenced by name are looked up in the service's control namespace, the placeholder only serves validation
+		if _, err := internal.ParseFlowReference(ref, "-"); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid flow reference %q: %s\n", ref, err)
+			flags.Usage()
+			return 1
+		}
+		refs = append(refs, strings.Trim(ref, "/"))
+	}
+
+	return cli.Tail(refs, connOpts, tailOpts, logs)
+}
@@ -0,0 +1,294 @@
+// protocol-gen generates the protocol module of the TypeScript client and the close codes of the Go client from the machine-readable protocol spec
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/pflag"
+
+	"github.com/banzaicloud/log-socket/internal"
+)
+
+type spec struct {
+	Name                   string      `json:"name"`
+	Version                int         `json:"version"`
+	Description            string      `json:"description"`
+	Subprotocol            string      `json:"subprotocol"`
+	TokenSubprotocolPrefix string      `json:"tokenSubprotocolPrefix"`
+	FlowKinds              []string    `json:"flowKinds"`
+	QueryParameters        []field     `json:"queryParameters"`
+	ClientMessage          message     `json:"clientMessage"`
+	ControlMessage         message     `json:"controlMessage"`
+	Envelope               message     `json:"envelope"`
+	CloseCodes             []closeCode `json:"closeCodes"`
+}
+
+type field struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Enum        []string `json:"enum"`
+	Required    bool     `json:"required"`
+	Description string   `json:"description"`
+}
+
+type message struct {
+	Description string  `json:"description"`
+	Actions     []value `json:"actions"`
+	Types       []value `json:"types"`
+	Fields      []field `json:"fields"`
+}
+
+type value struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type closeCode struct {
+	Code        int    `json:"code"`
+	Name        string `json:"name"`
+	Reconnect   bool   `json:"reconnect"`
+	Description string `json:"description"`
+}
+
+func main() {
+	var check bool
+	var outFile string
+	var goOutFile string
+	var specFile string
+	pflag.BoolVar(&check, "check", false, "fail if the output files are not up to date instead of writing them")
+	pflag.StringVar(&outFile, "out", "clients/typescript/src/protocol.ts", "TypeScript file to generate")
+	pflag.StringVar(&goOutFile, "go-out", "pkg/client/protocol.go", "Go file of the client package to generate")
+	pflag.StringVar(&specFile, "spec", "docs/protocol.json", "protocol spec to generate the files from")
+	pflag.Parse()
+
+	if err := run(specFile, outFile, goOutFile, check); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(specFile, outFile, goOutFile string, check bool) error {
+	data, err := os.ReadFile(specFile)
+	if err != nil {
+		return err
+	}
+	var s spec
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid protocol spec %s: %w", specFile, err)
+	}
+	if err := verify(s); err != nil {
+		return fmt.Errorf("protocol spec %s does not match the service: %w", specFile, err)
+	}
+	goOut, err := generateGo(s)
+	if err != nil {
+		return err
+	}
+	if err := output(outFile, generate(s), check); err != nil {
+		return err
+	}
+	return output(goOutFile, goOut, check)
+}
+
+// output writes the generated file, or only checks that it is up to date
+func output(file string, out []byte, check bool) error {
+	if !check {
+		return os.WriteFile(file, out, 0o644)
+	}
+	current, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, out) {
+		return fmt.Errorf("%s is out of date, run protocol-gen", file)
+	}
+	return nil
+}
+
+// verify checks the spec against the constants of the service, so that it cannot drift from the implementation
+func verify(s spec) error {
+	if s.Subprotocol != internal.WebSocketSubprotocol || s.TokenSubprotocolPrefix != internal.TokenSubprotocolPrefix {
+		return fmt.Errorf("subprotocol should be %q with token prefix %q", internal.WebSocketSubprotocol, internal.TokenSubprotocolPrefix)
+	}
+	actions := []internal.ClientAction{internal.ClientActionAck, internal.ClientActionSubscribe, internal.ClientActionUnsubscribe}
+	if err := sameSet("client actions", names(s.ClientMessage.Actions), actions); err != nil {
+		return err
+	}
+	controls := []internal.ControlType{
+		internal.ControlAckOverflow, internal.ControlError, internal.ControlFlowChanged, internal.ControlGap,
+		internal.ControlRateLimited, internal.ControlReplayed, internal.ControlSampled, internal.ControlSampling, internal.ControlSamplingEnded, internal.ControlSessionExpiring,
+		internal.ControlStats, internal.ControlSubscribed, internal.ControlThrottled, internal.ControlUnsubscribed,
+	}
+	if err := sameSet("control types", names(s.ControlMessage.Types), controls); err != nil {
+		return err
+	}
+	codes := []int{
+		websocket.CloseGoingAway, internal.CloseUnauthorized, internal.CloseForbidden, internal.CloseSlowConsumer,
+		internal.CloseTimeout, internal.CloseInternalError, internal.CloseMoved, internal.CloseDisconnected,
+		internal.CloseSessionExpired, internal.CloseFlowDeleted, internal.CloseIdle,
+	}
+	var specCodes []int
+	for _, c := range s.CloseCodes {
+		specCodes = append(specCodes, c.Code)
+	}
+	return sameSet("close codes", specCodes, codes)
+}
+
+func names(values []value) (res []string) {
+	for _, v := range values {
+		res = append(res, v.Name)
+	}
+	return
+}
+
+func sameSet[S ~string | ~int, T ~string | ~int](what string, spec []S, service []T) error {
+	format := func(items []string) string {
+		sort.Strings(items)
+		return strings.Join(items, ", ")
+	}
+	var a, b []string
+	for _, v := range spec {
+		a = append(a, fmt.Sprint(v))
+	}
+	for _, v := range service {
+		b = append(b, fmt.Sprint(v))
+	}
+	if fa, fb := format(a), format(b); fa != fb {
+		return fmt.Errorf("%s are [%s] instead of [%s]", what, fa, fb)
+	}
+	return nil
+}
+
+func generate(s spec) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by protocol-gen from docs/protocol.json. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "export const PROTOCOL_VERSION = %d;\n", s.Version)
+	fmt.Fprintf(&b, "export const SUBPROTOCOL = %q;\n", s.Subprotocol)
+	fmt.Fprintf(&b, "export const TOKEN_SUBPROTOCOL_PREFIX = %q;\n\n", s.TokenSubprotocolPrefix)
+	fmt.Fprintf(&b, "export type FlowKind = %s;\n\n", union(s.FlowKinds))
+
+	writeComment(&b, "", "query parameters of connection requests")
+	b.WriteString("export interface QueryParameters {\n")
+	for _, f := range s.QueryParameters {
+		writeField(&b, f, "")
+	}
+	b.WriteString("}\n\n")
+
+	writeComment(&b, "", s.ClientMessage.Description)
+	fmt.Fprintf(&b, "export type ClientAction = %s;\n\n", union(names(s.ClientMessage.Actions)))
+	b.WriteString("export interface ClientMessage {\n")
+	for _, f := range s.ClientMessage.Fields {
+		writeField(&b, f, "ClientAction")
+	}
+	b.WriteString("}\n\n")
+
+	writeComment(&b, "", s.ControlMessage.Description)
+	fmt.Fprintf(&b, "export type ControlType = %s;\n\n", union(names(s.ControlMessage.Types)))
+	b.WriteString("export const ControlTypeDescriptions: Record<ControlType, string> = {\n")
+	for _, t := range s.ControlMessage.Types {
+		fmt.Fprintf(&b, "  %s: %q,\n", t.Name, t.Description)
+	}
+	b.WriteString("};\n\n")
+	b.WriteString("export interface ControlMessage {\n")
+	for _, f := range s.ControlMessage.Fields {
+		writeField(&b, f, "ControlType")
+	}
+	b.WriteString("}\n\n")
+
+	writeComment(&b, "", s.Envelope.Description)
+	b.WriteString("export interface Envelope<R = unknown> {\n")
+	for _, f := range s.Envelope.Fields {
+		writeField(&b, f, "")
+	}
+	b.WriteString("}\n\n")
+
+	writeComment(&b, "", "codes of the close frames sent by the service")
+	b.WriteString("export const CloseCode = {\n")
+	for _, c := range s.CloseCodes {
+		writeComment(&b, "  ", c.Description)
+		fmt.Fprintf(&b, "  %s: %d,\n", c.Name, c.Code)
+	}
+	b.WriteString("} as const;\n\n")
+	writeComment(&b, "", "close codes after which reconnecting is expected to succeed")
+	b.WriteString("export const RECONNECT_CLOSE_CODES: ReadonlySet<number> = new Set([")
+	var reconnect []string
+	for _, c := range s.CloseCodes {
+		if c.Reconnect {
+			reconnect = append(reconnect, "CloseCode."+c.Name)
+		}
+	}
+	b.WriteString(strings.Join(reconnect, ", "))
+	b.WriteString("]);\n")
+	return b.Bytes()
+}
+
+// generateGo generates the close codes of the client package, so that it reconnects after the same close codes as the TypeScript client
+func generateGo(s spec) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by protocol-gen from docs/protocol.json. DO NOT EDIT.\n\n")
+	b.WriteString("package client\n\n")
+	b.WriteString("// codes of the close frames sent by the service\n")
+	b.WriteString("const (\n")
+	for _, c := range s.CloseCodes {
+		if c.Description != "" {
+			fmt.Fprintf(&b, "\t// %s\n", c.Description)
+		}
+		fmt.Fprintf(&b, "\tclose%s = %d\n", c.Name, c.Code)
+	}
+	b.WriteString(")\n\n")
+	b.WriteString("// closeCodeReconnect tells of each close code of the service whether reconnecting after it is expected to succeed\n")
+	b.WriteString("var closeCodeReconnect = map[int]bool{\n")
+	for _, c := range s.CloseCodes {
+		fmt.Fprintf(&b, "\tclose%s: %t,\n", c.Name, c.Reconnect)
+	}
+	b.WriteString("}\n")
+	return format.Source(b.Bytes())
+}
+
+func union(values []string) string {
+	var quoted []string
+	for _, v := range values {
+		quoted = append(quoted, fmt.Sprintf("%q", v))
+	}
+	return strings.Join(quoted, " | ")
+}
+
+func writeComment(b *bytes.Buffer, indent, text string) {
+	if text != "" {
+		fmt.Fprintf(b, "%s/** %s */\n", indent, text)
+	}
+}
+
+// writeField writes a property of an interface, fields of the action and control types are typed with enumType
+func writeField(b *bytes.Buffer, f field, enumType string) {
+	var typ string
+	switch f.Type {
+	case "string":
+		typ = "string"
+		if len(f.Enum) > 0 {
+			typ = union(f.Enum)
+		}
+	case "integer", "number":
+		typ = "number"
+	case "boolean":
+		typ = "boolean"
+	case "time":
+		typ = "string"
+	case "json":
+		typ = "R"
+	default:
+		typ = enumType
+	}
+	optional := "?"
+	if f.Required {
+		optional = ""
+	}
+	writeComment(b, "  ", f.Description)
+	fmt.Fprintf(b, "  %s%s: %s;\n", f.Name, optional, typ)
+}
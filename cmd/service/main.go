@@ -1,22 +1,35 @@
 package main
 
 import (
+	"compress/flate"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"math/big"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/pflag"
+	appsv1 "k8s.io/api/apps/v1"
 	authv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/banzaicloud/log-socket/internal"
 	"github.com/banzaicloud/log-socket/internal/reconciler"
 	"github.com/banzaicloud/log-socket/log"
+	logsocketv1alpha1 "github.com/banzaicloud/log-socket/pkg/api/v1alpha1"
 	"github.com/banzaicloud/log-socket/pkg/slice"
 	"github.com/banzaicloud/log-socket/pkg/tlstools"
 	loggingv1beta1 "github.com/banzaicloud/logging-operator/pkg/sdk/logging/api/v1beta1"
@@ -26,52 +39,811 @@ import (
 func main() {
 	var ingestAddr string
 	var listenAddr string
+	var grpcAddr string
 	var serviceAddr string
 	var verbosity int
+	var logFormat string
+	var logSamplePeriod time.Duration
+	var logSampleBurst int
+	var bufferSize int
+	var backpressurePolicy string
+	var authzMode string
+	var opaOpts internal.OPAAuthorizerOptions
+	var controlNamespace string
+	var tokenAudiences []string
+	var authCacheTTL time.Duration
+	var tokenSourceNames []string
+	var queryTokenKeyFile string
+	var queryTokenMaxTTL time.Duration
+	var ticketKeyFile string
+	var ticketTTL time.Duration
+	var impersonation bool
+	var authnMode string
+	var oidcOpts internal.OIDCOptions
+	var clientCAFile string
+	var recordRate float64
+	var throughputQuotaSpecs []string
+	var throughputSampleRate int
+	var recordBurst int
+	var connRate float64
+	var connBurst int
+	var replaySize int
+	var replayMaxAge time.Duration
+	var ackBufferSize int
+	var ackRetention time.Duration
+	var ackMaxUserConsumers int
+	var ackMaxConsumers int
+	var reconcileRetryInterval time.Duration
+	var replayDir string
+	var replayDirMaxBytes int64
+	var pingInterval time.Duration
+	var pongTimeout time.Duration
+	var maxMissedPongs int
+	var compression bool
+	var reauthInterval time.Duration
+	var sessionDuration time.Duration
+	var maxSessionDuration time.Duration
+	var writeTimeout time.Duration
+	var handshakeTimeout time.Duration
+	var idleTimeout time.Duration
+	var trustedProxySpecs []string
+	var allowedOrigins []string
+	var sessionWarnings []time.Duration
+	var auditSinks []string
+	var ingestClientCAFile string
+	var ingestHMACKeyFile string
+	var outputSubscriptions bool
+	var outputRoutesInterval time.Duration
+	var watchFlows bool
+	var selectorSubscriptions bool
+	var logTaps bool
+	var logTapsInterval time.Duration
+	var ingestMaxBodySize int64
+	var ingestMaxDecompressedSize int64
+	var maxRecordSize int
+	var ingestQueueSize int
+	var maxClockSkew time.Duration
+	var profilingAddr string
+	var memoryGuardOpts internal.MemoryGuardOptions
+	var clockSkewPolicy string
+	var oversizedRecordPolicy string
+	var ingestClientCertSecret string
+	var forwardAddr string
+	var forwardServiceAddr string
+	var forwardSharedKeyFile string
+	var syslogAddr string
+	var syslogNetwork string
+	var syslogTLS bool
+	var syslogFlow string
+	var gelfAddr string
+	var gelfNetwork string
+	var gelfFlow string
+	var kafkaOpts internal.KafkaOptions
+	var kafkaFlow string
+	var kafkaTLS bool
+	var kafkaPasswordFile string
+	var auditFile string
+	var compressionLevel int
+	var sinkSpecs []string
+	var redactionSpecs []string
+	var enrichRecords bool
+	var enrichmentAnnotations []string
+	var deadLettersEnabled bool
+	var deadLetterLog bool
+	var deadLetterFile string
+	var deadLetterMissingMetadata bool
+	var sinkOpts internal.SinkOptions
+	var s3Opts internal.S3Options
+	var tenancyModeName string
+	var http2 bool
+	var maxConns int
+	var maxUserConns int
+	var quotaRetryAfter time.Duration
+	var tenantsFile string
+	var dispatchWorkers int
+	var tlsCertFile string
+	var tlsKeyFile string
+	var tlsMinVersionName string
+	var tlsCipherSuiteNames []string
+	var tlsReloadInterval time.Duration
+	var acmeOpts internal.ACMEOptions
+	var acmeChallenge string
+	var acmeDNSHook string
+	var configFile string
+	var configReloadInterval time.Duration
+	var broadcastRedisAddr string
+	var broadcastChannel string
+	var leaderElectionNamespace string
+	var sharding bool
+	var flowsEndpoint bool
+	var dedupWindow time.Duration
+	var dedupMaxEntries int
+	var webUI bool
+	var adminAPI bool
+	var otlpOpts internal.OTLPExporterOptions
+	var tracingOpts internal.TracingOptions
+	var adminGroups []string
+	var capabilities bool
+	var capabilityKeyFile string
+	var capabilityMaxTTL time.Duration
+	var capabilityBaseURL string
+	var subscriptions bool
+	var subscriptionMaxTTL time.Duration
+	var subscriptionMaxRecords int
+	var clustersFile string
+	var shardAdvertiseAddr string
+	var shardProxyCAFile string
 	pflag.StringVar(&ingestAddr, "ingest-addr", ":10000", "local address where the service ingests logs")
 	pflag.StringVar(&serviceAddr, "service-addr", "log-socket.default.svc:10000", "remote address where the service ingests logs")
 	pflag.StringVar(&listenAddr, "listen-addr", ":10001", "address where the service accepts WebSocket listeners")
+	pflag.StringVar(&grpcAddr, "grpc-addr", "", "address where the service accepts gRPC listeners (empty disables the gRPC API)")
+	pflag.StringVar(&configFile, "config", "", "YAML file setting options by their flag names, flags set on the command line take precedence")
+	pflag.DurationVar(&configReloadInterval, "config-reload-interval", internal.DefaultConfigReloadInterval, "how often the configuration file is checked for changes of reloadable options")
 	pflag.IntVarP(&verbosity, "verbosity", "v", verbosity, "log verbosity level")
+	pflag.StringVar(&logFormat, "log-format", "text", "format of the service's logs (text or json)")
+	pflag.DurationVar(&logSamplePeriod, "log-sample-period", time.Second, "period in which at most --log-sample-burst events of the same error are logged")
+	pflag.IntVar(&logSampleBurst, "log-sample-burst", 10, "number of events of the same error logged per --log-sample-period, further ones are counted and suppressed (0 disables sampling)")
+	pflag.IntVar(&bufferSize, "listener-buffer-size", internal.DefaultListenerBufferSize, "number of records buffered per listener")
+	pflag.StringVar(&backpressurePolicy, "listener-backpressure-policy", string(internal.BackpressureDropOldest), "what to do when a listener's buffer is full (drop-oldest, drop-newest, disconnect or sample)")
+	pflag.DurationVar(&pingInterval, "listener-ping-interval", internal.DefaultPingInterval, "interval of keepalive pings sent to listeners (0 disables keepalive)")
+	pflag.DurationVar(&pongTimeout, "listener-pong-timeout", internal.DefaultPongTimeout, "time to wait for a listener to answer a keepalive ping")
+	pflag.IntVar(&maxMissedPongs, "listener-max-missed-pongs", internal.DefaultMaxMissedPongs, "number of consecutive missed pongs after which a listener is disconnected")
+	pflag.BoolVar(&compression, "listener-compression", true, "compress frames sent to listeners that support permessage-deflate")
+	pflag.IntVar(&compressionLevel, "listener-compression-level", internal.DefaultCompressionLevel, "flate compression level of frames sent to listeners (-2 to 9)")
+	pflag.BoolVar(&http2, "listener-http2", false, "serve listeners over HTTP/2 too, accepting websockets over HTTP/2 streams (RFC 8441) if the GODEBUG=http2xconnect=1 environment variable is set")
+	pflag.DurationVar(&reauthInterval, "listener-reauthorization-interval", internal.DefaultReauthorizationInterval, "interval of re-validating listener credentials and permissions (0 disables re-validation)")
+	pflag.DurationVar(&sessionDuration, "listener-session-duration", 0, "how long listeners stay connected unless they request a shorter session with the "+internal.DurationParam+" parameter (0 means the maximum session duration)")
+	pflag.DurationVar(&maxSessionDuration, "listener-max-session-duration", 0, "longest session listeners can request, after which their connection is closed (0 means unlimited)")
+	pflag.DurationSliceVar(&sessionWarnings, "listener-session-expiry-warnings", internal.DefaultSessionExpiryWarnings, "how long before their session expires listeners are warned with control messages")
+	pflag.DurationVar(&writeTimeout, "listener-write-timeout", internal.DefaultWriteTimeout, "how long writing a frame to a listener may block before it is disconnected (0 means unlimited)")
+	pflag.DurationVar(&handshakeTimeout, "listener-handshake-timeout", internal.DefaultHandshakeTimeout, "how long reading a connection request and completing the websocket handshake may take (0 means unlimited)")
+	pflag.StringSliceVar(&allowedOrigins, "allowed-origins", nil, "origins of the web pages browsers may connect to listener endpoints from, e.g. https://dashboard.example.com or https://*.example.com (* allows any, only pages served by the service if empty)")
+	pflag.StringSliceVar(&trustedProxySpecs, "trusted-proxies", nil, "addresses or CIDRs of the proxies whose X-Forwarded-For and X-Real-IP headers tell the address of listeners in audit events and the admin API")
+	pflag.DurationVar(&idleTimeout, "listener-idle-timeout", 0, "how long listeners may stay connected without records or messages exchanged, keepalive pings aside (0 means unlimited)")
+	pflag.StringArrayVar(&throughputQuotaSpecs, "throughput-quota", nil, "maximum rate of the records delivered of a namespace or flow, in target=limit[,limit] form where the target is namespace/<name>, namespace/* or a flow reference and limits are records or bytes per second, e.g. namespace/prod=1000/s,1MiB/s, can be repeated")
+	pflag.IntVar(&throughputSampleRate, "throughput-quota-sample-rate", internal.DefaultThroughputSampleRate, "one in this many records exceeding a throughput quota is delivered, records of error levels always are")
+	pflag.Float64Var(&recordRate, "listener-record-rate", 0, "maximum number of records per second delivered to each listener (0 means unlimited)")
+	pflag.IntVar(&recordBurst, "listener-record-burst", 0, "number of records that can be delivered to a listener at once above the rate limit (defaults to the rate)")
+	pflag.Float64Var(&connRate, "user-connection-rate", 0, "maximum number of connection attempts per second for each user (0 means unlimited)")
+	pflag.IntVar(&connBurst, "user-connection-burst", 1, "number of connection attempts a user can make at once above the rate limit")
+	pflag.IntVar(&maxConns, "max-connections", 0, "maximum number of concurrent listener connections (0 means unlimited)")
+	pflag.IntVar(&maxUserConns, "max-user-connections", 0, "maximum number of concurrent connections of each user (0 means unlimited)")
+	pflag.DurationVar(&quotaRetryAfter, "connection-quota-retry-after", internal.DefaultQuotaRetryAfter, "delay suggested to listeners rejected because a connection quota is exhausted")
+	pflag.IntVar(&dispatchWorkers, "dispatch-workers", internal.DefaultDispatchWorkers(), "number of workers handing records to listeners (1 dispatches records synchronously)")
+	pflag.StringVar(&broadcastRedisAddr, "broadcast-redis-addr", "", "address of the Redis server replicas exchange records through, which enables running several replicas (disabled if empty)")
+	pflag.StringVar(&broadcastChannel, "broadcast-channel", "log-socket", "Redis pub/sub channel replicas exchange records through")
+	pflag.BoolVar(&sharding, "broadcast-sharding", false, "hash flows to replicas instead of broadcasting records to all of them, proxying listeners to the replica owning their flows")
+	pflag.StringVar(&shardAdvertiseAddr, "shard-advertise-addr", "", "listener address other replicas proxy listeners to in sharding mode (defaults to the POD_IP environment variable and the port of the listen address)")
+	pflag.StringVar(&shardProxyCAFile, "shard-proxy-ca-file", "", "PEM file of CA certificates verifying the listener certificates of other replicas, required in sharding mode")
+	pflag.StringVar(&leaderElectionNamespace, "leader-election-namespace", "", "namespace of the lease replicas elect the one reconciling logging resources with (defaults to the control namespace)")
+	pflag.BoolVar(&flowsEndpoint, "flows-endpoint", true, "list the flows users are allowed to tail on the "+internal.FlowsEndpoint+" endpoint of the listener address")
+	pflag.BoolVar(&webUI, "web-ui", false, "serve a web UI for tailing flows under "+internal.UIPathPrefix+" of the listener address, it requires the flows endpoint")
+	pflag.DurationVar(&dedupWindow, "dedup-window", 0, "suppress ingested records identical to one received within this window, e.g. chunks retried by fluentd (0 disables de-duplication)")
+	pflag.IntVar(&dedupMaxEntries, "dedup-max-entries", internal.DefaultDedupMaxEntries, "maximum number of records remembered for de-duplication")
+	pflag.BoolVar(&adminAPI, "admin-api", false, "serve the admin API listing and disconnecting listeners under "+internal.AdminListenersEndpoint+" and changing the log verbosity on "+internal.AdminLogEndpoint+" of the listener address")
+	pflag.StringSliceVar(&adminGroups, "admin-groups", nil, "groups allowed to use the admin API (if empty, users need RBAC permissions on the endpoint as a non-resource URL)")
+	pflag.BoolVar(&capabilities, "capabilities", false, "let admins mint capability URLs sharing the logs of a flow without credentials on "+internal.AdminCapabilitiesEndpoint+", it requires the admin API")
+	pflag.StringVar(&capabilityKeyFile, "capability-key-file", "", "file containing the HMAC key capability URLs are signed with, replicas sharing it accept each other's capabilities (a random key is used if empty)")
+	pflag.DurationVar(&capabilityMaxTTL, "capability-max-ttl", internal.DefaultCapabilityMaxTTL, "the longest lifetime capability URLs can be minted with")
+	pflag.StringVar(&capabilityBaseURL, "capability-base-url", "", "external URL of the listener address capability URLs are built from, e.g. https://logs.example.com (the host of the minting request if empty)")
+	pflag.BoolVar(&subscriptions, "subscriptions", false, "let admins create persistent subscriptions on "+internal.AdminSubscriptionsEndpoint+", which capture the records of a flow until listeners connect with the "+internal.SubscriptionParam+" query parameter, it requires the admin API")
+	pflag.DurationVar(&subscriptionMaxTTL, "subscription-max-ttl", internal.DefaultSubscriptionMaxTTL, "the longest time persistent subscriptions can capture records for")
+	pflag.IntVar(&subscriptionMaxRecords, "subscription-max-records", internal.DefaultSubscriptionMaxRecords, "number of records each persistent subscription keeps, the oldest ones are evicted once it is full")
+	pflag.StringVar(&clustersFile, "clusters-file", "", "YAML file listing instances of the service in other clusters, whose flows are re-exposed under "+internal.ClusterPathPrefix+"<name>/ (disabled if empty)")
+	pflag.StringVar(&otlpOpts.Endpoint, "otlp-metrics-endpoint", "", "OTLP/HTTP URL metrics are exported to, e.g. http://otel-collector:4318/v1/metrics (disabled if empty)")
+	pflag.StringToStringVar(&otlpOpts.Headers, "otlp-metrics-headers", nil, "headers of OTLP metrics export requests, e.g. authorization=Bearer <token>")
+	pflag.DurationVar(&otlpOpts.Interval, "otlp-metrics-interval", internal.DefaultOTLPExportInterval, "time between OTLP metrics exports")
+	pflag.StringVar(&profilingAddr, "profiling-addr", "", "address where the pprof endpoints are served under /debug/pprof/, which should not be exposed outside the cluster (disabled if empty)")
+	pflag.Uint64Var(&memoryGuardOpts.MaxHeapBytes, "max-heap-bytes", 0, "heap size in bytes above which the older half of the replay buffer is dropped to avoid running out of memory (0 disables the check)")
+	pflag.DurationVar(&memoryGuardOpts.Interval, "memory-check-interval", internal.DefaultMemoryCheckInterval, "time between heap size checks of --max-heap-bytes")
+	pflag.StringVar(&tracingOpts.Endpoint, "tracing-endpoint", "", "OTLP/HTTP URL spans of the record path are exported to, e.g. http://otel-collector:4318/v1/traces (disabled if empty)")
+	pflag.StringToStringVar(&tracingOpts.Headers, "tracing-headers", nil, "headers of OTLP span export requests")
+	pflag.Float64Var(&tracingOpts.SampleRatio, "tracing-sample-ratio", internal.DefaultTracingSampleRatio, "ratio of ingest requests traced if their traceparent header does not decide it")
+	pflag.IntVar(&replaySize, "replay-buffer-size", 1000, "number of recent records retained per flow for replaying to new listeners (0 disables replay)")
+	pflag.DurationVar(&replayMaxAge, "replay-max-age", 15*time.Minute, "maximum age of records retained for replay (0 means no limit)")
+	pflag.IntVar(&ackBufferSize, "ack-buffer-size", internal.DefaultAckBufferSize, "number of unacknowledged records retained per consumer and flow for listeners connecting with the "+internal.AckParam+" parameter (0 disables acknowledgements)")
+	pflag.DurationVar(&ackRetention, "ack-retention", internal.DefaultAckRetention, "how long the unacknowledged records of a consumer are kept after its last activity")
+	pflag.IntVar(&ackMaxUserConsumers, "ack-max-consumers-per-user", internal.DefaultAckMaxUserConsumers, "maximum number of consumers and flows whose unacknowledged records are retained per user, further acknowledging listeners are rejected")
+	pflag.IntVar(&ackMaxConsumers, "ack-max-consumers", internal.DefaultAckMaxConsumers, "maximum number of consumers and flows whose unacknowledged records are retained overall")
+	pflag.StringVar(&replayDir, "replay-dir", "", "directory where records retained for replay are persisted, so that they survive restarts (disabled if empty)")
+	pflag.Int64Var(&replayDirMaxBytes, "replay-dir-max-bytes", internal.DefaultReplayDiskMaxBytes, "maximum size of the records of each flow persisted in the replay directory")
+	pflag.DurationVar(&reconcileRetryInterval, "reconcile-retry-interval", 10*time.Second, "delay before retrying a failed reconciliation of the outputs of tapped flows")
+	pflag.StringVar(&controlNamespace, "control-namespace", "default", "namespace of cluster flows referenced by listeners without a namespace")
+	pflag.BoolVar(&outputSubscriptions, "output-subscriptions", true, "let listeners subscribe to outputs and cluster outputs, receiving the records of all flows routing to them (not available in sharding mode)")
+	pflag.DurationVar(&outputRoutesInterval, "output-routes-refresh-interval", internal.DefaultOutputRoutesRefreshInterval, "how often flows are listed to find out which outputs they route records to")
+	pflag.BoolVar(&watchFlows, "watch-flows", true, "watch flows and cluster flows to disconnect the listeners of deleted flows and tell listeners when the match rules of their flows change")
+	pflag.BoolVar(&selectorSubscriptions, "label-selector-subscriptions", true, "let listeners connect to "+internal.SelectEndpoint+" to receive the records of pods selected by labels, generating a cluster flow in the control namespace for each selector")
+	pflag.BoolVar(&logTaps, "log-taps", false, "let the subjects of LogTap resources tail the flows they tap, restricted to the records matching their filters until they expire")
+	pflag.DurationVar(&logTapsInterval, "log-taps-refresh-interval", internal.DefaultLogTapsRefreshInterval, "how often LogTap resources are listed")
+	pflag.StringVar(&authnMode, "authentication-mode", string(internal.AuthenticationModeTokenReview), "how listeners are authenticated (tokenreview, oidc or mtls)")
+	pflag.StringVar(&oidcOpts.IssuerURL, "oidc-issuer-url", "", "URL of the OpenID provider issuing tokens in oidc authentication mode")
+	pflag.StringVar(&oidcOpts.ClientID, "oidc-client-id", "", "client ID tokens have to be issued for in oidc authentication mode")
+	pflag.StringVar(&oidcOpts.UsernameClaim, "oidc-username-claim", "sub", "JWT claim used as the user name in oidc authentication mode")
+	pflag.StringVar(&oidcOpts.UsernamePrefix, "oidc-username-prefix", "", "prefix prepended to user names in oidc authentication mode")
+	pflag.StringVar(&oidcOpts.GroupsClaim, "oidc-groups-claim", "groups", "JWT claim used as the user's groups in oidc authentication mode")
+	pflag.StringVar(&oidcOpts.GroupsPrefix, "oidc-groups-prefix", "", "prefix prepended to group names in oidc authentication mode")
+	pflag.StringVar(&clientCAFile, "client-ca-file", "", "PEM file of CA certificates used to verify listener client certificates in mtls authentication mode")
+	pflag.StringVar(&tlsCertFile, "tls-cert-file", "", "PEM file of the certificate served to listeners and forwarders (a self-signed certificate is generated if empty)")
+	pflag.StringVar(&tlsKeyFile, "tls-key-file", "", "PEM file of the private key of the served certificate")
+	pflag.DurationVar(&tlsReloadInterval, "tls-cert-reload-interval", internal.DefaultCertificateReloadInterval, "how often the certificate files are checked for changes, e.g. when cert-manager renews the certificate")
+	pflag.StringVar(&tlsMinVersionName, "tls-min-version", "1.2", "minimum TLS version accepted by the servers (1.0, 1.1, 1.2 or 1.3)")
+	pflag.StringSliceVar(&tlsCipherSuiteNames, "tls-cipher-suites", nil, "TLS 1.2 and older cipher suites accepted by the servers, by their IANA names (defaults to Go's secure cipher suites)")
+	pflag.StringSliceVar(&acmeOpts.Domains, "acme-domains", nil, "public DNS names of the listener endpoint to obtain a certificate for from an ACME CA, e.g. Let's Encrypt (disabled if empty)")
+	pflag.StringVar(&acmeOpts.Email, "acme-email", "", "contact address of the ACME account")
+	pflag.StringVar(&acmeOpts.DirectoryURL, "acme-directory-url", "", "directory URL of the ACME CA (defaults to Let's Encrypt)")
+	pflag.StringVar(&acmeChallenge, "acme-challenge", string(internal.ACMEChallengeHTTP01), "type of the ACME challenges answered to prove control of the domains (http-01 or dns-01)")
+	pflag.StringVar(&acmeOpts.HTTPAddr, "acme-http-addr", ":80", "local address where HTTP-01 challenges are answered, it has to be reachable on port 80 of the domains")
+	pflag.StringVar(&acmeOpts.CacheDir, "acme-cache-dir", "/var/cache/log-socket/acme", "directory where the ACME account key and certificates are kept, it should be persistent")
+	pflag.StringVar(&acmeDNSHook, "acme-dns-hook", "", "command publishing DNS-01 challenge records, run with the arguments present or cleanup, the record name and its value")
+	pflag.StringSliceVar(&tokenAudiences, "token-audience", nil, "audiences listener tokens have to be valid for (defaults to the API server's audiences)")
+	pflag.DurationVar(&authCacheTTL, "authentication-cache-ttl", time.Minute, "how long successful authentications are cached (0 disables caching)")
+	pflag.StringSliceVar(&tokenSourceNames, "token-sources", []string{"header", "bearer", "subprotocol", "ticket"}, "where listeners may present their token, in order of precedence (header, bearer, subprotocol, query or ticket)")
+	pflag.StringVar(&queryTokenKeyFile, "query-token-key-file", "", "file containing the HMAC key short-lived tokens of the "+internal.TokenQueryParam+" query parameter are signed with, required by the query token source")
+	pflag.DurationVar(&queryTokenMaxTTL, "query-token-max-ttl", internal.DefaultQueryTokenMaxTTL, "the longest lifetime signed query tokens are accepted with")
+	pflag.StringVar(&ticketKeyFile, "ticket-key-file", "", "file containing the key tickets issued by the "+internal.TicketEndpoint+" endpoint are encrypted with, replicas sharing it redeem each other's tickets (a random key is used if empty)")
+	pflag.BoolVar(&impersonation, "impersonation", false, "let users with RBAC permissions to impersonate others act as them with Impersonate-User and Impersonate-Group headers")
+	pflag.DurationVar(&ticketTTL, "ticket-ttl", internal.DefaultTicketTTL, "how long tickets issued by the "+internal.TicketEndpoint+" endpoint can be redeemed")
+	pflag.StringVar(&ingestClientCAFile, "ingest-client-ca-file", "", "PEM file of CA certificates used to verify forwarder client certificates (enables TLS on the ingest server)")
+	pflag.StringVar(&ingestClientCertSecret, "ingest-client-cert-secret", "", "name of the secret holding the client certificate generated outputs push records with")
+	pflag.StringVar(&ingestHMACKeyFile, "ingest-hmac-key-file", "", "file holding the shared key forwarders sign pushed records with")
+	pflag.Int64Var(&ingestMaxBodySize, "ingest-max-body-size", internal.DefaultMaxIngestBodySize, "maximum size of ingest request bodies in bytes, larger requests are rejected (0 means unlimited)")
+	pflag.Int64Var(&ingestMaxDecompressedSize, "ingest-max-decompressed-size", internal.DefaultMaxDecompressedBodySize, "maximum size of gzip or zstd compressed ingest request bodies in bytes once decompressed, larger requests are rejected (0 means unlimited)")
+	pflag.StringArrayVar(&redactionSpecs, "redact", nil, "mask a field (name:field:path, e.g. token:field:.kubernetes.annotations.token) or the matches of a regular expression in all string values (name:regex:expression, e.g. password:regex:password=\\S+) of ingested records, can be repeated")
+	pflag.BoolVar(&enrichRecords, "enrich-records", false, "add the node name and owner workload of their pod to the kubernetes field of ingested records, looked up in an informer cache of the cluster's pods")
+	pflag.StringSliceVar(&enrichmentAnnotations, "enrichment-annotations", nil, "pod annotations added to the kubernetes.annotations field of enriched records")
+	pflag.BoolVar(&deadLettersEnabled, "dead-letters", false, "route messages receivers cannot parse to the dead-letter flow, which admins tail on "+internal.DeadLetterEndpoint+", instead of dropping them")
+	pflag.BoolVar(&deadLetterLog, "dead-letter-log", false, "log each dead letter")
+	pflag.StringVar(&deadLetterFile, "dead-letter-file", "", "file dead letters are appended to, rotated like file sinks (disabled if empty)")
+	pflag.BoolVar(&deadLetterMissingMetadata, "dead-letter-missing-metadata", false, "also dead-letter the records of fluentd and Kafka receivers lacking the Kubernetes namespace or pod")
+	pflag.IntVar(&ingestQueueSize, "ingest-queue-size", internal.DefaultIngestQueueSize, "number of ingested records queued for dispatching before receivers are held up")
+	pflag.IntVar(&maxRecordSize, "max-record-size", internal.DefaultMaxRecordSize, "maximum size of ingested records in bytes (0 means unlimited)")
+	pflag.StringVar(&oversizedRecordPolicy, "oversized-record-policy", string(internal.RecordSizeTruncate), "what to do with records larger than --max-record-size (truncate their message or drop them)")
+	pflag.DurationVar(&maxClockSkew, "max-clock-skew", 0, "maximum difference between the timestamp of ingested records and the time they were received, records skewed further are handled according to --clock-skew-policy (0 disables the check)")
+	pflag.StringVar(&clockSkewPolicy, "clock-skew-policy", string(internal.ClockSkewFlag), "what to do with records skewed more than --max-clock-skew (flag them, or flag them and replace their event time with the time they were received)")
+	pflag.StringVar(&forwardAddr, "forward-addr", "", "local address where the service ingests logs over the Fluentd forward protocol (disabled if empty)")
+	pflag.StringVar(&forwardServiceAddr, "forward-service-addr", "", "remote host:port of the forward protocol receiver, generated outputs use the forward protocol instead of HTTP if set")
+	pflag.StringVar(&forwardSharedKeyFile, "forward-shared-key-file", "", "file holding the shared key forwarders authenticate to the forward protocol receiver with")
+	pflag.StringVar(&syslogAddr, "syslog-addr", "", "local address where the service ingests syslog messages (disabled if empty)")
+	pflag.StringVar(&syslogNetwork, "syslog-network", "udp", "network of the syslog receiver (udp or tcp)")
+	pflag.BoolVar(&syslogTLS, "syslog-tls", false, "use TLS for the tcp syslog receiver")
+	pflag.StringVar(&syslogFlow, "syslog-flow", "clusterflow/syslog", "reference of the flow syslog messages are streamed as, it does not have to exist")
+	pflag.StringVar(&gelfAddr, "gelf-addr", "", "local address where the service ingests GELF messages (disabled if empty)")
+	pflag.StringVar(&gelfNetwork, "gelf-network", "udp", "network of the GELF receiver (udp, or http for messages posted to "+internal.GELFEndpoint+")")
+	pflag.StringVar(&gelfFlow, "gelf-flow", "clusterflow/gelf", "reference of the flow GELF messages are streamed as, it does not have to exist")
+	pflag.StringSliceVar(&kafkaOpts.Brokers, "kafka-brokers", nil, "addresses of Kafka brokers to consume records from (disabled if empty)")
+	pflag.StringVar(&kafkaOpts.Topic, "kafka-topic", "", "Kafka topic to consume records from")
+	pflag.StringVar(&kafkaOpts.GroupID, "kafka-group-id", "log-socket", "Kafka consumer group of the service")
+	pflag.StringVar(&kafkaFlow, "kafka-flow", "clusterflow/kafka", "reference of the flow Kafka records without a "+internal.KafkaFlowHeader+" header are streamed as")
+	pflag.BoolVar(&kafkaTLS, "kafka-tls", false, "connect to Kafka brokers over TLS")
+	pflag.StringVar(&kafkaOpts.SASLMechanism, "kafka-sasl-mechanism", "", "SASL mechanism used to authenticate to Kafka brokers (plain, scram-sha-256 or scram-sha-512)")
+	pflag.StringVar(&kafkaOpts.Username, "kafka-username", "", "user name used to authenticate to Kafka brokers")
+	pflag.StringVar(&kafkaPasswordFile, "kafka-password-file", "", "file holding the password used to authenticate to Kafka brokers")
+	pflag.StringSliceVar(&sinkSpecs, "sink", nil, "mirror records of a flow to a file, an object storage bucket, Loki, Elasticsearch or a webhook, in flowref=url form (e.g. flow/default/app=file:///var/log/app.log, flow/default/app=s3://bucket/prefix, flow/default/app=loki://loki-gateway:3100, flow/default/app=elasticsearch://elasticsearch:9200 or flow/default/app=webhook+https://bot.example.com/logs), can be repeated")
+	pflag.IntVar(&sinkOpts.MaxSize, "sink-max-size", internal.DefaultSinkMaxSize, "number of bytes after which sink files are rotated or objects are uploaded")
+	pflag.DurationVar(&sinkOpts.MaxAge, "sink-max-age", internal.DefaultSinkMaxAge, "time after which sink files are rotated or objects are uploaded, regardless of their size")
+	pflag.StringVar(&s3Opts.Endpoint, "s3-endpoint", "", "base URL of the S3 compatible API of object storage sinks, e.g. https://storage.googleapis.com (defaults to AWS)")
+	pflag.StringVar(&s3Opts.Region, "s3-region", "us-east-1", "region of object storage sink buckets")
+	pflag.StringSliceVar(&auditSinks, "audit-sink", nil, "where to record audit events of log access (stdout, file or kubernetes), can be repeated")
+	pflag.StringVar(&auditFile, "audit-file", "", "file audit events are appended to when using the file audit sink")
+	pflag.StringVar(&authzMode, "authorization-mode", string(internal.AuthorizationModeLabels), "how access to logs is authorized (labels, opa or subjectaccessreview)")
+	pflag.StringVar(&opaOpts.URL, "opa-url", "http://localhost:8181/v1/data/logsocket/allow", "data API URL of the boolean decision of the Open Policy Agent policy when using the opa authorization mode")
+	pflag.DurationVar(&opaOpts.Timeout, "opa-timeout", internal.DefaultOPATimeout, "timeout of Open Policy Agent policy queries")
+	pflag.DurationVar(&opaOpts.CacheTTL, "opa-cache-ttl", internal.DefaultOPACacheTTL, "how long decisions of the Open Policy Agent policy are cached (0 disables caching)")
+	pflag.BoolVar(&opaOpts.Records, "opa-records", false, "have the Open Policy Agent policy decide on the records of each pod and container as well as on subscriptions")
+	pflag.StringVar(&tenancyModeName, "tenancy-mode", string(internal.TenancyModeNone), "how listeners are assigned to tenants confined to their namespaces (none, static or rbac)")
+	pflag.StringVar(&tenantsFile, "tenants-file", "", "YAML file listing the users, groups and namespaces of tenants when using the static tenancy mode")
 	pflag.Parse()
 
-	var logs log.Sink = log.WithVerbosityFilter(log.NewWriterSink(os.Stdout), verbosity)
-
-	metrics := internal.NewMetrics(logs)
+	var output log.Sink
+	switch logFormat {
+	case "text":
+		output = log.NewWriterSink(os.Stdout)
+	case "json":
+		output = log.NewJSONSink(os.Stdout)
+	default:
+		log.Event(log.NewWriterSink(os.Stdout), "invalid log format", log.Fields{"format": logFormat})
+		return
+	}
+	if logSampleBurst > 0 {
+		output = log.WithSampling(output, logSamplePeriod, logSampleBurst)
+	}
+	verbosityFilter := log.WithVerbosityFilter(output, verbosity)
+	var logs log.Sink = verbosityFilter
 
-	records := make(internal.RecordsChannel)
-	listenerReg := make(internal.ListenerEventChannel)
-	reconcileEventChannel := make(internal.ReconcileEventChannel)
+	var configReloader *internal.ConfigReloader
+	if configFile != "" {
+		configReloader = internal.NewConfigReloader(configFile, pflag.CommandLine, logs)
+		if err := configReloader.Load(); err != nil {
+			log.Event(logs, "failed to load configuration file", log.Error(err))
+			return
+		}
+		verbosityFilter.SetVerbosity(verbosity)
+	}
 
-	caCert, caKey, err := tlstools.GenerateSelfSignedCA()
+	policy, err := internal.ParseBackpressurePolicy(backpressurePolicy)
 	if err != nil {
-		log.Event(logs, "failed to generate self-signed CA", log.Error(err))
+		log.Event(logs, "invalid listener backpressure policy", log.Error(err))
 		return
 	}
-
-	tlsCert, err := tlstools.GenerateTLSCert(caCert, caKey, big.NewInt(1), []string{"localhost"}, []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::")})
+	sizePolicy, err := internal.ParseRecordSizePolicy(oversizedRecordPolicy)
+	if err != nil {
+		log.Event(logs, "invalid oversized record policy", log.Error(err))
+		return
+	}
+	skewPolicy, err := internal.ParseClockSkewPolicy(clockSkewPolicy)
+	if err != nil {
+		log.Event(logs, "invalid clock skew policy", log.Error(err))
+		return
+	}
+	if compressionLevel < flate.HuffmanOnly || compressionLevel > flate.BestCompression {
+		log.Event(logs, "invalid listener compression level", log.Fields{"level": compressionLevel})
+		return
+	}
+	authenticationMode, err := internal.ParseAuthenticationMode(authnMode)
+	if err != nil {
+		log.Event(logs, "invalid authentication mode", log.Error(err))
+		return
+	}
+	authorizationMode, err := internal.ParseAuthorizationMode(authzMode)
 	if err != nil {
-		log.Event(logs, "failed to generate TLS certificate with self-signed CA", log.Error(err))
+		log.Event(logs, "invalid authorization mode", log.Error(err))
 		return
 	}
+	var tokenSources []internal.TokenSource
+	for _, name := range tokenSourceNames {
+		src, err := internal.ParseTokenSource(name)
+		if err != nil {
+			log.Event(logs, "invalid token source", log.Error(err))
+			return
+		}
+		tokenSources = append(tokenSources, src)
+	}
+	var queryTokens *internal.QueryTokenSigner
+	if queryTokenKeyFile != "" {
+		key, err := os.ReadFile(queryTokenKeyFile)
+		if err != nil {
+			log.Event(logs, "failed to read query token key file", log.Error(err), log.Fields{"file": queryTokenKeyFile})
+			return
+		}
+		queryTokens = &internal.QueryTokenSigner{Key: []byte(strings.TrimSpace(string(key))), MaxTTL: queryTokenMaxTTL}
+	}
+	var tickets *internal.Tickets
+	for _, src := range tokenSources {
+		switch {
+		case src == internal.TokenSourceQuery && queryTokens == nil:
+			log.Event(logs, "the query token source requires a query token key file")
+			return
+		case src == internal.TokenSourceTicket:
+			var key []byte
+			if ticketKeyFile != "" {
+				if key, err = os.ReadFile(ticketKeyFile); err != nil {
+					log.Event(logs, "failed to read ticket key file", log.Error(err), log.Fields{"file": ticketKeyFile})
+					return
+				}
+			}
+			if tickets, err = internal.NewTickets(key, ticketTTL); err != nil {
+				log.Event(logs, "failed to set up tickets", log.Error(err))
+				return
+			}
+		}
+	}
+	tenancyMode, err := internal.ParseTenancyMode(tenancyModeName)
+	if err != nil {
+		log.Event(logs, "invalid tenancy mode", log.Error(err))
+		return
+	}
+	tlsMinVersion, err := internal.ParseTLSVersion(tlsMinVersionName)
+	if err != nil {
+		log.Event(logs, "invalid minimum TLS version", log.Error(err))
+		return
+	}
+	tlsCipherSuites, err := internal.ParseCipherSuites(tlsCipherSuiteNames)
+	if err != nil {
+		log.Event(logs, "invalid TLS cipher suites", log.Error(err))
+		return
+	}
+	trustedProxies, err := internal.ParseTrustedProxies(trustedProxySpecs)
+	if err != nil {
+		log.Event(logs, "invalid trusted proxies", log.Error(err))
+		return
+	}
+	listenerOpts := internal.ListenerOptions{
+		ControlNamespace:        controlNamespace,
+		BufferSize:              bufferSize,
+		BackpressurePolicy:      policy,
+		PingInterval:            pingInterval,
+		PongTimeout:             pongTimeout,
+		MaxMissedPongs:          maxMissedPongs,
+		RecordRate:              recordRate,
+		RecordBurst:             recordBurst,
+		ConnectionRate:          connRate,
+		ConnectionBurst:         connBurst,
+		HTTP2:                   http2,
+		MaxConnections:          maxConns,
+		MaxUserConnections:      maxUserConns,
+		QuotaRetryAfter:         quotaRetryAfter,
+		Compression:             compression,
+		ReauthorizationInterval: reauthInterval,
+		SessionDuration:         sessionDuration,
+		MaxSessionDuration:      maxSessionDuration,
+		SessionExpiryWarnings:   sessionWarnings,
+		WriteTimeout:            writeTimeout,
+		HandshakeTimeout:        handshakeTimeout,
+		IdleTimeout:             idleTimeout,
+		TrustedProxies:          trustedProxies,
+		Origins:                 internal.OriginPolicy{Allowed: allowedOrigins},
+		CompressionLevel:        compressionLevel,
+		UI:                      webUI,
+	}
+	if webUI && !flowsEndpoint {
+		log.Event(logs, "the web UI requires the flows endpoint")
+		return
+	}
+	var limitUpdates chan internal.ListenerOptions
+	if configReloader != nil {
+		limitUpdates = make(chan internal.ListenerOptions, 1)
+		listenerOpts.LimitUpdates = limitUpdates
+	}
 
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{
-			tlsCert,
-		},
+	if http2 && !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		log.Event(logs, "websockets over HTTP/2 are disabled by the Go runtime, set GODEBUG=http2xconnect=1 to enable them")
+	}
+
+	metrics := internal.NewMetrics(logs)
+
+	records := make(internal.RecordsChannel, ingestQueueSize)
+	ingested := internal.QueueRecords(records, metrics)
+	if maxRecordSize > 0 {
+		ingested = internal.LimitRecordSize(ingested, maxRecordSize, sizePolicy, logs, metrics)
+	}
+	if len(redactionSpecs) > 0 {
+		rules := make([]internal.RedactionRule, 0, len(redactionSpecs))
+		for _, spec := range redactionSpecs {
+			rule, err := internal.ParseRedactionRule(spec)
+			if err != nil {
+				log.Event(logs, "invalid redaction rule", log.Error(err))
+				return
+			}
+			rules = append(rules, rule)
+		}
+		ingested = internal.Redact(ingested, rules, logs, metrics)
+	}
+	if maxClockSkew > 0 {
+		ingested = internal.CheckClockSkew(ingested, maxClockSkew, skewPolicy, logs, metrics)
+	}
+	var deadLetters *internal.DeadLetters
+	if deadLettersEnabled {
+		// dead letters are redacted like records, but not enriched
+		deadLetters = &internal.DeadLetters{
+			Flow:            internal.DeadLetterFlow(controlNamespace),
+			Records:         ingested,
+			Log:             deadLetterLog,
+			Logs:            logs,
+			Metrics:         metrics,
+			MissingMetadata: deadLetterMissingMetadata,
+		}
+		listenerOpts.DeadLetters = true
+	}
+	var throughput *internal.ThroughputQuotas
+	if len(throughputQuotaSpecs) > 0 {
+		quotas := make([]internal.ThroughputQuota, 0, len(throughputQuotaSpecs))
+		for _, spec := range throughputQuotaSpecs {
+			quota, err := internal.ParseThroughputQuota(spec, controlNamespace)
+			if err != nil {
+				log.Event(logs, "invalid throughput quota", log.Error(err))
+				return
+			}
+			quotas = append(quotas, quota)
+		}
+		throughput = internal.NewThroughputQuotas(quotas, throughputSampleRate, metrics)
+	}
+	registry := internal.NewFlowRegistry(metrics)
+	replay := internal.NewReplayBuffer(replaySize, replayMaxAge)
+	if ackBufferSize > 0 {
+		listenerOpts.Acks = internal.NewAckStore(ackBufferSize, ackRetention, ackMaxUserConsumers, ackMaxConsumers)
+	}
+	if replayDir != "" {
+		if err := replay.Persist(replayDir, replayDirMaxBytes, logs); err != nil {
+			log.Event(logs, "failed to persist replay buffer", log.Error(err), log.Fields{"dir": replayDir})
+			return
+		}
+		defer replay.Close()
+	}
+	reconcileEventChannel := make(internal.ReconcileEventChannel)
+
+	var certReloader *internal.CertificateReloader
+	var tlsCert tls.Certificate
+	if tlsCertFile != "" {
+		if certReloader, err = internal.NewCertificateReloader(tlsCertFile, tlsKeyFile, logs); err != nil {
+			log.Event(logs, "failed to load TLS certificate", log.Error(err), log.Fields{"cert": tlsCertFile, "key": tlsKeyFile})
+			return
+		}
+	} else {
+		caCert, caKey, err := tlstools.GenerateSelfSignedCA()
+		if err != nil {
+			log.Event(logs, "failed to generate self-signed CA", log.Error(err))
+			return
+		}
+
+		tlsCert, err = tlstools.GenerateTLSCert(caCert, caKey, big.NewInt(1), []string{"localhost"}, []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::")})
+		if err != nil {
+			log.Event(logs, "failed to generate TLS certificate with self-signed CA", log.Error(err))
+			return
+		}
+	}
+
+	// newServerTLSConfig returns a configuration serving the (reloaded) certificate with the configured protocol versions and cipher suites
+	newServerTLSConfig := func() *tls.Config {
+		cfg := &tls.Config{
+			MinVersion:   tlsMinVersion,
+			CipherSuites: tlsCipherSuites,
+		}
+		if certReloader != nil {
+			cfg.GetCertificate = certReloader.GetCertificate
+		} else {
+			cfg.Certificates = []tls.Certificate{
+				tlsCert,
+			}
+		}
+		return cfg
+	}
+
+	tlsConfig := newServerTLSConfig()
+
+	var acmeManager internal.ACMEManager
+	if len(acmeOpts.Domains) > 0 {
+		if acmeOpts.Challenge, err = internal.ParseACMEChallenge(acmeChallenge); err != nil {
+			log.Event(logs, "invalid ACME challenge type", log.Error(err))
+			return
+		}
+		if acmeDNSHook != "" {
+			acmeOpts.DNSProvider = internal.ExecDNSProvider{Command: acmeDNSHook}
+		}
+		if acmeManager, err = internal.NewACMEManager(acmeOpts, logs); err != nil {
+			log.Event(logs, "failed to set up ACME certificate management", log.Error(err))
+			return
+		}
+		// only the public listener endpoint is served the ACME certificate, forwarders keep using the internal one
+		tlsConfig.Certificates = nil
+		tlsConfig.GetCertificate = acmeManager.GetCertificate
+	}
+
+	if authenticationMode == internal.AuthenticationModeMTLS {
+		caPEM, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			log.Event(logs, "failed to read client CA file", log.Error(err), log.Fields{"file": clientCAFile})
+			return
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			log.Event(logs, "no valid certificates found in client CA file", log.Fields{"file": clientCAFile})
+			return
+		}
+		// readiness probes cannot present a certificate, so the listener server requires one for other requests only
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = clientCAs
+	}
+
+	var ingestOpts internal.IngestOptions
+	if ingestClientCAFile != "" {
+		caPEM, err := os.ReadFile(ingestClientCAFile)
+		if err != nil {
+			log.Event(logs, "failed to read ingest client CA file", log.Error(err), log.Fields{"file": ingestClientCAFile})
+			return
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			log.Event(logs, "no valid certificates found in ingest client CA file", log.Fields{"file": ingestClientCAFile})
+			return
+		}
+		ingestOpts.TLSConfig = newServerTLSConfig()
+		// health probes cannot present a certificate, so the ingest server requires one for pushes only
+		ingestOpts.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		ingestOpts.TLSConfig.ClientCAs = clientCAs
+	}
+	if ingestHMACKeyFile != "" {
+		key, err := os.ReadFile(ingestHMACKeyFile)
+		if err != nil {
+			log.Event(logs, "failed to read ingest HMAC key file", log.Error(err), log.Fields{"file": ingestHMACKeyFile})
+			return
+		}
+		ingestOpts.HMACKey = []byte(strings.TrimSpace(string(key)))
+	}
+	ingestOpts.MaxBodySize = ingestMaxBodySize
+	ingestOpts.MaxDecompressedSize = ingestMaxDecompressedSize
+	ingestOpts.DeadLetters = deadLetters
+
+	forwardOpts := internal.ForwardOptions{
+		Hostname:    "log-socket",
+		TLSConfig:   ingestOpts.TLSConfig,
+		DeadLetters: deadLetters,
+	}
+	if forwardSharedKeyFile != "" {
+		key, err := os.ReadFile(forwardSharedKeyFile)
+		if err != nil {
+			log.Event(logs, "failed to read forward shared key file", log.Error(err), log.Fields{"file": forwardSharedKeyFile})
+			return
+		}
+		forwardOpts.SharedKey = strings.TrimSpace(string(key))
+	}
+
+	syslogOpts := internal.SyslogOptions{
+		Network:     syslogNetwork,
+		DeadLetters: deadLetters,
+	}
+	if syslogAddr != "" {
+		if syslogNetwork != "udp" && syslogNetwork != "tcp" {
+			log.Event(logs, "invalid syslog network", log.Fields{"network": syslogNetwork})
+			return
+		}
+		if syslogOpts.Flow, err = internal.ParseFlowReference(syslogFlow, controlNamespace); err != nil {
+			log.Event(logs, "invalid syslog flow reference", log.Error(err))
+			return
+		}
+		if syslogTLS {
+			syslogOpts.TLSConfig = newServerTLSConfig()
+		}
+	}
+
+	gelfOpts := internal.GELFOptions{
+		Network:     gelfNetwork,
+		DeadLetters: deadLetters,
+	}
+	if gelfAddr != "" {
+		if gelfNetwork != "udp" && gelfNetwork != "http" {
+			log.Event(logs, "invalid GELF network", log.Fields{"network": gelfNetwork})
+			return
+		}
+		if gelfOpts.Flow, err = internal.ParseFlowReference(gelfFlow, controlNamespace); err != nil {
+			log.Event(logs, "invalid GELF flow reference", log.Error(err))
+			return
+		}
+	}
+
+	kafkaOpts.DeadLetters = deadLetters
+	if len(kafkaOpts.Brokers) > 0 {
+		if kafkaOpts.Topic == "" {
+			log.Event(logs, "Kafka topic must be specified")
+			return
+		}
+		if kafkaOpts.Flow, err = internal.ParseFlowReference(kafkaFlow, controlNamespace); err != nil {
+			log.Event(logs, "invalid Kafka flow reference", log.Error(err))
+			return
+		}
+		if kafkaTLS {
+			kafkaOpts.TLSConfig = &tls.Config{}
+		}
+		if kafkaPasswordFile != "" {
+			password, err := os.ReadFile(kafkaPasswordFile)
+			if err != nil {
+				log.Event(logs, "failed to read Kafka password file", log.Error(err), log.Fields{"file": kafkaPasswordFile})
+				return
+			}
+			kafkaOpts.Password = strings.TrimSpace(string(password))
+		}
+	}
+
+	s3Opts.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	s3Opts.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	sinks := make([]internal.Sink, 0, len(sinkSpecs))
+	defer func() {
+		for _, sink := range sinks {
+			if err := sink.Close(); err != nil {
+				log.Event(logs, "an error occurred while closing sink", log.Error(err), log.Fields{"flow": sink.Flow()})
+			}
+		}
+	}()
+	for _, spec := range sinkSpecs {
+		flow, rawURL, err := internal.ParseSinkSpec(spec, controlNamespace)
+		if err != nil {
+			log.Event(logs, "invalid sink", log.Error(err))
+			return
+		}
+		sink, err := internal.NewSink(flow, rawURL, sinkOpts, s3Opts, logs)
+		if err != nil {
+			log.Event(logs, "failed to create sink", log.Error(err), log.Fields{"flow": flow})
+			return
+		}
+		sinks = append(sinks, sink)
+		registry.Register(sink)
+	}
+	if deadLetters != nil && deadLetterFile != "" {
+		sink, err := internal.NewFileSink(deadLetters.Flow, deadLetterFile, sinkOpts, log.WithFields(logs, log.Fields{"task": "dead letters"}))
+		if err != nil {
+			log.Event(logs, "failed to create dead letter file", log.Error(err), log.Fields{"file": deadLetterFile})
+			return
+		}
+		sinks = append(sinks, sink)
+		registry.Register(sink)
 	}
 
 	stopLatch := internal.NewWaitableLatch()
 	stopSignal := internal.NewHandleableLatch(stopLatch.Chan())
 
+	if certReloader != nil {
+		go certReloader.Run(tlsReloadInterval, stopLatch.Chan())
+	}
+	if acmeManager != nil {
+		go acmeManager.Run(stopLatch.Chan())
+	}
+	hostname, _ := os.Hostname()
+	if tracingOpts.Endpoint != "" {
+		tracingOpts.Attributes = map[string]string{"service.name": "log-socket", "service.instance.id": hostname}
+		tracerProvider, err := internal.NewTracerProvider(tracingOpts)
+		if err != nil {
+			log.Event(logs, "failed to set up tracing", log.Error(err))
+			return
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tracerProvider.Shutdown(ctx); err != nil {
+				log.Event(logs, "failed to flush spans", log.Error(err))
+			}
+		}()
+	}
+	var metricsExporters []internal.MetricsExporter
+	if otlpOpts.Endpoint != "" {
+		otlpOpts.Attributes = map[string]string{"service.name": "log-socket", "service.instance.id": hostname}
+		metricsExporters = append(metricsExporters, internal.NewOTLPExporter(otlpOpts, prometheus.DefaultGatherer, logs))
+	}
+	for _, exporter := range metricsExporters {
+		go exporter.Run(stopLatch.Chan())
+	}
+	if configReloader != nil {
+		// the reloaded values are set to the variables the flags are bound to
+		configReloader.OnReload(func() {
+			verbosityFilter.SetVerbosity(verbosity)
+		}, "verbosity")
+		configReloader.OnReload(func() {
+			update := listenerOpts
+			update.RecordRate = recordRate
+			update.RecordBurst = recordBurst
+			update.MaxConnections = maxConns
+			update.MaxUserConnections = maxUserConns
+			limitUpdates <- update
+		}, "listener-record-rate", "listener-record-burst", "max-connections", "max-user-connections")
+		go configReloader.Run(configReloadInterval, stopLatch.Chan())
+
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		go func() {
+			for range hangups {
+				log.Event(logs, "reloading configuration file on SIGHUP", log.V(1))
+				configReloader.Trigger()
+			}
+		}()
+	}
+
 	s := runtime.NewScheme()
 	if err := loggingv1beta1.AddToScheme(s); err != nil {
 		log.Event(logs, "an error occurred while adding API group to scheme", log.Error(err), log.Fields{"group": loggingv1beta1.GroupVersion, "scheme": s})
 		return
 	}
+	if err := logsocketv1alpha1.AddToScheme(s); err != nil {
+		log.Event(logs, "an error occurred while adding API group to scheme", log.Error(err), log.Fields{"group": logsocketv1alpha1.GroupVersion, "scheme": s})
+		return
+	}
 	if err := authv1.AddToScheme(s); err != nil {
 		log.Event(logs, "an error occurred while adding API group to scheme", log.Error(err), log.Fields{"group": authv1.SchemeGroupVersion, "scheme": s})
 		return
 	}
+	if err := authzv1.AddToScheme(s); err != nil {
+		log.Event(logs, "an error occurred while adding API group to scheme", log.Error(err), log.Fields{"group": authzv1.SchemeGroupVersion, "scheme": s})
+		return
+	}
+	if err := corev1.AddToScheme(s); err != nil {
+		log.Event(logs, "an error occurred while adding API group to scheme", log.Error(err), log.Fields{"group": corev1.SchemeGroupVersion, "scheme": s})
+		return
+	}
+	if err := appsv1.AddToScheme(s); err != nil {
+		log.Event(logs, "an error occurred while adding API group to scheme", log.Error(err), log.Fields{"group": appsv1.SchemeGroupVersion, "scheme": s})
+		return
+	}
+	if err := batchv1.AddToScheme(s); err != nil {
+		log.Event(logs, "an error occurred while adding API group to scheme", log.Error(err), log.Fields{"group": batchv1.SchemeGroupVersion, "scheme": s})
+		return
+	}
 	cfg, err := ctrl.GetConfig()
 	if err != nil {
 		log.Event(logs, "an error occurred while loading kubeconfig", log.Error(err))
@@ -82,23 +854,289 @@ func main() {
 		log.Event(logs, "an error occurred while creating kubernetes client", log.Error(err))
 		return
 	}
+	if flowsEndpoint {
+		listenerOpts.Flows = internal.KubernetesFlowLister{Client: c}
+	}
+	var outputRoutes *internal.KubernetesOutputRoutes
+	var outputRouteChanges <-chan struct{}
+	if enrichRecords {
+		podCache, err := cache.New(cfg, cache.Options{Scheme: s})
+		if err != nil {
+			log.Event(logs, "an error occurred while creating informer cache", log.Error(err))
+			return
+		}
+		podMetadata := internal.NewKubernetesPodMetadata(podCache, logs)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			stopLatch.Wait()
+			cancel()
+		}()
+		go podMetadata.Run(ctx)
+		// records are enriched before anything else so that redaction applies to the added annotations
+		ingested = internal.Enrich(ingested, podMetadata, enrichmentAnnotations, logs, metrics)
+	}
+	if watchFlows {
+		wc, err := client.NewWithWatch(cfg, client.Options{Scheme: s})
+		if err != nil {
+			log.Event(logs, "an error occurred while creating kubernetes client", log.Error(err))
+			return
+		}
+		go internal.NewFlowWatcher(wc, registry, logs).Run(internal.DefaultFlowWatchRetryInterval, stopLatch.Chan())
+	}
+	if outputSubscriptions && !sharding {
+		outputRoutes = internal.NewKubernetesOutputRoutes(c, controlNamespace, logs)
+		if err := outputRoutes.Refresh(context.Background()); err != nil {
+			log.Event(logs, "failed to list output routes", log.Error(err))
+		}
+		listenerOpts.Outputs = outputRoutes
+		outputRouteChanges = outputRoutes.Changes()
+		go outputRoutes.Run(outputRoutesInterval, stopLatch.Chan())
+	}
+	if selectorSubscriptions {
+		listenerOpts.Selectors = internal.KubernetesSelectorFlows{Client: c, ControlNamespace: controlNamespace}
+	}
+	if deadLettersEnabled && !adminAPI {
+		log.Event(logs, "dead letters can only be tailed on "+internal.DeadLetterEndpoint+" with the admin API enabled")
+	}
+	if adminAPI {
+		listenerOpts.LogLevel = verbosityFilter
+		if len(adminGroups) > 0 {
+			listenerOpts.Admin = internal.GroupAdminAuthorizer{Groups: adminGroups}
+		} else {
+			listenerOpts.Admin = internal.SubjectAccessReviewAdminAuthorizer{Client: c}
+		}
+	}
+	if subscriptions {
+		if !adminAPI {
+			log.Event(logs, "persistent subscriptions are created on "+internal.AdminSubscriptionsEndpoint+", which requires the admin API")
+			return
+		}
+		listenerOpts.Subscriptions = internal.NewPersistentSubscriptions(registry, subscriptionMaxTTL, subscriptionMaxRecords)
+	}
+	if clustersFile != "" {
+		listenerOpts.Clusters, err = internal.LoadRemoteClusters(clustersFile, logs)
+		if err != nil {
+			log.Event(logs, "failed to load remote clusters", log.Error(err), log.Fields{"file": clustersFile})
+			return
+		}
+	}
+	if capabilities {
+		if !adminAPI {
+			log.Event(logs, "capability URLs are minted on "+internal.AdminCapabilitiesEndpoint+", which requires the admin API")
+			return
+		}
+		var key []byte
+		if capabilityKeyFile != "" {
+			if key, err = os.ReadFile(capabilityKeyFile); err != nil {
+				log.Event(logs, "failed to read capability key file", log.Error(err), log.Fields{"file": capabilityKeyFile})
+				return
+			}
+		}
+		if listenerOpts.Capabilities, err = internal.NewCapabilities([]byte(strings.TrimSpace(string(key))), capabilityMaxTTL, capabilityBaseURL); err != nil {
+			log.Event(logs, "failed to set up capability URLs", log.Error(err))
+			return
+		}
+	}
 
 	if !strings.Contains(serviceAddr, "://") {
-		serviceAddr = "http://" + serviceAddr
+		if ingestOpts.TLSConfig != nil {
+			serviceAddr = "https://" + serviceAddr
+		} else {
+			serviceAddr = "http://" + serviceAddr
+		}
+	}
+
+	var authenticator internal.Authenticator
+	switch authenticationMode {
+	case internal.AuthenticationModeMTLS:
+		authenticator = internal.ClientCertificateAuthenticator{}
+	case internal.AuthenticationModeOIDC:
+		authenticator, err = internal.NewOIDCAuthenticator(oidcOpts)
+		if err != nil {
+			log.Event(logs, "an error occurred while creating OIDC authenticator", log.Error(err))
+			return
+		}
+	default:
+		authenticator = internal.TokenReviewAuthenticator{Client: c, Audiences: tokenAudiences}
+	}
+	if authCacheTTL > 0 && authenticationMode != internal.AuthenticationModeMTLS {
+		authenticator = internal.NewCachingAuthenticator(authenticator, authCacheTTL, metrics)
+	}
+	if authenticationMode != internal.AuthenticationModeMTLS {
+		policy := internal.TokenPolicy{Authenticator: authenticator, Sources: tokenSources, QueryTokens: queryTokens, Tickets: tickets}
+		if impersonation {
+			policy.Impersonation = internal.SubjectAccessReviewImpersonationAuthorizer{Client: c}
+		}
+		authenticator = policy
+	}
+
+	var authorizer internal.Authorizer
+	switch authorizationMode {
+	case internal.AuthorizationModeSubjectAccessReview:
+		authorizer = internal.SubjectAccessReviewAuthorizer{Client: c}
+	case internal.AuthorizationModeOPA:
+		authorizer = internal.NewOPAAuthorizer(opaOpts, logs)
+	default:
+		authorizer = internal.LabelAuthorizer{Logs: logs}
+	}
+	if logTaps {
+		taps := internal.NewKubernetesLogTaps(c, controlNamespace, logs)
+		if err := taps.Refresh(context.Background()); err != nil {
+			log.Event(logs, "failed to list log taps", log.Error(err))
+		}
+		go taps.Run(logTapsInterval, stopLatch.Chan())
+		authorizer = internal.TapAuthorizer{Authorizer: authorizer, Taps: taps, Logs: logs}
+	}
+
+	var tenancy internal.Tenancy
+	switch tenancyMode {
+	case internal.TenancyModeStatic:
+		tenancy, err = internal.LoadStaticTenancy(tenantsFile)
+		if err != nil {
+			log.Event(logs, "failed to load tenants", log.Error(err), log.Fields{"file": tenantsFile})
+			return
+		}
+	case internal.TenancyModeRBAC:
+		tenancy = internal.RBACTenancy{Client: c}
+	}
+	if tenancy != nil {
+		authorizer = internal.TenantAuthorizer{Authorizer: authorizer, Tenancy: tenancy}
+		listenerOpts.Tenancy = tenancy
+	}
+
+	var audit internal.AuditSinks
+	for _, sink := range auditSinks {
+		typ, err := internal.ParseAuditSinkType(sink)
+		if err != nil {
+			log.Event(logs, "invalid audit sink", log.Error(err))
+			return
+		}
+		switch typ {
+		case internal.AuditSinkStdout:
+			audit = append(audit, internal.NewJSONAuditSink(os.Stdout, logs))
+		case internal.AuditSinkFile:
+			f, err := os.OpenFile(auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+			if err != nil {
+				log.Event(logs, "failed to open audit file", log.Error(err), log.Fields{"file": auditFile})
+				return
+			}
+			defer f.Close()
+			audit = append(audit, internal.NewJSONAuditSink(f, logs))
+		case internal.AuditSinkKubernetes:
+			audit = append(audit, internal.KubernetesEventAuditSink{Client: c, Logs: logs})
+		}
+	}
+	if len(audit) > 0 {
+		listenerOpts.Audit = audit
 	}
 
-	authenticator := internal.TokenReviewAuthenticator{Client: c}
+	dispatched := records
+	var broadcaster *internal.Broadcaster
+	var flowChanges <-chan struct{}
+	var leader *internal.LeaderElector
+	if sharding && broadcastRedisAddr == "" {
+		log.Event(logs, "sharding requires a broadcast Redis address")
+		return
+	}
+	if broadcastRedisAddr != "" {
+		replica, err := os.Hostname()
+		if err != nil {
+			log.Event(logs, "failed to get hostname", log.Error(err))
+			return
+		}
+		broadcastOpts := internal.BroadcastOptions{
+			Replica: replica,
+			Channel: broadcastChannel,
+			Sharded: sharding,
+			Addr:    shardAdvertiseAddr,
+		}
+		if sharding {
+			if broadcastOpts.Addr == "" {
+				_, port, err := net.SplitHostPort(listenAddr)
+				if err != nil {
+					log.Event(logs, "failed to parse listen address", log.Error(err))
+					return
+				}
+				broadcastOpts.Addr = net.JoinHostPort(os.Getenv("POD_IP"), port)
+			}
+			// the listener certificates of replicas are generated or issued for them, so proxied connections are only made if they can be verified
+			if shardProxyCAFile == "" {
+				log.Event(logs, "--shard-proxy-ca-file is required in sharding mode to verify the listener certificates of other replicas")
+				return
+			}
+			pem, err := os.ReadFile(shardProxyCAFile)
+			if err != nil {
+				log.Event(logs, "failed to read shard proxy CA file", log.Error(err))
+				return
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				log.Event(logs, "no certificates found in shard proxy CA file", log.Fields{"file": shardProxyCAFile})
+				return
+			}
+			listenerOpts.ShardReplica = replica
+			listenerOpts.ShardProxyTLS = &tls.Config{RootCAs: pool}
+		}
+		broadcaster = internal.NewBroadcaster(broadcastOpts, internal.RedisTransport{
+			Client: redis.NewClient(&redis.Options{Addr: broadcastRedisAddr, Password: os.Getenv("REDIS_PASSWORD")}),
+		}, logs)
+		if sharding {
+			listenerOpts.Shards = broadcaster
+		}
+		dispatched = broadcaster.Relay(records, stopLatch.Chan())
+		flowChanges = broadcaster.Changes()
+
+		if leaderElectionNamespace == "" {
+			leaderElectionNamespace = controlNamespace
+		}
+		leader, err = internal.RunLeaderElection(cfg, internal.LeaderElectionOptions{
+			Namespace: leaderElectionNamespace,
+			Name:      "log-socket",
+			Identity:  replica,
+			OnStartedLeading: func() {
+				// wait for the other replicas to announce their flows before removing outputs they need
+				time.AfterFunc(internal.BroadcastAnnounceInterval, func() {
+					reconcileEventChannel <- internal.ReconcileEvent{Requests: broadcaster.Flows()}
+				})
+			},
+		}, logs, stopLatch.Chan())
+		if err != nil {
+			log.Event(logs, "failed to start leader election", log.Error(err))
+			return
+		}
+	}
 
 	go func() {
 		rec := reconciler.New(serviceAddr, c)
+		rec.ClientCertSecret = ingestClientCertSecret
+		rec.ForwardAddr = forwardServiceAddr
+		rec.ForwardSharedKey = forwardOpts.SharedKey
+		rec.ControlNamespace = controlNamespace
+		// failed reconciliations are retried unless a newer event supersedes them
+		var retry <-chan time.Time
+		var failed internal.ReconcileEvent
 		for {
+			var evt internal.ReconcileEvent
 			select {
 			case <-stopLatch.Chan():
 				return
-			case evt := <-reconcileEventChannel:
-				res, err := rec.Reconcile(context.Background(), evt)
-				log.Event(logs, "reconcile finished", log.V(1), log.Fields{"res": res, "err": err})
-				// TODO: requeue
+			case evt = <-reconcileEventChannel:
+			case <-retry:
+				evt = failed
+			}
+			retry = nil
+			if leader != nil && !leader.IsLeader() {
+				log.Event(logs, "not the leader, skipping reconciliation", log.V(2))
+				continue
+			}
+			res, err := rec.Reconcile(context.Background(), evt)
+			log.Event(logs, "reconcile finished", log.V(1), log.Fields{"res": res, "err": err})
+			if err != nil || res.Requeue || res.RequeueAfter > 0 {
+				delay := reconcileRetryInterval
+				if res.RequeueAfter > 0 {
+					delay = res.RequeueAfter
+				}
+				failed, retry = evt, time.After(delay)
 			}
 		}
 	}()
@@ -109,98 +1147,149 @@ func main() {
 		defer wg.Done()
 		defer stopLatch.Close()
 
-		internal.Ingest(ingestAddr, records, logs, metrics, stopSignal, nil)
+		internal.Ingest(ingestAddr, ingested, logs, metrics, stopSignal, nil, ingestOpts)
 	}()
+	if forwardAddr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stopLatch.Close()
+
+			internal.IngestForward(forwardAddr, ingested, logs, metrics, stopSignal, forwardOpts)
+		}()
+	}
+	if syslogAddr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stopLatch.Close()
+
+			internal.IngestSyslog(syslogAddr, ingested, logs, metrics, stopSignal, syslogOpts)
+		}()
+	}
+	if gelfAddr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stopLatch.Close()
+
+			internal.IngestGELF(gelfAddr, ingested, logs, metrics, stopSignal, gelfOpts)
+		}()
+	}
+	if len(kafkaOpts.Brokers) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stopLatch.Close()
+
+			internal.ConsumeKafka(ingested, logs, metrics, stopSignal, kafkaOpts)
+		}()
+	}
+	// websocket, event stream and gRPC listeners count against the same connection rate limit and quotas
+	listenerOpts.Admission = internal.NewListenerAdmission(listenerOpts, metrics)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		defer stopLatch.Close()
 
-		internal.Listen(listenAddr, tlsConfig, listenerReg, logs, metrics, stopSignal, nil, authenticator)
+		internal.Listen(listenAddr, tlsConfig, registry, logs, metrics, stopSignal, nil, authenticator, authorizer, replay, listenerOpts)
 	}()
+	if profilingAddr != "" {
+		go internal.ServeProfiling(profilingAddr, logs, stopSignal)
+	}
+	go replay.RunPruning(internal.DefaultReplayPruneInterval, func(flow internal.FlowReference) bool {
+		return len(internal.RoutedListeners(registry, listenerOpts.Outputs, flow)) > 0
+	}, stopLatch.Chan())
+	if memoryGuardOpts.MaxHeapBytes > 0 {
+		go internal.NewMemoryGuard(memoryGuardOpts, replay, logs, metrics).Run(stopLatch.Chan())
+	}
+	if grpcAddr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stopLatch.Close()
+
+			internal.ServeGRPC(grpcAddr, tlsConfig, registry, logs, metrics, stopSignal, authenticator, authorizer, replay, listenerOpts)
+		}()
+	}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		defer stopLatch.Close()
 
-		var listeners []internal.Listener
+		dispatcher := internal.NewDispatcher(dispatchWorkers)
+		defer dispatcher.Close()
+		var dedup *internal.Deduplicator
+		if dedupWindow > 0 {
+			dedup = internal.NewDeduplicator(dedupWindow, dedupMaxEntries, metrics)
+		}
+
+		// outputs get records of the flows routing to them, so those flows are tapped for their listeners
+		tapListenedFlows := func() {
+			flows := internal.TappedFlows(registry.Flows(), listenerOpts.Outputs)
+			// flows of non-Kubernetes sources need no outputs
+			slice.RemoveFunc(&flows, func(flow internal.FlowReference) bool {
+				return flow.Kind == internal.FKDeadLetter || (syslogAddr != "" && flow == syslogOpts.Flow) || (gelfAddr != "" && flow == gelfOpts.Flow) || (len(kafkaOpts.Brokers) > 0 && flow == kafkaOpts.Flow)
+			})
+			if broadcaster != nil {
+				flows = broadcaster.AnnounceFlows(flows)
+			}
+			reconcileEventChannel <- internal.ReconcileEvent{Requests: flows}
+		}
 
 	loop:
 		for {
 			select {
 			case <-stopLatch.Chan():
 				break loop
-			case ev := <-listenerReg:
-				listenersToAdd, listenersToRemove := gatherListenerEvents(ev, listenerReg)
-				if len(listenersToRemove) > 0 {
-					slice.RemoveFunc(&listeners, func(item internal.Listener) bool {
-						for _, l := range listenersToRemove {
-							if l == item {
-								metrics.ListenerRemoved(l)
-								return true
-							}
-						}
-						return false
-					})
-				}
-				listeners = append(listeners, listenersToAdd...)
-				metrics.CurrentListeners(len(listeners))
-				if len(listenersToAdd) > 0 || len(listenersToRemove) > 0 {
-					reconcileEventChannel <- generateReconcileEvent(listeners)
-
+			case <-registry.Changes():
+				tapListenedFlows()
+			case <-outputRouteChanges:
+				tapListenedFlows()
+			case <-flowChanges:
+				if sharding {
+					internal.CloseMovedListeners(registry, broadcaster)
 				}
-			case r, ok := <-records:
+				reconcileEventChannel <- internal.ReconcileEvent{Requests: broadcaster.Flows()}
+			case r, ok := <-dispatched:
 				if !ok {
 					log.Event(logs, "records channel closed", log.V(1))
 					break loop
 				}
 
+				if dedup != nil && dedup.Duplicate(r) {
+					log.Event(logs, "duplicate record, discarding", log.V(2), log.Fields{"record": r})
+					continue loop
+				}
+
+				r = replay.Push(r)
+
 				log.Event(logs, "forwarding record", log.V(2), log.Fields{"record": r})
 
+				listeners := internal.RoutedListeners(registry, listenerOpts.Outputs, r.Flow)
 				if len(listeners) == 0 {
 					log.Event(logs, "no listeners, discarding record", log.V(2), log.Fields{"record": r})
 					continue loop
 				}
-
-				for _, l := range listeners {
-					l.Send(r)
+				if throughput != nil {
+					admitted, notification := throughput.Admit(r, time.Now())
+					if notification != nil {
+						internal.NotifyThrottled(listeners, *notification)
+					}
+					if !admitted {
+						log.Event(logs, "record exceeds throughput quota, discarding", log.V(2), log.Fields{"record": r})
+						continue loop
+					}
 				}
+
+				dispatcher.Dispatch(r, listeners)
 			}
 		}
 	}()
 
-	reconcileEventChannel <- internal.ReconcileEvent{}
-
-	wg.Wait()
-}
-
-func gatherListenerEvents(ev internal.ListenerEvent, ch <-chan internal.ListenerEvent) (listenersToAdd []internal.Listener, listenersToRemove []internal.Listener) {
-start:
-	switch ev.EventType {
-	case internal.RegisterListener:
-		listenersToAdd = append(listenersToAdd, ev.Listener)
-	case internal.UnregisterListener:
-		listenersToRemove = append(listenersToRemove, ev.Listener)
-	}
-	select {
-	case ev = <-ch:
-		goto start
-	default:
-		return
+	if leader == nil {
+		reconcileEventChannel <- internal.ReconcileEvent{}
 	}
-}
-
-func generateReconcileEvent(listeners []internal.Listener) internal.ReconcileEvent {
-	requestMap := map[internal.FlowReference]bool{}
-	for _, l := range listeners {
-		requestMap[l.Flow()] = true
-	}
-
-	requests := []internal.FlowReference{}
 
-	for k := range requestMap {
-		requests = append(requests, k)
-	}
-
-	return internal.ReconcileEvent{Requests: requests}
+	wg.Wait()
 }
@@ -0,0 +1,273 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	// AckParam names the consumer of a connection requesting at-least-once delivery, records delivered to it are retained until acknowledged
+	AckParam = "ack"
+
+	ClientActionAck ClientAction = "ack"
+
+	DefaultAckBufferSize       = 10000
+	DefaultAckRetention        = time.Hour
+	DefaultAckMaxUserConsumers = 100
+	DefaultAckMaxConsumers     = 10000
+)
+
+// ErrAckConsumerLimit is returned when retaining the records of another consumer would exceed the limits of the store
+var ErrAckConsumerLimit = errors.New("too many acknowledging consumers")
+
+// NewAckStore returns a store retaining at most size unacknowledged records of each consumer and flow, consumers unused for retention are forgotten
+// At most maxUserConsumers consumers of flows are retained per user and maxConsumers overall, so that the store's memory is bounded
+func NewAckStore(size int, retention time.Duration, maxUserConsumers, maxConsumers int) *AckStore {
+	if size <= 0 {
+		size = DefaultAckBufferSize
+	}
+	if retention <= 0 {
+		retention = DefaultAckRetention
+	}
+	if maxUserConsumers <= 0 {
+		maxUserConsumers = DefaultAckMaxUserConsumers
+	}
+	if maxConsumers <= 0 {
+		maxConsumers = DefaultAckMaxConsumers
+	}
+	return &AckStore{
+		consumers:        make(map[ackKey]*ackConsumer),
+		maxConsumers:     maxConsumers,
+		maxUserConsumers: maxUserConsumers,
+		retention:        retention,
+		size:             size,
+		userConsumers:    make(map[string]int),
+	}
+}
+
+// AckStore keeps the records delivered to consumers until they acknowledge them, so that they are delivered again when the consumer reconnects
+type AckStore struct {
+	consumers        map[ackKey]*ackConsumer
+	maxConsumers     int
+	maxUserConsumers int
+	mutex            sync.Mutex
+	retention        time.Duration
+	size             int
+	// userConsumers counts the consumers of each user
+	userConsumers map[string]int
+}
+
+// ackKey identifies the stream of a flow to a consumer, consumers are scoped to users so that they cannot receive each other's records
+type ackKey struct {
+	user     string
+	consumer string
+	flow     FlowReference
+}
+
+type ackConsumer struct {
+	// delivered is the sequence number of the last record delivered, pending holds those delivered but not acknowledged, oldest first
+	delivered uint64
+	pending   []Record
+	// evicted counts the pending records dropped because the buffer was full since the consumer last connected
+	evicted  uint64
+	lastUsed time.Time
+}
+
+// consumer returns the consumer of the key, creating it if create is set and the limits allow, nil otherwise
+func (s *AckStore) consumer(key ackKey, now time.Time, create bool) *ackConsumer {
+	c := s.consumers[key]
+	if c == nil {
+		if !create || len(s.consumers) >= s.maxConsumers || s.userConsumers[key.user] >= s.maxUserConsumers {
+			return nil
+		}
+		c = &ackConsumer{}
+		s.consumers[key] = c
+		s.userConsumers[key.user]++
+	}
+	c.lastUsed = now
+	return c
+}
+
+// prune forgets the consumers unused for the retention
+func (s *AckStore) prune(now time.Time) {
+	for k, c := range s.consumers {
+		if now.Sub(c.lastUsed) > s.retention {
+			s.forget(k)
+		}
+	}
+}
+
+// forget deletes the consumer of the key, the mutex has to be held
+func (s *AckStore) forget(key ackKey) {
+	delete(s.consumers, key)
+	if s.userConsumers[key.user]--; s.userConsumers[key.user] <= 0 {
+		delete(s.userConsumers, key.user)
+	}
+}
+
+// Reserve makes sure the records delivered to the consumers of the keys are retained, it returns ErrAckConsumerLimit if that would exceed the limits of the store
+func (s *AckStore) Reserve(keys ...ackKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	s.prune(now)
+	var added int
+	users := make(map[string]int)
+	for _, key := range keys {
+		if s.consumers[key] == nil {
+			added++
+			users[key.user]++
+		}
+	}
+	if len(s.consumers)+added > s.maxConsumers {
+		return ErrAckConsumerLimit
+	}
+	for user, n := range users {
+		if s.userConsumers[user]+n > s.maxUserConsumers {
+			return ErrAckConsumerLimit
+		}
+	}
+	for _, key := range keys {
+		s.consumer(key, now, true)
+	}
+	return nil
+}
+
+// Release forgets the consumers of the keys that no records have been delivered to, undoing the reservation of a connection that could not be established
+func (s *AckStore) Release(keys ...ackKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, key := range keys {
+		if c := s.consumers[key]; c != nil && c.delivered == 0 && len(c.pending) == 0 {
+			s.forget(key)
+		}
+	}
+}
+
+// Delivered retains the record delivered to the consumer, records delivered again on reconnection are only retained once
+// Records of consumers beyond the limits of the store are not retained
+func (s *AckStore) Delivered(key ackKey, r Record) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c := s.consumer(key, time.Now(), true)
+	if c == nil || r.Sequence <= c.delivered {
+		return
+	}
+	c.delivered = r.Sequence
+	if len(c.pending) == s.size {
+		c.pending[0] = Record{}
+		c.pending = c.pending[1:]
+		c.evicted++
+	}
+	c.pending = append(c.pending, r)
+}
+
+// Ack releases the records of the consumer up to the sequence number
+func (s *AckStore) Ack(key ackKey, sequence uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// acknowledgements of unknown consumers are ignored, so that they cannot fill the store
+	c := s.consumer(key, time.Now(), false)
+	if c == nil {
+		return
+	}
+	n := 0
+	for n < len(c.pending) && c.pending[n].Sequence <= sequence {
+		c.pending[n] = Record{}
+		n++
+	}
+	c.pending = c.pending[n:]
+}
+
+// Resume returns the unacknowledged records of the consumer to deliver again, the sequence number of the last record delivered to it and the number of unacknowledged records evicted since it last connected
+func (s *AckStore) Resume(key ackKey) (pending []Record, delivered uint64, evicted uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	s.prune(now)
+	c := s.consumer(key, now, true)
+	if c == nil {
+		return nil, 0, 0
+	}
+	evicted, c.evicted = c.evicted, 0
+	return append([]Record(nil), c.pending...), c.delivered, evicted
+}
+
+func (l *listener) ackKey(flow FlowReference) ackKey {
+	return ackKey{user: l.usrInfo.Username, consumer: l.ackConsumer, flow: flow}
+}
+
+func ackKeys(usrInfo authv1.UserInfo, consumer string, flows []FlowReference) []ackKey {
+	keys := make([]ackKey, 0, len(flows))
+	for _, flow := range flows {
+		keys = append(keys, ackKey{user: usrInfo.Username, consumer: consumer, flow: flow})
+	}
+	return keys
+}
+
+// checkAckRequest rejects acknowledgements on connections that cannot send them or receive no sequence numbers to acknowledge
+func checkAckRequest(acks *AckStore, encoder Encoder, sse bool, multiplexed bool) error {
+	switch {
+	case acks == nil:
+		return errors.New("acknowledgements are disabled")
+	case sse:
+		return errors.New("event streams cannot acknowledge records")
+	case !multiplexed && !binaryEncoding(encoder):
+		return fmt.Errorf("acknowledgements require multiplexed connections or the %s or %s encoding", EncodingProtobuf, EncodingBinary)
+	}
+	return nil
+}
+
+// resumeAcked queues the unacknowledged records of the flow for redelivery
+// It returns the replay request extended to the records dispatched since the last delivery and the sequence number of the last record delivered again, zero if none
+func (l *listener) resumeAcked(flow FlowReference, req ReplayRequest) (ReplayRequest, uint64) {
+	pending, delivered, evicted := l.opts.Acks.Resume(l.ackKey(flow))
+	l.replay = append(l.replay, pending...)
+	if evicted > 0 {
+		l.sendControl(ControlMessage{Control: ControlAckOverflow, Message: "unacknowledged records were dropped because the acknowledgement buffer was full", Flow: flow.URL(), Records: evicted})
+	}
+	if delivered > req.After {
+		req.After = delivered
+	}
+	var last uint64
+	if n := len(pending); n > 0 {
+		last = pending[n-1].Sequence
+	}
+	return req, last
+}
+
+// handleAck releases the records acknowledged by the client, the flow can be omitted on connections with a single flow
+func (l *listener) handleAck(msg ClientMessage) {
+	if l.ackConsumer == "" {
+		l.sendControl(ControlMessage{Control: ControlError, Message: "acknowledgements require connecting with the " + AckParam + " parameter"})
+		return
+	}
+	var flow FlowReference
+	var err error
+	if msg.Flow == "" {
+		if flows := l.subscribedFlows(); len(flows) == 1 {
+			flow = flows[0]
+		} else {
+			err = errors.New("the flow of acknowledgements is required on connections with several flows")
+		}
+	} else {
+		flow, err = ParseFlowReference(msg.Flow, l.opts.ControlNamespace)
+	}
+	if err != nil {
+		l.sendControl(ControlMessage{Control: ControlError, Message: err.Error(), Flow: msg.Flow})
+		return
+	}
+	log.Event(l.logs, "listener acknowledged records", log.V(2), log.Fields{"listener": l, "flow": flow, "sequence": msg.Sequence})
+	l.opts.Acks.Ack(l.ackKey(flow), msg.Sequence)
+}
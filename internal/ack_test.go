@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAckStoreLimitsConsumers(t *testing.T) {
+	acks := NewAckStore(10, time.Hour, 2, 3)
+	flow, _ := ParseFlowReference("flow/default/flow1", "")
+	key := func(user, consumer string) ackKey {
+		return ackKey{user: user, consumer: consumer, flow: flow}
+	}
+
+	if err := acks.Reserve(key("alice", "a"), key("alice", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := acks.Reserve(key("alice", "c")); err != ErrAckConsumerLimit {
+		t.Fatalf("third consumer of the user is accepted: %v", err)
+	}
+	if err := acks.Reserve(key("alice", "a")); err != nil {
+		t.Fatalf("known consumer is rejected: %v", err)
+	}
+	if err := acks.Reserve(key("bob", "a"), key("bob", "b")); err != ErrAckConsumerLimit {
+		t.Fatalf("consumers beyond the overall limit are accepted: %v", err)
+	}
+	if err := acks.Reserve(key("bob", "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	acks.Ack(key("carol", "a"), 1)
+	acks.Delivered(key("carol", "a"), Record{Sequence: 1, Flow: flow})
+	if pending, _, _ := acks.Resume(key("carol", "a")); len(pending) != 0 || len(acks.consumers) != 3 {
+		t.Fatalf("records of a consumer beyond the limits are retained: %v", pending)
+	}
+}
+
+func TestAckStoreReleasesUnusedReservations(t *testing.T) {
+	acks := NewAckStore(10, time.Hour, 2, 10)
+	flow, _ := ParseFlowReference("flow/default/flow1", "")
+	unused := ackKey{user: "alice", consumer: "a", flow: flow}
+	used := ackKey{user: "alice", consumer: "b", flow: flow}
+
+	if err := acks.Reserve(unused, used); err != nil {
+		t.Fatal(err)
+	}
+	acks.Delivered(used, Record{Sequence: 1, Flow: flow})
+	acks.Release(unused, used)
+	if pending, _, _ := acks.Resume(used); len(pending) != 1 {
+		t.Fatalf("released a consumer with pending records: %v", pending)
+	}
+	if err := acks.Reserve(ackKey{user: "alice", consumer: "c", flow: flow}); err != nil {
+		t.Fatalf("released reservation still counts against the limit: %v", err)
+	}
+}
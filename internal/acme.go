@@ -0,0 +1,383 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	ACMEChallengeHTTP01 ACMEChallenge = "http-01"
+	ACMEChallengeDNS01  ACMEChallenge = "dns-01"
+
+	// acmeRenewBefore is how long before their expiry certificates obtained with DNS-01 challenges are renewed, like autocert does
+	acmeRenewBefore = 30 * 24 * time.Hour
+	// acmeRetryInterval is the delay before retrying to obtain a certificate after a failure
+	acmeRetryInterval = time.Hour
+	acmeCheckInterval = 12 * time.Hour
+	acmeOrderTimeout  = 10 * time.Minute
+)
+
+type ACMEChallenge string
+
+func ParseACMEChallenge(s string) (ACMEChallenge, error) {
+	switch c := ACMEChallenge(s); c {
+	case ACMEChallengeHTTP01, ACMEChallengeDNS01:
+		return c, nil
+	default:
+		return "", fmt.Errorf("invalid ACME challenge type %q", s)
+	}
+}
+
+// ACMEOptions holds the settings of obtaining certificates from an ACME CA, e.g. Let's Encrypt
+type ACMEOptions struct {
+	// Domains are the names included in the certificate, at least one is required
+	Domains []string
+	// Email is the contact address of the ACME account, it is notified of problems with certificates
+	Email string
+	// DirectoryURL is the directory of the ACME CA, Let's Encrypt's production directory by default
+	DirectoryURL string
+	Challenge    ACMEChallenge
+	// HTTPAddr is where HTTP-01 challenges are answered, it has to be reachable on port 80 of the domains
+	HTTPAddr string
+	// CacheDir is where the account key and certificates are kept, it should be persistent to avoid hitting the CA's rate limits
+	CacheDir string
+	// DNSProvider publishes the records answering DNS-01 challenges
+	DNSProvider ACMEDNSProvider
+}
+
+// ACMEDNSProvider publishes the TXT records answering DNS-01 challenges
+type ACMEDNSProvider interface {
+	// Present creates a TXT record with the specified name and value, it returns once the record can be resolved
+	Present(ctx context.Context, name, value string) error
+	// CleanUp removes a record created by Present
+	CleanUp(ctx context.Context, name, value string) error
+}
+
+// ACMEManager serves a certificate obtained from an ACME CA and renews it before it expires
+type ACMEManager interface {
+	// GetCertificate can be used as the GetCertificate callback of TLS configurations
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+	// Run answers challenges and renews the certificate until the stop signal is closed
+	Run(stopSignal <-chan struct{})
+}
+
+func NewACMEManager(opts ACMEOptions, logs log.Sink) (ACMEManager, error) {
+	if len(opts.Domains) == 0 {
+		return nil, errors.New("no domains specified for ACME certificates")
+	}
+	if opts.CacheDir == "" {
+		return nil, errors.New("no ACME cache directory specified")
+	}
+	logs = log.WithFields(logs, log.Fields{"task": "acme", "domains": opts.Domains})
+	client := &acme.Client{DirectoryURL: opts.DirectoryURL}
+	cache := autocert.DirCache(opts.CacheDir)
+
+	switch opts.Challenge {
+	case ACMEChallengeHTTP01, "":
+		return &http01Manager{
+			addr: opts.HTTPAddr,
+			logs: logs,
+			manager: &autocert.Manager{
+				Cache:      cache,
+				Client:     client,
+				Email:      opts.Email,
+				HostPolicy: autocert.HostWhitelist(opts.Domains...),
+				Prompt:     autocert.AcceptTOS,
+			},
+		}, nil
+	case ACMEChallengeDNS01:
+		if opts.DNSProvider == nil {
+			return nil, errors.New("no DNS provider specified for DNS-01 challenges")
+		}
+		m := &dns01Manager{
+			cache:  cache,
+			client: client,
+			opts:   opts,
+			logs:   logs,
+		}
+		if err := m.loadCached(); err != nil {
+			log.Event(logs, "no usable cached certificate, a new one will be obtained", log.V(1), log.Error(err))
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unsupported ACME challenge type %q", opts.Challenge)
+	}
+}
+
+// http01Manager obtains certificates on demand with autocert, answering HTTP-01 challenges on a server of its own
+type http01Manager struct {
+	addr    string
+	logs    log.Sink
+	manager *autocert.Manager
+}
+
+func (m *http01Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.manager.GetCertificate(hello)
+}
+
+func (m *http01Manager) Run(stopSignal <-chan struct{}) {
+	server := &http.Server{
+		Addr:    m.addr,
+		Handler: m.manager.HTTPHandler(nil),
+	}
+	go func() {
+		<-stopSignal
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Event(m.logs, "an error occurred while shutting down ACME challenge server", log.Error(err))
+		}
+	}()
+	log.Event(m.logs, "serving ACME HTTP-01 challenges", log.Fields{"addr": m.addr})
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Event(m.logs, "ACME challenge server failed", log.Error(err))
+	}
+}
+
+// dns01Manager obtains a certificate for all the domains up front, answering DNS-01 challenges with a DNS provider
+// autocert cannot be used as it only supports challenges answered by the service itself
+type dns01Manager struct {
+	cache  autocert.Cache
+	cert   *tls.Certificate
+	client *acme.Client
+	logs   log.Sink
+	mutex  sync.RWMutex
+	opts   ACMEOptions
+}
+
+func (m *dns01Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.cert == nil {
+		return nil, errors.New("no certificate has been obtained from the ACME CA yet")
+	}
+	return m.cert, nil
+}
+
+func (m *dns01Manager) Run(stopSignal <-chan struct{}) {
+	for {
+		delay := acmeCheckInterval
+		if m.needsRenewal() {
+			if err := m.obtain(); err != nil {
+				log.Event(m.logs, "failed to obtain certificate from ACME CA", log.Error(err))
+				delay = acmeRetryInterval
+			} else {
+				log.Event(m.logs, "obtained certificate from ACME CA")
+			}
+		}
+		select {
+		case <-stopSignal:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (m *dns01Manager) needsRenewal() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.cert == nil || time.Until(m.cert.Leaf.NotAfter) < acmeRenewBefore
+}
+
+func (m *dns01Manager) certCacheKey() string {
+	return "dns01+" + strings.Join(m.opts.Domains, ",")
+}
+
+func (m *dns01Manager) loadCached() error {
+	data, err := m.cache.Get(context.Background(), m.certCacheKey())
+	if err != nil {
+		return err
+	}
+	var certPEM, keyPEM []byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			keyPEM = pem.EncodeToMemory(block)
+		} else {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		}
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	m.cert = &cert
+	m.mutex.Unlock()
+	return nil
+}
+
+// accountKey returns the cached key of the ACME account, creating one if there's none
+func (m *dns01Manager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	const cacheKey = "dns01_account+key"
+	data, err := m.cache.Get(ctx, cacheKey)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("invalid cached ACME account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if err != autocert.ErrCacheMiss {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.cache.Put(ctx, cacheKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (m *dns01Manager) obtain() error {
+	ctx, cancel := context.WithTimeout(context.Background(), acmeOrderTimeout)
+	defer cancel()
+
+	if m.client.Key == nil {
+		key, err := m.accountKey(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get ACME account key: %w", err)
+		}
+		m.client.Key = key
+		var acct acme.Account
+		if m.opts.Email != "" {
+			acct.Contact = []string{"mailto:" + m.opts.Email}
+		}
+		if _, err := m.client.Register(ctx, &acct, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+			m.client.Key = nil
+			return fmt.Errorf("failed to register ACME account: %w", err)
+		}
+	}
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.opts.Domains...))
+	if err != nil {
+		return err
+	}
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, u); err != nil {
+			return err
+		}
+	}
+	if order, err = m.client.WaitOrder(ctx, order.URI); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.opts.Domains}, key)
+	if err != nil {
+		return err
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	_ = pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, b := range der {
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: b})
+	}
+	if err := m.cache.Put(ctx, m.certCacheKey(), buf.Bytes()); err != nil {
+		log.Event(m.logs, "failed to cache certificate obtained from ACME CA", log.Error(err))
+	}
+
+	m.mutex.Lock()
+	m.cert = &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}
+	m.mutex.Unlock()
+	return nil
+}
+
+func (m *dns01Manager) authorize(ctx context.Context, url string) error {
+	authz, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == string(ACMEChallengeDNS01) {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("ACME CA offers no DNS-01 challenge for %s", authz.Identifier.Value)
+	}
+	value, err := m.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	name := "_acme-challenge." + authz.Identifier.Value + "."
+	if err := m.opts.DNSProvider.Present(ctx, name, value); err != nil {
+		return fmt.Errorf("failed to publish DNS-01 challenge record %s: %w", name, err)
+	}
+	defer func() {
+		if err := m.opts.DNSProvider.CleanUp(context.Background(), name, value); err != nil {
+			log.Event(m.logs, "failed to remove DNS-01 challenge record", log.Error(err), log.Fields{"record": name})
+		}
+	}()
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = m.client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// ExecDNSProvider publishes DNS-01 challenge records by running a hook command with the arguments present or cleanup, the record name and its value
+type ExecDNSProvider struct {
+	Command string
+}
+
+func (p ExecDNSProvider) Present(ctx context.Context, name, value string) error {
+	return p.run(ctx, "present", name, value)
+}
+
+func (p ExecDNSProvider) CleanUp(ctx context.Context, name, value string) error {
+	return p.run(ctx, "cleanup", name, value)
+}
+
+func (p ExecDNSProvider) run(ctx context.Context, args ...string) error {
+	out, err := exec.CommandContext(ctx, p.Command, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	// AdminListenersEndpoint lists the connected listeners, listeners are disconnected by deleting AdminListenersEndpoint/<id>
+	AdminListenersEndpoint = "/admin/listeners"
+	// AdminLogEndpoint returns the verbosity of the service's logs, putting it changes the verbosity
+	AdminLogEndpoint = "/admin/log"
+)
+
+// LogLevel controls the verbosity of the service's logs at runtime
+type LogLevel interface {
+	Verbosity() int
+	SetVerbosity(verbosity int)
+}
+
+// LogLevelInfo is the body of requests and responses of the admin log endpoint
+type LogLevelInfo struct {
+	Verbosity int `json:"verbosity"`
+}
+
+// AdminAuthorizer decides whether a user may use the admin API
+type AdminAuthorizer interface {
+	// AuthorizeAdmin is called with the HTTP method of the request in lower case and the path of the endpoint
+	AuthorizeAdmin(user authv1.UserInfo, verb string, path string) (bool, error)
+}
+
+// SubjectAccessReviewAdminAuthorizer allows users permitted to perform the verb on the endpoint as a non-resource URL by RBAC, e.g. get and delete on /admin/listeners
+type SubjectAccessReviewAdminAuthorizer struct {
+	Client client.Client
+}
+
+func (a SubjectAccessReviewAdminAuthorizer) AuthorizeAdmin(user authv1.UserInfo, verb string, path string) (bool, error) {
+	sar := authzv1.SubjectAccessReview{
+		Spec: authzv1.SubjectAccessReviewSpec{
+			NonResourceAttributes: &authzv1.NonResourceAttributes{
+				Path: path,
+				Verb: verb,
+			},
+			User:   user.Username,
+			Groups: user.Groups,
+			Extra:  authzExtra(user),
+			UID:    user.UID,
+		},
+	}
+	if err := a.Client.Create(context.Background(), &sar); err != nil {
+		return false, err
+	}
+	return sar.Status.Allowed, nil
+}
+
+// GroupAdminAuthorizer allows the members of any of the groups
+type GroupAdminAuthorizer struct {
+	Groups []string
+}
+
+func (a GroupAdminAuthorizer) AuthorizeAdmin(user authv1.UserInfo, verb string, path string) (bool, error) {
+	for _, group := range user.Groups {
+		if hasItem(a.Groups, group) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListenerInfo describes a connected listener in responses of the admin API
+type ListenerInfo struct {
+	ID         string   `json:"id"`
+	User       string   `json:"user"`
+	Groups     []string `json:"groups,omitempty"`
+	Tenant     string   `json:"tenant,omitempty"`
+	Flows      []string `json:"flows"`
+	RemoteAddr string   `json:"remoteAddr"`
+	// ClientAddr is the address of the listener behind trusted proxies, the same as RemoteAddr if the connection does not come from one
+	ClientAddr string `json:"clientAddr"`
+	// RequestID is the ID of the connection request, see RequestIDHeader
+	RequestID string `json:"requestID"`
+	// Capability is the ID of the capability URL the listener connected with, if any
+	Capability  string    `json:"capability,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	// ExpiresAt is when the listener's session expires, if it is limited
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// BytesSent is the number of bytes written to the listener's connection, zero if unknown
+	BytesSent        uint64 `json:"bytesSent"`
+	RecordsDelivered uint64 `json:"recordsDelivered"`
+	RecordsFiltered  uint64 `json:"recordsFiltered"`
+	RecordsRedacted  uint64 `json:"recordsRedacted"`
+	RecordsDropped   uint64 `json:"recordsDropped"`
+	// RecordsQueued is the number of records waiting to be written to the listener
+	RecordsQueued int `json:"recordsQueued"`
+}
+
+func newListenerID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func (l *listener) info() ListenerInfo {
+	res := ListenerInfo{
+		ID:               l.id,
+		User:             l.usrInfo.Username,
+		Groups:           l.usrInfo.Groups,
+		Tenant:           UserTenant(l.usrInfo),
+		RemoteAddr:       l.remoteAddr,
+		ClientAddr:       l.clientAddr,
+		RequestID:        l.requestID,
+		Capability:       l.capability,
+		ConnectedAt:      l.connectedAt,
+		RecordsDelivered: atomic.LoadUint64(&l.delivered),
+		RecordsFiltered:  atomic.LoadUint64(&l.filtered),
+		RecordsRedacted:  atomic.LoadUint64(&l.redacted),
+		RecordsDropped:   atomic.LoadUint64(&l.dropped),
+		RecordsQueued:    len(l.queue),
+	}
+	if l.connCounter != nil {
+		res.BytesSent = l.connCounter.Written()
+	}
+	if !l.expiresAt.IsZero() {
+		expiresAt := l.expiresAt
+		res.ExpiresAt = &expiresAt
+	}
+	for _, flow := range l.subscribedFlows() {
+		res.Flows = append(res.Flows, flow.URL())
+	}
+	sort.Strings(res.Flows)
+	return res
+}
+
+// serveAdmin responds to requests of the admin API, it reports whether the request was handled
+func serveAdmin(w http.ResponseWriter, r *http.Request, admin AdminAuthorizer, active *activeListeners, logLevel LogLevel, authenticator Authenticator, tenancy Tenancy, logs log.Sink) bool {
+	if admin == nil {
+		return false
+	}
+	if r.URL.Path == AdminLogEndpoint && logLevel != nil {
+		serveAdminLog(w, r, admin, logLevel, authenticator, tenancy, logs)
+		return true
+	}
+	if r.URL.Path != AdminListenersEndpoint && !strings.HasPrefix(r.URL.Path, AdminListenersEndpoint+"/") {
+		return false
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, AdminListenersEndpoint), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+	case r.Method == http.MethodDelete && id != "":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+
+	usrInfo, ok := authorizeAdminRequest(w, r, admin, AdminListenersEndpoint, authenticator, tenancy, logs)
+	if !ok {
+		return true
+	}
+
+	if r.Method == http.MethodDelete {
+		for _, l := range active.list() {
+			if l.id == id {
+				log.Event(logs, "disconnecting listener on admin request", log.Fields{"listener": l, "admin": usrInfo.Username})
+				l.closeWith(CloseDisconnected, "disconnected by an administrator")
+				w.WriteHeader(http.StatusNoContent)
+				return true
+			}
+		}
+		http.Error(w, "listener not found", http.StatusNotFound)
+		return true
+	}
+
+	listeners := active.list()
+	res := make([]ListenerInfo, 0, len(listeners))
+	for _, l := range listeners {
+		res = append(res, l.info())
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ConnectedAt.Before(res[j].ConnectedAt)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Event(logs, "failed to write admin response", log.V(1), log.Error(err))
+	}
+	return true
+}
+
+func serveAdminLog(w http.ResponseWriter, r *http.Request, admin AdminAuthorizer, logLevel LogLevel, authenticator Authenticator, tenancy Tenancy, logs log.Sink) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	usrInfo, ok := authorizeAdminRequest(w, r, admin, AdminLogEndpoint, authenticator, tenancy, logs)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var update LogLevelInfo
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		logLevel.SetVerbosity(update.Verbosity)
+		log.Event(logs, "log verbosity changed on admin request", log.Fields{"verbosity": update.Verbosity, "admin": usrInfo.Username})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(LogLevelInfo{Verbosity: logLevel.Verbosity()}); err != nil {
+		log.Event(logs, "failed to write admin response", log.V(1), log.Error(err))
+	}
+}
+
+// authorizeAdminRequest authenticates the user and checks whether they may perform the request on the admin endpoint, writing the error response if not
+func authorizeAdminRequest(w http.ResponseWriter, r *http.Request, admin AdminAuthorizer, path string, authenticator Authenticator, tenancy Tenancy, logs log.Sink) (authv1.UserInfo, bool) {
+	usrInfo, _, ok := authenticateRequest(w, r, authenticator, tenancy, logs)
+	if !ok {
+		return usrInfo, false
+	}
+	allowed, err := admin.AuthorizeAdmin(usrInfo, strings.ToLower(r.Method), path)
+	if err != nil {
+		log.Event(logs, "admin authorization failed", log.V(1), log.Error(err), log.Fields{"user": usrInfo})
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return usrInfo, false
+	}
+	if !allowed {
+		log.Event(logs, "user is not allowed to use the admin API", log.V(1), log.Fields{"user": usrInfo, "path": r.URL.Path})
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return usrInfo, false
+	}
+	return usrInfo, true
+}
@@ -0,0 +1,23 @@
+package internal
+
+import (
+	"golang.org/x/time/rate"
+)
+
+// NewListenerAdmission returns the connection rate limit and quotas of the options, it is shared by the servers of listeners so that users cannot exceed them by connecting over several protocols
+func NewListenerAdmission(opts ListenerOptions, metrics QuotaMetrics) *ListenerAdmission {
+	a := &ListenerAdmission{}
+	if opts.ConnectionRate > 0 {
+		a.connLimiter = NewUserRateLimiter(rate.Limit(opts.ConnectionRate), opts.connectionBurst())
+	}
+	if opts.MaxConnections > 0 || opts.MaxUserConnections > 0 || opts.LimitUpdates != nil {
+		a.quota = NewConnectionQuota(opts.MaxConnections, opts.MaxUserConnections, metrics)
+	}
+	return a
+}
+
+// ListenerAdmission limits the connection attempts of each user and the concurrent connections of listeners, nil fields mean unlimited
+type ListenerAdmission struct {
+	connLimiter *UserRateLimiter
+	quota       *ConnectionQuota
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	AuditEventConnected    AuditEventType = "connected"
+	AuditEventSubscribed   AuditEventType = "subscribed"
+	AuditEventUnsubscribed AuditEventType = "unsubscribed"
+	AuditEventDisconnected AuditEventType = "disconnected"
+	// AuditEventCapabilityIssued and AuditEventCapabilityRevoked record the admins minting and revoking capability URLs
+	AuditEventCapabilityIssued  AuditEventType = "capability_issued"
+	AuditEventCapabilityRevoked AuditEventType = "capability_revoked"
+
+	AuditSinkFile       AuditSinkType = "file"
+	AuditSinkKubernetes AuditSinkType = "kubernetes"
+	AuditSinkStdout     AuditSinkType = "stdout"
+)
+
+type AuditEventType string
+
+type AuditSinkType string
+
+func ParseAuditSinkType(s string) (AuditSinkType, error) {
+	switch t := AuditSinkType(s); t {
+	case AuditSinkFile, AuditSinkKubernetes, AuditSinkStdout:
+		return t, nil
+	default:
+		return "", fmt.Errorf("invalid audit sink %q", s)
+	}
+}
+
+// AuditEvent records an access of a user to flow logs
+type AuditEvent struct {
+	Type   AuditEventType `json:"type"`
+	Time   time.Time      `json:"time"`
+	User   string         `json:"user"`
+	Groups []string       `json:"groups,omitempty"`
+	Tenant string         `json:"tenant,omitempty"`
+	// ClientAddr is the address of the listener, as told by trusted proxies
+	ClientAddr string `json:"clientAddr,omitempty"`
+	// RequestID is the ID of the connection request, see RequestIDHeader
+	RequestID string `json:"requestID,omitempty"`
+	// Capability is the ID of the capability URL the listener connected with, or the one minted or revoked
+	Capability string          `json:"capability,omitempty"`
+	Flows      []FlowReference `json:"flows"`
+	// ConnectedAt is the time the listener connected
+	ConnectedAt time.Time `json:"connectedAt"`
+	// RecordsDelivered is the number of records sent to the listener so far
+	RecordsDelivered uint64 `json:"recordsDelivered"`
+	// RecordsFiltered is the number of records withheld from the listener by its filter so far
+	RecordsFiltered uint64 `json:"recordsFiltered"`
+	// RecordsRedacted is the number of records the listener was not allowed to view so far
+	RecordsRedacted uint64 `json:"recordsRedacted"`
+}
+
+type AuditSink interface {
+	Audit(evt AuditEvent)
+}
+
+// AuditSinks sends events to each of its sinks
+type AuditSinks []AuditSink
+
+func (s AuditSinks) Audit(evt AuditEvent) {
+	for _, sink := range s {
+		sink.Audit(evt)
+	}
+}
+
+// NewJSONAuditSink returns a sink that writes events to w as newline delimited JSON
+func NewJSONAuditSink(w io.Writer, logs log.Sink) *JSONAuditSink {
+	return &JSONAuditSink{
+		encoder: json.NewEncoder(w),
+		logs:    logs,
+	}
+}
+
+type JSONAuditSink struct {
+	encoder *json.Encoder
+	logs    log.Sink
+	mutex   sync.Mutex
+}
+
+func (s *JSONAuditSink) Audit(evt AuditEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.encoder.Encode(evt); err != nil {
+		log.Event(s.logs, "an error occurred while writing audit event", log.Error(err), log.Fields{"event": evt})
+	}
+}
+
+// KubernetesEventAuditSink records audit events as Kubernetes events of the accessed flow resources
+type KubernetesEventAuditSink struct {
+	Client client.Client
+	Logs   log.Sink
+}
+
+func (s KubernetesEventAuditSink) Audit(evt AuditEvent) {
+	for _, flow := range evt.Flows {
+		if flow.Kind == FKSelector || flow.Kind == FKDeadLetter {
+			// label selectors and dead letters have no resource to record the event of
+			continue
+		}
+		kind := map[FlowKind]string{
+			FKFlow:          "Flow",
+			FKClusterFlow:   "ClusterFlow",
+			FKOutput:        "Output",
+			FKClusterOutput: "ClusterOutput",
+		}[flow.Kind]
+		ts := metav1.NewTime(evt.Time)
+		event := corev1.Event{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: flow.Namespace,
+				Name:      fmt.Sprintf("%s.%x", flow.Name, evt.Time.UnixNano()),
+				Labels:    DefLabel,
+			},
+			InvolvedObject: corev1.ObjectReference{
+				APIVersion: loggingAPIGroup + "/v1beta1",
+				Kind:       kind,
+				Namespace:  flow.Namespace,
+				Name:       flow.Name,
+			},
+			Reason:         auditEventReasons[evt.Type],
+			Message:        auditEventMessage(evt),
+			Type:           corev1.EventTypeNormal,
+			Source:         corev1.EventSource{Component: "log-socket"},
+			FirstTimestamp: ts,
+			LastTimestamp:  ts,
+			Count:          1,
+		}
+		if err := s.Client.Create(context.Background(), &event); err != nil {
+			log.Event(s.Logs, "an error occurred while creating audit event", log.Error(err), log.Fields{"event": evt, "flow": flow})
+		}
+	}
+}
+
+var auditEventReasons = map[AuditEventType]string{
+	AuditEventConnected:    "ListenerConnected",
+	AuditEventSubscribed:   "ListenerSubscribed",
+	AuditEventUnsubscribed: "ListenerUnsubscribed",
+	AuditEventDisconnected: "ListenerDisconnected",
+
+	AuditEventCapabilityIssued:  "CapabilityIssued",
+	AuditEventCapabilityRevoked: "CapabilityRevoked",
+}
+
+func auditEventMessage(evt AuditEvent) string {
+	switch evt.Type {
+	case AuditEventDisconnected, AuditEventUnsubscribed:
+		return fmt.Sprintf("%s stopped tailing logs after %s (%d records delivered, %d filtered, %d redacted)",
+			evt.User, evt.Time.Sub(evt.ConnectedAt).Round(time.Second), evt.RecordsDelivered, evt.RecordsFiltered, evt.RecordsRedacted)
+	case AuditEventCapabilityIssued:
+		return fmt.Sprintf("%s shared the logs with capability %s", evt.User, evt.Capability)
+	case AuditEventCapabilityRevoked:
+		return fmt.Sprintf("%s revoked capability %s", evt.User, evt.Capability)
+	default:
+		return fmt.Sprintf("%s started tailing logs", evt.User)
+	}
+}
@@ -2,25 +2,156 @@ package internal
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	authv1 "k8s.io/api/authentication/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+const (
+	AuthenticationModeMTLS        AuthenticationMode = "mtls"
+	AuthenticationModeOIDC        AuthenticationMode = "oidc"
+	AuthenticationModeTokenReview AuthenticationMode = "tokenreview"
+)
+
+type AuthenticationMode string
+
+func ParseAuthenticationMode(s string) (AuthenticationMode, error) {
+	switch m := AuthenticationMode(s); m {
+	case AuthenticationModeMTLS, AuthenticationModeOIDC, AuthenticationModeTokenReview:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid authentication mode %q", s)
+	}
+}
+
 type TokenReviewAuthenticator struct {
 	Client client.Client `json:"client" yaml:"client"` //this is a client
+	// Audiences is the list of audiences the token has to be valid for, an empty list means the API server's audiences
+	Audiences []string `json:"audiences,omitempty" yaml:"audiences,omitempty"`
 }
 
 func (t TokenReviewAuthenticator) Authenticate(token string) (res authv1.UserInfo, err error) {
 
-	tr := authv1.TokenReview{Spec: authv1.TokenReviewSpec{Token: token}}
+	tr := authv1.TokenReview{Spec: authv1.TokenReviewSpec{Token: token, Audiences: t.Audiences}}
 	if err = t.Client.Create(context.Background(), &tr); err != nil {
 		return res, err
 	}
 	if !tr.Status.Authenticated {
-		return res, errors.New("unauthorized")
+		return res, invalidCredentials("unauthorized")
+	}
+	if len(t.Audiences) > 0 && !hasAnyItem(tr.Status.Audiences, t.Audiences) {
+		return res, invalidCredentials("token is not valid for any of the accepted audiences")
 	}
 
 	return tr.Status.User, nil
 }
+
+// readinessProbeToken is a token no API server accepts, reviewing it only tells whether the API server is reachable
+const readinessProbeToken = "log-socket-readiness-probe"
+
+func (t TokenReviewAuthenticator) Ready() error {
+	tr := authv1.TokenReview{Spec: authv1.TokenReviewSpec{Token: readinessProbeToken}}
+	return t.Client.Create(context.Background(), &tr)
+}
+
+// ClientCertificateAuthenticator identifies listeners by their client certificate, using the subject's common name as user name and organizations as groups
+// Certificates are verified during the TLS handshake, so the listener server's TLS config has to verify client certificates, requests without one are rejected apart from health probes
+type ClientCertificateAuthenticator struct{}
+
+func (ClientCertificateAuthenticator) Authenticate(string) (authv1.UserInfo, error) {
+	return authv1.UserInfo{}, errors.New("token authentication is disabled, a client certificate is required")
+}
+
+func (ClientCertificateAuthenticator) AuthenticateCertificate(cert *x509.Certificate) (res authv1.UserInfo, err error) {
+	if cert.Subject.CommonName == "" {
+		return res, invalidCredentials("client certificate has no common name")
+	}
+	if time.Now().After(cert.NotAfter) {
+		return res, invalidCredentials("client certificate has expired")
+	}
+	res.Username = cert.Subject.CommonName
+	res.Groups = append(res.Groups, cert.Subject.Organization...)
+	return res, nil
+}
+
+// NewCachingAuthenticator returns an authenticator that remembers successful authentications for the specified duration
+func NewCachingAuthenticator(authenticator Authenticator, ttl time.Duration, metrics AuthenticationCacheMetrics) *CachingAuthenticator {
+	return &CachingAuthenticator{
+		authenticator: authenticator,
+		entries:       make(map[[sha256.Size]byte]authCacheEntry),
+		metrics:       metrics,
+		ttl:           ttl,
+	}
+}
+
+type CachingAuthenticator struct {
+	authenticator Authenticator
+	entries       map[[sha256.Size]byte]authCacheEntry
+	lastSweep     time.Time
+	metrics       AuthenticationCacheMetrics
+	mutex         sync.Mutex
+	ttl           time.Duration
+}
+
+type AuthenticationCacheMetrics interface {
+	AuthenticationCacheHit()
+	AuthenticationCacheMiss()
+}
+
+type authCacheEntry struct {
+	expires time.Time
+	user    authv1.UserInfo
+}
+
+func (a *CachingAuthenticator) Authenticate(token string) (authv1.UserInfo, error) {
+	// only the hash of the token is kept in memory
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	a.mutex.Lock()
+	entry, ok := a.entries[key]
+	a.mutex.Unlock()
+	if ok && now.Before(entry.expires) {
+		a.metrics.AuthenticationCacheHit()
+		return entry.user, nil
+	}
+	a.metrics.AuthenticationCacheMiss()
+
+	user, err := a.authenticator.Authenticate(token)
+	if err != nil {
+		return user, err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.entries[key] = authCacheEntry{
+		expires: now.Add(a.ttl),
+		user:    user,
+	}
+	if now.Sub(a.lastSweep) > a.ttl {
+		a.sweep(now)
+	}
+	return user, nil
+}
+
+func (a *CachingAuthenticator) sweep(now time.Time) {
+	for key, entry := range a.entries {
+		if !now.Before(entry.expires) {
+			delete(a.entries, key)
+		}
+	}
+	a.lastSweep = now
+}
+
+func (a *CachingAuthenticator) Ready() error {
+	if c, ok := a.authenticator.(ReadinessChecker); ok {
+		return c.Ready()
+	}
+	return nil
+}
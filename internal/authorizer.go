@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	authv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	AuthorizationModeLabels              AuthorizationMode = "labels"
+	AuthorizationModeOPA                 AuthorizationMode = "opa"
+	AuthorizationModeSubjectAccessReview AuthorizationMode = "subjectaccessreview"
+
+	loggingAPIGroup = "logging.banzaicloud.io"
+)
+
+type AuthorizationMode string
+
+func ParseAuthorizationMode(s string) (AuthorizationMode, error) {
+	switch m := AuthorizationMode(s); m {
+	case AuthorizationModeLabels, AuthorizationModeOPA, AuthorizationModeSubjectAccessReview:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid authorization mode %q", s)
+	}
+}
+
+// SubjectAccessReviewAuthorizer decides access to a flow's logs based on the user's RBAC permissions on the flow resource itself
+type SubjectAccessReviewAuthorizer struct {
+	Client client.Client
+	// Verb is the verb the user has to be allowed to perform on the flow resource, defaults to "get"
+	Verb string
+}
+
+func (a SubjectAccessReviewAuthorizer) AuthorizeFlow(user authv1.UserInfo, flow FlowReference) (bool, error) {
+	verb := a.Verb
+	if verb == "" {
+		verb = "get"
+	}
+
+	resource := map[FlowKind]string{
+		FKFlow:          "flows",
+		FKClusterFlow:   "clusterflows",
+		FKOutput:        "outputs",
+		FKClusterOutput: "clusteroutputs",
+	}[flow.Kind]
+	attrs := &authzv1.ResourceAttributes{
+		Namespace: flow.Namespace,
+		Verb:      verb,
+		Group:     loggingAPIGroup,
+		Resource:  resource,
+		Name:      flow.Name,
+	}
+	if flow.Kind == FKSelector {
+		// label selectors have no resource, the user has to be allowed to read the logs of the pods in the namespace
+		attrs = &authzv1.ResourceAttributes{
+			Namespace:   flow.Namespace,
+			Verb:        "get",
+			Resource:    "pods",
+			Subresource: "log",
+		}
+	}
+
+	sar := authzv1.SubjectAccessReview{
+		Spec: authzv1.SubjectAccessReviewSpec{
+			ResourceAttributes: attrs,
+			User:               user.Username,
+			Groups:             user.Groups,
+			Extra:              authzExtra(user),
+			UID:                user.UID,
+		},
+	}
+	if err := a.Client.Create(context.Background(), &sar); err != nil {
+		return false, err
+	}
+	return sar.Status.Allowed, nil
+}
+
+func (a SubjectAccessReviewAuthorizer) AuthorizeRecord(authv1.UserInfo, Record) bool {
+	return true
+}
+
+// LabelAuthorizer decides access to each record based on the rbac/ labels of the pod the record comes from
+type LabelAuthorizer struct {
+	Logs log.Sink
+}
+
+func (a LabelAuthorizer) AuthorizeFlow(authv1.UserInfo, FlowReference) (bool, error) {
+	return true, nil
+}
+
+func (a LabelAuthorizer) AuthorizeRecord(user authv1.UserInfo, r Record) bool {
+	rules, err := loadRBACRules(r)
+	if err != nil && a.Logs != nil {
+		log.Event(a.Logs, "an error occurred while loading RBAC rules from record", log.V(1), log.Error(err), log.Fields{"record": r})
+	}
+	allowed := rules.canView(user)
+	if !allowed && a.Logs != nil {
+		log.Event(a.Logs, "RBAC rules deny access to log record", log.V(1), log.Fields{"user": user.Username, "record": r, "rules": rules})
+	}
+	return allowed
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"testing"
+
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+func benchRBACRecord(tb testing.TB) Record {
+	meta, err := ParseRecordMeta(benchRecordData)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return Record{RawData: benchRecordData, Meta: meta}
+}
+
+var (
+	benchAllowedUser = authv1.UserInfo{Username: "system:serviceaccount:default:alice", Groups: []string{"system:serviceaccounts", "system:authenticated"}}
+	benchDeniedUser  = authv1.UserInfo{Username: "system:serviceaccount:default:bob", Groups: []string{"system:serviceaccounts", "system:authenticated"}}
+)
+
+func BenchmarkLabelAuthorizerAuthorizeRecord(b *testing.B) {
+	r := benchRBACRecord(b)
+	for _, bc := range []struct {
+		name string
+		user authv1.UserInfo
+	}{
+		{name: "allowed", user: benchAllowedUser},
+		{name: "denied", user: benchDeniedUser},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				LabelAuthorizer{}.AuthorizeRecord(bc.user, r)
+			}
+		})
+	}
+}
+
+func TestLabelAuthorizerAuthorizeRecordAllocations(t *testing.T) {
+	skipUnderRace(t)
+	r := benchRBACRecord(t)
+	for _, tc := range []struct {
+		name    string
+		user    authv1.UserInfo
+		allowed bool
+		budget  float64
+	}{
+		{name: "allowed", user: benchAllowedUser, allowed: true, budget: 3},
+		{name: "denied", user: benchDeniedUser, allowed: false, budget: 9},
+	} {
+		if allowed := (LabelAuthorizer{}).AuthorizeRecord(tc.user, r); allowed != tc.allowed {
+			t.Errorf("%s: allowed is %v, want %v", tc.name, allowed, tc.allowed)
+		}
+		allocs := testing.AllocsPerRun(100, func() {
+			LabelAuthorizer{}.AuthorizeRecord(tc.user, r)
+		})
+		if allocs > tc.budget {
+			t.Errorf("%s: %v allocations, the budget is %v", tc.name, allocs, tc.budget)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// BatchArray sends batches of JSON records as JSON arrays in text frames
+	BatchArray BatchMode = "array"
+	// BatchLengthPrefixed sends batches as binary frames, each record prefixed with its size as a 4 byte big-endian integer
+	BatchLengthPrefixed BatchMode = "length-prefixed"
+
+	BatchParam         = "batch"
+	BatchBytesParam    = "batchBytes"
+	BatchIntervalParam = "batchInterval"
+
+	DefaultBatchBytes    = 64 << 10
+	DefaultBatchInterval = 100 * time.Millisecond
+)
+
+type BatchMode string
+
+// BatchOptions makes a listener receive several records in each frame, a batch is sent once it reaches MaxBytes or when Interval has elapsed
+type BatchOptions struct {
+	Mode     BatchMode
+	MaxBytes int
+	Interval time.Duration
+}
+
+// ParseBatchOptions parses the batch (array or length-prefixed), batchBytes and batchInterval query parameters, batching is disabled unless batch is set
+func ParseBatchOptions(query url.Values) (res BatchOptions, err error) {
+	res = BatchOptions{Mode: BatchMode(query.Get(BatchParam)), MaxBytes: DefaultBatchBytes, Interval: DefaultBatchInterval}
+	switch res.Mode {
+	case "":
+		return BatchOptions{}, nil
+	case BatchArray, BatchLengthPrefixed:
+	default:
+		return res, fmt.Errorf("invalid %s parameter %q", BatchParam, res.Mode)
+	}
+	if size := query.Get(BatchBytesParam); size != "" {
+		if res.MaxBytes, err = strconv.Atoi(size); err != nil || res.MaxBytes <= 0 {
+			return res, fmt.Errorf("invalid %s parameter %q", BatchBytesParam, size)
+		}
+	}
+	if interval := query.Get(BatchIntervalParam); interval != "" {
+		if res.Interval, err = time.ParseDuration(interval); err != nil || res.Interval <= 0 {
+			return res, fmt.Errorf("invalid %s parameter %q", BatchIntervalParam, interval)
+		}
+	}
+	return res, nil
+}
+
+func (o BatchOptions) Enabled() bool {
+	return o.Mode != ""
+}
+
+// validFor checks whether the records produced by the encoder can be batched in the mode
+func (o BatchOptions) validFor(enc Encoder) error {
+	if o.Mode != BatchArray {
+		return nil
+	}
+	switch e := enc.(type) {
+	case RawEncoder, CloudEventsEncoder:
+		return nil
+	case envelopeEncoder:
+		if !e.newline {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s batches require the raw or cloudevents encoding", BatchArray)
+}
+
+// recordBatch collects the encoded records of a listener until they are written as a single frame
+type recordBatch struct {
+	buf []byte
+	// first is the oldest record of the batch, frame metrics are reported for it
+	first   Record
+	opts    BatchOptions
+	records int
+}
+
+func (b *recordBatch) add(r Record, data []byte) {
+	if b.records == 0 {
+		b.first = r
+		if b.opts.Mode == BatchArray {
+			b.buf = append(b.buf, '[')
+		}
+	} else if b.opts.Mode == BatchArray {
+		b.buf = append(b.buf, ',')
+	}
+	if b.opts.Mode == BatchLengthPrefixed {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+		b.buf = append(b.buf, size[:]...)
+	}
+	b.buf = append(b.buf, data...)
+	b.records++
+}
+
+func (b *recordBatch) full() bool {
+	return len(b.buf) >= b.opts.MaxBytes
+}
+
+// frame returns the payload of the batch, it is valid until the batch is reset
+func (b *recordBatch) frame() []byte {
+	if b.opts.Mode == BatchArray {
+		b.buf = append(b.buf, ']')
+	}
+	return b.buf
+}
+
+func (b *recordBatch) reset() {
+	b.buf = b.buf[:0]
+	b.first = Record{}
+	b.records = 0
+}
+
+func (b *recordBatch) messageType() int {
+	if b.opts.Mode == BatchArray {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
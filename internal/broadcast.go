@@ -0,0 +1,386 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	// BroadcastAnnounceInterval is how often replicas announce the flows listened to on them, it is also the time it takes a replica to learn about the flows of the others
+	BroadcastAnnounceInterval = 15 * time.Second
+	// broadcastReplicaTimeout is how long the flows announced by a replica are kept without a new announcement
+	broadcastReplicaTimeout = 3 * BroadcastAnnounceInterval
+	// broadcastQueueSize is the number of ingested records waiting to be published
+	broadcastQueueSize = 4096
+
+	broadcastKindFlows  = "flows"
+	broadcastKindRecord = "record"
+)
+
+// BroadcastTransport delivers the messages published to a channel by any replica of the service to all replicas subscribed to it, including the publisher
+type BroadcastTransport interface {
+	Publish(ctx context.Context, channel string, msg []byte) error
+	// Subscribe delivers messages published to the channels until the context is done or the subscription fails
+	Subscribe(ctx context.Context, channels []string, deliver func(msg []byte)) error
+}
+
+// RedisTransport broadcasts messages over Redis pub/sub channels
+type RedisTransport struct {
+	Client *redis.Client
+}
+
+func (t RedisTransport) Publish(ctx context.Context, channel string, msg []byte) error {
+	return t.Client.Publish(ctx, channel, msg).Err()
+}
+
+func (t RedisTransport) Subscribe(ctx context.Context, channels []string, deliver func(msg []byte)) error {
+	sub := t.Client.Subscribe(ctx, channels...)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		return err
+	}
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			deliver([]byte(msg.Payload))
+		}
+	}
+}
+
+type broadcastMessage struct {
+	Kind    string `json:"kind"`
+	Replica string `json:"replica"`
+	// Addr is the listener address of the replica and Flows are the flows listened to on it, for flows messages
+	Addr  string          `json:"addr,omitempty"`
+	Flows []FlowReference `json:"flows,omitempty"`
+	// Flow, Data and ReceivedAt describe the ingested record, for record messages
+	Flow       FlowReference   `json:"flow,omitempty"`
+	Data       json.RawMessage `json:"data,omitempty"`
+	ReceivedAt time.Time       `json:"receivedAt,omitempty"`
+	// EventTime and ClockSkewed carry the result of the clock skew check of the ingesting replica
+	EventTime   time.Time `json:"eventTime,omitempty"`
+	ClockSkewed bool      `json:"clockSkewed,omitempty"`
+	// Trace is the traceparent of the record if it is traced
+	Trace string `json:"trace,omitempty"`
+
+	// channel is where the message is published
+	channel string
+}
+
+type replicaFlows struct {
+	addr  string
+	flows []FlowReference
+	seen  time.Time
+}
+
+// BroadcastOptions holds the settings of exchanging records between replicas
+type BroadcastOptions struct {
+	// Replica is the unique name of this replica
+	Replica string
+	// Channel is the channel shared by the replicas, in sharding mode each replica also receives records on a channel of its own prefixed with it
+	Channel string
+	// Sharded enables sharding mode, in which records are only sent to the replica owning their flow instead of all replicas
+	Sharded bool
+	// Addr is the listener address of this replica, other replicas proxy listeners of flows owned by this replica to it in sharding mode
+	Addr string
+}
+
+func NewBroadcaster(opts BroadcastOptions, transport BroadcastTransport, logs log.Sink) *Broadcaster {
+	return &Broadcaster{
+		changes:   make(chan struct{}, 1),
+		logs:      log.WithFields(logs, log.Fields{"task": "broadcast", "replica": opts.Replica}),
+		opts:      opts,
+		outgoing:  make(chan broadcastMessage, broadcastQueueSize),
+		replicas:  make(map[string]replicaFlows),
+		transport: transport,
+	}
+}
+
+// Broadcaster exchanges ingested records between the replicas of the service, so that listeners see records regardless of the replica they were ingested by
+// Replicas also announce the flows listened to on them, so that outputs can be reconciled for the listeners of all replicas
+// Sequence numbers are assigned by each replica, so listeners cannot resume from a sequence number on another replica
+type Broadcaster struct {
+	changes   chan struct{}
+	local     []FlowReference
+	logs      log.Sink
+	mutex     sync.Mutex
+	opts      BroadcastOptions
+	outgoing  chan broadcastMessage
+	replicas  map[string]replicaFlows
+	transport BroadcastTransport
+}
+
+// Relay returns a channel of the records ingested locally, which are also published to the other replicas, and the ones published by other replicas
+func (b *Broadcaster) Relay(local RecordsChannel, stopSignal <-chan struct{}) RecordsChannel {
+	out := make(RecordsChannel)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopSignal
+		cancel()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case r, ok := <-local:
+				if !ok {
+					return
+				}
+				msg := broadcastMessage{Kind: broadcastKindRecord, Flow: r.Flow, Data: r.RawData, ReceivedAt: r.ReceivedAt, EventTime: r.EventTime, ClockSkewed: r.ClockSkewed, Trace: injectTrace(r), channel: b.opts.Channel}
+				if b.opts.Sharded {
+					owner, _ := b.owner(r.Flow)
+					if owner != b.opts.Replica {
+						msg.channel = b.replicaChannel(owner)
+						b.publish(msg)
+						continue
+					}
+				}
+				select {
+				case out <- r:
+				case <-ctx.Done():
+					return
+				}
+				if !b.opts.Sharded {
+					b.publish(msg)
+				}
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		b.publishLoop(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			channels := []string{b.opts.Channel}
+			if b.opts.Sharded {
+				channels = append(channels, b.replicaChannel(b.opts.Replica))
+			}
+			err := b.transport.Subscribe(ctx, channels, func(msg []byte) {
+				b.receive(ctx, msg, out)
+			})
+			if err != nil {
+				log.Event(b.logs, "broadcast subscription failed, resubscribing", log.Error(err))
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// publish queues a message for publishing, records are dropped rather than holding up local listeners if the transport can't keep up
+func (b *Broadcaster) publish(msg broadcastMessage) {
+	msg.Replica = b.opts.Replica
+	select {
+	case b.outgoing <- msg:
+	default:
+		log.Event(b.logs, "broadcast queue is full, discarding message", log.V(1), log.Fields{"kind": msg.Kind})
+	}
+}
+
+func (b *Broadcaster) publishLoop(ctx context.Context) {
+	ticker := time.NewTicker(BroadcastAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.announce()
+			if b.prune(time.Now()) {
+				b.notify()
+			}
+		case msg := <-b.outgoing:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				log.Event(b.logs, "failed to marshal broadcast message", log.Error(err))
+				continue
+			}
+			if err := b.transport.Publish(ctx, msg.channel, data); err != nil {
+				log.Event(b.logs, "failed to publish broadcast message", log.V(1), log.Error(err), log.Fields{"kind": msg.Kind})
+			}
+		}
+	}
+}
+
+func (b *Broadcaster) receive(ctx context.Context, data []byte, out RecordsChannel) {
+	var msg broadcastMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Event(b.logs, "failed to parse broadcast message", log.Error(err))
+		return
+	}
+	if msg.Replica == b.opts.Replica {
+		return
+	}
+	switch msg.Kind {
+	case broadcastKindRecord:
+		r := Record{
+			RawData:     msg.Data,
+			Flow:        msg.Flow,
+			ReceivedAt:  msg.ReceivedAt,
+			EventTime:   msg.EventTime,
+			ClockSkewed: msg.ClockSkewed,
+			trace:       extractTrace(msg.Trace),
+		}
+		var err error
+		if r.Meta, err = ParseRecordMeta(r.RawData); err != nil {
+			log.Event(b.logs, "failed to parse broadcast record", log.Error(err), log.Fields{"from": msg.Replica})
+			return
+		}
+		select {
+		case out <- r:
+		case <-ctx.Done():
+		}
+	case broadcastKindFlows:
+		b.mutex.Lock()
+		old, known := b.replicas[msg.Replica]
+		b.replicas[msg.Replica] = replicaFlows{addr: msg.Addr, flows: msg.Flows, seen: time.Now()}
+		b.mutex.Unlock()
+		if !known || old.addr != msg.Addr || !equalFlows(old.flows, msg.Flows) {
+			b.notify()
+		}
+	}
+}
+
+// AnnounceFlows publishes the flows listened to on this replica and returns the flows listened to on any replica
+func (b *Broadcaster) AnnounceFlows(flows []FlowReference) []FlowReference {
+	flows = append([]FlowReference(nil), flows...)
+	sortFlows(flows)
+	b.mutex.Lock()
+	b.local = flows
+	b.mutex.Unlock()
+	b.announce()
+	return b.Flows()
+}
+
+func (b *Broadcaster) announce() {
+	b.mutex.Lock()
+	flows := b.local
+	b.mutex.Unlock()
+	b.publish(broadcastMessage{Kind: broadcastKindFlows, Addr: b.opts.Addr, Flows: flows, channel: b.opts.Channel})
+}
+
+func (b *Broadcaster) replicaChannel(replica string) string {
+	return b.opts.Channel + "." + replica
+}
+
+// Owner returns the listener address of the replica owning the flow in sharding mode and whether it is this replica
+func (b *Broadcaster) Owner(flow FlowReference) (string, bool) {
+	replica, addr := b.owner(flow)
+	return addr, replica == b.opts.Replica
+}
+
+// owner picks the replica with the highest random weight for the flow (rendezvous hashing), so that only the flows of a replica joining or leaving move
+func (b *Broadcaster) owner(flow FlowReference) (replica string, addr string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	replica, addr = b.opts.Replica, b.opts.Addr
+	best := shardWeight(replica, flow)
+	for name, r := range b.replicas {
+		if w := shardWeight(name, flow); w > best || (w == best && name < replica) {
+			replica, addr, best = name, r.addr, w
+		}
+	}
+	return
+}
+
+func shardWeight(replica string, flow FlowReference) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(replica))
+	h.Write([]byte{0})
+	h.Write([]byte(flow.URL()))
+	return h.Sum64()
+}
+
+// Flows returns the flows listened to on any replica
+func (b *Broadcaster) Flows() []FlowReference {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	set := make(map[FlowReference]bool)
+	for _, flow := range b.local {
+		set[flow] = true
+	}
+	for _, r := range b.replicas {
+		for _, flow := range r.flows {
+			set[flow] = true
+		}
+	}
+	res := make([]FlowReference, 0, len(set))
+	for flow := range set {
+		res = append(res, flow)
+	}
+	sortFlows(res)
+	return res
+}
+
+func sortFlows(flows []FlowReference) {
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].URL() < flows[j].URL()
+	})
+}
+
+// Changes signals changes of the flows listened to on other replicas
+func (b *Broadcaster) Changes() <-chan struct{} {
+	return b.changes
+}
+
+func (b *Broadcaster) notify() {
+	select {
+	case b.changes <- struct{}{}:
+	default:
+	}
+}
+
+// prune forgets the flows of replicas that stopped announcing them, it reports whether any were forgotten
+func (b *Broadcaster) prune(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	pruned := false
+	for replica, r := range b.replicas {
+		if now.Sub(r.seen) > broadcastReplicaTimeout {
+			delete(b.replicas, replica)
+			pruned = true
+		}
+	}
+	return pruned
+}
+
+func equalFlows(a, b []FlowReference) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
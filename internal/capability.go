@@ -0,0 +1,417 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	// AdminCapabilitiesEndpoint mints capability URLs on POST requests and lists them on GET requests, capabilities are revoked by deleting AdminCapabilitiesEndpoint/<id>
+	AdminCapabilitiesEndpoint = "/admin/capabilities"
+	// CapabilityParam carries the token of capability URLs, which grants read access to a single flow without credentials
+	CapabilityParam = "capability"
+	// CapabilityIssuerExtraKey is the extra key of the user of capability listeners holding the name of the capability's issuer
+	CapabilityIssuerExtraKey = "log-socket.banzaicloud.io/capability-issuer"
+
+	DefaultCapabilityMaxTTL = 24 * time.Hour
+)
+
+// capabilityFilterParams are the query parameters a capability can restrict the records of its flow with
+var capabilityFilterParams = []string{FilterParamContainer, FilterParamContainerRegex, FilterParamLevel, FilterParamMinLevel, FilterParamNamespace, FilterParamNamespaceRegex, FilterParamPod, FilterParamPodRegex}
+
+// CapabilityRequest is the body of requests minting capability URLs
+type CapabilityRequest struct {
+	// Flow is the reference of the shared flow in kind/namespace/name form
+	Flow string `json:"flow"`
+	// TTL is how long the capability is valid, e.g. 1h
+	TTL string `json:"ttl"`
+	// Filter holds the filter query parameters the records of the flow are restricted to, e.g. {"podRegex": "api-.*", "minLevel": "warn"}
+	Filter      map[string]string `json:"filter,omitempty"`
+	Description string            `json:"description,omitempty"`
+}
+
+// CapabilityInfo describes a capability in responses of the admin API, its URL is only returned when it is minted
+type CapabilityInfo struct {
+	ID          string            `json:"id"`
+	URL         string            `json:"url,omitempty"`
+	Flow        string            `json:"flow"`
+	Filter      map[string]string `json:"filter,omitempty"`
+	Description string            `json:"description,omitempty"`
+	IssuedBy    string            `json:"issuedBy"`
+	IssuedAt    time.Time         `json:"issuedAt"`
+	ExpiresAt   time.Time         `json:"expiresAt"`
+	Revoked     bool              `json:"revoked,omitempty"`
+}
+
+// capabilityClaims are the signed contents of capability tokens, which embed the user info of their issuer so that any replica sharing the key can verify them
+type capabilityClaims struct {
+	ID          string            `json:"jti"`
+	Flow        string            `json:"flow"`
+	Filter      map[string]string `json:"filter,omitempty"`
+	Description string            `json:"desc,omitempty"`
+	Issuer      queryTokenClaims  `json:"iss"`
+	IssuedAt    int64             `json:"iat"`
+	Expiry      int64             `json:"exp"`
+}
+
+// NewCapabilities returns a capability issuer signing tokens with the key, replicas sharing the key accept each other's capabilities
+// A random key is generated if the key is empty, in which case capabilities are only accepted by the issuing replica
+func NewCapabilities(key []byte, maxTTL time.Duration, baseURL string) (*Capabilities, error) {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	if maxTTL <= 0 {
+		maxTTL = DefaultCapabilityMaxTTL
+	}
+	return &Capabilities{
+		key:     key,
+		maxTTL:  maxTTL,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		issued:  make(map[string]CapabilityInfo),
+		revoked: make(map[string]time.Time),
+	}, nil
+}
+
+// Capabilities mints and verifies capability URLs, which let anyone holding them tail a flow as their issuer, restricted to the filters of the capability, until they expire or are revoked
+// Revocations are kept in memory by the replica they are requested from until the capability expires
+type Capabilities struct {
+	key     []byte
+	maxTTL  time.Duration
+	baseURL string
+
+	mutex sync.Mutex
+	// issued holds the capabilities minted by this replica until they expire
+	issued map[string]CapabilityInfo
+	// revoked holds the expiry of revoked capabilities by their ID
+	revoked map[string]time.Time
+}
+
+// Mint issues a capability of the issuer, the URL of the result is built from baseURL, an https URL of the request's host by default
+func (c *Capabilities) Mint(req CapabilityRequest, issuer authv1.UserInfo, baseURL string, now time.Time) (CapabilityInfo, error) {
+	var res CapabilityInfo
+	flow, err := ParseFlowReference(req.Flow, "")
+	if err != nil {
+		return res, err
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl <= 0 || ttl > c.maxTTL {
+		return res, fmt.Errorf("invalid ttl %q, expected a positive duration of at most %s", req.TTL, c.maxTTL)
+	}
+	query := make(url.Values, len(req.Filter))
+	for k, v := range req.Filter {
+		if !hasItem(capabilityFilterParams, k) {
+			return res, fmt.Errorf("invalid filter parameter %q, expected one of %s", k, strings.Join(capabilityFilterParams, ", "))
+		}
+		query.Set(k, v)
+	}
+	if _, err := ParseRecordFilter(query); err != nil {
+		return res, err
+	}
+
+	id := newListenerID()
+	claims, err := json.Marshal(capabilityClaims{
+		ID:          id,
+		Flow:        flow.URL(),
+		Filter:      req.Filter,
+		Description: req.Description,
+		Issuer:      queryTokenClaims{Username: issuer.Username, UID: issuer.UID, Groups: issuer.Groups, Extra: issuer.Extra},
+		IssuedAt:    now.Unix(),
+		Expiry:      now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return res, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	token := payload + "." + base64.RawURLEncoding.EncodeToString(c.mac(payload))
+
+	res = CapabilityInfo{
+		ID:          id,
+		Flow:        flow.URL(),
+		Filter:      req.Filter,
+		Description: req.Description,
+		IssuedBy:    issuer.Username,
+		IssuedAt:    time.Unix(now.Unix(), 0),
+		ExpiresAt:   time.Unix(now.Add(ttl).Unix(), 0),
+	}
+	c.mutex.Lock()
+	c.expire(now)
+	c.issued[id] = res
+	c.mutex.Unlock()
+
+	if c.baseURL != "" {
+		baseURL = c.baseURL
+	}
+	query.Set(CapabilityParam, token)
+	res.URL = baseURL + "/" + flow.URL() + "?" + query.Encode()
+	return res, nil
+}
+
+// Verify returns the capability of a token issued by Mint and the user info of its issuer if it is intact, not expired and not revoked
+func (c *Capabilities) Verify(token string, now time.Time) (CapabilityInfo, authv1.UserInfo, error) {
+	var res CapabilityInfo
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return res, authv1.UserInfo{}, invalidCredentials("malformed capability")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, c.mac(payload)) {
+		return res, authv1.UserInfo{}, invalidCredentials("invalid capability signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return res, authv1.UserInfo{}, invalidCredentials("malformed capability")
+	}
+	var claims capabilityClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return res, authv1.UserInfo{}, invalidCredentials("malformed capability claims")
+	}
+	res = CapabilityInfo{
+		ID:          claims.ID,
+		Flow:        claims.Flow,
+		Filter:      claims.Filter,
+		Description: claims.Description,
+		IssuedBy:    claims.Issuer.Username,
+		IssuedAt:    time.Unix(claims.IssuedAt, 0),
+		ExpiresAt:   time.Unix(claims.Expiry, 0),
+	}
+	switch {
+	case !now.Before(res.ExpiresAt):
+		return res, authv1.UserInfo{}, invalidCredentials("capability has expired")
+	case res.ExpiresAt.Sub(now) > c.maxTTL:
+		return res, authv1.UserInfo{}, invalidCredentials("capability is valid for longer than accepted")
+	case c.Revoked(res.ID):
+		return res, authv1.UserInfo{}, invalidCredentials("capability has been revoked")
+	}
+	return res, authv1.UserInfo{Username: claims.Issuer.Username, UID: claims.Issuer.UID, Groups: claims.Issuer.Groups, Extra: claims.Issuer.Extra}, nil
+}
+
+// Revoke revokes the capability and returns it if it was minted by this replica, capabilities minted by other replicas are revoked for the longest capability lifetime
+func (c *Capabilities) Revoke(id string, now time.Time) (CapabilityInfo, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.expire(now)
+	expiresAt := now.Add(c.maxTTL)
+	info, ok := c.issued[id]
+	if ok {
+		expiresAt = info.ExpiresAt
+	}
+	c.revoked[id] = expiresAt
+	return info, ok
+}
+
+// Revoked reports whether the capability has been revoked
+func (c *Capabilities) Revoked(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.revoked[id]
+	return ok
+}
+
+// List returns the unexpired capabilities minted by this replica
+func (c *Capabilities) List(now time.Time) []CapabilityInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.expire(now)
+	res := make([]CapabilityInfo, 0, len(c.issued))
+	for id, info := range c.issued {
+		_, info.Revoked = c.revoked[id]
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].IssuedAt.Before(res[j].IssuedAt)
+	})
+	return res
+}
+
+// expire forgets expired capabilities, the mutex has to be held
+func (c *Capabilities) expire(now time.Time) {
+	for id, info := range c.issued {
+		if !now.Before(info.ExpiresAt) {
+			delete(c.issued, id)
+		}
+	}
+	for id, expiresAt := range c.revoked {
+		if !now.Before(expiresAt) {
+			delete(c.revoked, id)
+		}
+	}
+}
+
+func (c *Capabilities) mac(payload string) []byte {
+	h := hmac.New(sha256.New, c.key)
+	_, _ = h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// capabilityUser is the user listeners connecting with the capability are identified as
+func capabilityUser(capability CapabilityInfo, issuer authv1.UserInfo) authv1.UserInfo {
+	extra := authv1.ExtraValue{issuer.Username}
+	user := authv1.UserInfo{
+		Username: "capability:" + capability.ID,
+		Extra:    map[string]authv1.ExtraValue{CapabilityIssuerExtraKey: extra},
+	}
+	if tenant := UserTenant(issuer); tenant != "" {
+		user = withTenant(user, tenant)
+	}
+	return user
+}
+
+// capabilityRequest returns the request with the filters of the capability, which replace those the listener requested
+func capabilityRequest(r *http.Request, capability CapabilityInfo) *http.Request {
+	query := r.URL.Query()
+	for k, v := range capability.Filter {
+		// names are matched either literally or by a regular expression
+		for literal, regex := range filterRegexParams {
+			if k == literal || k == regex {
+				query.Del(literal)
+				query.Del(regex)
+			}
+		}
+		query.Set(k, v)
+	}
+	res := r.Clone(r.Context())
+	res.URL.RawQuery = query.Encode()
+	return res
+}
+
+// capabilityAuthorizer allows the listeners of a capability to tail its flow as long as the capability is not revoked and its issuer may tail the flow
+type capabilityAuthorizer struct {
+	Authorizer
+	Capabilities *Capabilities
+	Capability   CapabilityInfo
+	Issuer       authv1.UserInfo
+}
+
+func (a capabilityAuthorizer) AuthorizeFlow(user authv1.UserInfo, flow FlowReference) (bool, error) {
+	if flow.URL() != a.Capability.Flow || a.Capabilities.Revoked(a.Capability.ID) || !time.Now().Before(a.Capability.ExpiresAt) {
+		return false, nil
+	}
+	return a.Authorizer.AuthorizeFlow(a.Issuer, flow)
+}
+
+func (a capabilityAuthorizer) AuthorizeRecord(user authv1.UserInfo, r Record) bool {
+	return a.Authorizer.AuthorizeRecord(a.Issuer, r)
+}
+
+// serveCapabilities responds to requests of the capabilities admin endpoint, it reports whether the request was handled
+// Admins may only share the flows they may tail themselves
+func serveCapabilities(w http.ResponseWriter, r *http.Request, opts ListenerOptions, active *activeListeners, authenticator Authenticator, authorizer Authorizer, logs log.Sink) bool {
+	if opts.Admin == nil || opts.Capabilities == nil {
+		return false
+	}
+	if r.URL.Path != AdminCapabilitiesEndpoint && !strings.HasPrefix(r.URL.Path, AdminCapabilitiesEndpoint+"/") {
+		return false
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, AdminCapabilitiesEndpoint), "/")
+	switch {
+	case (r.Method == http.MethodGet || r.Method == http.MethodPost) && id == "":
+	case r.Method == http.MethodDelete && id != "":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+
+	usrInfo, ok := authorizeAdminRequest(w, r, opts.Admin, AdminCapabilitiesEndpoint, authenticator, opts.Tenancy, logs)
+	if !ok {
+		return true
+	}
+
+	var res interface{}
+	switch r.Method {
+	case http.MethodDelete:
+		info, issued := opts.Capabilities.Revoke(id, time.Now())
+		log.Event(logs, "capability revoked on admin request", log.Fields{"capability": id, "admin": usrInfo.Username})
+		var flows []FlowReference
+		if flow, err := ParseFlowReference(info.Flow, ""); issued && err == nil {
+			flows = append(flows, flow)
+		}
+		for _, l := range active.list() {
+			if l.capability == id {
+				if len(flows) == 0 {
+					flows = l.subscribedFlows()
+				}
+				l.closeWith(CloseForbidden, "the capability has been revoked")
+			}
+		}
+		auditCapability(opts.Audit, AuditEventCapabilityRevoked, usrInfo, id, flows)
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	case http.MethodPost:
+		var req CapabilityRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return true
+		}
+		flow, err := ParseFlowReference(req.Flow, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return true
+		}
+		allowed, err := authorizer.AuthorizeFlow(usrInfo, flow)
+		if err != nil {
+			log.Event(logs, "authorization failed", log.V(1), log.Error(err), log.Fields{"user": usrInfo, "flow": flow})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return true
+		}
+		if !allowed {
+			http.Error(w, fmt.Sprintf("permission denied to tail %s", flow.URL()), http.StatusForbidden)
+			return true
+		}
+		baseURL := "https://" + r.Host
+		if r.TLS == nil {
+			baseURL = "http://" + r.Host
+		}
+		info, err := opts.Capabilities.Mint(req, usrInfo, baseURL, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return true
+		}
+		log.Event(logs, "capability minted on admin request", log.Fields{"capability": info.ID, "flow": info.Flow, "filter": info.Filter, "expiresAt": info.ExpiresAt, "admin": usrInfo.Username})
+		auditCapability(opts.Audit, AuditEventCapabilityIssued, usrInfo, info.ID, []FlowReference{flow})
+		res = info
+	default:
+		res = opts.Capabilities.List(time.Now())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodPost {
+		// the URL is a credential
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Event(logs, "failed to write admin response", log.V(1), log.Error(err))
+	}
+	return true
+}
+
+func auditCapability(sink AuditSink, typ AuditEventType, admin authv1.UserInfo, id string, flows []FlowReference) {
+	if sink == nil {
+		return
+	}
+	sink.Audit(AuditEvent{
+		Type:       typ,
+		Time:       time.Now(),
+		User:       admin.Username,
+		Groups:     admin.Groups,
+		Tenant:     UserTenant(admin),
+		Capability: id,
+		Flows:      flows,
+	})
+}
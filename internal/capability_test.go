@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+// capabilityToken returns the token of the URL of a minted capability
+func capabilityToken(t *testing.T, info CapabilityInfo) string {
+	u, err := url.Parse(info.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query().Get(CapabilityParam)
+}
+
+func TestCapabilities(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	alice := authv1.UserInfo{Username: "alice", Groups: []string{"devs"}}
+	capabilities, err := NewCapabilities([]byte("key"), time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewCapabilities([]byte("other"), time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	longLived, err := NewCapabilities([]byte("key"), 2*time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := CapabilityRequest{Flow: "flow/default/all", TTL: "1m", Filter: map[string]string{FilterParamPod: "api"}}
+	for name, tc := range map[string]struct {
+		// mint mints the capability that verify verifies
+		mint   *Capabilities
+		ttl    string
+		verify *Capabilities
+		now    time.Time
+		// token changes the token of the minted capability before it is verified
+		token  func(string) string
+		revoke bool
+		valid  bool
+	}{
+		"valid":                  {mint: capabilities, verify: capabilities, now: now, valid: true},
+		"valid until its expiry": {mint: capabilities, verify: capabilities, now: now.Add(time.Minute - time.Second), valid: true},
+		"expired":                {mint: capabilities, verify: capabilities, now: now.Add(time.Minute)},
+		"over the maximum ttl":   {mint: longLived, ttl: "2h", verify: capabilities, now: now},
+		"tampered":               {mint: capabilities, verify: capabilities, now: now, token: func(token string) string { return tamper(t, token, `"alice"`, `"admin"`) }},
+		"wrong key":              {mint: capabilities, verify: other, now: now},
+		"revoked":                {mint: capabilities, verify: capabilities, now: now, revoke: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := req
+			if tc.ttl != "" {
+				req.TTL = tc.ttl
+			}
+			minted, err := tc.mint.Mint(req, alice, "https://logs.example.com", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token := capabilityToken(t, minted)
+			if tc.token != nil {
+				token = tc.token(token)
+			}
+			if tc.revoke {
+				tc.verify.Revoke(minted.ID, now)
+			}
+			info, issuer, err := tc.verify.Verify(token, tc.now)
+			if !tc.valid {
+				if !errors.Is(err, ErrInvalidCredentials) {
+					t.Errorf("got error %v, want invalid credentials", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.ID != minted.ID || info.Flow != "flow/default/all" || info.Filter[FilterParamPod] != "api" {
+				t.Errorf("got capability %+v, want %+v", info, minted)
+			}
+			if !info.ExpiresAt.Equal(now.Add(time.Minute)) {
+				t.Errorf("got expiry %v, want %v", info.ExpiresAt, now.Add(time.Minute))
+			}
+			if issuer.Username != alice.Username || len(issuer.Groups) != 1 || issuer.Groups[0] != "devs" {
+				t.Errorf("got issuer %+v, want %+v", issuer, alice)
+			}
+		})
+	}
+}
+
+func TestCapabilitiesRejectInvalidRequests(t *testing.T) {
+	capabilities, err := NewCapabilities([]byte("key"), time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, req := range map[string]CapabilityRequest{
+		"over the maximum ttl": {Flow: "flow/default/all", TTL: "2h"},
+		"negative ttl":         {Flow: "flow/default/all", TTL: "-1m"},
+		"invalid flow":         {Flow: "default/all", TTL: "1m"},
+		"unknown filter":       {Flow: "flow/default/all", TTL: "1m", Filter: map[string]string{"labels": "app"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := capabilities.Mint(req, authv1.UserInfo{Username: "alice"}, "https://logs.example.com", time.Now()); err == nil {
+				t.Error("minted a capability")
+			}
+		})
+	}
+}
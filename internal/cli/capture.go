@@ -0,0 +1,173 @@
+package cli
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// captureFileOptions describe how the file records are captured to is rotated
+type captureFileOptions struct {
+	// MaxSize is the number of bytes after which the file is rotated, 0 means no limit
+	MaxSize int64
+	// MaxAge is the time after which the file is rotated at the next record, 0 means no limit
+	MaxAge time.Duration
+	// MaxFiles is the number of rotated files kept, 0 means all of them
+	MaxFiles int
+	// Compress means that rotated files are compressed with gzip
+	Compress bool
+}
+
+// captureFile appends the lines written to it to a file, full files are renamed by appending the time of rotation to their name
+type captureFile struct {
+	file    *os.File
+	logs    log.Sink
+	opts    captureFileOptions
+	path    string
+	started time.Time
+	written int64
+	// wg tracks the compression of rotated files, mutex serializes it with their removal
+	mutex sync.Mutex
+	wg    sync.WaitGroup
+}
+
+func openCaptureFile(path string, opts captureFileOptions, logs log.Sink) (*captureFile, error) {
+	f := &captureFile{
+		logs: logs,
+		opts: opts,
+		path: path,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *captureFile) open() (err error) {
+	if f.file, err = os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600); err != nil {
+		return err
+	}
+	info, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	f.written = info.Size()
+	f.started = time.Now()
+	return nil
+}
+
+// Write is called with whole lines, so files are only rotated between them
+func (f *captureFile) Write(data []byte) (int, error) {
+	if f.written > 0 && (f.opts.MaxSize > 0 && f.written+int64(len(data)) > f.opts.MaxSize || f.opts.MaxAge > 0 && time.Since(f.started) >= f.opts.MaxAge) {
+		if err := f.rotate(); err != nil {
+			log.Event(f.logs, "failed to rotate output file", log.Error(err), log.Fields{"file": f.path})
+			if f.file == nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := f.file.Write(data)
+	f.written += int64(n)
+	return n, err
+}
+
+func (f *captureFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	rotated := f.path + "." + time.Now().UTC().Format("20060102T150405.000Z")
+	if err := os.Rename(f.path, rotated); err != nil {
+		// records keep being appended to the full file
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	log.Event(f.logs, "rotated output file", log.V(1), log.Fields{"file": rotated})
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		if f.opts.Compress {
+			if err := compressFile(rotated); err != nil {
+				log.Event(f.logs, "failed to compress rotated output file", log.Error(err), log.Fields{"file": rotated})
+			}
+		}
+		f.prune()
+	}()
+	return f.open()
+}
+
+// prune removes the oldest rotated files beyond the maximum number of files, it is called with mutex held
+func (f *captureFile) prune() {
+	if f.opts.MaxFiles <= 0 {
+		return
+	}
+	names, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	// rotated files are named after the time of rotation, so their names sort chronologically
+	rotated := names[:0]
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".tmp") {
+			rotated = append(rotated, name)
+		}
+	}
+	sort.Strings(rotated)
+	for len(rotated) > f.opts.MaxFiles {
+		if err := os.Remove(rotated[0]); err != nil && !os.IsNotExist(err) {
+			log.Event(f.logs, "failed to remove rotated output file", log.Error(err), log.Fields{"file": rotated[0]})
+		}
+		rotated = rotated[1:]
+	}
+}
+
+// Close closes the file once rotated files are compressed
+func (f *captureFile) Close() error {
+	f.wg.Wait()
+	return f.file.Close()
+}
+
+// compressFile replaces the file with a gzip compressed copy named after it with a .gz suffix
+func compressFile(name string) (err error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := name + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(tmp)
+		}
+	}()
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, name+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
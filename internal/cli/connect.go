@@ -0,0 +1,185 @@
+// Package cli implements the commands of the log-socket client and the kubectl plugin
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	pathpkg "path"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/banzaicloud/log-socket/internal"
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// ConnectOptions describe how the service is reached and how listeners authenticate to it
+type ConnectOptions struct {
+	Token          string
+	ClientCertFile string
+	ClientKeyFile  string
+	// ListenAddr is the address where the service accepts listeners, the service proxy of the API server is used if empty
+	ListenAddr       string
+	ServiceName      string
+	ServiceNamespace string
+	ServicePort      string
+	// Kubeconfig is used to connect through the service proxy and to get the token if none is set, it is loaded if nil
+	Kubeconfig *rest.Config
+	// ImpersonateUser and ImpersonateGroups are the user and groups to act as, if the service allows it
+	ImpersonateUser   string
+	ImpersonateGroups []string
+}
+
+// AddAuthFlags registers the flags of the credentials and the listen address
+func (o *ConnectOptions) AddAuthFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&o.Token, "token", "t", "", "token used for authentication (defaults to the token of the kubeconfig's credentials)")
+	flags.StringVar(&o.ClientCertFile, "client-cert", "", "PEM file of the client certificate used for authentication instead of a token")
+	flags.StringVar(&o.ClientKeyFile, "client-key", "", "PEM file of the client certificate's private key")
+	flags.StringVar(&o.ListenAddr, "listen-addr", "", "address where the service accepts WebSocket listeners (defaults to the service proxy of the API server)")
+	flags.StringVar(&o.ImpersonateUser, "as", "", "user to impersonate, requires --listen-addr")
+	flags.StringSliceVar(&o.ImpersonateGroups, "as-group", nil, "group to impersonate, can be repeated")
+}
+
+// AddServiceFlags registers the flags selecting the service reached through the service proxy
+func (o *ConnectOptions) AddServiceFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&o.ServiceName, "service", "s", "log-socket", "name of the service that accepts WebSocket listeners")
+	flags.StringVarP(&o.ServiceNamespace, "namespace", "n", "default", "log socket service namespace")
+	flags.StringVarP(&o.ServicePort, "port", "p", "10001", "log socket service listening port")
+}
+
+// Dial opens a websocket connection to the service at the specified path
+func Dial(ctx context.Context, path string, query url.Values, opts ConnectOptions, logs log.Sink) (*websocket.Conn, error) {
+	listenURL, header, tlsCfg, err := serviceRequest(path, opts, logs)
+	if err != nil {
+		return nil, err
+	}
+	listenURL.Scheme = "wss"
+	listenURL.RawQuery = query.Encode()
+
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	dialer.TLSClientConfig = tlsCfg
+	log.Event(logs, "connecting to service", log.V(1), log.Fields{"url": listenURL})
+	wsConn, _, err := dialer.DialContext(ctx, listenURL.String(), header)
+	return wsConn, err
+}
+
+// ListFlows returns the flows the user may tail, as listed by the flows endpoint of the service
+func ListFlows(ctx context.Context, opts ConnectOptions, logs log.Sink) ([]internal.FlowInfo, error) {
+	flowsURL, header, tlsCfg, err := serviceRequest(internal.FlowsEndpoint, opts, logs)
+	if err != nil {
+		return nil, err
+	}
+	flowsURL.Scheme = "https"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, flowsURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+
+	log.Event(logs, "listing flows", log.V(1), log.Fields{"url": flowsURL})
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsCfg}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("failed to list flows: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var flows []internal.FlowInfo
+	if err := json.NewDecoder(resp.Body).Decode(&flows); err != nil {
+		return nil, fmt.Errorf("invalid flows response: %w", err)
+	}
+	return flows, nil
+}
+
+// serviceRequest returns the URL, headers and TLS configuration of requests to the service at the specified path, the scheme of the URL is up to the caller
+func serviceRequest(path string, opts ConnectOptions, logs log.Sink) (*url.URL, http.Header, *tls.Config, error) {
+	header := make(http.Header)
+	if opts.ImpersonateUser != "" || len(opts.ImpersonateGroups) > 0 {
+		if opts.ListenAddr == "" {
+			// the API server proxy would act on the impersonation headers itself
+			return nil, nil, nil, errors.New("impersonation requires connecting to the service directly with --listen-addr")
+		}
+		header.Set(internal.ImpersonateUserHeader, opts.ImpersonateUser)
+		for _, group := range opts.ImpersonateGroups {
+			header.Add(internal.ImpersonateGroupHeader, group)
+		}
+	}
+
+	cfg := opts.Kubeconfig
+	if cfg == nil && (opts.ListenAddr == "" || (opts.Token == "" && opts.ClientCertFile == "")) {
+		var err error
+		if cfg, err = ctrl.GetConfig(); err != nil {
+			if opts.ListenAddr == "" {
+				return nil, nil, nil, err
+			}
+			log.Event(logs, "failed to get kubeconfig, connecting without credentials", log.V(1), log.Error(err))
+		}
+	}
+	if cfg != nil {
+		kubeHeader, err := kubeconfigHeaders(cfg)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if opts.Token == "" && opts.ClientCertFile == "" {
+			opts.Token = kubeconfigToken(kubeHeader)
+		}
+		if opts.ListenAddr == "" {
+			// the API server proxy authenticates the request with the kubeconfig's credentials
+			for key, values := range kubeHeader {
+				header[key] = values
+			}
+		}
+	}
+
+	var listenURL *url.URL
+	var tlsCfg *tls.Config
+	if opts.ListenAddr == "" {
+		var err error
+		if tlsCfg, err = rest.TLSConfigFor(cfg); err != nil {
+			return nil, nil, nil, err
+		}
+		if listenURL, err = proxyURL(cfg, opts.ServiceNamespace, "services", opts.ServiceName, true, opts.ServicePort, path); err != nil {
+			return nil, nil, nil, err
+		}
+	} else {
+		listenAddr := opts.ListenAddr
+		if !strings.Contains(listenAddr, "://") {
+			listenAddr = "wss://" + listenAddr
+		}
+		var err error
+		if listenURL, err = url.Parse(listenAddr); err != nil {
+			return nil, nil, nil, err
+		}
+		listenURL.Path = pathpkg.Join(listenURL.Path, path)
+	}
+
+	if tlsCfg == nil {
+		tlsCfg = &tls.Config{}
+	}
+	tlsCfg.InsecureSkipVerify = true
+
+	if opts.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		tlsCfg.Certificates = append(tlsCfg.Certificates, cert)
+	}
+	if opts.Token != "" {
+		header.Set(internal.AuthHeaderKey, opts.Token)
+	}
+	return listenURL, header, tlsCfg, nil
+}
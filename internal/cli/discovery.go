@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// ListenURLAnnotation can be set on the service or on an ingress routing to it to make clients connect to the URL instead of the service proxy
+	ListenURLAnnotation = "log-socket.banzaicloud.io/listen-url"
+	// DefaultServiceSelector selects the services deployed by the Helm chart
+	DefaultServiceSelector = "app.kubernetes.io/name=log-socket"
+
+	listenPortName = "http-api"
+)
+
+// DiscoverService finds the service that accepts listeners and sets how it is reached in opts
+func DiscoverService(ctx context.Context, cfg *rest.Config, selector string, opts *ConnectOptions) error {
+	sel, err := labels.Parse(selector)
+	if err != nil {
+		return err
+	}
+
+	s := runtime.NewScheme()
+	if err := corev1.AddToScheme(s); err != nil {
+		return err
+	}
+	if err := networkingv1.AddToScheme(s); err != nil {
+		return err
+	}
+	c, err := client.New(cfg, client.Options{Scheme: s})
+	if err != nil {
+		return err
+	}
+
+	var services corev1.ServiceList
+	if err := c.List(ctx, &services, client.MatchingLabelsSelector{Selector: sel}); err != nil {
+		return err
+	}
+	var svc *corev1.Service
+	var port int32
+	for i := range services.Items {
+		for _, p := range services.Items[i].Spec.Ports {
+			if p.Name == listenPortName {
+				svc, port = &services.Items[i], p.Port
+				break
+			}
+		}
+		if svc != nil {
+			break
+		}
+	}
+	if svc == nil {
+		return fmt.Errorf("no service matching %q with a port named %s found", selector, listenPortName)
+	}
+
+	if url := svc.Annotations[ListenURLAnnotation]; url != "" {
+		opts.ListenAddr = url
+		return nil
+	}
+
+	// users are not necessarily permitted to list ingresses, in which case the service proxy is used
+	var ingresses networkingv1.IngressList
+	if err := c.List(ctx, &ingresses, client.InNamespace(svc.Namespace)); err == nil {
+		for _, ing := range ingresses.Items {
+			if url := ing.Annotations[ListenURLAnnotation]; url != "" && routesTo(ing, svc.Name) {
+				opts.ListenAddr = url
+				return nil
+			}
+		}
+	}
+
+	opts.ServiceNamespace = svc.Namespace
+	opts.ServiceName = svc.Name
+	opts.ServicePort = strconv.Itoa(int(port))
+	return nil
+}
+
+func routesTo(ing networkingv1.Ingress, service string) bool {
+	if b := ing.Spec.DefaultBackend; b != nil && b.Service != nil && b.Service.Name == service {
+		return true
+	}
+	for _, rule := range ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			if path.Backend.Service != nil && path.Backend.Service.Name == service {
+				return true
+			}
+		}
+	}
+	return false
+}
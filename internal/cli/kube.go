@@ -0,0 +1,84 @@
+package cli
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	pathpkg "path"
+	"strings"
+
+	"k8s.io/client-go/rest"
+)
+
+func proxyURL(cfg *rest.Config, namespace, resourceType, name string, tls bool, port string, path string) (uri *url.URL, err error) {
+	switch resourceType {
+	case "pods", "services":
+	default:
+		return nil, errors.New("invalid resource type")
+	}
+
+	uri, err = url.Parse(cfg.Host)
+	if err != nil {
+		return
+	}
+
+	apiPath := cfg.APIPath
+	if apiPath == "" {
+		apiPath = "/api/v1"
+	}
+
+	resource := name
+	if tls {
+		resource = "https:" + resource
+	}
+	if port != "" {
+		resource = resource + ":" + port
+	}
+
+	uri.Path = pathpkg.Join(apiPath, "namespaces", namespace, resourceType, resource, "proxy", path)
+
+	return
+}
+
+// kubeconfigHeaders returns the headers the kubeconfig's credentials (token, token file, auth provider or exec plugin) add to requests
+func kubeconfigHeaders(cfg *rest.Config) (http.Header, error) {
+	capture := &headerCapture{}
+	rt, err := rest.HTTPWrappersForConfig(cfg, capture)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, cfg.Host, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return capture.header, nil
+}
+
+// kubeconfigToken returns the bearer token of the kubeconfig's credentials, if any
+func kubeconfigToken(header http.Header) string {
+	const prefix = "bearer "
+	if auth := header.Get("Authorization"); len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return auth[len(prefix):]
+	}
+	return ""
+}
+
+// headerCapture records the headers of requests instead of sending them
+type headerCapture struct {
+	header http.Header
+}
+
+func (c *headerCapture) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.header = req.Header.Clone()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
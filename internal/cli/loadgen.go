@@ -0,0 +1,209 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/time/rate"
+
+	"github.com/banzaicloud/log-socket/internal"
+	"github.com/banzaicloud/log-socket/log"
+)
+
+var loadgenLevels = []string{"debug", "info", "info", "info", "warning", "error"}
+
+// LoadgenOptions describe the synthetic records pushed to the ingest endpoint and how fast
+type LoadgenOptions struct {
+	// Addr is the base URL of the service's ingest endpoint, e.g. http://localhost:10000
+	Addr        string
+	BatchSize   int
+	Concurrency int
+	Containers  int
+	Duration    time.Duration
+	HMACKeyFile string
+	Pods        int
+	Rate        float64
+	Size        int
+}
+
+func (o *LoadgenOptions) AddFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&o.Addr, "ingest-addr", "http://localhost:10000", "base URL of the service's ingest endpoint")
+	flags.IntVar(&o.BatchSize, "batch-size", 100, "number of records pushed per request")
+	flags.IntVar(&o.Concurrency, "concurrency", 4, "number of concurrent ingest requests")
+	flags.IntVar(&o.Containers, "containers", 1, "number of distinct container names per pod")
+	flags.DurationVar(&o.Duration, "duration", 0, "how long records are generated (0 means until interrupted)")
+	flags.StringVar(&o.HMACKeyFile, "hmac-key-file", "", "file holding the shared key requests are signed with, for services started with --ingest-hmac-key-file")
+	flags.IntVar(&o.Pods, "pods", 10, "number of distinct pod names records are attributed to")
+	flags.Float64Var(&o.Rate, "rate", 1000, "number of records generated per second")
+	flags.IntVar(&o.Size, "size", 256, "approximate size of records in bytes")
+}
+
+func (o LoadgenOptions) Validate() error {
+	switch {
+	case o.Rate <= 0:
+		return errors.New("rate has to be positive")
+	case o.BatchSize <= 0 || o.Concurrency <= 0 || o.Pods <= 0 || o.Containers <= 0:
+		return errors.New("batch size, concurrency, pods and containers have to be positive")
+	case o.Size < 0:
+		return errors.New("size cannot be negative")
+	}
+	return nil
+}
+
+type loadgenStats struct {
+	records  uint64
+	bytes    uint64
+	requests uint64
+	failures uint64
+	latency  int64
+}
+
+// Loadgen pushes synthetic records of the flow through the ingest endpoint at the configured rate until the duration elapses or it is interrupted, then reports what was sent
+func Loadgen(ref string, opts LoadgenOptions, logs log.Sink) int {
+	flow, err := internal.ParseFlowReference(ref, "")
+	if err != nil {
+		log.Event(logs, "invalid flow reference", log.Error(err), log.Fields{"flow": ref})
+		return 1
+	}
+	var key []byte
+	if opts.HMACKeyFile != "" {
+		if key, err = os.ReadFile(opts.HMACKeyFile); err != nil {
+			log.Event(logs, "failed to read HMAC key file", log.Error(err))
+			return 1
+		}
+		key = bytes.TrimSpace(key)
+	}
+	endpoint := strings.TrimSuffix(opts.Addr, "/") + "/" + flow.URL()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if opts.Duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+
+	// a full batch is the burst, so batches are released as soon as the rate allows
+	limiter := rate.NewLimiter(rate.Limit(opts.Rate), opts.BatchSize)
+	gen := newRecordGenerator(flow.Namespace, opts)
+	client := &http.Client{Timeout: 30 * time.Second}
+	var stats loadgenStats
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if err := limiter.WaitN(ctx, opts.BatchSize); err != nil {
+					return
+				}
+				body := gen.batch(opts.BatchSize)
+				sent := time.Now()
+				if err := pushBatch(ctx, client, endpoint, body, key); err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					atomic.AddUint64(&stats.failures, 1)
+					log.Event(logs, "failed to push records", log.V(1), log.Error(err))
+					continue
+				}
+				atomic.AddInt64(&stats.latency, int64(time.Since(sent)))
+				atomic.AddUint64(&stats.requests, 1)
+				atomic.AddUint64(&stats.records, uint64(opts.BatchSize))
+				atomic.AddUint64(&stats.bytes, uint64(len(body)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	var avgLatency time.Duration
+	if stats.requests > 0 {
+		avgLatency = time.Duration(stats.latency / int64(stats.requests))
+	}
+	fmt.Fprintf(os.Stderr, "sent %d records (%d bytes) in %d requests in %s, %.1f records/s, %d failed requests, average request latency %s\n",
+		stats.records, stats.bytes, stats.requests, elapsed.Round(time.Millisecond), float64(stats.records)/elapsed.Seconds(), stats.failures, avgLatency.Round(time.Microsecond))
+	if stats.failures > 0 {
+		return 2
+	}
+	return 0
+}
+
+func pushBatch(ctx context.Context, client *http.Client, endpoint string, body []byte, key []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if len(key) > 0 {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(body)
+		req.Header.Set(internal.IngestSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ingest request failed with status %s", resp.Status)
+	}
+	return nil
+}
+
+// recordGenerator generates records shaped like those of fluentd's kubernetes metadata filter
+type recordGenerator struct {
+	namespace string
+	opts      LoadgenOptions
+	padding   string
+	seq       uint64
+}
+
+func newRecordGenerator(namespace string, opts LoadgenOptions) *recordGenerator {
+	g := &recordGenerator{namespace: namespace, opts: opts}
+	if sample := len(g.record(0)); sample < opts.Size {
+		g.padding = strings.Repeat("x", opts.Size-sample)
+	}
+	return g
+}
+
+func (g *recordGenerator) batch(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		buf.Write(g.record(atomic.AddUint64(&g.seq, 1)))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func (g *recordGenerator) record(seq uint64) []byte {
+	pod := seq % uint64(g.opts.Pods)
+	data, _ := json.Marshal(map[string]interface{}{
+		"kubernetes": map[string]interface{}{
+			"namespace_name": g.namespace,
+			"pod_name":       "loadgen-" + strconv.FormatUint(pod, 10),
+			"container_name": "container-" + strconv.FormatUint(seq/uint64(g.opts.Pods)%uint64(g.opts.Containers), 10),
+			"labels":         map[string]string{"app": "loadgen"},
+		},
+		"level":   loadgenLevels[seq%uint64(len(loadgenLevels))],
+		"message": "synthetic record " + strconv.FormatUint(seq, 10) + " " + g.padding,
+		"time":    time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	return data
+}
@@ -0,0 +1,198 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// ErrPickCanceled is returned by PickFlow if the user leaves the finder without choosing a flow
+var ErrPickCanceled = errors.New("no flow chosen")
+
+const pickerMaxRows = 10
+
+// CanPick reports whether flows can be picked interactively, which requires the standard input and error to be terminals
+func CanPick() bool {
+	return term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stderr.Fd()))
+}
+
+// PickFlow lists the flows the user may tail and lets them choose one with a fuzzy finder on the terminal, it returns the reference of the chosen flow
+func PickFlow(ctx context.Context, opts ConnectOptions, logs log.Sink) (string, error) {
+	flows, err := ListFlows(ctx, opts, logs)
+	if err != nil {
+		return "", err
+	}
+	if len(flows) == 0 {
+		return "", errors.New("there are no flows you may tail")
+	}
+	refs := make([]string, 0, len(flows))
+	for _, flow := range flows {
+		refs = append(refs, flow.Flow)
+	}
+	sort.Strings(refs)
+
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = term.Restore(fd, state) }()
+	rows := pickerMaxRows
+	if _, height, err := term.GetSize(fd); err == nil && height-1 < rows {
+		rows = height - 1
+	}
+	p := &picker{candidates: refs, rows: rows, out: os.Stderr}
+	return p.run(bufio.NewReader(os.Stdin))
+}
+
+// picker is a fuzzy finder drawn below the cursor, the query is matched against the candidates as a case-insensitive subsequence
+type picker struct {
+	candidates []string
+	matches    []string
+	query      []rune
+	rows       int
+	selected   int
+	out        io.Writer
+}
+
+func (p *picker) run(in io.RuneReader) (string, error) {
+	defer p.clear()
+	p.filter()
+	for {
+		p.draw()
+		r, _, err := in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			if len(p.matches) > 0 {
+				return p.matches[p.selected], nil
+			}
+		case 3, 4: // Ctrl-C, Ctrl-D
+			return "", ErrPickCanceled
+		case 27: // arrow keys are sent as escape sequences
+			if next, _, err := in.ReadRune(); err == nil && (next == '[' || next == 'O') {
+				if key, _, err := in.ReadRune(); err == nil {
+					switch key {
+					case 'A':
+						p.move(-1)
+					case 'B':
+						p.move(1)
+					}
+				}
+			}
+		case 16: // Ctrl-P
+			p.move(-1)
+		case 14: // Ctrl-N
+			p.move(1)
+		case 127, 8: // backspace
+			if len(p.query) > 0 {
+				p.query = p.query[:len(p.query)-1]
+				p.filter()
+			}
+		case 21: // Ctrl-U
+			p.query = p.query[:0]
+			p.filter()
+		default:
+			if unicode.IsPrint(r) {
+				p.query = append(p.query, r)
+				p.filter()
+			}
+		}
+	}
+}
+
+func (p *picker) move(delta int) {
+	if len(p.matches) == 0 {
+		return
+	}
+	p.selected = (p.selected + delta + len(p.matches)) % len(p.matches)
+}
+
+// filter selects the candidates matching the query, best matches first
+func (p *picker) filter() {
+	query := strings.ToLower(string(p.query))
+	type match struct {
+		candidate string
+		score     int
+	}
+	var matches []match
+	for _, candidate := range p.candidates {
+		if score, ok := fuzzyScore(strings.ToLower(candidate), query); ok {
+			matches = append(matches, match{candidate: candidate, score: score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score < matches[j].score
+	})
+	p.matches = p.matches[:0]
+	for _, m := range matches {
+		p.matches = append(p.matches, m.candidate)
+	}
+	p.selected = 0
+}
+
+// fuzzyScore reports whether the characters of the query appear in order in the candidate, with a lower score for closer matches and matches at the start of path segments
+func fuzzyScore(candidate, query string) (int, bool) {
+	score, pos := 0, 0
+	for _, r := range query {
+		i := strings.IndexRune(candidate[pos:], r)
+		if i < 0 {
+			return 0, false
+		}
+		score += i
+		if start := pos + i; start > 0 && !strings.ContainsRune("/-.", rune(candidate[start-1])) {
+			score++
+		}
+		pos += i + utf8.RuneLen(r)
+	}
+	return score, true
+}
+
+func (p *picker) draw() {
+	var b strings.Builder
+	b.WriteString("\r\x1b[J")
+	prompt := fmt.Sprintf("flow (%d/%d)> ", len(p.matches), len(p.candidates))
+	b.WriteString(prompt)
+	b.WriteString(string(p.query))
+
+	// the selected candidate is kept visible when there are more matches than rows
+	first := 0
+	if p.selected >= p.rows {
+		first = p.selected - p.rows + 1
+	}
+	drawn := 0
+	for i := first; i < len(p.matches) && i < first+p.rows; i++ {
+		b.WriteString("\r\n")
+		if i == p.selected {
+			b.WriteString(ansiReverse + "> " + p.matches[i] + ansiReset)
+		} else {
+			b.WriteString("  " + p.matches[i])
+		}
+		drawn++
+	}
+	if drawn > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", drawn)
+	}
+	b.WriteString("\r")
+	if col := utf8.RuneCountInString(prompt) + len(p.query); col > 0 {
+		fmt.Fprintf(&b, "\x1b[%dC", col)
+	}
+	fmt.Fprint(p.out, b.String())
+}
+
+func (p *picker) clear() {
+	fmt.Fprint(p.out, "\r\x1b[J")
+}
@@ -0,0 +1,212 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/banzaicloud/log-socket/internal"
+)
+
+const (
+	ansiReset   = "\x1b[0m"
+	ansiBold    = "\x1b[1m"
+	ansiDim     = "\x1b[2m"
+	ansiRed     = "\x1b[31m"
+	ansiGreen   = "\x1b[32m"
+	ansiYellow  = "\x1b[33m"
+	ansiBlue    = "\x1b[34m"
+	ansiMagenta = "\x1b[35m"
+	ansiCyan    = "\x1b[36m"
+	ansiReverse = "\x1b[7m"
+)
+
+// prefixColors are the colors pod and container names are told apart with, red is left to errors
+var prefixColors = []string{ansiCyan, ansiGreen, ansiYellow, ansiBlue, ansiMagenta, ansiBold + ansiCyan, ansiBold + ansiGreen, ansiBold + ansiYellow, ansiBold + ansiBlue, ansiBold + ansiMagenta}
+
+// prefixColor returns the color of a pod or container name, which stays the same across sessions
+func prefixColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return prefixColors[h.Sum32()%uint32(len(prefixColors))]
+}
+
+// useColors resolves the color flag, auto enables colors if stdout is a terminal
+func useColors(mode string) bool {
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	default:
+		if _, ok := os.LookupEnv("NO_COLOR"); ok {
+			return false
+		}
+		info, err := os.Stdout.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+}
+
+func levelColor(level string) string {
+	switch strings.ToLower(level) {
+	case "fatal", "panic", "crit", "critical", "alert", "emerg", "error", "err":
+		return ansiRed
+	case "warn", "warning":
+		return ansiYellow
+	case "info", "notice":
+		return ansiGreen
+	case "debug", "trace":
+		return ansiBlue
+	default:
+		return ""
+	}
+}
+
+// printer writes records and control messages received from the service
+type printer struct {
+	colors bool
+	// detectGaps enables reporting records missing from the sequence of a flow, which are only dropped records if no filter is set
+	detectGaps bool
+	// envelopes means that records are wrapped with their flow reference and sequence number
+	envelopes bool
+	// highlight matches the parts of messages that are emphasized
+	highlight *regexp.Regexp
+	// lastSequences holds the sequence number of the last record of each flow
+	lastSequences map[string]uint64
+	output        string
+	raw           bool
+	showFlow      bool
+	stdout        io.Writer
+	stderr        io.Writer
+	// timestamps prefixes records with the time they were produced, or received if unknown
+	timestamps bool
+}
+
+func (p *printer) control(data []byte, msg internal.ControlMessage) {
+	if p.raw {
+		fmt.Fprintln(p.stdout, strings.TrimSuffix(string(data), "\n"))
+		return
+	}
+	if msg.Control == internal.ControlStats {
+		fmt.Fprintln(p.stderr, p.colorize(ansiDim, fmt.Sprintf("--- %d records delivered, %d hidden by RBAC, %d filtered out, %d dropped due to slow link, %d queued, lag %s",
+			msg.RecordsDelivered, msg.RecordsRedacted, msg.RecordsFiltered, msg.RecordsDropped, msg.RecordsQueued, time.Duration(msg.LagMillis)*time.Millisecond)))
+		return
+	}
+	text := string(msg.Control)
+	if msg.Flow != "" {
+		text += " " + msg.Flow
+	}
+	if msg.Records > 0 {
+		text += fmt.Sprintf(" (%d records)", msg.Records)
+	}
+	if msg.Message != "" {
+		text += ": " + msg.Message
+	}
+	fmt.Fprintln(p.stderr, p.colorize(ansiDim, "--- "+text))
+}
+
+func (p *printer) record(data []byte) {
+	if p.raw {
+		fmt.Fprintln(p.stdout, strings.TrimSuffix(string(data), "\n"))
+		return
+	}
+
+	flow := ""
+	var ts time.Time
+	if p.envelopes {
+		var envelope struct {
+			Flow       string          `json:"flow"`
+			Sequence   uint64          `json:"sequence"`
+			Time       time.Time       `json:"time"`
+			ReceivedAt time.Time       `json:"receivedAt"`
+			Record     json.RawMessage `json:"record"`
+		}
+		if err := json.Unmarshal(data, &envelope); err == nil && envelope.Record != nil {
+			flow, data = envelope.Flow, envelope.Record
+			p.sequence(flow, envelope.Sequence)
+			if ts = envelope.Time; ts.IsZero() {
+				ts = envelope.ReceivedAt
+			}
+		}
+	}
+	if !p.showFlow {
+		flow = ""
+	}
+
+	if p.output == outputJSON {
+		fmt.Fprintln(p.stdout, strings.TrimSuffix(string(data), "\n"))
+		return
+	}
+
+	meta, err := internal.ParseRecordMeta(data)
+	if err != nil {
+		fmt.Fprintln(p.stdout, strings.TrimSuffix(string(data), "\n"))
+		return
+	}
+
+	var b strings.Builder
+	if p.timestamps {
+		if ts.IsZero() {
+			ts = meta.Timestamp
+		}
+		if !ts.IsZero() {
+			b.WriteString(p.colorize(ansiDim, ts.Local().Format("2006-01-02T15:04:05.000Z07:00")))
+			b.WriteByte(' ')
+		}
+	}
+	if flow != "" {
+		b.WriteString(p.colorize(ansiMagenta, "["+flow+"]"))
+		b.WriteByte(' ')
+	}
+	if meta.Pod != "" {
+		b.WriteString(p.colorize(prefixColor(meta.Pod), meta.Pod))
+		if meta.Container != "" {
+			b.WriteString(p.colorize(prefixColor(meta.Container), "/"+meta.Container))
+		}
+		b.WriteByte(' ')
+	}
+	if level := meta.Level; level != "" {
+		b.WriteString(p.colorize(ansiBold+levelColor(level), strings.ToUpper(level)))
+		b.WriteByte(' ')
+	}
+	b.WriteString(p.highlighted(strings.TrimRight(meta.Message, "\r\n")))
+	fmt.Fprintln(p.stdout, b.String())
+}
+
+// highlighted emphasizes the matches of the highlight expression in the message
+func (p *printer) highlighted(message string) string {
+	if p.highlight == nil || !p.colors {
+		return message
+	}
+	return p.highlight.ReplaceAllStringFunc(message, func(match string) string {
+		return p.colorize(ansiBold+ansiReverse, match)
+	})
+}
+
+// sequence reports the records missing between the last and the current record of the flow
+func (p *printer) sequence(flow string, seq uint64) {
+	if seq == 0 {
+		return
+	}
+	if p.lastSequences == nil {
+		p.lastSequences = make(map[string]uint64)
+	}
+	last := p.lastSequences[flow]
+	p.lastSequences[flow] = seq
+	// sequence numbers start over when the service restarts
+	if p.detectGaps && last > 0 && seq > last+1 {
+		fmt.Fprintln(p.stderr, p.colorize(ansiYellow, fmt.Sprintf("--- %d records of %s were dropped", seq-last-1, flow)))
+	}
+}
+
+func (p *printer) colorize(color string, s string) string {
+	if !p.colors || color == "" {
+		return s
+	}
+	return color + s + ansiReset
+}
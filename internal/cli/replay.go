@@ -0,0 +1,214 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/banzaicloud/log-socket/internal"
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// ReplayOptions describe where captured records are replayed and how fast
+type ReplayOptions struct {
+	// Addr is the base URL of the service's ingest endpoint, e.g. http://localhost:10000
+	Addr        string
+	BatchSize   int
+	HMACKeyFile string
+	// Speed is the factor the original pace of records is replayed at according to their timestamps, 0 means as fast as possible
+	Speed float64
+}
+
+func (o *ReplayOptions) AddFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&o.Addr, "ingest-addr", "http://localhost:10000", "base URL of the service's ingest endpoint")
+	flags.IntVar(&o.BatchSize, "batch-size", 100, "maximum number of records pushed per request")
+	flags.StringVar(&o.HMACKeyFile, "hmac-key-file", "", "file holding the shared key requests are signed with, for services started with --ingest-hmac-key-file")
+	flags.Float64Var(&o.Speed, "speed", 0, "replay records at this multiple of their original pace according to their timestamps, e.g. 1 for real time or 10 for ten times faster (0 means as fast as possible)")
+}
+
+func (o ReplayOptions) Validate() error {
+	switch {
+	case o.BatchSize <= 0:
+		return errors.New("batch size has to be positive")
+	case o.Speed < 0:
+		return errors.New("speed cannot be negative")
+	}
+	return nil
+}
+
+type replayStats struct {
+	records  uint64
+	bytes    uint64
+	requests uint64
+	failures uint64
+	skipped  uint64
+}
+
+// Replay pushes the NDJSON records read from the files, or the standard input if there are none or the file is -, through the ingest endpoint as records of the flow, then reports what was sent
+// Records captured with envelopes, e.g. by tail --raw, are unwrapped, and lines that are not JSON are skipped
+func Replay(ref string, files []string, opts ReplayOptions, logs log.Sink) int {
+	flow, err := internal.ParseFlowReference(ref, "")
+	if err != nil {
+		log.Event(logs, "invalid flow reference", log.Error(err), log.Fields{"flow": ref})
+		return 1
+	}
+	var key []byte
+	if opts.HMACKeyFile != "" {
+		if key, err = os.ReadFile(opts.HMACKeyFile); err != nil {
+			log.Event(logs, "failed to read HMAC key file", log.Error(err))
+			return 1
+		}
+		key = bytes.TrimSpace(key)
+	}
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	r := &replayer{
+		client:   &http.Client{Timeout: 30 * time.Second},
+		endpoint: strings.TrimSuffix(opts.Addr, "/") + "/" + flow.URL(),
+		key:      key,
+		logs:     logs,
+		opts:     opts,
+		start:    time.Now(),
+	}
+	for _, file := range files {
+		if err := r.replayFile(ctx, file); err != nil {
+			if ctx.Err() == nil {
+				log.Event(logs, "failed to read records", log.Error(err), log.Fields{"file": file})
+				return 1
+			}
+			break
+		}
+	}
+	if ctx.Err() == nil {
+		r.flush(ctx)
+	}
+
+	elapsed := time.Since(r.start)
+	fmt.Fprintf(os.Stderr, "replayed %d records (%d bytes) in %d requests in %s, %d lines skipped, %d failed requests\n",
+		r.stats.records, r.stats.bytes, r.stats.requests, elapsed.Round(time.Millisecond), r.stats.skipped, r.stats.failures)
+	if r.stats.failures > 0 {
+		return 2
+	}
+	return 0
+}
+
+// replayer batches records in the order they are read, pacing them if a speed is set
+type replayer struct {
+	client   *http.Client
+	endpoint string
+	key      []byte
+	logs     log.Sink
+	opts     ReplayOptions
+	start    time.Time
+	// first is the timestamp of the first replayed record, the pace of the following ones is relative to it
+	first time.Time
+	batch bytes.Buffer
+	count int
+	stats replayStats
+}
+
+func (r *replayer) replayFile(ctx context.Context, file string) error {
+	in := io.Reader(os.Stdin)
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	reader := bufio.NewReader(in)
+	for ctx.Err() == nil {
+		line, err := reader.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			r.add(ctx, line)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (r *replayer) add(ctx context.Context, line []byte) {
+	record, ok := replayRecord(line)
+	if !ok {
+		r.stats.skipped++
+		log.Event(r.logs, "skipping line that is not a JSON record", log.V(1), log.Fields{"line": string(line)})
+		return
+	}
+	if r.opts.Speed > 0 {
+		if meta, err := internal.ParseRecordMeta(record); err == nil && !meta.Timestamp.IsZero() {
+			if r.first.IsZero() {
+				r.first = meta.Timestamp
+			}
+			due := r.start.Add(time.Duration(float64(meta.Timestamp.Sub(r.first)) / r.opts.Speed))
+			if wait := time.Until(due); wait > 0 {
+				r.flush(ctx)
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+	r.batch.Write(record)
+	r.batch.WriteByte('\n')
+	if r.count++; r.count >= r.opts.BatchSize {
+		r.flush(ctx)
+	}
+}
+
+func (r *replayer) flush(ctx context.Context) {
+	if r.count == 0 {
+		return
+	}
+	body := r.batch.Bytes()
+	if err := pushBatch(ctx, r.client, r.endpoint, body, r.key); err != nil {
+		if ctx.Err() == nil {
+			r.stats.failures++
+			log.Event(r.logs, "failed to push records", log.Error(err), log.Fields{"records": r.count})
+		}
+	} else {
+		r.stats.requests++
+		r.stats.records += uint64(r.count)
+		r.stats.bytes += uint64(len(body))
+	}
+	r.batch.Reset()
+	r.count = 0
+}
+
+// replayRecord returns the record of a captured line, unwrapping it from its envelope if it has one
+func replayRecord(line []byte) ([]byte, bool) {
+	var envelope struct {
+		Flow   string          `json:"flow"`
+		Record json.RawMessage `json:"record"`
+	}
+	if err := json.Unmarshal(line, &envelope); err != nil {
+		return nil, false
+	}
+	if envelope.Flow != "" && len(envelope.Record) > 0 && envelope.Record[0] == '{' {
+		return envelope.Record, true
+	}
+	return line, true
+}
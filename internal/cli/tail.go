@@ -0,0 +1,285 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/pflag"
+
+	"github.com/banzaicloud/log-socket/internal"
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	outputJSON   = "json"
+	outputPretty = "pretty"
+)
+
+// TailOptions select the records to stream and how they are printed
+type TailOptions struct {
+	Color           string
+	ContainerFilter string
+	Duration        time.Duration
+	Follow          bool
+	Highlight       string
+	LevelFilter     string
+	MinLevel        string
+	Output          string
+	OutputFile      string
+	OutputRotation  captureFileOptions
+	PodFilter       string
+	Raw             bool
+	Sample          string
+	Select          string
+	Since           string
+	Stats           time.Duration
+	Subscription    string
+	Tail            int
+	Template        string
+	Timestamps      bool
+}
+
+func (o *TailOptions) AddFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&o.Color, "color", "auto", "when to colorize output (auto, always or never)")
+	flags.StringVar(&o.ContainerFilter, "container", "", "only stream records from containers with names matching this regular expression")
+	flags.DurationVar(&o.Duration, "duration", 0, "how long the session lasts before the service closes it (defaults to the service's session duration), you are asked whether to renew it once it expires")
+	flags.BoolVarP(&o.Follow, "follow", "f", false, "keep streaming live records after the retained ones")
+	flags.StringVar(&o.Highlight, "highlight", "", "emphasize the parts of messages matching this regular expression (e.g. ERROR), if output is colorized")
+	flags.StringVar(&o.LevelFilter, "level", "", "only stream records with levels matching this regular expression")
+	flags.StringVar(&o.MinLevel, "min-level", "", "only stream records of at least this severity (trace, debug, info, warn, error or fatal), whatever the format of their level")
+	flags.StringVarP(&o.Output, "output", "o", outputPretty, "how records are printed (pretty or json)")
+	flags.StringVar(&o.OutputFile, "output-file", "", "append records to this file instead of printing them, control messages are still printed on the standard error")
+	flags.Int64Var(&o.OutputRotation.MaxSize, "output-max-size", 0, "number of bytes after which the output file is rotated by appending the time of rotation to its name (0 means no limit)")
+	flags.DurationVar(&o.OutputRotation.MaxAge, "output-max-age", 0, "time after which the output file is rotated at the next record, regardless of its size (0 means no limit)")
+	flags.IntVar(&o.OutputRotation.MaxFiles, "output-max-files", 0, "number of rotated output files kept, the oldest ones are removed (0 means all of them)")
+	flags.BoolVar(&o.OutputRotation.Compress, "output-compress", false, "compress rotated output files with gzip")
+	flags.StringVar(&o.PodFilter, "pod", "", "only stream records from pods with names matching this regular expression")
+	flags.BoolVar(&o.Raw, "raw", false, "print frames exactly as received from the service")
+	flags.StringVar(&o.Sample, "sample", "", "only receive a sample of the records apart from errors, a probability of receiving each record (e.g. 0.1) or one in N records (e.g. 1/10)")
+	flags.StringVar(&o.Select, "select", "", "only receive these fields of records, as comma-separated jq-like paths optionally preceded by a field name (e.g. .message,pod=.kubernetes.pod_name)")
+	flags.StringVar(&o.Since, "since", "", "only print retained records received within this duration (e.g. 5m) or after this RFC 3339 timestamp")
+	flags.DurationVar(&o.Stats, "stats", 0, "print statistics of the records delivered, hidden by RBAC and dropped at this interval (e.g. 30s)")
+	flags.StringVar(&o.Subscription, "subscription", "", "print the records captured by this persistent subscription of the flow since it was created, instead of the retained ones")
+	flags.IntVar(&o.Tail, "tail", -1, "number of the most recent retained records to print (-1 means all)")
+	flags.StringVar(&o.Template, "template", "", "Go template the service renders each record with, e.g. '{{.kubernetes.pod_name}} {{.message}}', rendered records are printed as they are")
+	flags.BoolVar(&o.Timestamps, "timestamps", false, "prefix records with the time they were produced, or received by the service if unknown")
+}
+
+func (o TailOptions) Validate() error {
+	if o.Output != outputPretty && o.Output != outputJSON {
+		return fmt.Errorf("unsupported output %q", o.Output)
+	}
+	if _, err := regexp.Compile(o.Highlight); err != nil {
+		return fmt.Errorf("invalid highlight expression: %w", err)
+	}
+	switch rotation := o.OutputRotation; {
+	case rotation.MaxSize < 0 || rotation.MaxAge < 0 || rotation.MaxFiles < 0:
+		return errors.New("output file rotation limits cannot be negative")
+	case o.OutputFile == "" && rotation != captureFileOptions{}:
+		return errors.New("output file rotation requires an output file")
+	}
+	return nil
+}
+
+func (o TailOptions) query() url.Values {
+	query := make(url.Values)
+	for name, value := range map[string]string{
+		internal.FilterParamContainerRegex: o.ContainerFilter,
+		internal.FilterParamLevel:          o.LevelFilter,
+		internal.FilterParamMinLevel:       o.MinLevel,
+		internal.FilterParamPodRegex:       o.PodFilter,
+		internal.ReplayParamSince:          o.Since,
+		internal.SampleParam:               o.Sample,
+		internal.SelectParam:               o.Select,
+		internal.SubscriptionParam:         o.Subscription,
+		internal.TemplateParam:             o.Template,
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if o.Duration > 0 {
+		query.Set(internal.DurationParam, o.Duration.String())
+	}
+	if o.Stats > 0 {
+		query.Set(internal.StatsParam, o.Stats.String())
+	}
+	switch {
+	case o.Tail >= 0:
+		query.Set(internal.ReplayParamTail, strconv.Itoa(o.Tail))
+	case o.Since == "":
+		query.Set(internal.ReplayParamTail, strconv.Itoa(math.MaxInt32))
+	}
+	return query
+}
+
+// Tail streams the records of the referenced flows and prints them until interrupted, it returns the exit code of the command
+func Tail(refs []string, conn ConnectOptions, opts TailOptions, logs log.Sink) int {
+	path := "/" + strings.Join(refs, ",")
+	query := opts.query()
+	if opts.Template != "" {
+		// rendered records are not JSON, so they are printed like raw frames
+		opts.Raw = true
+	}
+	if !opts.Raw {
+		// multiplexed streams carry the sequence numbers of records, which reveal dropped records
+		query.Set(internal.MultiplexParam, "true")
+	}
+	stdout, colors := io.Writer(os.Stdout), useColors(opts.Color)
+	if opts.OutputFile != "" {
+		file, err := openCaptureFile(opts.OutputFile, opts.OutputRotation, logs)
+		if err != nil {
+			log.Event(logs, "failed to open output file", log.Error(err), log.Fields{"file": opts.OutputFile})
+			return 1
+		}
+		defer func() {
+			if err := file.Close(); err != nil {
+				log.Event(logs, "failed to close output file", log.Error(err), log.Fields{"file": opts.OutputFile})
+			}
+		}()
+		stdout, colors = file, opts.Color == "always"
+	}
+	var highlight *regexp.Regexp
+	if opts.Highlight != "" {
+		highlight = regexp.MustCompile(opts.Highlight)
+	}
+	p := &printer{
+		colors:     colors,
+		detectGaps: opts.ContainerFilter == "" && opts.LevelFilter == "" && opts.MinLevel == "" && opts.PodFilter == "" && opts.Sample == "",
+		envelopes:  len(refs) > 1 || !opts.Raw,
+		highlight:  highlight,
+		output:     opts.Output,
+		raw:        opts.Raw,
+		showFlow:   len(refs) > 1,
+		stdout:     stdout,
+		stderr:     os.Stderr,
+		timestamps: opts.Timestamps,
+	}
+	for {
+		code, expired := tailSession(path, query, conn, opts, p, logs)
+		if !expired || !promptRenewal(os.Stdin, os.Stderr) {
+			return code
+		}
+		query = resumeQuery(query, p, len(refs) == 1, time.Now())
+	}
+}
+
+// tailSession prints the records of a connection until it is closed, it reports whether it was closed because the session expired
+func tailSession(path string, query url.Values, conn ConnectOptions, opts TailOptions, p *printer, logs log.Sink) (int, bool) {
+	wsConn, err := Dial(context.Background(), path, query, conn, logs)
+	if err != nil {
+		log.Event(logs, "failed to open websocket connection", log.Error(err), log.Fields{"path": path})
+		return 2, false
+	}
+	defer wsConn.Close()
+
+	log.Event(logs, "successfully connected to service", log.V(1), log.Fields{"addr": wsConn.UnderlyingConn().RemoteAddr()})
+
+	exitCode := make(chan int, 1)
+	expired := make(chan struct{})
+	go func() {
+		for {
+			msgTyp, data, err := wsConn.ReadMessage()
+			if err != nil {
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) {
+					log.Event(logs, "connection closed by service", log.Fields{"code": closeErr.Code, "reason": closeErr.Text})
+					if closeErr.Code == websocket.CloseNormalClosure || closeErr.Code == websocket.CloseGoingAway {
+						exitCode <- 0
+						return
+					}
+					if closeErr.Code == internal.CloseSessionExpired {
+						close(expired)
+						return
+					}
+					exitCode <- 3
+					return
+				}
+				log.Event(logs, "failed to read from websocket connection", log.Error(err))
+				exitCode <- 2
+				return
+			}
+			log.Event(logs, "new frame", log.V(2), log.Fields{"data": data})
+			if msgTyp == websocket.TextMessage {
+				var msg internal.ControlMessage
+				if json.Unmarshal(data, &msg) == nil && msg.Control != "" {
+					p.control(data, msg)
+					if msg.Control == internal.ControlReplayed && !opts.Follow {
+						exitCode <- 0
+						return
+					}
+					continue
+				}
+			}
+			p.record(data)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+
+	select {
+	case code := <-exitCode:
+		closeConn(wsConn, websocket.CloseNormalClosure, "", logs)
+		return code, false
+	case <-expired:
+		return 3, true
+	case sig := <-signals:
+		log.Event(logs, "received signal", log.V(1), log.Fields{"signal": sig})
+		closeConn(wsConn, websocket.CloseGoingAway, sig.String(), logs)
+		return 0, false
+	}
+}
+
+// resumeQuery returns the query of a connection resuming the stream where it ended at the time, after the last record of a single flow if its sequence number is known
+func resumeQuery(query url.Values, p *printer, singleFlow bool, ended time.Time) url.Values {
+	res := make(url.Values, len(query))
+	for name, values := range query {
+		res[name] = values
+	}
+	res.Del(internal.ReplayParamTail)
+	res.Del(internal.ReplayParamSince)
+	res.Del(internal.ReplayParamAfter)
+	res.Del(internal.ReplayParamLastSequence)
+	if singleFlow && len(p.lastSequences) == 1 {
+		// the service reports the records that were not retained until the reconnection with a gap message
+		for _, seq := range p.lastSequences {
+			res.Set(internal.ReplayParamLastSequence, strconv.FormatUint(seq, 10))
+		}
+	} else {
+		res.Set(internal.ReplayParamSince, ended.Format(time.RFC3339))
+	}
+	return res
+}
+
+// promptRenewal asks whether to start a new session if the input is a terminal
+func promptRenewal(in *os.File, out io.Writer) bool {
+	if info, err := in.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	fmt.Fprint(out, "Session expired, renew it? [y/N] ")
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func closeConn(wsConn *websocket.Conn, code int, reason string, logs log.Sink) {
+	deadline := time.Now().Add(5 * time.Second)
+	if err := wsConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline); err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+		log.Event(logs, "an error occurred while writing close message to websocket", log.V(1), log.Error(err))
+	}
+}
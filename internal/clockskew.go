@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// ClockSkewPolicy determines what happens to records the timestamp of which is too far from the time they were received
+type ClockSkewPolicy string
+
+const (
+	// ClockSkewFlag marks skewed records, keeping their timestamp
+	ClockSkewFlag ClockSkewPolicy = "flag"
+	// ClockSkewNormalize marks skewed records and replaces their event time with the time they were received
+	ClockSkewNormalize ClockSkewPolicy = "normalize"
+)
+
+func ParseClockSkewPolicy(s string) (ClockSkewPolicy, error) {
+	switch p := ClockSkewPolicy(s); p {
+	case ClockSkewFlag, ClockSkewNormalize:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid clock skew policy %q", s)
+	}
+}
+
+type ClockSkewMetrics interface {
+	LogRecordClockSkewed(r Record, policy ClockSkewPolicy)
+}
+
+// CheckClockSkew returns a sink applying the policy to records whose timestamp is more than maxSkew before or after the time they were received, before pushing them to records
+// Records without a timestamp are pushed as they are
+func CheckClockSkew(records RecordSink, maxSkew time.Duration, policy ClockSkewPolicy, logs log.Sink, metrics ClockSkewMetrics) RecordSink {
+	return clockSkewChecker{
+		logs:    logs,
+		maxSkew: maxSkew,
+		metrics: metrics,
+		policy:  policy,
+		records: records,
+	}
+}
+
+type clockSkewChecker struct {
+	logs    log.Sink
+	maxSkew time.Duration
+	metrics ClockSkewMetrics
+	policy  ClockSkewPolicy
+	records RecordSink
+}
+
+func (c clockSkewChecker) Push(r Record) {
+	if r.Meta.Timestamp.IsZero() || r.ReceivedAt.IsZero() {
+		c.records.Push(r)
+		return
+	}
+	skew := r.Meta.Timestamp.Sub(r.ReceivedAt)
+	if skew <= c.maxSkew && skew >= -c.maxSkew {
+		c.records.Push(r)
+		return
+	}
+	log.Event(c.logs, "received record with skewed timestamp", log.V(2), log.Fields{"flow": r.Flow, "timestamp": r.Meta.Timestamp, "receivedAt": r.ReceivedAt, "maxSkew": c.maxSkew})
+	c.metrics.LogRecordClockSkewed(r, c.policy)
+	r.ClockSkewed = true
+	if c.policy == ClockSkewNormalize {
+		r.EventTime = r.ReceivedAt
+	}
+	c.records.Push(r)
+}
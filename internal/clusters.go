@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	authv1 "k8s.io/api/authentication/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// ClusterPathPrefix precedes the name of a remote cluster in the paths of the requests the aggregator forwards to it, e.g. /cluster/east/flow/default/flow1
+const ClusterPathPrefix = "/cluster/"
+
+// RemoteClusterSpec describes an instance of the service in another cluster whose flows the aggregator re-exposes
+type RemoteClusterSpec struct {
+	Name string `json:"name"`
+	// URL is the base URL of the listener address of the remote instance, e.g. https://log-socket.east.example.com
+	URL string `json:"url"`
+	// TokenFile holds the token the aggregator authenticates with, it is read for each request so that it can be rotated
+	TokenFile string `json:"tokenFile"`
+	// CAFile holds the CA bundle the certificate of the remote instance is verified with, the system roots are used if empty
+	CAFile string `json:"caFile,omitempty"`
+	// Groups restricts the cluster to the members of these groups, any authenticated user may reach it if empty
+	Groups []string `json:"groups,omitempty"`
+}
+
+// RemoteClusters forward the listener requests of the aggregator to instances of the service in other clusters
+// Requests are authenticated by the aggregator and forwarded with its own token, impersonating the user, so that the remote instance authorizes access to its flows as usual
+type RemoteClusters map[string]*remoteCluster
+
+type remoteCluster struct {
+	spec   RemoteClusterSpec
+	target *url.URL
+	proxy  *httputil.ReverseProxy
+}
+
+// LoadRemoteClusters reads a YAML or JSON file holding a list of remote clusters
+func LoadRemoteClusters(fileName string, logs log.Sink) (RemoteClusters, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var specs []RemoteClusterSpec
+	if err := yaml.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("failed to parse clusters file %s: %w", fileName, err)
+	}
+	res := make(RemoteClusters, len(specs))
+	for _, spec := range specs {
+		if spec.Name == "" || strings.Contains(spec.Name, "/") {
+			return nil, fmt.Errorf("clusters file %s has a cluster with an invalid name %q", fileName, spec.Name)
+		}
+		if _, ok := res[spec.Name]; ok {
+			return nil, fmt.Errorf("clusters file %s lists cluster %s more than once", fileName, spec.Name)
+		}
+		if spec.TokenFile == "" {
+			return nil, fmt.Errorf("cluster %s has no token file", spec.Name)
+		}
+		cluster, err := newRemoteCluster(spec, logs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster %s: %w", spec.Name, err)
+		}
+		res[spec.Name] = cluster
+	}
+	return res, nil
+}
+
+func newRemoteCluster(spec RemoteClusterSpec, logs log.Sink) (*remoteCluster, error) {
+	target, err := url.Parse(spec.URL)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" || target.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q, expected an http or https URL", spec.URL)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if spec.CAFile != "" {
+		pem, err := os.ReadFile(spec.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", spec.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	}
+	logs = log.WithFields(logs, log.Fields{"cluster": spec.Name})
+	return &remoteCluster{
+		spec:   spec,
+		target: target,
+		proxy: &httputil.ReverseProxy{
+			// the request is rewritten by forward
+			Director:  func(*http.Request) {},
+			Transport: transport,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Event(logs, "failed to forward listener to remote cluster", log.Error(err))
+				http.Error(w, fmt.Sprintf("failed to reach cluster %s: %s", spec.Name, err), http.StatusBadGateway)
+			},
+		},
+	}, nil
+}
+
+// allows reports whether the user may reach the cluster
+func (c *remoteCluster) allows(user authv1.UserInfo) bool {
+	if len(c.spec.Groups) == 0 {
+		return true
+	}
+	for _, group := range user.Groups {
+		for _, allowed := range c.spec.Groups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forward sends the request to the remote instance at the path, replacing the credentials of the user with the token of the aggregator impersonating them
+func (c *remoteCluster) forward(w http.ResponseWriter, r *http.Request, urlPath string, user authv1.UserInfo) error {
+	token, err := os.ReadFile(c.spec.TokenFile)
+	if err != nil {
+		return err
+	}
+	req := r.Clone(r.Context())
+	query := req.URL.Query()
+	query.Del(TokenQueryParam)
+	query.Del(TicketParam)
+	req.URL = &url.URL{
+		Scheme:   c.target.Scheme,
+		Host:     c.target.Host,
+		Path:     path.Join("/", c.target.Path, urlPath),
+		RawQuery: query.Encode(),
+	}
+	req.Host = c.target.Host
+	req.RequestURI = ""
+
+	h := req.Header
+	// the origin has been checked by the aggregator, and would not match the address of the remote instance
+	h.Del("Origin")
+	h.Del(AuthHeaderKey)
+	var protocols []string
+	for _, value := range h.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" && !strings.HasPrefix(protocol, TokenSubprotocolPrefix) {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	h.Del("Sec-WebSocket-Protocol")
+	if len(protocols) > 0 {
+		h.Set("Sec-WebSocket-Protocol", strings.Join(protocols, ", "))
+	}
+	for name := range h {
+		if strings.HasPrefix(name, "Impersonate-") {
+			h.Del(name)
+		}
+	}
+	h.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	h.Set(ImpersonateUserHeader, user.Username)
+	for _, group := range user.Groups {
+		h.Add(ImpersonateGroupHeader, group)
+	}
+	if user.UID != "" {
+		h.Set(ImpersonateUIDHeader, user.UID)
+	}
+	for key, values := range user.Extra {
+		for _, value := range values {
+			h.Add(ImpersonateExtraHeaderPrefix+url.PathEscape(key), value)
+		}
+	}
+	c.proxy.ServeHTTP(w, req)
+	return nil
+}
+
+// serveClusters forwards requests under ClusterPathPrefix, event streams included, to the remote clusters, it reports whether the request was handled
+func serveClusters(w http.ResponseWriter, r *http.Request, clusters RemoteClusters, authenticator Authenticator, tenancy Tenancy, logs log.Sink) bool {
+	if len(clusters) == 0 {
+		return false
+	}
+	urlPath, prefix := r.URL.Path, "/"
+	if isSSERequest(r) {
+		urlPath, prefix = "/"+strings.TrimPrefix(urlPath, SSEPathPrefix), SSEPathPrefix
+	}
+	if !strings.HasPrefix(urlPath, ClusterPathPrefix) {
+		return false
+	}
+	name, rest, _ := strings.Cut(strings.TrimPrefix(urlPath, ClusterPathPrefix), "/")
+	cluster := clusters[name]
+	if cluster == nil {
+		http.Error(w, fmt.Sprintf("cluster %s not found", name), http.StatusNotFound)
+		return true
+	}
+
+	usrInfo, _, ok := authenticateRequest(w, r, authenticator, tenancy, logs)
+	if !ok {
+		return true
+	}
+	if !cluster.allows(usrInfo) {
+		log.Event(logs, "user may not reach remote cluster", log.V(1), log.Fields{"user": usrInfo.Username, "cluster": name})
+		http.Error(w, fmt.Sprintf("permission denied to reach cluster %s", name), http.StatusForbidden)
+		return true
+	}
+	log.Event(logs, "forwarding listener to remote cluster", log.V(1), log.Fields{"user": usrInfo.Username, "cluster": name, "path": rest})
+	if err := cluster.forward(w, r, prefix+rest, usrInfo); err != nil {
+		log.Event(logs, "failed to read token of remote cluster", log.Error(err), log.Fields{"cluster": name})
+		http.Error(w, fmt.Sprintf("failed to reach cluster %s", name), http.StatusInternalServerError)
+	}
+	return true
+}
@@ -1,19 +1,28 @@
 package internal
 
 import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"path"
+	"strings"
 	"sync"
+	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	authv1 "k8s.io/api/authentication/v1"
 	"k8s.io/apimachinery/pkg/types"
 )
 
 const (
-	FKClusterFlow FlowKind = "clusterflow"
-	FKFlow        FlowKind = "flow"
-
-	RegisterListener listenerEventType = iota
-	UnregisterListener
+	FKClusterFlow   FlowKind = "clusterflow"
+	FKFlow          FlowKind = "flow"
+	FKClusterOutput FlowKind = "clusteroutput"
+	FKOutput        FlowKind = "output"
+	// FKSelector references are the flows of label selectors, see LabelSelector
+	FKSelector FlowKind = "selector"
 
 	AuthHeaderKey = "X-Authorization"
 )
@@ -24,14 +33,114 @@ var (
 )
 
 type Record struct {
+	// RawData is shared by the listeners of the record and must not be modified once the record is ingested
 	RawData []byte
-	Data    struct {
+	// Meta is parsed from RawData when the record is ingested
+	Meta RecordMeta
+	Flow FlowReference
+	// ReceivedAt is the time the record was ingested
+	ReceivedAt time.Time
+	// Sequence is the position of the record in its flow, assigned before fan-out
+	Sequence uint64
+	// EventTime replaces the timestamp of the record if its clock skew was normalized, see CheckClockSkew
+	EventTime time.Time
+	// ClockSkewed tells that the record's timestamp was further from ReceivedAt than the maximum clock skew
+	ClockSkewed bool
+	// frames caches the encodings of the record across listeners, it is reset whenever the data is changed for a listener
+	frames *encodedFrames
+	// trace is the span context of the latest step of handling the record, valid only if the record is traced
+	trace trace.SpanContext
+}
+
+// Message returns the log line of the record
+func (r Record) Message() string {
+	return r.Meta.Message
+}
+
+// Time returns the time the record was produced, zero if unknown
+func (r Record) Time() time.Time {
+	if !r.EventTime.IsZero() {
+		return r.EventTime
+	}
+	return r.Meta.Timestamp
+}
+
+// RecordMeta holds the fields of a record used for routing, authorization and filtering, so that they don't have to be looked up in the record's data for each listener
+type RecordMeta struct {
+	Namespace string
+	Pod       string
+	Container string
+	Labels    map[string]string
+	Level     string
+	// Severity is normalized from the level, severity or pri field of the record when it is ingested
+	Severity Severity
+	// Message is the message field of the record, or its log field if it has no message
+	Message string
+	// Timestamp is the time the record was produced according to its time or @timestamp field, zero if unknown
+	Timestamp time.Time
+}
+
+// ParseRecordMeta parses the metadata of a JSON record shipped by fluentd with Kubernetes metadata
+func ParseRecordMeta(data []byte) (res RecordMeta, err error) {
+	var rec struct {
 		Kubernetes struct {
-			Labels  map[string]string `json:"labels"`
-			PodName string            `json:"pod_name"`
+			ContainerName string            `json:"container_name"`
+			Labels        map[string]string `json:"labels"`
+			NamespaceName string            `json:"namespace_name"`
+			PodName       string            `json:"pod_name"`
 		} `json:"kubernetes"`
+		Level     json.RawMessage `json:"level"`
+		Log       string          `json:"log"`
+		Message   string          `json:"message"`
+		Pri       json.RawMessage `json:"pri"`
+		Severity  json.RawMessage `json:"severity"`
+		Time      json.RawMessage `json:"time"`
+		Timestamp json.RawMessage `json:"@timestamp"`
 	}
-	Flow FlowReference
+	if err = json.Unmarshal(data, &rec); err != nil {
+		return
+	}
+	res = RecordMeta{
+		Namespace: rec.Kubernetes.NamespaceName,
+		Pod:       rec.Kubernetes.PodName,
+		Container: rec.Kubernetes.ContainerName,
+		Labels:    rec.Kubernetes.Labels,
+		Level:     jsonText(rec.Level),
+		Message:   rec.Message,
+	}
+	res.Severity = deriveSeverity(res.Level, rec.Severity, rec.Pri)
+	if res.Message == "" {
+		res.Message = rec.Log
+	}
+	for _, ts := range []json.RawMessage{rec.Time, rec.Timestamp} {
+		if t, ok := parseRecordTime(ts); ok {
+			res.Timestamp = t
+			break
+		}
+	}
+	return res, nil
+}
+
+// recordTimeLayouts are the layouts of the string timestamps of records, RFC 3339 and fluentd's default time format
+var recordTimeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999 -0700", "2006-01-02T15:04:05.999999999-0700"}
+
+// parseRecordTime parses a timestamp of a record, which is a string in one of recordTimeLayouts or a number of seconds since the Unix epoch
+func parseRecordTime(data json.RawMessage) (time.Time, bool) {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		for _, layout := range recordTimeLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, true
+			}
+		}
+		return time.Time{}, false
+	}
+	var secs float64
+	if err := json.Unmarshal(data, &secs); err == nil && secs > 0 {
+		whole, frac := math.Modf(secs)
+		return time.Unix(int64(whole), int64(frac*1e9)).UTC(), true
+	}
+	return time.Time{}, false
 }
 
 type RecordSink interface {
@@ -113,6 +222,29 @@ type ReconcileEventChannel chan ReconcileEvent
 
 type FlowKind string
 
+var FlowKinds = []FlowKind{FKClusterFlow, FKFlow, FKClusterOutput, FKOutput, FKSelector}
+
+func ParseFlowKind(s string) (FlowKind, error) {
+	if k := FlowKind(s); hasItem(FlowKinds, k) {
+		return k, nil
+	}
+	kinds := make([]string, len(FlowKinds))
+	for i, k := range FlowKinds {
+		kinds[i] = string(k)
+	}
+	return "", fmt.Errorf("invalid flow kind %q, must be one of: %s", s, strings.Join(kinds, ", "))
+}
+
+// IsClusterScoped returns whether resources of this kind are addressable without a namespace
+func (k FlowKind) IsClusterScoped() bool {
+	return k == FKClusterFlow || k == FKClusterOutput
+}
+
+// IsOutput returns whether references of this kind are outputs, the listeners of which receive the records of the flows routing to them
+func (k FlowKind) IsOutput() bool {
+	return k == FKOutput || k == FKClusterOutput
+}
+
 type FlowReference struct {
 	types.NamespacedName
 	Kind FlowKind
@@ -122,33 +254,62 @@ func (f FlowReference) URL() string {
 	return path.Join(string(f.Kind), f.Namespace, f.Name)
 }
 
+// ParseFlowReference parses a flow reference from a URL path of the form kind/namespace/name
+// For cluster-scoped kinds the namespace segment can be omitted, in which case defaultNamespace is used if not empty
+func ParseFlowReference(urlPath string, defaultNamespace string) (res FlowReference, err error) {
+	elts := strings.Split(strings.Trim(urlPath, "/"), "/")
+	if len(elts) < 2 || len(elts) > 3 {
+		return res, errors.New("URL path is not a valid flow reference, expected kind/namespace/name")
+	}
+	if res.Kind, err = ParseFlowKind(elts[0]); err != nil {
+		return
+	}
+	switch len(elts) {
+	case 3:
+		res.Namespace, res.Name = elts[1], elts[2]
+	case 2:
+		if !res.Kind.IsClusterScoped() {
+			return res, fmt.Errorf("URL path is not a valid flow reference, namespace is required for %s resources", res.Kind)
+		}
+		if defaultNamespace == "" {
+			return res, fmt.Errorf("URL path is not a valid flow reference, namespace is required for %s resources since no default is configured", res.Kind)
+		}
+		res.Namespace, res.Name = defaultNamespace, elts[1]
+	}
+	if res.Namespace == "" || res.Name == "" {
+		return res, errors.New("URL path is not a valid flow reference, namespace and name cannot be empty")
+	}
+	return
+}
+
 type ReconcileEvent struct {
 	Requests []FlowReference
 }
 
-type ListenerEventChannel chan ListenerEvent
-
-type ListenerEvent struct {
-	Listener  Listener
-	EventType listenerEventType
+type Authenticator interface {
+	Authenticate(token string) (authv1.UserInfo, error)
 }
 
-type listenerEventType uint
+// ErrInvalidCredentials is wrapped by authentication errors caused by the credentials themselves rather than an unavailable backend
+var ErrInvalidCredentials = errors.New("invalid credentials")
 
-func (r ListenerEventChannel) Register(l Listener) {
-	r <- ListenerEvent{
-		Listener:  l,
-		EventType: RegisterListener,
-	}
+func invalidCredentials(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidCredentials, reason)
 }
 
-func (r ListenerEventChannel) Unregister(l Listener) {
-	r <- ListenerEvent{
-		Listener:  l,
-		EventType: UnregisterListener,
-	}
+// CertificateAuthenticator is implemented by authenticators that identify listeners by their verified TLS client certificate instead of a token
+type CertificateAuthenticator interface {
+	AuthenticateCertificate(cert *x509.Certificate) (authv1.UserInfo, error)
 }
 
-type Authenticator interface {
-	Authenticate(token string) (authv1.UserInfo, error)
+// RecordHistory provides recently received records of flows
+type RecordHistory interface {
+	Records(flow FlowReference, req ReplayRequest) []Record
+}
+
+type Authorizer interface {
+	// AuthorizeFlow is called once when a listener connects to decide whether the user may tail the flow at all
+	AuthorizeFlow(user authv1.UserInfo, flow FlowReference) (bool, error)
+	// AuthorizeRecord is called for each record before it is sent to the listener
+	AuthorizeRecord(user authv1.UserInfo, r Record) bool
 }
@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"testing"
+)
+
+// benchRecordData is a record as shipped by fluentd with Kubernetes metadata and RBAC labels
+var benchRecordData = []byte(`{"log":"GET /healthz 200","stream":"stdout","time":"2022-05-04T10:11:12.123456789Z","kubernetes":{"pod_name":"web-5d8f9c7b6-x2x7k","namespace_name":"default","container_name":"nginx","labels":{"app":"web","rbac/default_alice":"allow","rbac/policy":"deny"}}}`)
+
+func BenchmarkParseFlowReference(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseFlowReference("flow/default/all", ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseFlowReferenceAllocations(t *testing.T) {
+	skipUnderRace(t)
+	for _, ref := range []string{"flow/default/all", "clusterflow/all"} {
+		allocs := testing.AllocsPerRun(100, func() {
+			_, _ = ParseFlowReference(ref, "logging")
+		})
+		if allocs > 1 {
+			t.Errorf("parsing %s: %v allocations, the budget is 1", ref, allocs)
+		}
+	}
+}
+
+func BenchmarkParseRecordMeta(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchRecordData)))
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseRecordMeta(benchRecordData); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseRecordMetaAllocations(t *testing.T) {
+	skipUnderRace(t)
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = ParseRecordMeta(benchRecordData)
+	})
+	if allocs > 12 {
+		t.Errorf("%v allocations, the budget is 12", allocs)
+	}
+}
@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// DefaultConfigReloadInterval is how often the configuration file is checked for changes
+const DefaultConfigReloadInterval = 10 * time.Second
+
+// NewConfigReloader returns a reloader of a YAML configuration file mapping flag names to values, e.g. listen-addr: ":10001"
+// Flags set on the command line take precedence over the file, it has to be called after the flags have been parsed
+func NewConfigReloader(fileName string, flags *pflag.FlagSet, logs log.Sink) *ConfigReloader {
+	r := &ConfigReloader{
+		cliFlags:   make(map[string]bool),
+		fileName:   fileName,
+		flags:      flags,
+		logs:       log.WithFields(logs, log.Fields{"task": "config reloader", "file": fileName}),
+		reloadable: make(map[string]int),
+		trigger:    make(chan struct{}, 1),
+	}
+	flags.Visit(func(f *pflag.Flag) {
+		r.cliFlags[f.Name] = true
+	})
+	return r
+}
+
+// ConfigReloader sets flags from a configuration file and applies changes of reloadable flags while the service is running
+type ConfigReloader struct {
+	appliers []func()
+	cliFlags map[string]bool
+	// config holds the values of the file last loaded
+	config     map[string][]string
+	data       []byte
+	fileName   string
+	flags      *pflag.FlagSet
+	logs       log.Sink
+	mutex      sync.Mutex
+	reloadable map[string]int
+	trigger    chan struct{}
+}
+
+// Load sets the flags not set on the command line from the file
+func (r *ConfigReloader) Load() error {
+	data, err := os.ReadFile(r.fileName)
+	if err != nil {
+		return err
+	}
+	config, err := parseConfig(data, r.flags)
+	if err != nil {
+		return fmt.Errorf("invalid configuration file %s: %w", r.fileName, err)
+	}
+	for _, name := range sortedKeys(config) {
+		if r.cliFlags[name] {
+			continue
+		}
+		for _, v := range config[name] {
+			if err := r.flags.Set(name, v); err != nil {
+				return fmt.Errorf("invalid value of %s in configuration file %s: %w", name, r.fileName, err)
+			}
+		}
+	}
+	r.config = config
+	r.data = data
+	return nil
+}
+
+// OnReload registers a function applying the new values of the specified flags, which makes them reloadable
+func (r *ConfigReloader) OnReload(apply func(), names ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.appliers = append(r.appliers, apply)
+	for _, name := range names {
+		r.reloadable[name] = len(r.appliers) - 1
+	}
+}
+
+// Trigger makes Run check the file for changes without waiting for the interval to elapse, e.g. on SIGHUP
+func (r *ConfigReloader) Trigger() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run checks the file for changes at the specified interval, or when triggered, until the stop signal is closed
+// Changes of reloadable flags are applied, other changes only take effect after restarting the service
+func (r *ConfigReloader) Run(interval time.Duration, stopSignal <-chan struct{}) {
+	if interval <= 0 {
+		interval = DefaultConfigReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopSignal:
+			return
+		case <-ticker.C:
+		case <-r.trigger:
+		}
+		if err := r.reload(); err != nil {
+			log.Event(r.logs, "failed to reload configuration file", log.Error(err))
+		}
+	}
+}
+
+func (r *ConfigReloader) reload() error {
+	data, err := os.ReadFile(r.fileName)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, r.data) {
+		return nil
+	}
+	config, err := parseConfig(data, r.flags)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// values are validated before applying any of them, so that a bad file is not applied partially
+	for _, name := range sortedKeys(config) {
+		if _, ok := r.reloadable[name]; ok && !r.cliFlags[name] && len(config[name]) != 1 {
+			return fmt.Errorf("reloadable option %s must have a single value", name)
+		}
+	}
+
+	apply := make(map[int]bool)
+	for _, name := range sortedKeys(config) {
+		if r.cliFlags[name] || equalValues(config[name], r.config[name]) {
+			continue
+		}
+		idx, ok := r.reloadable[name]
+		if !ok {
+			log.Event(r.logs, "option changed in configuration file, restart the service to apply it", log.Fields{"option": name})
+			continue
+		}
+		if err := r.flags.Set(name, config[name][0]); err != nil {
+			log.Event(r.logs, "invalid value of option in configuration file", log.Error(err), log.Fields{"option": name})
+			continue
+		}
+		log.Event(r.logs, "option reloaded from configuration file", log.Fields{"option": name, "value": config[name][0]})
+		apply[idx] = true
+	}
+	for idx := range r.appliers {
+		if apply[idx] {
+			r.appliers[idx]()
+		}
+	}
+	r.config = config
+	r.data = data
+	return nil
+}
+
+// parseConfig returns the values of the flags in a configuration file, lists hold the values of repeatable flags
+func parseConfig(data []byte, flags *pflag.FlagSet) (map[string][]string, error) {
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	res := make(map[string][]string, len(raw))
+	for name, value := range raw {
+		if flags.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown option %s", name)
+		}
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			s, err := configValue(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of %s: %w", name, err)
+			}
+			res[name] = append(res[name], s)
+		}
+	}
+	return res, nil
+}
+
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
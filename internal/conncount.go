@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+)
+
+// countingListener wraps accepted connections so that the number of bytes written to the wire can be measured
+type countingListener struct {
+	net.Listener
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: c}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	written uint64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+// Written returns the number of bytes written to the connection so far
+func (c *countingConn) Written() uint64 {
+	return atomic.LoadUint64(&c.written)
+}
+
+type countingConnKey struct{}
+
+// withCountingConn is used as the ConnContext of servers accepting connections from a countingListener
+func withCountingConn(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if cc, ok := c.(*countingConn); ok {
+		return context.WithValue(ctx, countingConnKey{}, cc)
+	}
+	return ctx
+}
+
+func countingConnFrom(ctx context.Context) *countingConn {
+	cc, _ := ctx.Value(countingConnKey{}).(*countingConn)
+	return cc
+}
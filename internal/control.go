@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	ControlAckOverflow ControlType = "ack_overflow"
+	ControlError       ControlType = "error"
+	// ControlFlowChanged tells that the match rules of a flow have changed, so its records may come from other pods from now on
+	ControlFlowChanged ControlType = "flow_changed"
+	// ControlGap tells a listener resuming a flow with ReplayParamLastSequence that Records records following its last sequence number are not retained anymore, or that an unknown number of them are missing if Records is zero
+	ControlGap         ControlType = "gap"
+	ControlRateLimited ControlType = "rate_limited"
+	ControlReplayed    ControlType = "replayed"
+	// ControlSampled tells that the listener receives the sample of records it requested with SampleParam, it is sent when the listener connects
+	ControlSampled ControlType = "sampled"
+	// ControlSampling tells that the listener only receives one in SampleRate records apart from those of error levels, because it cannot keep up
+	ControlSampling      ControlType = "sampling"
+	ControlSamplingEnded ControlType = "sampling_ended"
+	// ControlSessionExpiring warns that the connection will be closed with CloseSessionExpired at ExpiresAt
+	ControlSessionExpiring ControlType = "session_expiring"
+	// ControlStats reports the counts of records of the connection to listeners that requested them with StatsParam
+	ControlStats      ControlType = "stats"
+	ControlSubscribed ControlType = "subscribed"
+	// ControlThrottled tells that the records of Flow exceed a throughput quota, so that only one in SampleRate of them is delivered apart from errors
+	ControlThrottled    ControlType = "throttled"
+	ControlUnsubscribed ControlType = "unsubscribed"
+)
+
+type ControlType string
+
+// Close codes sent to listeners when the service closes their connection, from the range reserved for applications (4000-4999)
+// Shutdowns of the service are signaled with the standard going away (1001) code
+const (
+	// CloseUnauthorized means that the listener's credentials are not valid anymore
+	CloseUnauthorized = 4001
+	// CloseForbidden means that the listener's permission to tail a flow has been withdrawn
+	CloseForbidden = 4003
+	// CloseSlowConsumer means that the listener could not keep up with the records of its flows
+	CloseSlowConsumer = 4008
+	// CloseTimeout means that the listener stopped responding to keepalive pings
+	CloseTimeout = 4009
+	// CloseInternalError means that the service encountered an error it cannot recover from
+	CloseInternalError = 4011
+	// CloseMoved means that a flow of the listener is now served by another replica in sharding mode, reconnecting resumes it there
+	CloseMoved = 4012
+	// CloseDisconnected means that an administrator disconnected the listener
+	CloseDisconnected = 4013
+	// CloseSessionExpired means that the listener's session has lasted for its maximum duration, reconnecting starts a new one
+	CloseSessionExpired = 4014
+	// CloseFlowDeleted means that a flow of the listener has been deleted
+	CloseFlowDeleted = 4015
+	// CloseIdle means that neither records nor messages have been exchanged with the listener for the idle timeout
+	CloseIdle = 4016
+
+	closeTimeout = 5 * time.Second
+)
+
+// ControlMessage is sent to listeners as a JSON text frame to inform them about the state of their stream
+type ControlMessage struct {
+	Control ControlType `json:"control"`
+	Message string      `json:"message,omitempty"`
+	// Flow is the reference of the flow the message refers to in kind/namespace/name form
+	Flow string `json:"flow,omitempty"`
+	// Code is the close code of the connection for messages sent before closing it
+	Code int `json:"code,omitempty"`
+	// Records is the number of records the message refers to, e.g. the number of records dropped
+	Records uint64 `json:"records,omitempty"`
+	// SampleRate is the number of records one of which is delivered, for sampling messages
+	SampleRate uint64 `json:"sampleRate,omitempty"`
+	// Probability is the probability of delivering each record, for sampled messages of probabilistic samples
+	Probability float64 `json:"probability,omitempty"`
+	// ExpiresAt is when the session of the listener expires, for session expiry warnings
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// RecordsDelivered, RecordsFiltered, RecordsRedacted and RecordsDropped count the records of the connection so far, for stats messages
+	RecordsDelivered uint64 `json:"recordsDelivered,omitempty"`
+	RecordsFiltered  uint64 `json:"recordsFiltered,omitempty"`
+	RecordsRedacted  uint64 `json:"recordsRedacted,omitempty"`
+	RecordsDropped   uint64 `json:"recordsDropped,omitempty"`
+	// RecordsQueued is the number of records waiting to be written, for stats messages
+	RecordsQueued int `json:"recordsQueued,omitempty"`
+	// LagMillis is how long the last live record written waited since it was received in milliseconds, for stats messages
+	LagMillis int64 `json:"lagMillis,omitempty"`
+}
+
+// sendControl queues a control message for the listener, messages are discarded when the control queue is full
+func (l *listener) sendControl(msg ControlMessage) {
+	select {
+	case l.controls <- msg:
+	default:
+		log.Event(l.logs, "listener control queue is full, discarding control message", log.V(1), log.Fields{"listener": l, "message": msg})
+	}
+}
+
+type closeRequest struct {
+	code   int
+	reason string
+}
+
+// closeWith stops delivering records to the listener and makes its write loop send an error frame and a close frame with the specified code
+// The listener is disconnected regardless of whether the frames could be delivered within closeTimeout
+func (l *listener) closeWith(code int, reason string) {
+	if !atomic.CompareAndSwapUint32(&l.closing, 0, 1) {
+		return
+	}
+	log.Event(l.logs, "closing listener connection", log.V(1), log.Fields{"listener": l, "code": code, "reason": reason})
+	l.closeRequests <- closeRequest{code: code, reason: reason}
+	time.AfterFunc(closeTimeout, l.disconnect)
+}
+
+func (l *listener) writeClose(req closeRequest) {
+	deadline := time.Now().Add(closeTimeout)
+	if err := l.conn.SetWriteDeadline(deadline); err == nil {
+		if err := l.writeControl(ControlMessage{Control: ControlError, Code: req.code, Message: req.reason}); err != nil {
+			log.Event(l.logs, "an error occurred while writing error frame to websocket connection", log.V(1), log.Error(err), log.Fields{"listener": l})
+		}
+	}
+	if err := l.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(req.code, req.reason), deadline); err != nil {
+		log.Event(l.logs, "an error occurred while writing close frame to websocket connection", log.V(1), log.Error(err), log.Fields{"listener": l})
+	}
+	l.disconnect()
+}
+
+func (l *listener) writeControl(msg ControlMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := l.setWriteDeadline(); err != nil {
+		return err
+	}
+	if err := l.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		l.writeFailed(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	// DeadLetterEndpoint streams the dead letters of all receivers to listeners allowed to use the admin API
+	DeadLetterEndpoint = "/dead-letter"
+
+	// FKDeadLetter references the flow of dead letters, which has no resource and cannot be referenced in URLs, see DeadLetterEndpoint
+	FKDeadLetter FlowKind = "deadletter"
+
+	// DeadLetterUnparsable and DeadLetterMissingMetadata tell why a record was dead-lettered in metrics
+	DeadLetterUnparsable      = "unparsable"
+	DeadLetterMissingMetadata = "missing_metadata"
+
+	deadLetterFlowName = "dead-letter"
+)
+
+// DeadLetterFlow returns the reference of the flow dead letters are routed to
+func DeadLetterFlow(controlNamespace string) FlowReference {
+	return FlowReference{
+		NamespacedName: types.NamespacedName{Namespace: controlNamespace, Name: deadLetterFlowName},
+		Kind:           FKDeadLetter,
+	}
+}
+
+type DeadLetterMetrics interface {
+	DeadLetter(receiver string, reason string)
+}
+
+// DeadLetters routes the messages receivers could not turn into records to the dead-letter flow instead of dropping them
+// Dead letters are JSON records holding the error as their message, the receiver, the flow the message was ingested for and the message as received
+type DeadLetters struct {
+	// Flow is the flow dead letters are pushed for, see DeadLetterFlow
+	Flow    FlowReference
+	Records RecordSink
+	// Log enables logging each dead letter
+	Log     bool
+	Logs    log.Sink
+	Metrics DeadLetterMetrics
+	// MissingMetadata also dead-letters the records of fluentd receivers lacking the namespace or pod of their Kubernetes metadata
+	MissingMetadata bool
+}
+
+type deadLetter struct {
+	Message  string    `json:"message"`
+	Level    string    `json:"level"`
+	Time     time.Time `json:"time"`
+	Receiver string    `json:"receiver"`
+	Flow     string    `json:"flow,omitempty"`
+	Data     string    `json:"data"`
+}
+
+// Reject dead-letters the data received for the flow, it does nothing if d is nil
+func (d *DeadLetters) Reject(receiver string, flow FlowReference, data []byte, reason string, err error) {
+	if d == nil {
+		return
+	}
+	d.Metrics.DeadLetter(receiver, reason)
+	var flowURL string
+	if flow != (FlowReference{}) {
+		flowURL = flow.URL()
+	}
+	now := time.Now()
+	letter, jsonErr := json.Marshal(deadLetter{
+		Message:  err.Error(),
+		Level:    "error",
+		Time:     now,
+		Receiver: receiver,
+		Flow:     flowURL,
+		Data:     string(data),
+	})
+	if jsonErr != nil {
+		log.Event(d.Logs, "failed to encode dead letter", log.Error(jsonErr), log.Fields{"receiver": receiver, "flow": flow})
+		return
+	}
+	if d.Log {
+		log.Event(d.Logs, "dead letter", log.Error(err), log.Fields{"receiver": receiver, "flow": flow, "reason": reason, "data": string(data)})
+	}
+	rec := Record{
+		RawData:    letter,
+		Flow:       d.Flow,
+		ReceivedAt: now,
+	}
+	rec.Meta, _ = ParseRecordMeta(letter)
+	d.Records.Push(rec)
+}
+
+// Unattributed dead-letters the record if it lacks Kubernetes metadata and MissingMetadata is set, in which case it returns true
+func (d *DeadLetters) Unattributed(receiver string, r Record) bool {
+	if d == nil || !d.MissingMetadata || r.Meta.Namespace != "" && r.Meta.Pod != "" {
+		return false
+	}
+	d.Reject(receiver, r.Flow, r.RawData, DeadLetterMissingMetadata, errMissingMetadata)
+	return true
+}
+
+var errMissingMetadata = errors.New("record has no Kubernetes namespace or pod")
+
+// deadLetterAuthorizer allows users permitted to get DeadLetterEndpoint on the admin API to tail the dead-letter flow, and nothing else
+type deadLetterAuthorizer struct {
+	Admin AdminAuthorizer
+}
+
+func (a deadLetterAuthorizer) AuthorizeFlow(user authv1.UserInfo, flow FlowReference) (bool, error) {
+	if flow.Kind != FKDeadLetter {
+		return false, nil
+	}
+	return a.Admin.AuthorizeAdmin(user, "get", DeadLetterEndpoint)
+}
+
+func (a deadLetterAuthorizer) AuthorizeRecord(authv1.UserInfo, Record) bool {
+	return true
+}
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultMaxDecompressedBodySize is the default maximum size of ingest request bodies once decompressed
+const DefaultMaxDecompressedBodySize = 64 << 20
+
+var (
+	errUnsupportedContentEncoding = errors.New("unsupported content encoding, expected gzip or zstd")
+	errDecompressedBodyTooLarge   = errors.New("decompressed request body too large")
+)
+
+// decompressBody inflates a request body compressed with the content encoding, reading at most maxSize bytes of the result so that small bodies cannot inflate to exhaust memory
+// Bodies without a content encoding are returned as they are, zero maxSize means unlimited
+func decompressBody(data []byte, encoding string, maxSize int64) ([]byte, error) {
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return data, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		r = zr
+	case "zstd":
+		opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if maxSize > 0 {
+			opts = append(opts, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+		}
+		zr, err := zstd.NewReader(bytes.NewReader(data), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd body: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, errUnsupportedContentEncoding
+	}
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+	res, err := io.ReadAll(r)
+	if err != nil {
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return nil, errDecompressedBodyTooLarge
+		}
+		return nil, fmt.Errorf("invalid %s body: %w", encoding, err)
+	}
+	if maxSize > 0 && int64(len(res)) > maxSize {
+		return nil, errDecompressedBodyTooLarge
+	}
+	return res, nil
+}
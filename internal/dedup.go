@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"time"
+)
+
+const DefaultDedupMaxEntries = 100000
+
+type DedupMetrics interface {
+	LogRecordDeduplicated(r Record)
+}
+
+// NewDeduplicator returns a deduplicator suppressing records identical to one received less than window earlier, remembering at most maxEntries records
+func NewDeduplicator(window time.Duration, maxEntries int, metrics DedupMetrics) *Deduplicator {
+	if maxEntries <= 0 {
+		maxEntries = DefaultDedupMaxEntries
+	}
+	return &Deduplicator{
+		maxEntries: maxEntries,
+		metrics:    metrics,
+		seen:       make(map[uint64]time.Time),
+		window:     window,
+	}
+}
+
+// Deduplicator suppresses records delivered more than once, e.g. because fluentd retried sending a chunk
+// Records are identified by a hash of their flow, source, timestamp and message, records without a timestamp are never considered duplicates
+// It is not safe for concurrent use
+type Deduplicator struct {
+	maxEntries int
+	metrics    DedupMetrics
+	// order lists the remembered records in the order they were received, starting at head
+	order  []dedupEntry
+	head   int
+	seen   map[uint64]time.Time
+	window time.Duration
+}
+
+type dedupEntry struct {
+	key        uint64
+	receivedAt time.Time
+}
+
+// Duplicate reports whether the record is a duplicate of a record received within the window, the record is remembered otherwise
+func (d *Deduplicator) Duplicate(r Record) bool {
+	if r.Meta.Timestamp.IsZero() {
+		return false
+	}
+	now := r.ReceivedAt
+	if now.IsZero() {
+		now = time.Now()
+	}
+	d.expire(now)
+
+	key := dedupKey(r)
+	if _, ok := d.seen[key]; ok {
+		d.metrics.LogRecordDeduplicated(r)
+		return true
+	}
+	if len(d.seen) >= d.maxEntries {
+		d.forget()
+	}
+	d.seen[key] = now
+	d.order = append(d.order, dedupEntry{key: key, receivedAt: now})
+	return false
+}
+
+// expire forgets the records received before the window
+func (d *Deduplicator) expire(now time.Time) {
+	for d.head < len(d.order) && now.Sub(d.order[d.head].receivedAt) > d.window {
+		d.forget()
+	}
+}
+
+// forget forgets the oldest remembered record
+func (d *Deduplicator) forget() {
+	e := d.order[d.head]
+	// the key might have been remembered again since
+	if t, ok := d.seen[e.key]; ok && t.Equal(e.receivedAt) {
+		delete(d.seen, e.key)
+	}
+	d.order[d.head] = dedupEntry{}
+	d.head++
+	if d.head > len(d.order)/2 {
+		d.order = append(d.order[:0], d.order[d.head:]...)
+		d.head = 0
+	}
+}
+
+func dedupKey(r Record) uint64 {
+	h := fnv.New64a()
+	for _, s := range []string{r.Flow.URL(), r.Meta.Namespace, r.Meta.Pod, r.Meta.Container, r.Meta.Message} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(r.Meta.Timestamp.UnixNano()))
+	h.Write(ts[:])
+	return h.Sum64()
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// dispatchBufferSize is the number of records queued for each dispatch worker
+const dispatchBufferSize = 1024
+
+// DefaultDispatchWorkers returns the default number of dispatch workers, one per usable CPU
+func DefaultDispatchWorkers() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// NewDispatcher starts a dispatcher fanning records out with the specified number of workers, with fewer than two workers records are dispatched synchronously
+func NewDispatcher(workers int) *Dispatcher {
+	d := &Dispatcher{}
+	if workers < 2 {
+		return d
+	}
+	d.workers = make([]chan dispatch, workers)
+	for i := range d.workers {
+		queue := make(chan dispatch, dispatchBufferSize)
+		d.workers[i] = queue
+		d.wg.Add(1)
+		go d.work(i, queue)
+	}
+	return d
+}
+
+// Dispatcher hands records to their listeners, which queue them for their own writers, so that dispatching never waits for connections
+// Each listener is served by the same worker, which keeps the records it receives in order
+type Dispatcher struct {
+	wg      sync.WaitGroup
+	workers []chan dispatch
+}
+
+type dispatch struct {
+	record    Record
+	listeners []Listener
+}
+
+// Dispatch sends the record to the listeners, the slice must not be modified afterwards
+func (d *Dispatcher) Dispatch(r Record, listeners []Listener) {
+	r, span := StartRecordSpan(r, "dispatch", attribute.Int("listeners", len(listeners)))
+	defer span.End()
+	if len(d.workers) == 0 {
+		for _, l := range listeners {
+			l.Send(r)
+		}
+		return
+	}
+	for _, queue := range d.workers {
+		queue <- dispatch{record: r, listeners: listeners}
+	}
+}
+
+// Close stops the workers once the records dispatched so far have been handed to their listeners
+func (d *Dispatcher) Close() {
+	for _, queue := range d.workers {
+		close(queue)
+	}
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) work(shard int, queue <-chan dispatch) {
+	defer d.wg.Done()
+	for item := range queue {
+		for _, l := range item.listeners {
+			if dispatchShard(l, len(d.workers)) == shard {
+				l.Send(item.record)
+			}
+		}
+	}
+}
+
+// dispatchShard assigns listeners to workers by the address of the connection behind them, so that the subscriptions of a listener share a worker
+func dispatchShard(l Listener, shards int) int {
+	var p uintptr
+	if s, ok := l.(subscription); ok {
+		p = reflect.ValueOf(s.listener).Pointer()
+	} else if v := reflect.ValueOf(l); v.Kind() == reflect.Ptr {
+		p = v.Pointer()
+	}
+	return int(((uint64(p) * 0x9e3779b97f4a7c15) >> 32) % uint64(shards))
+}
@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// discardListener counts the records sent to it
+type discardListener struct {
+	flow    FlowReference
+	records int
+}
+
+func (l *discardListener) Send(Record) {
+	l.records++
+}
+
+func (l *discardListener) Flow() FlowReference {
+	return l.flow
+}
+
+func (l *discardListener) User() authv1.UserInfo {
+	return authv1.UserInfo{}
+}
+
+// fanOutRegistry returns a registry with the number of listeners of the flow
+func fanOutRegistry(flow FlowReference, listeners int) *FlowRegistry {
+	reg := NewFlowRegistry(testMetrics())
+	for i := 0; i < listeners; i++ {
+		reg.Register(&discardListener{flow: flow})
+	}
+	return reg
+}
+
+func BenchmarkFanOut(b *testing.B) {
+	r := benchRBACRecord(b)
+	r.Flow, _ = ParseFlowReference("flow/default/all", "")
+	for _, listeners := range []int{1, 100, 1000} {
+		b.Run(fmt.Sprintf("listeners=%d", listeners), func(b *testing.B) {
+			reg := fanOutRegistry(r.Flow, listeners)
+			dispatcher := NewDispatcher(1)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				dispatcher.Dispatch(r, RoutedListeners(reg, nil, r.Flow))
+			}
+		})
+	}
+}
+
+func TestFanOutAllocations(t *testing.T) {
+	skipUnderRace(t)
+	r := benchRBACRecord(t)
+	r.Flow, _ = ParseFlowReference("flow/default/all", "")
+	for _, listeners := range []int{1, 1000} {
+		reg := fanOutRegistry(r.Flow, listeners)
+		dispatcher := NewDispatcher(1)
+		allocs := testing.AllocsPerRun(100, func() {
+			dispatcher.Dispatch(r, RoutedListeners(reg, nil, r.Flow))
+		})
+		if allocs > 0 {
+			t.Errorf("%d listeners: %v allocations, the budget is 0", listeners, allocs)
+		}
+		for _, l := range reg.Listeners(r.Flow) {
+			if n := l.(*discardListener).records; n != 101 {
+				t.Fatalf("%d listeners: a listener received %d records, want 101", listeners, n)
+			}
+		}
+	}
+}
+
+// discardConn is a listener connection counting the frames written to it, writes block while it is blocked
+type discardConn struct {
+	blocked chan struct{}
+	frames  uint64
+}
+
+func (c *discardConn) Close() error {
+	return nil
+}
+
+func (c *discardConn) NextWriter(int) (io.WriteCloser, error) {
+	if c.blocked != nil {
+		<-c.blocked
+	}
+	return discardFrame{c}, nil
+}
+
+func (c *discardConn) ReadMessage() (int, []byte, error) {
+	return 0, nil, io.EOF
+}
+
+func (c *discardConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *discardConn) WriteControl(int, []byte, time.Time) error {
+	return nil
+}
+
+func (c *discardConn) WriteMessage(int, []byte) error {
+	atomic.AddUint64(&c.frames, 1)
+	return nil
+}
+
+type discardFrame struct {
+	conn *discardConn
+}
+
+func (f discardFrame) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (f discardFrame) Close() error {
+	atomic.AddUint64(&f.conn.frames, 1)
+	return nil
+}
+
+// startDeliveryListener starts the writer of a listener of the flow connected over the connection, as accepted by Listen
+// The listener is disconnected when the test finishes, which waits for its writer to return
+func startDeliveryListener(tb testing.TB, conn listenerConn, reg ListenerRegistry, flow FlowReference, opts ListenerOptions) *listener {
+	l := &listener{
+		authorizer:    allowAuthorizer{},
+		closeRequests: make(chan closeRequest, 1),
+		conn:          conn,
+		connectedAt:   time.Now(),
+		controls:      make(chan ControlMessage, listenerControlQueueSize),
+		done:          NewWaitableLatch(),
+		encoder:       NDJSONEncoder{},
+		filter:        RecordFilter{},
+		flows:         make(map[FlowReference]bool),
+		id:            newListenerID(),
+		logs:          log.WithVerbosityFilter(log.NewWriterSink(io.Discard), 0),
+		metrics:       testMetrics(),
+		opts:          opts,
+		policy:        opts.BackpressurePolicy,
+		pongs:         make(chan struct{}, 1),
+		queue:         make(chan Record, opts.bufferSize()),
+		reg:           reg,
+		replayedUpTo:  make(map[FlowReference]uint64),
+		usrInfo:       authv1.UserInfo{Username: "bench"},
+	}
+	l.subscribe(flow)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		l.writeLoop()
+	}()
+	tb.Cleanup(func() {
+		l.disconnect()
+		<-stopped
+	})
+	return l
+}
+
+// BenchmarkListenerDelivery dispatches records to 1000 listeners whose writers discard them, reporting the rate each listener is delivered records at
+// Records that listeners could not keep up with are dropped rather than holding up dispatching, their share is reported too
+// Profile it with go test -run XXX -bench ListenerDelivery -cpuprofile cpu.out ./internal, delivery at 10k records/s takes about 10M listener writes per second
+func BenchmarkListenerDelivery(b *testing.B) {
+	const listeners = 1000
+	flow, _ := ParseFlowReference("flow/default/all", "")
+	reg := NewFlowRegistry(testMetrics())
+	opts := ListenerOptions{BackpressurePolicy: BackpressureDropNewest}
+	started := make([]*listener, listeners)
+	conns := make([]*discardConn, listeners)
+	for i := range started {
+		conns[i] = &discardConn{}
+		started[i] = startDeliveryListener(b, conns[i], reg, flow, opts)
+	}
+	dispatcher := NewDispatcher(DefaultDispatchWorkers())
+	defer dispatcher.Close()
+	r := benchRBACRecord(b)
+	r.Flow = flow
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		r.Sequence = uint64(i + 1)
+		dispatcher.Dispatch(shareEncodings(r), reg.Listeners(flow))
+	}
+	var dropped uint64
+	for i, l := range started {
+		for atomic.LoadUint64(&conns[i].frames)+atomic.LoadUint64(&l.dropped) < uint64(b.N) {
+			time.Sleep(time.Millisecond)
+		}
+		dropped += atomic.LoadUint64(&l.dropped)
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "records/s")
+	b.ReportMetric(float64(dropped)/float64(b.N*listeners), "dropped/record")
+}
+
+func TestDispatchDoesNotWaitForConnections(t *testing.T) {
+	flow, _ := ParseFlowReference("flow/default/all", "")
+	reg := NewFlowRegistry(testMetrics())
+	const records = 1000
+	stuck := &discardConn{blocked: make(chan struct{})}
+	stuckListener := startDeliveryListener(t, stuck, reg, flow, ListenerOptions{BackpressurePolicy: BackpressureDropNewest, BufferSize: 10})
+	// the writer of the stuck listener returns once its write is unblocked
+	t.Cleanup(func() { close(stuck.blocked) })
+	fast := &discardConn{}
+	startDeliveryListener(t, fast, reg, flow, ListenerOptions{BackpressurePolicy: BackpressureDropNewest, BufferSize: records})
+	dispatcher := NewDispatcher(2)
+
+	r := benchRBACRecord(t)
+	r.Flow = flow
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < records; i++ {
+			r.Sequence = uint64(i + 1)
+			dispatcher.Dispatch(shareEncodings(r), reg.Listeners(flow))
+		}
+		// the workers hand the records to the listeners asynchronously
+		dispatcher.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatching waits for a listener that does not write")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&fast.frames) < records {
+		if time.Now().After(deadline) {
+			t.Fatalf("the listener that keeps up got %d of %d records", atomic.LoadUint64(&fast.frames), records)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadUint64(&stuckListener.dropped) == 0 {
+		t.Error("the stuck listener dropped no records")
+	}
+}
@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// DefaultElasticsearchIndex is the index pattern of Elasticsearch sinks unless set with their index query parameter
+const DefaultElasticsearchIndex = "log-socket-{namespace}-{date}"
+
+// NewElasticsearchSink returns a sink bulk-indexing the records of the flow into Elasticsearch or OpenSearch at the URL, e.g. elasticsearch://elasticsearch:9200 (elasticsearch+https for TLS, or opensearch)
+// The index query parameter is the pattern of index names, see elasticsearchIndex, and apiKey authenticates with an API key instead of the user info of the URL
+func NewElasticsearchSink(flow FlowReference, u *url.URL, logs log.Sink) (*ElasticsearchSink, error) {
+	query := u.Query()
+	opts, err := parsePushSinkOptions(query)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "http"
+	if strings.HasSuffix(u.Scheme, "+https") {
+		scheme = "https"
+	}
+	index := query.Get("index")
+	if index == "" {
+		index = DefaultElasticsearchIndex
+	}
+	if strings.ToLower(index) != index || strings.ContainsAny(index, `\/*?"<>| ,#`) {
+		return nil, fmt.Errorf("invalid index pattern %q, index names are lowercase and cannot contain special characters", index)
+	}
+	endpoint := url.URL{Scheme: scheme, Host: u.Host, Path: strings.TrimSuffix(u.Path, "/") + "/_bulk"}
+	s := &ElasticsearchSink{
+		apiKey:   query.Get("apiKey"),
+		client:   &http.Client{Timeout: pushSinkTimeout},
+		endpoint: endpoint.String(),
+		index:    index,
+		user:     u.User,
+	}
+	s.batchingSink = batchingSink{
+		flow: flow,
+		logs: logs,
+		opts: opts,
+		push: s.pushBatch,
+	}
+	s.start()
+	return s, nil
+}
+
+// ElasticsearchSink indexes records as documents with the create operation, so that it works with data streams too
+// Documents get IDs derived from their flow, reception time and sequence number, so that retried batches do not duplicate them
+type ElasticsearchSink struct {
+	batchingSink
+	apiKey   string
+	client   *http.Client
+	endpoint string
+	index    string
+	user     *url.Userinfo
+}
+
+// elasticsearchIndex returns the index of the record, replacing {kind}, {namespace} and {name} in the pattern with those of the record's flow and {date} with the UTC date of the record in YYYY.MM.DD form
+func (s *ElasticsearchSink) elasticsearchIndex(r Record, ts time.Time) string {
+	return strings.NewReplacer(
+		"{kind}", string(r.Flow.Kind),
+		"{namespace}", r.Flow.Namespace,
+		"{name}", r.Flow.Name,
+		"{date}", ts.UTC().Format("2006.01.02"),
+	).Replace(s.index)
+}
+
+// elasticsearchDocument returns the record as a document with an @timestamp field, records that are not JSON objects become the message field
+func elasticsearchDocument(r Record, ts time.Time) ([]byte, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(r.RawData, &doc); err != nil || doc == nil {
+		message, _ := json.Marshal(string(r.RawData))
+		doc = map[string]json.RawMessage{"message": message}
+	}
+	if _, ok := doc["@timestamp"]; !ok {
+		timestamp, _ := json.Marshal(ts.UTC().Format(time.RFC3339Nano))
+		doc["@timestamp"] = timestamp
+	}
+	return json.Marshal(doc)
+}
+
+func elasticsearchID(r Record) string {
+	id := sha256.Sum256([]byte(r.Flow.URL() + "/" + strconv.FormatInt(r.ReceivedAt.UnixNano(), 10) + "/" + strconv.FormatUint(r.Sequence, 10)))
+	return hex.EncodeToString(id[:16])
+}
+
+func (s *ElasticsearchSink) pushBatch(batch []Record) error {
+	var body bytes.Buffer
+	for _, r := range batch {
+		ts := r.Time()
+		if ts.IsZero() {
+			ts = r.ReceivedAt
+		}
+		doc, err := elasticsearchDocument(r, ts)
+		if err != nil {
+			log.Event(s.logs, "failed to convert record to document, skipping it", log.V(1), log.Error(err))
+			continue
+		}
+		action, _ := json.Marshal(map[string]interface{}{"create": map[string]string{"_index": s.elasticsearchIndex(r, ts), "_id": elasticsearchID(r)}})
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(doc)
+		body.WriteByte('\n')
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pushSinkTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	switch {
+	case s.apiKey != "":
+		req.Header.Set("Authorization", "ApiKey "+s.apiKey)
+	case s.user != nil:
+		password, _ := s.user.Password()
+		req.SetBasicAuth(s.user.Username(), password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return pushResponseError(resp)
+	}
+	return s.checkBulkResponse(resp)
+}
+
+// checkBulkResponse fails if documents were rejected because the cluster was overloaded, so that the batch is retried, other rejections are logged and dropped
+// Documents that were already created by a previous attempt are reported as conflicts, which are successes
+func (s *ElasticsearchSink) checkBulkResponse(resp *http.Response) error {
+	var res struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("invalid bulk response: %w", err)
+	}
+	if !res.Errors {
+		return nil
+	}
+	var retryable, rejected int
+	var reason string
+	for _, item := range res.Items {
+		for _, result := range item {
+			switch {
+			case result.Status/100 == 2 || result.Status == http.StatusConflict:
+			case result.Status == http.StatusTooManyRequests || result.Status/100 == 5:
+				retryable++
+			default:
+				rejected++
+				reason = result.Error.Type + ": " + result.Error.Reason
+			}
+		}
+	}
+	if rejected > 0 {
+		log.Event(s.logs, "documents rejected by bulk request, dropping them", log.Fields{"documents": rejected, "reason": reason})
+	}
+	if retryable > 0 {
+		return fmt.Errorf("%d documents could not be indexed because the cluster is overloaded", retryable)
+	}
+	return nil
+}
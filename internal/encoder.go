@@ -0,0 +1,382 @@
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	EncodingBinary      Encoding = "binary"
+	EncodingCloudEvents Encoding = "cloudevents"
+	EncodingMessage     Encoding = "message"
+	EncodingNDJSON      Encoding = "ndjson"
+	EncodingProtobuf    Encoding = "protobuf"
+	EncodingRaw         Encoding = "raw"
+
+	// CloudEventType is the type of the CloudEvents records are wrapped in
+	CloudEventType = "io.banzaicloud.logsocket.record"
+
+	EncodingParam = "format"
+)
+
+type Encoding string
+
+// Encoder turns records into websocket frame payloads
+type Encoder interface {
+	Encode(r Record) ([]byte, error)
+	// MessageType returns the websocket message type of the frames produced by the encoder
+	MessageType() int
+}
+
+func NewEncoder(enc Encoding) (Encoder, error) {
+	switch enc {
+	case EncodingRaw, "":
+		return RawEncoder{}, nil
+	case EncodingNDJSON:
+		return NDJSONEncoder{}, nil
+	case EncodingMessage:
+		return MessageEncoder{}, nil
+	case EncodingProtobuf:
+		return ProtobufEncoder{}, nil
+	case EncodingBinary:
+		return BinaryEncoder{}, nil
+	case EncodingCloudEvents:
+		return CloudEventsEncoder{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", enc)
+	}
+}
+
+var encodingsByMediaType = map[string]Encoding{
+	"application/json":             EncodingRaw,
+	"application/x-ndjson":         EncodingNDJSON,
+	"application/x-protobuf":       EncodingProtobuf,
+	"application/cloudevents+json": EncodingCloudEvents,
+	BinaryEnvelopeMediaType:        EncodingBinary,
+	"text/plain":                   EncodingMessage,
+}
+
+// ExtractEncoding determines the encoding requested by a listener
+// The format query parameter takes precedence over the Accept header, the first supported media type of which is used
+func ExtractEncoding(req *http.Request) Encoding {
+	if enc := req.URL.Query().Get(EncodingParam); enc != "" {
+		return Encoding(enc)
+	}
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if enc, ok := encodingsByMediaType[mediaType]; ok {
+			return enc
+		}
+	}
+	return EncodingRaw
+}
+
+// MultiplexedEncoder wraps records encoded by enc with their flow reference so that listeners of several flows can tell them apart
+// JSON records are wrapped in an envelope, log lines and rendered templates are prefixed and protobuf messages, binary envelopes and CloudEvents already contain the flow reference
+func MultiplexedEncoder(enc Encoder) Encoder {
+	switch e := enc.(type) {
+	case RawEncoder:
+		return envelopeEncoder{}
+	case NDJSONEncoder:
+		return envelopeEncoder{newline: true}
+	case MessageEncoder:
+		return prefixEncoder{}
+	case *TemplateEncoder:
+		return prefixEncoder{template: e}
+	default:
+		return enc
+	}
+}
+
+type envelopeEncoder struct {
+	newline bool
+}
+
+func (e envelopeEncoder) Encode(r Record) ([]byte, error) {
+	var eventTime, receivedAt *time.Time
+	if t := r.Time(); !t.IsZero() {
+		eventTime = &t
+	}
+	if !r.ReceivedAt.IsZero() {
+		receivedAt = &r.ReceivedAt
+	}
+	data, err := json.Marshal(struct {
+		Flow        string          `json:"flow"`
+		Sequence    uint64          `json:"sequence,omitempty"`
+		Time        *time.Time      `json:"time,omitempty"`
+		ReceivedAt  *time.Time      `json:"receivedAt,omitempty"`
+		ClockSkewed bool            `json:"clockSkewed,omitempty"`
+		Severity    string          `json:"severity,omitempty"`
+		Record      json.RawMessage `json:"record"`
+	}{
+		Flow:        r.Flow.URL(),
+		Sequence:    r.Sequence,
+		Time:        eventTime,
+		ReceivedAt:  receivedAt,
+		ClockSkewed: r.ClockSkewed,
+		Severity:    r.Meta.Severity.String(),
+		Record:      r.RawData,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if e.newline {
+		data = append(data, '\n')
+	}
+	return data, nil
+}
+
+func (e envelopeEncoder) MessageType() int {
+	if e.newline {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
+
+// prefixEncoder prefixes the log line of records, or the template rendered for them if set, with their flow reference
+type prefixEncoder struct {
+	template *TemplateEncoder
+}
+
+func (e prefixEncoder) Encode(r Record) ([]byte, error) {
+	if e.template == nil {
+		return []byte("[" + r.Flow.URL() + "] " + r.Message()), nil
+	}
+	data, err := e.template.Encode(r)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("["+r.Flow.URL()+"] "), data...), nil
+}
+
+func (prefixEncoder) MessageType() int {
+	return websocket.TextMessage
+}
+
+// RawEncoder sends the record's data as received
+type RawEncoder struct{}
+
+func (RawEncoder) Encode(r Record) ([]byte, error) {
+	return r.RawData, nil
+}
+
+func (RawEncoder) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+// NDJSONEncoder sends the record's data terminated by a newline
+type NDJSONEncoder struct{}
+
+func (NDJSONEncoder) Encode(r Record) ([]byte, error) {
+	data := make([]byte, 0, len(r.RawData)+1)
+	data = append(data, r.RawData...)
+	return append(data, '\n'), nil
+}
+
+func (NDJSONEncoder) MessageType() int {
+	return websocket.TextMessage
+}
+
+// MessageEncoder sends only the log line of the record
+type MessageEncoder struct{}
+
+func (MessageEncoder) Encode(r Record) ([]byte, error) {
+	return []byte(r.Message()), nil
+}
+
+func (MessageEncoder) MessageType() int {
+	return websocket.TextMessage
+}
+
+// CloudEventsEncoder sends records as CloudEvents in the structured JSON format, with the flow reference as their source
+// Events are identified by the sequence number of the record, which is also set as the sequence extension, and their subject is the pod of the record
+type CloudEventsEncoder struct{}
+
+func (CloudEventsEncoder) Encode(r Record) ([]byte, error) {
+	event := struct {
+		SpecVersion     string          `json:"specversion"`
+		ID              string          `json:"id"`
+		Source          string          `json:"source"`
+		Type            string          `json:"type"`
+		Subject         string          `json:"subject,omitempty"`
+		Time            *time.Time      `json:"time,omitempty"`
+		Sequence        string          `json:"sequence,omitempty"`
+		DataContentType string          `json:"datacontenttype"`
+		Data            json.RawMessage `json:"data,omitempty"`
+		DataBase64      []byte          `json:"data_base64,omitempty"`
+	}{
+		SpecVersion: "1.0",
+		Source:      r.Flow.URL(),
+		Type:        CloudEventType,
+	}
+	if r.Sequence > 0 {
+		event.ID = strconv.FormatUint(r.Sequence, 10)
+		event.Sequence = event.ID
+	} else {
+		event.ID = newListenerID()
+	}
+	if r.Meta.Namespace != "" && r.Meta.Pod != "" {
+		event.Subject = r.Meta.Namespace + "/" + r.Meta.Pod
+	}
+	if t := r.Time(); !t.IsZero() {
+		event.Time = &t
+	}
+	if json.Valid(r.RawData) {
+		event.DataContentType, event.Data = "application/json", r.RawData
+	} else {
+		event.DataContentType, event.DataBase64 = "application/octet-stream", r.RawData
+	}
+	return json.Marshal(event)
+}
+
+func (CloudEventsEncoder) MessageType() int {
+	return websocket.TextMessage
+}
+
+// ProtobufEncoder sends records as protobuf messages described by pkg/api/logsocket/logsocket.proto
+type ProtobufEncoder struct{}
+
+const (
+	pbFieldFlowKind = iota + 1
+	pbFieldFlowNamespace
+	pbFieldFlowName
+	pbFieldNamespace
+	pbFieldPod
+	pbFieldContainer
+	pbFieldLevel
+	pbFieldMessage
+	pbFieldRawData
+	pbFieldLabels
+	pbFieldSequence
+	pbFieldReceivedAt
+	pbFieldTime
+	pbFieldClockSkewed
+	pbFieldSeverity
+)
+
+func (ProtobufEncoder) Encode(r Record) ([]byte, error) {
+	var b []byte
+	b = appendPBString(b, pbFieldFlowKind, string(r.Flow.Kind))
+	b = appendPBString(b, pbFieldFlowNamespace, r.Flow.Namespace)
+	b = appendPBString(b, pbFieldFlowName, r.Flow.Name)
+	b = appendPBString(b, pbFieldNamespace, r.Meta.Namespace)
+	b = appendPBString(b, pbFieldPod, r.Meta.Pod)
+	b = appendPBString(b, pbFieldContainer, r.Meta.Container)
+	b = appendPBString(b, pbFieldLevel, r.Meta.Level)
+	b = appendPBString(b, pbFieldMessage, r.Message())
+	if len(r.RawData) > 0 {
+		b = protowire.AppendTag(b, pbFieldRawData, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.RawData)
+	}
+	for k, v := range r.Meta.Labels {
+		// map entries are encoded as embedded messages with the key as field 1 and the value as field 2
+		var entry []byte
+		entry = appendPBString(entry, 1, k)
+		entry = appendPBString(entry, 2, v)
+		b = protowire.AppendTag(b, pbFieldLabels, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	if r.Sequence > 0 {
+		b = protowire.AppendTag(b, pbFieldSequence, protowire.VarintType)
+		b = protowire.AppendVarint(b, r.Sequence)
+	}
+	if !r.ReceivedAt.IsZero() {
+		b = protowire.AppendTag(b, pbFieldReceivedAt, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(r.ReceivedAt.UnixNano()))
+	}
+	if t := r.Time(); !t.IsZero() {
+		b = protowire.AppendTag(b, pbFieldTime, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(t.UnixNano()))
+	}
+	if r.ClockSkewed {
+		b = protowire.AppendTag(b, pbFieldClockSkewed, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	b = appendPBString(b, pbFieldSeverity, r.Meta.Severity.String())
+	return b, nil
+}
+
+func (ProtobufEncoder) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+const (
+	BinaryEnvelopeMediaType = "application/vnd.log-socket.envelope"
+	BinaryEnvelopeVersion   = 1
+
+	// BinaryFlagClockSkewed tells that the record's timestamp was further from the time it was received than the maximum clock skew
+	BinaryFlagClockSkewed = 1 << 0
+	// BinaryFlagNormalizedTime tells that the timestamp is the time the record was received rather than its own
+	BinaryFlagNormalizedTime = 1 << 1
+
+	binaryEnvelopeHeaderSize = 1 + 1 + 2 + 8 + 8 + 4
+)
+
+// BinaryEncoder wraps the record's data in a compact binary envelope carrying its routing metadata, all integers big-endian:
+// version (1 byte), flags (1 byte), flow reference length (2 bytes), flow reference in kind/namespace/name form,
+// sequence number (8 bytes), timestamp in Unix nanoseconds, zero if unknown (8 bytes), data length (4 bytes), data
+// Envelopes are self-delimiting, so length-prefixed batches can also be read by skipping the batch's size prefixes
+type BinaryEncoder struct{}
+
+func (BinaryEncoder) Encode(r Record) ([]byte, error) {
+	flow := r.Flow.URL()
+	if len(flow) > math.MaxUint16 {
+		return nil, fmt.Errorf("flow reference of %d bytes is too long for binary envelopes", len(flow))
+	}
+	var flags byte
+	if r.ClockSkewed {
+		flags |= BinaryFlagClockSkewed
+	}
+	if !r.EventTime.IsZero() {
+		flags |= BinaryFlagNormalizedTime
+	}
+	var timestamp int64
+	if t := r.Time(); !t.IsZero() {
+		timestamp = t.UnixNano()
+	}
+
+	b := make([]byte, binaryEnvelopeHeaderSize+len(flow)+len(r.RawData))
+	b[0], b[1] = BinaryEnvelopeVersion, flags
+	binary.BigEndian.PutUint16(b[2:], uint16(len(flow)))
+	n := 4 + copy(b[4:], flow)
+	binary.BigEndian.PutUint64(b[n:], r.Sequence)
+	binary.BigEndian.PutUint64(b[n+8:], uint64(timestamp))
+	binary.BigEndian.PutUint32(b[n+16:], uint32(len(r.RawData)))
+	copy(b[n+20:], r.RawData)
+	return b, nil
+}
+
+func (BinaryEncoder) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+// binaryEncoding reports whether the encoder produces binary messages that carry the routing metadata of records
+func binaryEncoding(enc Encoder) bool {
+	switch enc.(type) {
+	case ProtobufEncoder, BinaryEncoder:
+		return true
+	default:
+		return false
+	}
+}
+
+func appendPBString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	podMetadataTTL        = 30 * time.Second
+	podMetadataCacheLimit = 10000
+)
+
+// PodMetadata is the context records of a pod are enriched with
+type PodMetadata struct {
+	Node         string
+	WorkloadKind string
+	WorkloadName string
+	Annotations  map[string]string
+}
+
+// PodMetadataSource looks up the metadata of pods
+type PodMetadataSource interface {
+	PodMetadata(namespace string, name string) (PodMetadata, bool)
+}
+
+type EnrichmentMetrics interface {
+	LogRecordNotEnriched(r Record)
+}
+
+// Enrich adds the node name, owner workload and selected annotations of the pod of ingested JSON records to their kubernetes field before pushing them to records
+// Records of pods the source does not know are pushed as they are
+func Enrich(records RecordSink, source PodMetadataSource, annotations []string, logs log.Sink, metrics EnrichmentMetrics) RecordSink {
+	return enricher{
+		annotations: annotations,
+		logs:        logs,
+		metrics:     metrics,
+		records:     records,
+		source:      source,
+	}
+}
+
+type enricher struct {
+	annotations []string
+	logs        log.Sink
+	metrics     EnrichmentMetrics
+	records     RecordSink
+	source      PodMetadataSource
+}
+
+func (e enricher) Push(r Record) {
+	e.records.Push(e.enrich(r))
+}
+
+func (e enricher) enrich(r Record) Record {
+	if r.Meta.Namespace == "" || r.Meta.Pod == "" {
+		return r
+	}
+	meta, ok := e.source.PodMetadata(r.Meta.Namespace, r.Meta.Pod)
+	if !ok {
+		e.metrics.LogRecordNotEnriched(r)
+		return r
+	}
+	decoder := json.NewDecoder(bytes.NewReader(r.RawData))
+	decoder.UseNumber()
+	var data map[string]interface{}
+	if err := decoder.Decode(&data); err != nil {
+		return r
+	}
+	kubernetes, _ := data["kubernetes"].(map[string]interface{})
+	if kubernetes == nil {
+		kubernetes = make(map[string]interface{})
+		data["kubernetes"] = kubernetes
+	}
+	if meta.Node != "" {
+		kubernetes["node_name"] = meta.Node
+	}
+	if meta.WorkloadKind != "" {
+		kubernetes["workload"] = map[string]interface{}{"kind": meta.WorkloadKind, "name": meta.WorkloadName}
+	}
+	annotations, _ := kubernetes["annotations"].(map[string]interface{})
+	for _, key := range e.annotations {
+		if value, ok := meta.Annotations[key]; ok {
+			if annotations == nil {
+				annotations = make(map[string]interface{})
+				kubernetes["annotations"] = annotations
+			}
+			annotations[key] = value
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(data); err != nil {
+		log.Event(e.logs, "failed to encode enriched record", log.V(1), log.Error(err), log.Fields{"flow": r.Flow})
+		return r
+	}
+	return withData(r, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// NewKubernetesPodMetadata returns a source looking up pods and their owners in the informer cache, which knows no pods until it is synced by Run
+func NewKubernetesPodMetadata(c cache.Cache, logs log.Sink) *KubernetesPodMetadata {
+	return &KubernetesPodMetadata{
+		cache:   c,
+		entries: make(map[types.NamespacedName]podMetadataEntry),
+		logs:    log.WithFields(logs, log.Fields{"task": "pod metadata"}),
+	}
+}
+
+// KubernetesPodMetadata resolves the workload of pods owned by replica sets to their deployment and that of pods owned by jobs to their cron job
+// The metadata of each pod is kept for podMetadataTTL so that the cache is not queried for every record
+type KubernetesPodMetadata struct {
+	cache  cache.Cache
+	logs   log.Sink
+	synced uint32
+
+	mutex   sync.Mutex
+	entries map[types.NamespacedName]podMetadataEntry
+}
+
+type podMetadataEntry struct {
+	meta      PodMetadata
+	found     bool
+	expiresAt time.Time
+}
+
+// Run starts the informers of pods, replica sets and jobs, and waits for them to sync until the context is done
+func (m *KubernetesPodMetadata) Run(ctx context.Context) {
+	for _, obj := range []client.Object{&corev1.Pod{}, &appsv1.ReplicaSet{}, &batchv1.Job{}} {
+		if _, err := m.cache.GetInformer(ctx, obj); err != nil {
+			log.Event(m.logs, "failed to start informer", log.Error(err), log.Fields{"type": obj})
+			return
+		}
+	}
+	go func() {
+		if err := m.cache.Start(ctx); err != nil {
+			log.Event(m.logs, "informer cache stopped", log.Error(err))
+		}
+	}()
+	if !m.cache.WaitForCacheSync(ctx) {
+		return
+	}
+	atomic.StoreUint32(&m.synced, 1)
+	log.Event(m.logs, "informer cache synced", log.V(1))
+}
+
+func (m *KubernetesPodMetadata) PodMetadata(namespace string, name string) (PodMetadata, bool) {
+	if atomic.LoadUint32(&m.synced) == 0 {
+		return PodMetadata{}, false
+	}
+	key := types.NamespacedName{Namespace: namespace, Name: name}
+	now := time.Now()
+	m.mutex.Lock()
+	entry, ok := m.entries[key]
+	m.mutex.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.meta, entry.found
+	}
+
+	entry = podMetadataEntry{expiresAt: now.Add(podMetadataTTL)}
+	entry.meta, entry.found = m.lookup(key)
+	m.mutex.Lock()
+	if len(m.entries) >= podMetadataCacheLimit {
+		for k, e := range m.entries {
+			if !now.Before(e.expiresAt) {
+				delete(m.entries, k)
+			}
+		}
+	}
+	if len(m.entries) < podMetadataCacheLimit {
+		m.entries[key] = entry
+	}
+	m.mutex.Unlock()
+	return entry.meta, entry.found
+}
+
+func (m *KubernetesPodMetadata) lookup(key types.NamespacedName) (PodMetadata, bool) {
+	ctx := context.Background()
+	var pod corev1.Pod
+	if err := m.cache.Get(ctx, key, &pod); err != nil {
+		log.Event(m.logs, "pod of record not found", log.V(2), log.Error(err), log.Fields{"pod": key})
+		return PodMetadata{}, false
+	}
+	res := PodMetadata{Node: pod.Spec.NodeName, Annotations: pod.Annotations}
+	owner := metav1.GetControllerOf(&pod)
+	if owner == nil {
+		return res, true
+	}
+	res.WorkloadKind, res.WorkloadName = owner.Kind, owner.Name
+
+	// the owners of replica sets and jobs are looked up as well, since pods are rarely managed by them directly
+	var parent client.Object
+	switch owner.Kind {
+	case "ReplicaSet":
+		parent = &appsv1.ReplicaSet{}
+	case "Job":
+		parent = &batchv1.Job{}
+	default:
+		return res, true
+	}
+	if err := m.cache.Get(ctx, types.NamespacedName{Namespace: key.Namespace, Name: owner.Name}, parent); err != nil {
+		log.Event(m.logs, "owner of pod not found", log.V(2), log.Error(err), log.Fields{"pod": key, "owner": owner.Name})
+		return res, true
+	}
+	if parentOwner := metav1.GetControllerOf(parent); parentOwner != nil {
+		res.WorkloadKind, res.WorkloadName = parentOwner.Kind, parentOwner.Name
+	}
+	return res, true
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+const (
+	FilterParamContainer = "container"
+	FilterParamLevel     = "level"
+	FilterParamNamespace = "namespace"
+	FilterParamPod       = "pod"
+
+	FilterParamContainerRegex = "containerRegex"
+	FilterParamNamespaceRegex = "namespaceRegex"
+	FilterParamPodRegex       = "podRegex"
+)
+
+// filterRegexParams are the parameters matching names by regular expressions, by the parameters matching them literally
+var filterRegexParams = map[string]string{
+	FilterParamContainer: FilterParamContainerRegex,
+	FilterParamNamespace: FilterParamNamespaceRegex,
+	FilterParamPod:       FilterParamPodRegex,
+}
+
+// RecordFilter selects records by matching their metadata against regular expressions, nil expressions match everything
+type RecordFilter struct {
+	Container *regexp.Regexp
+	Level     *regexp.Regexp
+	Namespace *regexp.Regexp
+	Pod       *regexp.Regexp
+	// MinSeverity only matches records of at least this severity, records of unknown severity included if it is SeverityUnknown
+	MinSeverity Severity
+	// Selector restricts the records to those of the pods it selects, if not nil
+	Selector *LabelSelector
+}
+
+// ParseRecordFilter builds a filter from the query parameters of a listener connection request
+// The pod, container and namespace parameters match names literally, their podRegex, containerRegex and namespaceRegex counterparts by regular expressions
+// Expressions must match the whole field value, levels are matched case-insensitively
+func ParseRecordFilter(query url.Values) (res RecordFilter, err error) {
+	if res.Container, err = compileNameFilterParam(query, FilterParamContainer); err != nil {
+		return
+	}
+	if res.Level, err = compileFilterParam(query.Get(FilterParamLevel), FilterParamLevel, "(?i)"); err != nil {
+		return
+	}
+	if res.Namespace, err = compileNameFilterParam(query, FilterParamNamespace); err != nil {
+		return
+	}
+	if res.Pod, err = compileNameFilterParam(query, FilterParamPod); err != nil {
+		return
+	}
+	res.MinSeverity, err = ParseMinSeverity(query.Get(FilterParamMinLevel))
+	return
+}
+
+// compileNameFilterParam compiles the name of the parameter matched literally or the expression of its regular expression counterpart, only one of which can be set
+func compileNameFilterParam(query url.Values, name string) (*regexp.Regexp, error) {
+	regexName := filterRegexParams[name]
+	literal, expr := query.Get(name), query.Get(regexName)
+	if literal != "" {
+		if expr != "" {
+			return nil, fmt.Errorf("the %s and %s filters cannot be combined", name, regexName)
+		}
+		return compileFilterParam(regexp.QuoteMeta(literal), name, "")
+	}
+	return compileFilterParam(expr, regexName, "")
+}
+
+// compileFilterParam compiles the expression of the parameter, no expression matches everything
+func compileFilterParam(expr string, name string, flags string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(flags + "^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s filter: %w", name, err)
+	}
+	return re, nil
+}
+
+func (f RecordFilter) Matches(r Record) bool {
+	return matchFilter(f.Container, r.Meta.Container) &&
+		matchFilter(f.Level, r.Meta.Level) &&
+		matchFilter(f.Namespace, r.Meta.Namespace) &&
+		matchFilter(f.Pod, r.Meta.Pod) &&
+		(f.MinSeverity == SeverityUnknown || r.Meta.Severity >= f.MinSeverity) &&
+		(f.Selector == nil || f.Selector.Matches(r))
+}
+
+func matchFilter(re *regexp.Regexp, value string) bool {
+	return re == nil || re.MatchString(value)
+}
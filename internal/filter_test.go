@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseRecordFilterNames(t *testing.T) {
+	tests := []struct {
+		param, value string
+		pod          string
+		matches      bool
+	}{
+		{FilterParamPod, "acme-app-7d4f9", "acme-app-7d4f9", true},
+		{FilterParamPod, "acme-app-7d4f9", "acme-app-7d4f9x", false},
+		{FilterParamPod, "app.v1", "app.v1", true},
+		{FilterParamPod, "app.v1", "appxv1", false},
+		{FilterParamPod, "acme-app-.*", "acme-app-7d4f9", false},
+		{FilterParamPod, "acme-app-.*", "acme-app-.*", true},
+		{FilterParamPodRegex, "acme-app-.*", "acme-app-7d4f9", true},
+		{FilterParamPodRegex, "app.v1", "appxv1", true},
+		{FilterParamPodRegex, "api-.", "api-x", true},
+		{FilterParamPodRegex, "api-.", "api-xy", false},
+		{FilterParamLevel, "warn|error", "", true},
+	}
+	for _, test := range tests {
+		filter, err := ParseRecordFilter(url.Values{test.param: {test.value}})
+		if err != nil {
+			t.Fatalf("%s=%s: %v", test.param, test.value, err)
+		}
+		r := Record{Meta: RecordMeta{Pod: test.pod, Level: "WARN"}}
+		if got := filter.Matches(r); got != test.matches {
+			t.Errorf("%s=%s matching pod %q is %t instead of %t", test.param, test.value, test.pod, got, test.matches)
+		}
+	}
+}
+
+func TestParseRecordFilterRejectsLiteralAndRegexNames(t *testing.T) {
+	for literal, regex := range filterRegexParams {
+		if _, err := ParseRecordFilter(url.Values{literal: {"app"}, regex: {"app-.*"}}); err == nil {
+			t.Errorf("%s and %s were combined", literal, regex)
+		}
+	}
+	if _, err := ParseRecordFilter(url.Values{FilterParamPodRegex: {"("}}); err == nil {
+		t.Error("an invalid expression was accepted")
+	}
+}
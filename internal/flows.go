@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	loggingv1beta1 "github.com/banzaicloud/logging-operator/pkg/sdk/logging/api/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// FlowsEndpoint lists the flows the authenticated user is allowed to tail
+const FlowsEndpoint = "/flows"
+
+// FlowLister lists the flows that exist in the cluster
+type FlowLister interface {
+	ListFlows(ctx context.Context) ([]FlowReference, error)
+}
+
+// KubernetesFlowLister lists the Flow and ClusterFlow resources of all namespaces
+type KubernetesFlowLister struct {
+	Client client.Client
+}
+
+func (l KubernetesFlowLister) ListFlows(ctx context.Context) ([]FlowReference, error) {
+	var flows loggingv1beta1.FlowList
+	if err := l.Client.List(ctx, &flows); err != nil {
+		return nil, err
+	}
+	var clusterFlows loggingv1beta1.ClusterFlowList
+	if err := l.Client.List(ctx, &clusterFlows); err != nil {
+		return nil, err
+	}
+	res := make([]FlowReference, 0, len(flows.Items)+len(clusterFlows.Items))
+	for _, f := range flows.Items {
+		res = append(res, FlowReference{NamespacedName: types.NamespacedName{Namespace: f.Namespace, Name: f.Name}, Kind: FKFlow})
+	}
+	for _, f := range clusterFlows.Items {
+		if strings.HasPrefix(f.Name, SelectorFlowPrefix) {
+			// generated for label selectors
+			continue
+		}
+		res = append(res, FlowReference{NamespacedName: types.NamespacedName{Namespace: f.Namespace, Name: f.Name}, Kind: FKClusterFlow})
+	}
+	sortFlows(res)
+	return res, nil
+}
+
+// FlowInfo describes a flow listed by the flows endpoint
+type FlowInfo struct {
+	Kind      FlowKind `json:"kind"`
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	// Flow is the flow reference in kind/namespace/name form, as accepted by listener requests
+	Flow string `json:"flow"`
+}
+
+// serveFlows responds to requests of the flows endpoint, it reports whether the request was handled
+func serveFlows(w http.ResponseWriter, r *http.Request, lister FlowLister, authenticator Authenticator, authorizer Authorizer, tenancy Tenancy, logs log.Sink) bool {
+	if lister == nil || r.URL.Path != FlowsEndpoint {
+		return false
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+	usrInfo, _, ok := authenticateRequest(w, r, authenticator, tenancy, logs)
+	if !ok {
+		return true
+	}
+
+	flows, err := lister.ListFlows(r.Context())
+	if err != nil {
+		log.Event(logs, "failed to list flows", log.Error(err))
+		http.Error(w, "failed to list flows", http.StatusInternalServerError)
+		return true
+	}
+	res := make([]FlowInfo, 0, len(flows))
+	for _, flow := range flows {
+		allowed, err := authorizer.AuthorizeFlow(usrInfo, flow)
+		if err != nil {
+			log.Event(logs, "authorization failed", log.V(1), log.Error(err), log.Fields{"user": usrInfo, "flow": flow})
+			continue
+		}
+		if allowed {
+			res = append(res, FlowInfo{Kind: flow.Kind, Namespace: flow.Namespace, Name: flow.Name, Flow: flow.URL()})
+		}
+	}
+	log.Event(logs, "listed flows", log.V(1), log.Fields{"user": usrInfo, "flows": len(res)})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Event(logs, "failed to write flows response", log.V(1), log.Error(err))
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	loggingv1beta1 "github.com/banzaicloud/logging-operator/pkg/sdk/logging/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const DefaultFlowWatchRetryInterval = 10 * time.Second
+
+// NewFlowWatcher returns a watcher of the Flow and ClusterFlow resources of the cluster notifying the listeners of the registry about changes of their flows
+func NewFlowWatcher(c client.WithWatch, registry *FlowRegistry, logs log.Sink) *FlowWatcher {
+	return &FlowWatcher{
+		client:   c,
+		logs:     log.WithFields(logs, log.Fields{"task": "flow watch"}),
+		registry: registry,
+	}
+}
+
+// FlowWatcher closes the connections of listeners of deleted flows, or unsubscribes multiplexed ones from them, and tells listeners when the match rules of their flows change
+type FlowWatcher struct {
+	client   client.WithWatch
+	logs     log.Sink
+	registry *FlowRegistry
+}
+
+// Run watches flows and cluster flows until the stop signal is closed, watches that fail are restarted after retryInterval
+func (w *FlowWatcher) Run(retryInterval time.Duration, stopSignal <-chan struct{}) {
+	if retryInterval <= 0 {
+		retryInterval = DefaultFlowWatchRetryInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.watchKind(ctx, FKFlow, func() client.ObjectList { return &loggingv1beta1.FlowList{} }, retryInterval)
+	go w.watchKind(ctx, FKClusterFlow, func() client.ObjectList { return &loggingv1beta1.ClusterFlowList{} }, retryInterval)
+	<-stopSignal
+}
+
+// watchKind lists the flows of the kind and watches them from the version of the list, listing them again whenever the watch ends
+// Flows missing from a list were deleted while they were not watched
+func (w *FlowWatcher) watchKind(ctx context.Context, kind FlowKind, newList func() client.ObjectList, retryInterval time.Duration) {
+	var matches map[FlowReference]string
+	for {
+		err := func() error {
+			list := newList()
+			if err := w.client.List(ctx, list); err != nil {
+				return err
+			}
+			objs, err := flowObjects(list)
+			if err != nil {
+				return err
+			}
+			current := make(map[FlowReference]string, len(objs))
+			for _, obj := range objs {
+				flow, match := flowMatch(obj, kind)
+				current[flow] = match
+				if old, ok := matches[flow]; ok && old != match {
+					w.flowChanged(flow)
+				}
+			}
+			if matches != nil {
+				for flow := range matches {
+					if _, ok := current[flow]; !ok {
+						w.flowDeleted(flow)
+					}
+				}
+			}
+			matches = current
+
+			watcher, err := w.client.Watch(ctx, newList(), &client.ListOptions{Raw: &metav1.ListOptions{ResourceVersion: list.GetResourceVersion()}})
+			if err != nil {
+				return err
+			}
+			defer watcher.Stop()
+			for event := range watcher.ResultChan() {
+				if event.Type == watch.Error {
+					return fmt.Errorf("watch failed: %v", event.Object)
+				}
+				obj, ok := event.Object.(client.Object)
+				if !ok {
+					continue
+				}
+				flow, match := flowMatch(obj, kind)
+				switch event.Type {
+				case watch.Added:
+					matches[flow] = match
+				case watch.Modified:
+					if old, ok := matches[flow]; ok && old != match {
+						w.flowChanged(flow)
+					}
+					matches[flow] = match
+				case watch.Deleted:
+					delete(matches, flow)
+					w.flowDeleted(flow)
+				}
+			}
+			return nil
+		}()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Event(w.logs, "failed to watch flows", log.Error(err), log.Fields{"kind": kind, "retryInterval": retryInterval})
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryInterval):
+			}
+		}
+	}
+}
+
+func flowObjects(list client.ObjectList) ([]client.Object, error) {
+	var res []client.Object
+	switch l := list.(type) {
+	case *loggingv1beta1.FlowList:
+		for i := range l.Items {
+			res = append(res, &l.Items[i])
+		}
+	case *loggingv1beta1.ClusterFlowList:
+		for i := range l.Items {
+			res = append(res, &l.Items[i])
+		}
+	default:
+		return nil, fmt.Errorf("unexpected list type %T", list)
+	}
+	return res, nil
+}
+
+// flowMatch returns the reference of the flow and its match rules encoded as JSON, which are compared to detect changes
+func flowMatch(obj client.Object, kind FlowKind) (FlowReference, string) {
+	flow := FlowReference{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}, Kind: kind}
+	var rules interface{}
+	switch f := obj.(type) {
+	case *loggingv1beta1.Flow:
+		rules = []interface{}{f.Spec.Selectors, f.Spec.Match}
+	case *loggingv1beta1.ClusterFlow:
+		rules = []interface{}{f.Spec.Selectors, f.Spec.Match}
+	}
+	data, _ := json.Marshal(rules)
+	return flow, string(data)
+}
+
+func (w *FlowWatcher) flowDeleted(flow FlowReference) {
+	listeners := w.registry.Listeners(flow)
+	log.Event(w.logs, "flow deleted", log.V(1), log.Fields{"flow": flow, "listeners": len(listeners)})
+	for _, l := range listeners {
+		if s, ok := l.(subscription); ok {
+			s.withdraw(flow, CloseFlowDeleted, fmt.Sprintf("%s has been deleted", flow.URL()))
+		}
+	}
+}
+
+func (w *FlowWatcher) flowChanged(flow FlowReference) {
+	listeners := w.registry.Listeners(flow)
+	log.Event(w.logs, "match rules of flow changed", log.V(1), log.Fields{"flow": flow, "listeners": len(listeners)})
+	for _, l := range listeners {
+		if s, ok := l.(subscription); ok {
+			s.sendControl(ControlMessage{Control: ControlFlowChanged, Message: "the match rules of the flow have changed", Flow: flow.URL()})
+		}
+	}
+}
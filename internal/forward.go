@@ -0,0 +1,371 @@
+package internal
+
+import (
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+	"github.com/banzaicloud/log-socket/pkg/msgpack"
+)
+
+// ForwardOptions holds the settings of the Fluentd forward protocol receiver
+type ForwardOptions struct {
+	// SharedKey enables the forward protocol handshake, forwarders have to prove they know the key
+	SharedKey string
+	// Hostname is the server hostname sent to forwarders during the handshake
+	Hostname string
+	// TLSConfig enables TLS for the receiver
+	TLSConfig *tls.Config
+	// DeadLetters receives the entries that are not valid records, nil disables dead letters
+	DeadLetters *DeadLetters
+}
+
+const forwardHandshakeTimeout = 10 * time.Second
+
+// IngestForward receives records over the Fluentd forward protocol (msgpack over TCP)
+// Records are routed to the flow named by the user name sent during the handshake, or else by their tag in kind.namespace.name form
+func IngestForward(addr string, records RecordSink, logs log.Sink, metrics IngestMetrics, stopSignal Handleable, opts ForwardOptions) {
+	logs = log.WithFields(logs, log.Fields{"task": "forward ingestion"})
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Event(logs, "forward receiver failed to listen", log.Error(err), log.Fields{"addr": addr})
+		return
+	}
+	if opts.TLSConfig != nil {
+		ln = tls.NewListener(ln, opts.TLSConfig)
+	}
+
+	srv := &forwardServer{
+		conns:   make(map[net.Conn]struct{}),
+		logs:    logs,
+		metrics: metrics,
+		opts:    opts,
+		records: records,
+	}
+	if stopSignal != nil {
+		stopSignal.HandleWith(func() {
+			if err := ln.Close(); err != nil {
+				log.Event(logs, "error during forward receiver shutdown", log.Error(err))
+			}
+			srv.closeAll()
+		})
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Event(logs, "forward receiver failed to accept connection", log.Error(err))
+			}
+			break
+		}
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			srv.serve(conn)
+		}()
+	}
+	srv.wg.Wait()
+}
+
+type forwardServer struct {
+	conns   map[net.Conn]struct{}
+	logs    log.Sink
+	metrics IngestMetrics
+	mutex   sync.Mutex
+	opts    ForwardOptions
+	records RecordSink
+	wg      sync.WaitGroup
+}
+
+func (s *forwardServer) closeAll() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *forwardServer) serve(conn net.Conn) {
+	s.mutex.Lock()
+	s.conns[conn] = struct{}{}
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+
+	logs := log.WithFields(s.logs, log.Fields{"remoteAddr": conn.RemoteAddr().String()})
+	dec := msgpack.NewDecoder(conn)
+
+	var flow FlowReference
+	if s.opts.SharedKey != "" {
+		var err error
+		if flow, err = s.handshake(conn, dec); err != nil {
+			log.Event(logs, "forward handshake failed", log.V(1), log.Error(err))
+			s.metrics.IngestRejected("invalid shared key")
+			return
+		}
+	}
+
+	for {
+		v, err := dec.Decode()
+		if err != nil {
+			if err != io.EOF {
+				log.Event(logs, "failed to decode forwarded message", log.V(1), log.Error(err))
+				s.metrics.IngestParseFailed(ReceiverForward)
+			}
+			return
+		}
+		msg, ok := v.([]interface{})
+		if !ok || len(msg) < 2 {
+			log.Event(logs, "forwarded message is not an array", log.V(1))
+			return
+		}
+
+		msgFlow := flow
+		if msgFlow == (FlowReference{}) {
+			if msgFlow, err = flowFromTag(forwardString(msg[0])); err != nil {
+				log.Event(logs, "forwarded message tag is not a valid flow reference", log.V(1), log.Error(err))
+				return
+			}
+		}
+
+		option, err := s.pushEntries(msgFlow, msg)
+		if err != nil {
+			log.Event(logs, "failed to process forwarded message", log.V(1), log.Error(err))
+			return
+		}
+		if chunk := forwardString(option["chunk"]); chunk != "" {
+			ack := msgpack.AppendMapHeader(nil, 1)
+			ack = msgpack.AppendString(ack, "ack")
+			ack = msgpack.AppendString(ack, chunk)
+			if _, err := conn.Write(ack); err != nil {
+				log.Event(logs, "failed to acknowledge forwarded chunk", log.V(1), log.Error(err))
+				return
+			}
+		}
+	}
+}
+
+// pushEntries pushes the records of a message in any of the Message, Forward, PackedForward or CompressedPackedForward modes and returns its options
+func (s *forwardServer) pushEntries(flow FlowReference, msg []interface{}) (option map[interface{}]interface{}, err error) {
+	receivedAt := time.Now()
+	switch entries := msg[1].(type) {
+	case []interface{}: // Forward
+		if len(msg) > 2 {
+			option, _ = msg[2].(map[interface{}]interface{})
+		}
+		for _, entry := range entries {
+			if err := s.pushEntry(flow, entry, receivedAt); err != nil {
+				return nil, err
+			}
+		}
+	case string, []byte: // PackedForward, CompressedPackedForward
+		if len(msg) > 2 {
+			option, _ = msg[2].(map[interface{}]interface{})
+		}
+		var r io.Reader = strings.NewReader(forwardString(entries))
+		if forwardString(option["compressed"]) == "gzip" {
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			defer gz.Close()
+			r = gz
+		}
+		dec := msgpack.NewDecoder(r)
+		for {
+			entry, err := dec.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := s.pushEntry(flow, entry, receivedAt); err != nil {
+				return nil, err
+			}
+		}
+	default: // Message
+		if len(msg) < 3 {
+			return nil, errors.New("message has no record")
+		}
+		if len(msg) > 3 {
+			option, _ = msg[3].(map[interface{}]interface{})
+		}
+		if err := s.pushEntry(flow, []interface{}{msg[1], msg[2]}, receivedAt); err != nil {
+			return nil, err
+		}
+	}
+	return option, nil
+}
+
+func (s *forwardServer) pushEntry(flow FlowReference, entry interface{}, receivedAt time.Time) error {
+	e, ok := entry.([]interface{})
+	if !ok || len(e) < 2 {
+		return errors.New("entry is not a [time, record] pair")
+	}
+	data, err := json.Marshal(jsonCompatible(e[1]))
+	if err != nil {
+		return err
+	}
+
+	rec := Record{
+		RawData:    data,
+		Flow:       flow,
+		ReceivedAt: receivedAt,
+	}
+	s.metrics.LogRecordReceived(ReceiverForward, rec)
+	if rec.Meta, err = ParseRecordMeta(data); err != nil {
+		s.metrics.IngestParseFailed(ReceiverForward)
+		if s.opts.DeadLetters != nil {
+			s.opts.DeadLetters.Reject(ReceiverForward, flow, data, DeadLetterUnparsable, err)
+			return nil
+		}
+		return fmt.Errorf("failed to parse log data: %w", err)
+	}
+	if s.opts.DeadLetters.Unattributed(ReceiverForward, rec) {
+		return nil
+	}
+	log.Event(s.logs, "ingested log record via forward protocol", log.V(1), log.Fields{"record": rec})
+	s.records.Push(rec)
+	return nil
+}
+
+// handshake authenticates the forwarder with the shared key and returns the flow named by its user name, if any
+func (s *forwardServer) handshake(conn net.Conn, dec *msgpack.Decoder) (flow FlowReference, err error) {
+	if err = conn.SetDeadline(time.Now().Add(forwardHandshakeTimeout)); err != nil {
+		return
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, 16)
+	authSalt := make([]byte, 16)
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	if _, err = rand.Read(authSalt); err != nil {
+		return
+	}
+
+	helo := msgpack.AppendArrayHeader(nil, 2)
+	helo = msgpack.AppendString(helo, "HELO")
+	helo = msgpack.AppendMapHeader(helo, 3)
+	helo = msgpack.AppendString(helo, "nonce")
+	helo = msgpack.AppendBytes(helo, nonce)
+	// requesting user authentication makes forwarders send their user name, which selects the flow
+	helo = msgpack.AppendString(helo, "auth")
+	helo = msgpack.AppendBytes(helo, authSalt)
+	helo = msgpack.AppendString(helo, "keepalive")
+	helo = msgpack.AppendBool(helo, true)
+	if _, err = conn.Write(helo); err != nil {
+		return
+	}
+
+	v, err := dec.Decode()
+	if err != nil {
+		return
+	}
+	ping, ok := v.([]interface{})
+	if !ok || len(ping) < 4 || forwardString(ping[0]) != "PING" {
+		return flow, errors.New("expected PING message")
+	}
+	clientHostname, sharedKeySalt, digest := forwardString(ping[1]), forwardString(ping[2]), forwardString(ping[3])
+	if digest != s.sharedKeyDigest(sharedKeySalt, clientHostname, nonce) {
+		s.pong(conn, false, "shared key mismatch", sharedKeySalt, nonce)
+		return flow, errors.New("shared key mismatch")
+	}
+	if len(ping) > 4 {
+		if username := forwardString(ping[4]); username != "" {
+			if flow, err = parseRecordFlow(username); err != nil {
+				s.pong(conn, false, "user name is not a flow reference", sharedKeySalt, nonce)
+				return
+			}
+		}
+	}
+	return flow, s.pong(conn, true, "", sharedKeySalt, nonce)
+}
+
+func (s *forwardServer) pong(conn net.Conn, ok bool, reason string, sharedKeySalt string, nonce []byte) error {
+	hostname := s.opts.Hostname
+	digest := ""
+	if ok {
+		digest = s.sharedKeyDigest(sharedKeySalt, hostname, nonce)
+	}
+	pong := msgpack.AppendArrayHeader(nil, 5)
+	pong = msgpack.AppendString(pong, "PONG")
+	pong = msgpack.AppendBool(pong, ok)
+	pong = msgpack.AppendString(pong, reason)
+	pong = msgpack.AppendString(pong, hostname)
+	pong = msgpack.AppendString(pong, digest)
+	_, err := conn.Write(pong)
+	return err
+}
+
+func (s *forwardServer) sharedKeyDigest(salt string, hostname string, nonce []byte) string {
+	h := sha512.New()
+	h.Write([]byte(salt))
+	h.Write([]byte(hostname))
+	h.Write(nonce)
+	h.Write([]byte(s.opts.SharedKey))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// flowFromTag parses tags in kind.namespace.name form, names may contain dots
+func flowFromTag(tag string) (FlowReference, error) {
+	parts := strings.SplitN(tag, ".", 3)
+	if len(parts) != 3 {
+		return FlowReference{}, fmt.Errorf("tag %q is not in kind.namespace.name form", tag)
+	}
+	return parseRecordFlow(strings.Join(parts, "/"))
+}
+
+func forwardString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return ""
+	}
+}
+
+// jsonCompatible converts decoded msgpack values so that they can be marshaled as JSON
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			res[fmt.Sprint(k)] = jsonCompatible(item)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, item := range v {
+			res[i] = jsonCompatible(item)
+		}
+		return res
+	case []byte:
+		return string(v)
+	case msgpack.Ext:
+		return nil
+	default:
+		return v
+	}
+}
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"reflect"
+	"sync"
+)
+
+// encodedFrames holds the encodings of a record computed so far, it is shared by the copies of the record handed to listeners
+// Encoded frames are never modified once computed, so that listeners of the same flow can write the same buffer
+type encodedFrames struct {
+	mutex  sync.Mutex
+	frames map[Encoder]*encodedFrame
+}
+
+type encodedFrame struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// shareEncodings makes the copies of the record encode it at most once for each encoder
+func shareEncodings(r Record) Record {
+	r.frames = &encodedFrames{frames: make(map[Encoder]*encodedFrame)}
+	return r
+}
+
+// encodeShared encodes the record with enc, reusing the frame encoded for another listener if the record is shared
+// Records whose data has been changed for a listener, and encoders holding state, are encoded each time
+func encodeShared(enc Encoder, r Record) ([]byte, error) {
+	if r.frames == nil || !reflect.TypeOf(enc).Comparable() {
+		return enc.Encode(r)
+	}
+
+	r.frames.mutex.Lock()
+	f := r.frames.frames[enc]
+	if f == nil {
+		f = &encodedFrame{}
+		r.frames.frames[enc] = f
+	}
+	r.frames.mutex.Unlock()
+
+	f.once.Do(func() {
+		f.data, f.err = enc.Encode(r)
+	})
+	return f.data, f.err
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+// sharedFrameEncoders are the encoders of the listeners of a flow in the shared frame benchmark
+var sharedFrameEncoders = []Encoder{NDJSONEncoder{}, ProtobufEncoder{}, CloudEventsEncoder{}}
+
+// encodeForListeners encodes a record shared like those of the replay buffer for each of the listeners, the encoders being spread evenly over them
+// It returns the frame of each encoder and fails if a listener did not get the same buffer as the others using its encoder
+func encodeForListeners(tb testing.TB, r Record, listeners int) [][]byte {
+	r = shareEncodings(r)
+	frames := make([][]byte, 0, len(sharedFrameEncoders))
+	for i := 0; i < listeners; i++ {
+		enc := sharedFrameEncoders[i%len(sharedFrameEncoders)]
+		data, err := encodeShared(enc, r)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if i < len(sharedFrameEncoders) {
+			frames = append(frames, data)
+		} else if &data[0] != &frames[i%len(sharedFrameEncoders)][0] {
+			tb.Fatalf("listener %d got a frame of its own", i)
+		}
+	}
+	return frames
+}
+
+func BenchmarkSharedFrames(b *testing.B) {
+	r := benchRBACRecord(b)
+	r.Flow, _ = ParseFlowReference("flow/default/all", "")
+	for _, listeners := range []int{3, 30, 300, 3000} {
+		b.Run(fmt.Sprintf("listeners=%d", listeners), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				encodeForListeners(b, r, listeners)
+			}
+		})
+	}
+}
+
+func TestSharedFramesAllocations(t *testing.T) {
+	skipUnderRace(t)
+	r := benchRBACRecord(t)
+	r.Flow, _ = ParseFlowReference("flow/default/all", "")
+	few := testing.AllocsPerRun(100, func() {
+		encodeForListeners(t, r, len(sharedFrameEncoders))
+	})
+	many := testing.AllocsPerRun(100, func() {
+		encodeForListeners(t, r, 1000*len(sharedFrameEncoders))
+	})
+	if many != few {
+		t.Errorf("encoding for 3000 listeners made %v allocations, %v for one listener per encoder", many, few)
+	}
+}
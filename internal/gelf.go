@@ -0,0 +1,269 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	// GELFEndpoint is the path GELF messages are posted to by HTTP shippers, like Graylog's HTTP input
+	GELFEndpoint = "/gelf"
+
+	maxGELFMessageSize = 1 << 20
+	maxGELFChunks      = 128
+	gelfChunkTimeout   = 5 * time.Second
+)
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+// GELFOptions holds the settings of a GELF receiver
+type GELFOptions struct {
+	// Network is either udp or http
+	Network string
+	// Flow is the flow received messages are routed to
+	Flow FlowReference
+	// DeadLetters receives the messages that cannot be parsed, nil disables dead letters
+	DeadLetters *DeadLetters
+}
+
+// IngestGELF receives GELF messages, chunked and compressed datagrams over UDP or JSON posted to GELFEndpoint over HTTP, and routes them as records to the flow specified in opts
+func IngestGELF(addr string, records RecordSink, logs log.Sink, metrics IngestMetrics, stopSignal Handleable, opts GELFOptions) {
+	logs = log.WithFields(logs, log.Fields{"task": "gelf ingestion", "network": opts.Network})
+
+	ingest := func(data []byte) error {
+		rec, err := gelfRecord(data, opts.Flow)
+		if err != nil {
+			log.Event(logs, "failed to parse GELF message", log.V(1), log.Error(err))
+			metrics.IngestParseFailed(ReceiverGELF)
+			opts.DeadLetters.Reject(ReceiverGELF, opts.Flow, data, DeadLetterUnparsable, err)
+			return err
+		}
+		metrics.LogRecordReceived(ReceiverGELF, rec)
+		log.Event(logs, "ingested log record via GELF", log.V(1), log.Fields{"record": rec})
+		records.Push(rec)
+		return nil
+	}
+
+	switch opts.Network {
+	case "udp":
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			log.Event(logs, "GELF receiver failed to listen", log.Error(err), log.Fields{"addr": addr})
+			return
+		}
+		if stopSignal != nil {
+			stopSignal.HandleWith(func() {
+				conn.Close()
+			})
+		}
+		chunks := newGELFChunks()
+		buf := make([]byte, 64<<10)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Event(logs, "GELF receiver failed to read datagram", log.Error(err))
+				}
+				return
+			}
+			data := buf[:n]
+			if bytes.HasPrefix(data, gelfChunkMagic) {
+				if data, err = chunks.add(data, time.Now()); err != nil {
+					log.Event(logs, "invalid GELF chunk", log.V(1), log.Error(err))
+					continue
+				}
+				if data == nil {
+					continue
+				}
+			}
+			if data, err = decompressGELF(data); err != nil {
+				log.Event(logs, "failed to decompress GELF message", log.V(1), log.Error(err))
+				continue
+			}
+			_ = ingest(data)
+		}
+	case "http":
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != GELFEndpoint {
+				http.NotFound(w, r)
+				return
+			}
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			body := io.Reader(http.MaxBytesReader(w, r.Body, maxGELFMessageSize))
+			switch r.Header.Get("Content-Encoding") {
+			case "", "identity":
+			case "gzip":
+				zr, err := gzip.NewReader(body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				body = zr
+			case "deflate":
+				zr, err := zlib.NewReader(body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				body = zr
+			default:
+				http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+				return
+			}
+			data, err := io.ReadAll(io.LimitReader(body, maxGELFMessageSize))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := ingest(data); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		})
+		server := &http.Server{Addr: addr, Handler: handler}
+		if stopSignal != nil {
+			stopSignal.HandleWith(func() {
+				server.Close()
+			})
+		}
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Event(logs, "GELF receiver failed to serve", log.Error(err), log.Fields{"addr": addr})
+		}
+	default:
+		log.Event(logs, "unsupported GELF network", log.Fields{"network": opts.Network})
+	}
+}
+
+// decompressGELF inflates gzip and zlib compressed messages, other messages are returned as they are
+func decompressGELF(data []byte) ([]byte, error) {
+	var zr io.Reader
+	var err error
+	switch {
+	case len(data) > 1 && data[0] == 0x1f && data[1] == 0x8b:
+		zr, err = gzip.NewReader(bytes.NewReader(data))
+	case len(data) > 0 && data[0] == 0x78:
+		zr, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(zr, maxGELFMessageSize))
+}
+
+// gelfChunks reassembles chunked GELF messages, chunks of messages that are not complete within gelfChunkTimeout are discarded
+type gelfChunks struct {
+	mutex    sync.Mutex
+	messages map[uint64]*gelfChunkedMessage
+}
+
+type gelfChunkedMessage struct {
+	chunks    [][]byte
+	received  int
+	expiresAt time.Time
+}
+
+func newGELFChunks() *gelfChunks {
+	return &gelfChunks{messages: make(map[uint64]*gelfChunkedMessage)}
+}
+
+// add stores a chunk, it returns the message once all of its chunks have been received
+// Chunks start with the magic bytes, followed by the message ID (8 bytes), the sequence number and the sequence count (1 byte each)
+func (c *gelfChunks) add(chunk []byte, now time.Time) ([]byte, error) {
+	if len(chunk) < 12 {
+		return nil, errors.New("chunk header is incomplete")
+	}
+	id := binary.BigEndian.Uint64(chunk[2:10])
+	seq, count := int(chunk[10]), int(chunk[11])
+	if count == 0 || count > maxGELFChunks || seq >= count {
+		return nil, fmt.Errorf("invalid chunk %d of %d", seq, count)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, msg := range c.messages {
+		if !now.Before(msg.expiresAt) {
+			delete(c.messages, id)
+		}
+	}
+	msg := c.messages[id]
+	if msg == nil {
+		msg = &gelfChunkedMessage{chunks: make([][]byte, count), expiresAt: now.Add(gelfChunkTimeout)}
+		c.messages[id] = msg
+	}
+	if len(msg.chunks) != count {
+		delete(c.messages, id)
+		return nil, errors.New("chunks of message have different sequence counts")
+	}
+	if msg.chunks[seq] == nil {
+		msg.chunks[seq] = append([]byte(nil), chunk[12:]...)
+		msg.received++
+	}
+	if msg.received < count {
+		return nil, nil
+	}
+	delete(c.messages, id)
+	return bytes.Join(msg.chunks, nil), nil
+}
+
+// gelfRecord converts a GELF message to a record holding the message, its level and time, and the message itself under the gelf key
+func gelfRecord(data []byte, flow FlowReference) (rec Record, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	if err = decoder.Decode(&fields); err != nil {
+		return rec, fmt.Errorf("invalid GELF message: %w", err)
+	}
+	msg, _ := fields["short_message"].(string)
+	if msg == "" {
+		return rec, errors.New("GELF message has no short_message")
+	}
+
+	res := struct {
+		Message string                 `json:"message"`
+		Level   string                 `json:"level,omitempty"`
+		Time    *time.Time             `json:"time,omitempty"`
+		Host    string                 `json:"host,omitempty"`
+		GELF    map[string]interface{} `json:"gelf"`
+	}{Message: msg, GELF: fields}
+	res.Host, _ = fields["host"].(string)
+	if level, ok := fields["level"].(json.Number); ok {
+		if n, err := level.Int64(); err == nil && n >= 0 && int(n) < len(syslogSeverities) {
+			res.Level = syslogSeverities[n]
+		}
+	}
+	if ts, ok := fields["timestamp"].(json.Number); ok {
+		if f, err := ts.Float64(); err == nil {
+			sec, frac := math.Modf(f)
+			t := time.Unix(int64(sec), int64(frac*1e9)).UTC()
+			res.Time = &t
+		}
+	}
+	if rec.RawData, err = json.Marshal(res); err != nil {
+		return
+	}
+	if rec.Meta, err = ParseRecordMeta(rec.RawData); err != nil {
+		return
+	}
+	rec.Flow = flow
+	rec.ReceivedAt = time.Now()
+	return
+}
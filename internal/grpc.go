@@ -0,0 +1,456 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/banzaicloud/log-socket/log"
+	"github.com/banzaicloud/log-socket/pkg/api/logsocket"
+)
+
+// ServeGRPC serves the LogSocket service defined in pkg/api/logsocket/logsocket.proto, which streams the records of a flow like a websocket listener connection
+func ServeGRPC(addr string, tlsConfig *tls.Config, reg ListenerRegistry, logs log.Sink, metrics ListenMetrics,
+	stopSignal Handleable, authenticator Authenticator, authorizer Authorizer, history RecordHistory, opts ListenerOptions) {
+	serverOpts := []grpc.ServerOption{
+		grpc.Creds(credentials.NewTLS(tlsConfig)),
+		grpc.ForceServerCodec(grpcCodec{}),
+	}
+	if opts.PingInterval > 0 {
+		serverOpts = append(serverOpts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    opts.PingInterval,
+			Timeout: opts.pongTimeout(),
+		}))
+	}
+	admission := opts.Admission
+	if admission == nil {
+		admission = NewListenerAdmission(opts, metrics)
+	}
+	server := grpc.NewServer(serverOpts...)
+	logsocket.RegisterLogSocketServer(server, &grpcServer{
+		admission:     admission,
+		authenticator: authenticator,
+		authorizer:    authorizer,
+		history:       history,
+		logs:          logs,
+		metrics:       metrics,
+		opts:          opts,
+		reg:           reg,
+	})
+
+	if stopSignal != nil {
+		stopSignal.HandleWith(server.GracefulStop)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Event(logs, "gRPC server failed to listen", log.Error(err), log.Fields{"addr": addr})
+		return
+	}
+	if err := server.Serve(ln); err != nil {
+		log.Event(logs, "gRPC server returned an error", log.Error(err))
+	}
+}
+
+type grpcServer struct {
+	logsocket.UnimplementedLogSocketServer
+	admission     *ListenerAdmission
+	authenticator Authenticator
+	authorizer    Authorizer
+	history       RecordHistory
+	logs          log.Sink
+	metrics       ListenMetrics
+	opts          ListenerOptions
+	reg           ListenerRegistry
+}
+
+func (s *grpcServer) StreamLogs(req *logsocket.StreamLogsRequest, stream logsocket.LogSocket_StreamLogsServer) error {
+	ctx := stream.Context()
+
+	flow, err := ParseFlowReference(path.Join(req.GetFlow().GetKind(), req.GetFlow().GetNamespace(), req.GetFlow().GetName()), s.opts.ControlNamespace)
+	if err == nil {
+		err = checkOutputs(s.opts.Outputs, flow)
+	}
+	if err != nil {
+		s.metrics.ListenerRejected(FlowReference{}, authv1.UserInfo{})
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if s.opts.Shards != nil {
+		// gRPC streams are not proxied, clients have to reach the owner themselves
+		if addr, local := s.opts.Shards.Owner(flow); !local {
+			s.metrics.ListenerRejected(flow, authv1.UserInfo{})
+			return status.Error(codes.FailedPrecondition, fmt.Sprintf("%s is served by the replica at %s", flow.URL(), addr))
+		}
+	}
+	query := streamLogsQuery(req.GetFilter())
+	filter, err := ParseRecordFilter(query)
+	if err != nil {
+		s.metrics.ListenerRejected(flow, authv1.UserInfo{})
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	replayReq, err := ParseReplayRequest(query, time.Now())
+	if err != nil {
+		s.metrics.ListenerRejected(flow, authv1.UserInfo{})
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := make(http.Header, len(md))
+	for key, values := range md {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	reqID := header.Get(RequestIDHeader)
+	if !validRequestID(reqID) {
+		reqID = newListenerID()
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, reqID))
+
+	usrInfo, authToken, cert, err := s.authenticate(ctx, header)
+	creds := requestCredentials{token: authToken, cert: cert}
+	if err != nil {
+		log.Event(s.logs, "gRPC authentication failed", log.V(1), log.Error(err))
+		s.metrics.ListenerRejected(flow, usrInfo)
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	target, impersonating, err := headerImpersonation(header)
+	if err == nil && impersonating {
+		authUser := usrInfo
+		if usrInfo, err = impersonate(s.authenticator, usrInfo, target); err == nil {
+			log.Event(s.logs, "user impersonates another user", log.V(1), log.Fields{"user": authUser, "impersonated": usrInfo})
+			creds.impersonation = &impersonation{user: authUser, target: target}
+		}
+	}
+	if err != nil {
+		log.Event(s.logs, "impersonation failed", log.V(1), log.Error(err), log.Fields{"user": usrInfo})
+		s.metrics.ListenerRejected(flow, usrInfo)
+		if errors.Is(err, errImpersonationDisabled) || errors.Is(err, errImpersonationForbidden) || !impersonating {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+	if s.opts.Tenancy != nil {
+		tenant, ok := s.opts.Tenancy.Tenant(usrInfo)
+		if !ok {
+			s.metrics.ListenerRejected(flow, usrInfo)
+			return status.Error(codes.PermissionDenied, "user belongs to no tenant")
+		}
+		usrInfo = withTenant(usrInfo, tenant)
+	}
+	if s.admission.connLimiter != nil {
+		if ok, retryAfter := s.admission.connLimiter.Reserve(usrInfo.Username); !ok {
+			log.Event(s.logs, "user exceeded connection rate limit", log.V(1), log.Fields{"user": usrInfo, "retryAfter": retryAfter})
+			s.metrics.ListenerRejected(flow, usrInfo)
+			return status.Error(codes.ResourceExhausted, fmt.Sprintf("too many connection attempts, retry after %s", retryAfter.Round(time.Second)))
+		}
+	}
+	allowed, err := s.authorizer.AuthorizeFlow(usrInfo, flow)
+	if err != nil {
+		log.Event(s.logs, "authorization failed", log.V(1), log.Error(err), log.Fields{"user": usrInfo, "flow": flow})
+		s.metrics.ListenerRejected(flow, usrInfo)
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !allowed {
+		s.metrics.ListenerRejected(flow, usrInfo)
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("permission denied to tail %s", flow.URL()))
+	}
+	if quota := s.admission.quota; quota != nil {
+		if !quota.Acquire(usrInfo) {
+			log.Event(s.logs, "connection quota exceeded", log.V(1), log.Fields{"user": usrInfo})
+			s.metrics.ListenerRejected(flow, usrInfo)
+			return status.Error(codes.ResourceExhausted, fmt.Sprintf("too many concurrent connections, retry after %s", s.opts.quotaRetryAfter()))
+		}
+		defer quota.Release(usrInfo)
+	}
+
+	var remoteAddr string
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+	l := &grpcListener{
+		clientAddr:  s.opts.TrustedProxies.ClientAddr(&http.Request{RemoteAddr: remoteAddr, Header: header}),
+		connectedAt: time.Now(),
+		flow:        flow,
+		filter:      filter,
+		metrics:     s.metrics,
+		policy:      s.opts.BackpressurePolicy,
+		queue:       make(chan Record, s.opts.bufferSize()),
+		requestID:   reqID,
+		slow:        make(chan struct{}),
+		usrInfo:     usrInfo,
+	}
+	s.metrics.ListenerAccepted(flow, usrInfo)
+	s.reg.Register(l)
+	defer s.reg.Unregister(l)
+	log.Event(s.logs, "gRPC listener connected", log.Fields{"flow": flow, "user": usrInfo, "requestID": reqID})
+	defer log.Event(s.logs, "gRPC listener disconnected", log.Fields{"flow": flow, "user": usrInfo, "requestID": reqID})
+	s.audit(l, AuditEventConnected)
+	defer s.audit(l, AuditEventDisconnected)
+
+	var reauthorize <-chan time.Time
+	if s.opts.ReauthorizationInterval > 0 {
+		ticker := time.NewTicker(s.opts.ReauthorizationInterval)
+		defer ticker.Stop()
+		reauthorize = ticker.C
+	}
+
+	// the history is queried after registering so that records dispatched in the meantime are either replayed or delivered live
+	var replayedUpTo uint64
+	if !replayReq.Empty() && s.history != nil {
+		for _, r := range s.history.Records(flow, replayReq) {
+			if !filter.Matches(r) {
+				continue
+			}
+			if err := s.send(stream, l, r); err != nil {
+				return err
+			}
+			replayedUpTo = r.Sequence
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.slow:
+			return status.Error(codes.ResourceExhausted, "listener could not keep up with records")
+		case <-reauthorize:
+			if err := s.reauthorize(l, creds); err != nil {
+				return err
+			}
+		case r := <-l.queue:
+			if r.Sequence <= replayedUpTo {
+				continue
+			}
+			if err := s.send(stream, l, r); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *grpcServer) send(stream grpc.ServerStream, l *grpcListener, r Record) error {
+	r, span := StartRecordSpan(r, "write", attribute.String("user", l.usrInfo.Username))
+	defer span.End()
+	if !s.authorizer.AuthorizeRecord(l.usrInfo, r) {
+		s.metrics.LogRecordRedacted(l, r)
+		atomic.AddUint64(&l.redacted, 1)
+		r = redactedRecord(r, l.usrInfo)
+	} else {
+		s.metrics.LogRecordTransmitted(l, r)
+	}
+	data, err := encodeShared(ProtobufEncoder{}, r)
+	if err != nil {
+		log.Event(s.logs, "an error occurred while encoding log record", log.V(1), log.Error(err), log.Fields{"record": r})
+		return nil
+	}
+	if err := stream.SendMsg(grpcRecord(data)); err != nil {
+		return err
+	}
+	atomic.AddUint64(&l.delivered, 1)
+	s.metrics.FrameWritten(l, r, len(data), -1)
+	return nil
+}
+
+// reauthorize validates the credentials of the listener again and checks that it may still tail its flow, it returns the status the stream ends with otherwise
+func (s *grpcServer) reauthorize(l *grpcListener, creds requestCredentials) error {
+	err := reauthenticate(s.authenticator, creds)
+	if errors.Is(err, ErrInvalidCredentials) {
+		log.Event(s.logs, "gRPC listener credentials are not valid anymore, disconnecting", log.Error(err), log.Fields{"flow": l.flow, "user": l.usrInfo})
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	if errors.Is(err, errImpersonationDisabled) || errors.Is(err, errImpersonationForbidden) {
+		log.Event(s.logs, "gRPC listener may not impersonate its user anymore, disconnecting", log.Error(err), log.Fields{"flow": l.flow, "user": l.usrInfo})
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err != nil {
+		// the backend might be temporarily unavailable, so the listener is given the benefit of the doubt until the next check
+		log.Event(s.logs, "an error occurred while re-authenticating gRPC listener", log.V(1), log.Error(err), log.Fields{"flow": l.flow, "user": l.usrInfo})
+		return nil
+	}
+	allowed, err := s.authorizer.AuthorizeFlow(l.usrInfo, l.flow)
+	if err != nil {
+		log.Event(s.logs, "an error occurred while re-authorizing gRPC listener", log.V(1), log.Error(err), log.Fields{"flow": l.flow, "user": l.usrInfo})
+		return nil
+	}
+	if !allowed {
+		log.Event(s.logs, "gRPC listener is not allowed to tail flow anymore", log.Fields{"flow": l.flow, "user": l.usrInfo})
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("permission to tail %s has been withdrawn", l.flow.URL()))
+	}
+	return nil
+}
+
+func (s *grpcServer) audit(l *grpcListener, typ AuditEventType) {
+	if s.opts.Audit == nil {
+		return
+	}
+	s.opts.Audit.Audit(AuditEvent{
+		Type:             typ,
+		Time:             time.Now(),
+		User:             l.usrInfo.Username,
+		Groups:           l.usrInfo.Groups,
+		Tenant:           UserTenant(l.usrInfo),
+		ClientAddr:       l.clientAddr,
+		RequestID:        l.requestID,
+		Flows:            []FlowReference{l.flow},
+		ConnectedAt:      l.connectedAt,
+		RecordsDelivered: atomic.LoadUint64(&l.delivered),
+		RecordsRedacted:  atomic.LoadUint64(&l.redacted),
+	})
+}
+
+// authenticate authenticates the client certificate of the stream in mTLS mode, or else the token in its metadata
+func (s *grpcServer) authenticate(ctx context.Context, header http.Header) (usrInfo authv1.UserInfo, token string, cert *x509.Certificate, err error) {
+	if certAuthenticator, ok := s.authenticator.(CertificateAuthenticator); ok {
+		p, _ := peer.FromContext(ctx)
+		if p == nil {
+			return usrInfo, "", nil, errors.New("missing client certificate")
+		}
+		tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+		if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+			return usrInfo, "", nil, errors.New("missing client certificate")
+		}
+		cert = tlsInfo.State.PeerCertificates[0]
+		usrInfo, err = certAuthenticator.AuthenticateCertificate(cert)
+		return usrInfo, "", cert, err
+	}
+
+	if token = header.Get(AuthHeaderKey); token == "" {
+		token = strings.TrimPrefix(header.Get("Authorization"), "Bearer ")
+	}
+	if token == "" {
+		return usrInfo, "", nil, errors.New("missing authentication token")
+	}
+	usrInfo, err = s.authenticator.Authenticate(token)
+	return usrInfo, token, nil, err
+}
+
+// grpcListener queues the records of a flow for a gRPC stream
+// Streams are flow-controlled, so records are dropped according to the backpressure policy when the client does not keep up
+type grpcListener struct {
+	clientAddr  string
+	connectedAt time.Time
+	delivered   uint64
+	filter      RecordFilter
+	flow        FlowReference
+	metrics     listenerMetrics
+	policy      BackpressurePolicy
+	queue       chan Record
+	redacted    uint64
+	requestID   string
+	slow        chan struct{}
+	slowOnce    sync.Once
+	usrInfo     authv1.UserInfo
+}
+
+func (l *grpcListener) Flow() FlowReference {
+	return l.flow
+}
+
+func (l *grpcListener) User() authv1.UserInfo {
+	return l.usrInfo
+}
+
+func (l *grpcListener) Send(r Record) {
+	if !l.filter.Matches(r) {
+		return
+	}
+	select {
+	case l.queue <- r:
+		return
+	default:
+	}
+
+	switch l.policy {
+	case BackpressureDropNewest:
+		l.metrics.LogRecordDropped(l, r)
+	case BackpressureDisconnect:
+		l.metrics.LogRecordDropped(l, r)
+		l.slowOnce.Do(func() { close(l.slow) })
+	default: // drop oldest
+		select {
+		case old := <-l.queue:
+			l.metrics.LogRecordDropped(l, old)
+		default:
+		}
+		select {
+		case l.queue <- r:
+		default:
+			l.metrics.LogRecordDropped(l, r)
+		}
+	}
+}
+
+// streamLogsQuery converts the filter options to the query parameters of websocket listeners
+func streamLogsQuery(filter *logsocket.FilterOptions) url.Values {
+	query := make(url.Values)
+	for name, value := range map[string]string{
+		FilterParamContainerRegex: filter.GetContainer(),
+		FilterParamLevel:          filter.GetLevel(),
+		FilterParamMinLevel:       filter.GetMinLevel(),
+		FilterParamNamespaceRegex: filter.GetNamespace(),
+		FilterParamPodRegex:       filter.GetPod(),
+		ReplayParamSince:          filter.GetSince(),
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if filter.GetTail() > 0 {
+		query.Set(ReplayParamTail, strconv.Itoa(int(filter.GetTail())))
+	}
+	if filter.GetAfter() > 0 {
+		query.Set(ReplayParamAfter, strconv.FormatUint(filter.GetAfter(), 10))
+	}
+	return query
+}
+
+// grpcRecord is a Record message encoded by ProtobufEncoder
+type grpcRecord []byte
+
+// grpcCodec is the protobuf codec of gRPC, except that records encoded once for all listeners are sent as they are
+type grpcCodec struct{}
+
+func (grpcCodec) Marshal(v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case grpcRecord:
+		return m, nil
+	case proto.Message:
+		return proto.Marshal(m)
+	}
+	return nil, fmt.Errorf("cannot marshal %T", v)
+}
+
+func (grpcCodec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	return fmt.Errorf("cannot unmarshal %T", v)
+}
+
+func (grpcCodec) Name() string {
+	return "proto"
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/banzaicloud/log-socket/pkg/api/logsocket"
+)
+
+func TestProtobufEncoderMatchesProto(t *testing.T) {
+	flow, _ := ParseFlowReference("flow/default/all", "")
+	r := Record{
+		RawData:    []byte(`{"message":"hello"}`),
+		Meta:       RecordMeta{Namespace: "default", Pod: "web", Container: "nginx", Level: "warning", Severity: SeverityWarn, Message: "hello", Labels: map[string]string{"app": "web"}},
+		Flow:       flow,
+		ReceivedAt: time.Unix(0, 1000),
+		Sequence:   7,
+		EventTime:  time.Unix(0, 900),
+	}
+	data, err := ProtobufEncoder{}.Encode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got logsocket.Record
+	if err := proto.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := &logsocket.Record{
+		FlowKind:      string(flow.Kind),
+		FlowNamespace: "default",
+		FlowName:      "all",
+		Namespace:     "default",
+		Pod:           "web",
+		Container:     "nginx",
+		Level:         "warning",
+		Message:       "hello",
+		RawData:       r.RawData,
+		Labels:        map[string]string{"app": "web"},
+		Sequence:      7,
+		ReceivedAt:    1000,
+		Time:          900,
+		Severity:      "warn",
+	}
+	if !proto.Equal(&got, want) {
+		t.Errorf("decoded %v, want %v", &got, want)
+	}
+}
+
+func TestGRPCStreamLogs(t *testing.T) {
+	reg := NewFlowRegistry(testMetrics())
+	opts := ListenerOptions{MaxUserConnections: 1}
+	client := startTestGRPCServer(t, &grpcServer{
+		admission:     NewListenerAdmission(opts, testMetrics()),
+		authenticator: tokenAuthenticator{"alice": {Username: "alice"}},
+		authorizer:    allowAuthorizer{},
+		logs:          testLogs(),
+		metrics:       testMetrics(),
+		opts:          opts,
+		reg:           reg,
+	})
+	flow, _ := ParseFlowReference("flow/default/all", "")
+	req := &logsocket.StreamLogsRequest{
+		Flow:   &logsocket.FlowReference{Kind: string(flow.Kind), Namespace: flow.Namespace, Name: flow.Name},
+		Filter: &logsocket.FilterOptions{Pod: "^web$"},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := recvFirst(client.StreamLogs(metadata.AppendToOutgoingContext(ctx, "x-authorization", "mallory"), req)); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("unknown token: got %v, want Unauthenticated", err)
+	}
+
+	stream, err := client.StreamLogs(metadata.AppendToOutgoingContext(ctx, "x-authorization", "alice"), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners := waitForListeners(t, reg, flow, 1)
+	listeners[0].Send(Record{Flow: flow, Meta: RecordMeta{Pod: "db", Message: "filtered"}, Sequence: 1})
+	listeners[0].Send(Record{Flow: flow, Meta: RecordMeta{Pod: "web", Message: "delivered"}, Sequence: 2})
+	got, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetMessage() != "delivered" || got.GetSequence() != 2 {
+		t.Errorf("received %v, want the record of the web pod", got)
+	}
+
+	// the user's only connection is taken by the open stream
+	if _, err := recvFirst(client.StreamLogs(metadata.AppendToOutgoingContext(ctx, "x-authorization", "alice"), req)); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("second stream: got %v, want ResourceExhausted", err)
+	}
+}
+
+func recvFirst(stream logsocket.LogSocket_StreamLogsClient, err error) (*logsocket.Record, error) {
+	if err != nil {
+		return nil, err
+	}
+	return stream.Recv()
+}
+
+func startTestGRPCServer(t *testing.T, srv *grpcServer) logsocket.LogSocketClient {
+	t.Helper()
+	ln := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.ForceServerCodec(grpcCodec{}))
+	logsocket.RegisterLogSocketServer(server, srv)
+	go func() { _ = server.Serve(ln) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return ln.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return logsocket.NewLogSocketClient(conn)
+}
+
+// waitForListeners waits until the flow has the number of listeners
+func waitForListeners(t *testing.T, reg *FlowRegistry, flow FlowReference, n int) []Listener {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if listeners := reg.Listeners(flow); len(listeners) >= n {
+			return listeners
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("flow %s has %d listeners, want %d", flow, len(reg.Listeners(flow)), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// isExtendedConnect reports whether the request opens a websocket over an HTTP/2 stream (RFC 8441)
+func isExtendedConnect(r *http.Request) bool {
+	return r.ProtoMajor == 2 && r.Method == http.MethodConnect && r.Header.Get(":protocol") == "websocket"
+}
+
+// acceptExtendedConnect adapts an extended CONNECT request to a websocket upgrade request over HTTP/1.1, so that it can be handled by the websocket upgrader
+// The returned response writer hijacks the HTTP/2 stream, the handler has to wait for the returned connection to be closed before returning
+func acceptExtendedConnect(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, *h2StreamConn) {
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+
+	req := r.Clone(r.Context())
+	req.Method = http.MethodGet
+	req.Header.Del(":protocol")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	// the key only protects HTTP/1.1 upgrades from caching proxies, RFC 8441 does without it
+	req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+
+	conn := &h2StreamConn{
+		body:   r.Body,
+		closed: make(chan struct{}),
+		remote: h2Addr(r.RemoteAddr),
+		w:      w,
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.local = addr
+	}
+	conn.counter = &countingConn{Conn: conn}
+	return h2Hijacker{ResponseWriter: w, conn: conn}, req, conn
+}
+
+type h2Hijacker struct {
+	http.ResponseWriter
+	conn *h2StreamConn
+}
+
+func (h h2Hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h.conn.hijacked = true
+	return h.conn.counter, bufio.NewReadWriter(bufio.NewReader(h.conn.counter), bufio.NewWriter(h.conn.counter)), nil
+}
+
+// h2StreamConn is a websocket connection over an HTTP/2 stream
+// The HTTP/1.1 handshake response written by the upgrader is translated to a 200 response, further writes are sent as stream data
+type h2StreamConn struct {
+	body      io.ReadCloser
+	closeOnce sync.Once
+	closed    chan struct{}
+	// counter measures the bytes written to the stream, HTTP/2 framing excluded
+	counter    *countingConn
+	handshake  bytes.Buffer
+	handshaken bool
+	hijacked   bool
+	local      net.Addr
+	mutex      sync.Mutex
+	released   bool
+	remote     net.Addr
+	w          http.ResponseWriter
+}
+
+var errH2StreamClosed = errors.New("http2 stream closed")
+
+func (c *h2StreamConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *h2StreamConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.released {
+		return 0, errH2StreamClosed
+	}
+	if !c.handshaken {
+		c.handshake.Write(b)
+		end := bytes.Index(c.handshake.Bytes(), []byte("\r\n\r\n"))
+		if end < 0 {
+			return len(b), nil
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(c.handshake.Bytes()[:end+4])), nil)
+		if err != nil {
+			return 0, err
+		}
+		for _, name := range []string{"Sec-WebSocket-Extensions", "Sec-WebSocket-Protocol"} {
+			if v := resp.Header.Get(name); v != "" {
+				c.w.Header().Set(name, v)
+			}
+		}
+		c.w.WriteHeader(http.StatusOK)
+		c.handshaken = true
+		rest := c.handshake.Bytes()[end+4:]
+		if len(rest) > 0 {
+			if _, err := c.w.Write(rest); err != nil {
+				return 0, err
+			}
+		}
+		c.flush()
+		return len(b), nil
+	}
+
+	n, err := c.w.Write(b)
+	if err == nil {
+		c.flush()
+	}
+	return n, err
+}
+
+func (c *h2StreamConn) flush() {
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *h2StreamConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.body.Close()
+	})
+	return nil
+}
+
+// wait blocks until the connection is closed if the stream has been hijacked, after which the response writer must not be used anymore
+func (c *h2StreamConn) wait() {
+	if !c.hijacked {
+		return
+	}
+	<-c.closed
+	c.mutex.Lock()
+	c.released = true
+	c.mutex.Unlock()
+}
+
+func (c *h2StreamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *h2StreamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// deadlines are supported by response writers of newer Go versions
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+func (c *h2StreamConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *h2StreamConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.w.(deadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *h2StreamConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.w.(deadliner); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+type h2Addr string
+
+func (a h2Addr) Network() string {
+	return "tcp"
+}
+
+func (a h2Addr) String() string {
+	return string(a)
+}
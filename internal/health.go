@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const ReadinessCheckEndpoint = "/readyz"
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// readinessCheckInterval is how long the result of checking the backends is reused, so that frequent probes do not load them
+const readinessCheckInterval = 10 * time.Second
+
+// ReadinessChecker is implemented by components that depend on a backend, Ready returns an error while the backend is unreachable
+type ReadinessChecker interface {
+	Ready() error
+}
+
+type HealthMetrics interface {
+	HealthCheck()
+}
+
+// readiness tracks whether a server accepts new connections, it becomes permanently unready once shutdown starts
+type readiness struct {
+	checkers     []ReadinessChecker
+	shuttingDown uint32
+	// checkedAt and lastErr hold the result of the last check of the backends, see readinessCheckInterval
+	mutex     sync.Mutex
+	checkedAt time.Time
+	lastErr   error
+}
+
+func (r *readiness) shutdown() {
+	atomic.StoreUint32(&r.shuttingDown, 1)
+}
+
+func (r *readiness) check() error {
+	if atomic.LoadUint32(&r.shuttingDown) != 0 {
+		return errShuttingDown
+	}
+	if len(r.checkers) == 0 {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.checkedAt) < readinessCheckInterval {
+		return r.lastErr
+	}
+	r.lastErr = nil
+	for _, c := range r.checkers {
+		if err := c.Ready(); err != nil {
+			r.lastErr = err
+			break
+		}
+	}
+	r.checkedAt = time.Now()
+	return r.lastErr
+}
+
+// serveHealth answers liveness and readiness probes, it returns false if the request is not a probe
+func serveHealth(w http.ResponseWriter, r *http.Request, ready *readiness, logs log.Sink, metrics HealthMetrics) bool {
+	switch r.URL.Path {
+	case HealthCheckEndpoint:
+		log.Event(logs, "health check", log.V(1))
+		metrics.HealthCheck()
+		w.WriteHeader(http.StatusOK)
+		return true
+	case ReadinessCheckEndpoint:
+		if err := ready.check(); err != nil {
+			log.Event(logs, "readiness check failed", log.V(1), log.Error(err))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return true
+		}
+		log.Event(logs, "readiness check", log.V(1))
+		w.WriteHeader(http.StatusOK)
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+)
+
+// countingChecker counts the readiness checks it answers
+type countingChecker struct {
+	checks int
+	err    error
+}
+
+func (c *countingChecker) Ready() error {
+	c.checks++
+	return c.err
+}
+
+func TestReadinessReusesCheckResult(t *testing.T) {
+	checker := &countingChecker{err: errors.New("API server unreachable")}
+	ready := readiness{checkers: []ReadinessChecker{checker}}
+	for i := 0; i < 3; i++ {
+		if err := ready.check(); err != checker.err {
+			t.Errorf("check %d: got %v, want %v", i, err, checker.err)
+		}
+	}
+	if checker.checks != 1 {
+		t.Errorf("the backend was checked %d times, want once within %s", checker.checks, readinessCheckInterval)
+	}
+
+	ready.shutdown()
+	if err := ready.check(); err != errShuttingDown {
+		t.Errorf("after shutdown: got %v, want %v", err, errShuttingDown)
+	}
+}
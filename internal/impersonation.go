@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	authv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	ImpersonateUserHeader        = "Impersonate-User"
+	ImpersonateGroupHeader       = "Impersonate-Group"
+	ImpersonateUIDHeader         = "Impersonate-Uid"
+	ImpersonateExtraHeaderPrefix = "Impersonate-Extra-"
+)
+
+var (
+	errImpersonationDisabled  = errors.New("impersonation is disabled")
+	errImpersonationForbidden = errors.New("permission denied to impersonate the user")
+)
+
+// ImpersonationAuthorizer decides whether a user may act as another user
+type ImpersonationAuthorizer interface {
+	AuthorizeImpersonation(user authv1.UserInfo, target authv1.UserInfo) (bool, error)
+}
+
+// SubjectAccessReviewImpersonationAuthorizer allows users permitted to impersonate the target's user name, groups, UID and extra values by RBAC, like the API server does
+type SubjectAccessReviewImpersonationAuthorizer struct {
+	Client client.Client
+}
+
+func (a SubjectAccessReviewImpersonationAuthorizer) AuthorizeImpersonation(user authv1.UserInfo, target authv1.UserInfo) (bool, error) {
+	var attrs []authzv1.ResourceAttributes
+	if namespace, name, ok := serviceAccountName(target.Username); ok {
+		attrs = append(attrs, authzv1.ResourceAttributes{Namespace: namespace, Resource: "serviceaccounts", Name: name})
+	} else {
+		attrs = append(attrs, authzv1.ResourceAttributes{Resource: "users", Name: target.Username})
+	}
+	for _, group := range target.Groups {
+		attrs = append(attrs, authzv1.ResourceAttributes{Resource: "groups", Name: group})
+	}
+	if target.UID != "" {
+		attrs = append(attrs, authzv1.ResourceAttributes{Group: authv1.GroupName, Resource: "uids", Name: target.UID})
+	}
+	for key, values := range target.Extra {
+		for _, value := range values {
+			attrs = append(attrs, authzv1.ResourceAttributes{Group: authv1.GroupName, Resource: "userextras", Subresource: key, Name: value})
+		}
+	}
+
+	for i := range attrs {
+		attrs[i].Verb = "impersonate"
+		sar := authzv1.SubjectAccessReview{
+			Spec: authzv1.SubjectAccessReviewSpec{
+				ResourceAttributes: &attrs[i],
+				User:               user.Username,
+				Groups:             user.Groups,
+				Extra:              authzExtra(user),
+				UID:                user.UID,
+			},
+		}
+		if err := a.Client.Create(context.Background(), &sar); err != nil {
+			return false, err
+		}
+		if !sar.Status.Allowed {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func serviceAccountName(username string) (namespace string, name string, ok bool) {
+	const prefix = "system:serviceaccount:"
+	if !strings.HasPrefix(username, prefix) {
+		return "", "", false
+	}
+	namespace, name, ok = strings.Cut(strings.TrimPrefix(username, prefix), ":")
+	return namespace, name, ok && namespace != "" && name != ""
+}
+
+// requestImpersonation returns the user the request impersonates according to its impersonation headers, if any
+func requestImpersonation(r *http.Request) (res authv1.UserInfo, ok bool, err error) {
+	return headerImpersonation(r.Header)
+}
+
+// headerImpersonation returns the user impersonated according to the impersonation headers, if any
+func headerImpersonation(header http.Header) (res authv1.UserInfo, ok bool, err error) {
+	res.Username = header.Get(ImpersonateUserHeader)
+	res.Groups = header.Values(ImpersonateGroupHeader)
+	res.UID = header.Get(ImpersonateUIDHeader)
+	for name, values := range header {
+		if !strings.HasPrefix(name, ImpersonateExtraHeaderPrefix) {
+			continue
+		}
+		// extra keys are percent-encoded since header names are case-insensitive
+		key, err := url.PathUnescape(strings.ToLower(strings.TrimPrefix(name, ImpersonateExtraHeaderPrefix)))
+		if err != nil {
+			return res, false, err
+		}
+		if res.Extra == nil {
+			res.Extra = make(map[string]authv1.ExtraValue)
+		}
+		res.Extra[key] = append(res.Extra[key], values...)
+	}
+	if res.Username == "" {
+		if len(res.Groups) > 0 || res.UID != "" || res.Extra != nil {
+			return res, false, errors.New("impersonating groups, a UID or extra values requires impersonating a user")
+		}
+		return res, false, nil
+	}
+	return res, true, nil
+}
+
+// impersonate returns the user the authenticated user impersonates if they are allowed to, with the groups the API server adds to impersonated users
+func impersonate(authenticator Authenticator, user authv1.UserInfo, target authv1.UserInfo) (authv1.UserInfo, error) {
+	policy, _ := authenticator.(TokenPolicy)
+	if policy.Impersonation == nil {
+		return user, errImpersonationDisabled
+	}
+	allowed, err := policy.Impersonation.AuthorizeImpersonation(user, target)
+	if err != nil {
+		return user, err
+	}
+	if !allowed {
+		return user, errImpersonationForbidden
+	}
+	if namespace, _, ok := serviceAccountName(target.Username); ok {
+		target.Groups = append(target.Groups, "system:serviceaccounts", "system:serviceaccounts:"+namespace)
+	}
+	if !hasItem(target.Groups, "system:authenticated") {
+		target.Groups = append(target.Groups, "system:authenticated")
+	}
+	return target, nil
+}
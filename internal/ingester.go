@@ -3,31 +3,72 @@ package internal
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"io"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/banzaicloud/log-socket/log"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const HealthCheckEndpoint = "/healthz"
 const MetricsEndpoint = "/metrics"
 
-func Ingest(addr string, records RecordSink, logs log.Sink, metrics IngestMetrics, stopSignal Handleable, terminateSignal Handleable) {
+// IngestOptions holds the settings used to verify that pushed records come from the logging pipeline
+type IngestOptions struct {
+	// TLSConfig enables TLS for the ingest server, forwarders have to present a client certificate if it has client CAs
+	TLSConfig *tls.Config
+	// HMACKey is the shared key forwarders sign request bodies with, requests without a valid signature are rejected if set
+	HMACKey []byte
+	// MaxBodySize is the maximum size of request bodies in bytes, larger requests are rejected, zero means unlimited
+	MaxBodySize int64
+	// MaxDecompressedSize is the maximum size of gzip or zstd compressed request bodies once decompressed, larger requests are rejected, zero means unlimited
+	MaxDecompressedSize int64
+	// DeadLetters receives the lines that are not valid records, which are then skipped instead of failing the request, nil disables dead letters
+	DeadLetters *DeadLetters
+}
+
+const (
+	// IngestSignatureHeader holds the hex encoded HMAC-SHA256 signature of the request body prefixed with "sha256="
+	IngestSignatureHeader = "X-Log-Socket-Signature"
+
+	ingestSignaturePrefix = "sha256="
+
+	// ReceiverHTTP, ReceiverForward, ReceiverSyslog, ReceiverGELF and ReceiverKafka tell which receiver ingested a record in metrics
+	ReceiverHTTP    = "http"
+	ReceiverForward = "forward"
+	ReceiverSyslog  = "syslog"
+	ReceiverGELF    = "gelf"
+	ReceiverKafka   = "kafka"
+
+	DefaultIngestQueueSize = 256
+)
+
+func (o IngestOptions) requireClientCert() bool {
+	return o.TLSConfig != nil && o.TLSConfig.ClientCAs != nil
+}
+
+func Ingest(addr string, records RecordSink, logs log.Sink, metrics IngestMetrics, stopSignal Handleable, terminateSignal Handleable, opts IngestOptions) {
 	logs = log.WithFields(logs, log.Fields{"task": "log ingestion"})
+	var ready readiness
 
 	server := &http.Server{
 		Addr: addr,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			log.Event(logs, "HTTP server received request", log.V(2), log.Fields{"request": r.Body})
 
-			if r.URL.Path == HealthCheckEndpoint {
-				log.Event(logs, "health check", log.V(1))
-				metrics.HealthCheck()
-				w.WriteHeader(http.StatusOK)
+			if serveHealth(w, r, &ready, logs, metrics) {
 				return
 			}
 
@@ -37,23 +78,32 @@ func Ingest(addr string, records RecordSink, logs log.Sink, metrics IngestMetric
 				return
 			}
 
-			elts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
-			if len(elts) != 3 {
-				log.Event(logs, "URL path is not a valid flow reference", log.V(1), log.Fields{"url": r.URL})
-				http.Error(w, "invalid URL path", http.StatusBadRequest)
+			logs := withRequestID(logs, requestID(w, r))
+
+			rw := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+			w = rw
+			defer func() { metrics.IngestResponse(rw.code) }()
+
+			// client certificates are verified during the handshake if present, but probes are allowed without one
+			if opts.requireClientCert() && (r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+				log.Event(logs, "ingest request without client certificate", log.V(1), log.Fields{"remoteAddr": r.RemoteAddr})
+				metrics.IngestRejected("missing client certificate")
+				http.Error(w, "missing client certificate", http.StatusUnauthorized)
 				return
 			}
 
-			var flow FlowReference
-			flow.Kind, flow.Namespace, flow.Name = FlowKind(elts[0]), elts[1], elts[2]
-			switch flow.Kind {
-			case FKClusterFlow, FKFlow:
-			default:
-				http.Error(w, "invalid flow kind", http.StatusBadRequest)
+			flow, err := parseRecordFlow(r.URL.Path)
+			if err != nil {
+				log.Event(logs, "URL path is not a valid flow reference", log.V(1), log.Error(err), log.Fields{"url": r.URL})
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			data, err := io.ReadAll(r.Body)
+			body := io.Reader(r.Body)
+			if opts.MaxBodySize > 0 {
+				body = io.LimitReader(r.Body, opts.MaxBodySize+1)
+			}
+			data, err := io.ReadAll(body)
 			if err != nil {
 				log.Event(logs, "failed to read request body", log.V(1), log.Error(err))
 				http.Error(w, "failed to read request body", http.StatusInternalServerError)
@@ -65,6 +115,42 @@ func Ingest(addr string, records RecordSink, logs log.Sink, metrics IngestMetric
 				return
 			}
 
+			if opts.MaxBodySize > 0 && int64(len(data)) > opts.MaxBodySize {
+				log.Event(logs, "ingest request body is too large", log.V(1), log.Fields{"remoteAddr": r.RemoteAddr, "flow": flow, "maxBodySize": opts.MaxBodySize})
+				metrics.IngestRejected("request too large")
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			if len(opts.HMACKey) > 0 && !validSignature(opts.HMACKey, data, r.Header.Get(IngestSignatureHeader)) {
+				log.Event(logs, "ingest request has invalid signature", log.V(1), log.Fields{"remoteAddr": r.RemoteAddr})
+				metrics.IngestRejected("invalid signature")
+				http.Error(w, "invalid signature", http.StatusUnauthorized)
+				return
+			}
+
+			// signatures are made over the body as sent, compressed or not
+			if data, err = decompressBody(data, r.Header.Get("Content-Encoding"), opts.MaxDecompressedSize); err != nil {
+				log.Event(logs, "failed to decompress ingest request body", log.V(1), log.Error(err), log.Fields{"remoteAddr": r.RemoteAddr, "flow": flow, "encoding": r.Header.Get("Content-Encoding")})
+				switch {
+				case errors.Is(err, errUnsupportedContentEncoding):
+					metrics.IngestRejected("unsupported content encoding")
+					http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+				case errors.Is(err, errDecompressedBodyTooLarge):
+					metrics.IngestRejected("decompressed request too large")
+					http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				default:
+					metrics.IngestRejected("invalid compressed body")
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				}
+				return
+			}
+
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			_, span := tracer.Start(ctx, "ingest", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(flowAttributes(flow)...), trace.WithAttributes(attribute.String("request.id", r.Header.Get(RequestIDHeader))))
+			defer span.End()
+
+			receivedAt := time.Now()
 			dataSet := bytes.Split(data, []byte{'\n'})
 			for _, data := range dataSet {
 
@@ -73,23 +159,35 @@ func Ingest(addr string, records RecordSink, logs log.Sink, metrics IngestMetric
 				}
 
 				rec := Record{
-					RawData: data,
-					Flow:    flow,
+					RawData:    data,
+					Flow:       flow,
+					ReceivedAt: receivedAt,
+					trace:      span.SpanContext(),
 				}
 
-				metrics.LogRecordReceived(rec)
+				metrics.LogRecordReceived(ReceiverHTTP, rec)
 
-				if err := json.Unmarshal(data, &rec.Data); err != nil {
+				var err error
+				if rec.Meta, err = ParseRecordMeta(data); err != nil {
 					log.Event(logs, "failed to parse log data", log.V(1), log.Error(err), log.Fields{"data": string(data)})
+					metrics.IngestParseFailed(ReceiverHTTP)
+					if opts.DeadLetters != nil {
+						opts.DeadLetters.Reject(ReceiverHTTP, flow, data, DeadLetterUnparsable, err)
+						continue
+					}
 					http.Error(w, "failed to parse log data", http.StatusBadRequest)
 					return
 				}
+				if opts.DeadLetters.Unattributed(ReceiverHTTP, rec) {
+					continue
+				}
 
 				log.Event(logs, "ingested log record via HTTP", log.V(1), log.Fields{"record": rec})
 				records.Push(rec)
 			}
 			w.WriteHeader(http.StatusOK)
 		}),
+		TLSConfig: opts.TLSConfig,
 	}
 
 	var shutdownWG sync.WaitGroup
@@ -105,19 +203,81 @@ func Ingest(addr string, records RecordSink, logs log.Sink, metrics IngestMetric
 		stopSignal.HandleWith(func() {
 			shutdownWG.Add(1)
 			defer shutdownWG.Done()
+			ready.shutdown()
 			if err := server.Shutdown(ctx); err != nil {
 				log.Event(logs, "error during HTTP server shutdown", log.Error(err))
 			}
 		})
 	}
 
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	var err error
+	if opts.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Event(logs, "HTTP server ListenAndServe returned an error", log.Error(err))
 	}
 	shutdownWG.Wait()
 }
 
+// validSignature checks the signature header of a request body in constant time
+func validSignature(key []byte, body []byte, header string) bool {
+	if !strings.HasPrefix(header, ingestSignaturePrefix) {
+		return false
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(header, ingestSignaturePrefix))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
 type IngestMetrics interface {
-	HealthCheck()
-	LogRecordReceived(r Record)
+	HealthMetrics
+	IngestParseFailed(receiver string)
+	IngestRejected(reason string)
+	IngestResponse(code int)
+	LogRecordReceived(receiver string, r Record)
+}
+
+// statusRecorder remembers the status code of the response to an ingest request
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// IngestQueueMetrics reports the records waiting to be dispatched and how long receivers were held up by a full queue
+type IngestQueueMetrics interface {
+	IngestQueue(depth func() int)
+	IngestQueueBlocked(d time.Duration)
+}
+
+// QueueRecords pushes ingested records to the buffered channel, reporting its depth and the time receivers wait for room in it
+func QueueRecords(queue RecordsChannel, metrics IngestQueueMetrics) RecordSink {
+	metrics.IngestQueue(func() int { return len(queue) })
+	return recordQueue{metrics: metrics, queue: queue}
+}
+
+type recordQueue struct {
+	metrics IngestQueueMetrics
+	queue   RecordsChannel
+}
+
+func (q recordQueue) Push(r Record) {
+	select {
+	case q.queue <- r:
+	default:
+		start := time.Now()
+		q.queue <- r
+		q.metrics.IngestQueueBlocked(time.Since(start))
+	}
 }
@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	authv1 "k8s.io/api/authentication/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/banzaicloud/log-socket/pkg/tlstools"
+)
+
+// tokenReviewClient answers TokenReviews like the API server would for the tokens of its users, other reviews are not authenticated
+type tokenReviewClient struct {
+	client.Client
+	users map[string]authv1.UserInfo
+}
+
+func (c tokenReviewClient) Create(_ context.Context, obj client.Object, _ ...client.CreateOption) error {
+	review, ok := obj.(*authv1.TokenReview)
+	if !ok {
+		return fmt.Errorf("unexpected object %T", obj)
+	}
+	review.Status.User, review.Status.Authenticated = c.users[review.Spec.Token]
+	return nil
+}
+
+// integrationHarness runs the ingest and listener servers with record dispatching in between, like the service does
+type integrationHarness struct {
+	ingestAddr string
+	listenAddr string
+	clientTLS  *tls.Config
+	registry   *FlowRegistry
+}
+
+func startIntegrationHarness(t *testing.T, users map[string]authv1.UserInfo) *integrationHarness {
+	t.Helper()
+	serverTLS, clientTLS := testTLSConfigs(t)
+	h := &integrationHarness{
+		ingestAddr: freeAddr(t),
+		listenAddr: freeAddr(t),
+		clientTLS:  clientTLS,
+		registry:   NewFlowRegistry(testMetrics()),
+	}
+	logs, metrics := testLogs(), testMetrics()
+	records := make(RecordsChannel, DefaultIngestQueueSize)
+	stop := NewWaitableLatch()
+	stopSignal := NewHandleableLatch(stop.Chan())
+	authenticator := TokenReviewAuthenticator{Client: tokenReviewClient{users: users}}
+	history := NewReplayBuffer(100, time.Minute)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		Ingest(h.ingestAddr, records, logs, metrics, stopSignal, nil, IngestOptions{})
+	}()
+	go func() {
+		defer wg.Done()
+		Listen(h.listenAddr, serverTLS, h.registry, logs, metrics, stopSignal, nil, authenticator, LabelAuthorizer{Logs: logs}, history, ListenerOptions{})
+	}()
+	go func() {
+		defer wg.Done()
+		dispatcher := NewDispatcher(1)
+		defer dispatcher.Close()
+		for {
+			select {
+			case <-stop.Chan():
+				return
+			case r := <-records:
+				r = history.Push(r)
+				dispatcher.Dispatch(r, h.registry.Listeners(r.Flow))
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		stop.Close()
+		wg.Wait()
+	})
+	waitForServer(t, h.ingestAddr)
+	waitForServer(t, h.listenAddr)
+	return h
+}
+
+// connect opens a websocket listener connection authenticated with the token
+func (h *integrationHarness) connect(flow FlowReference, token string) (*websocket.Conn, *http.Response, error) {
+	dialer := websocket.Dialer{
+		TLSClientConfig:  h.clientTLS,
+		Subprotocols:     []string{WebSocketSubprotocol},
+		HandshakeTimeout: 5 * time.Second,
+	}
+	return dialer.Dial("wss://"+h.listenAddr+"/"+flow.URL(), http.Header{AuthHeaderKey: {token}})
+}
+
+// push ingests the records of the flow the way fluentd's HTTP output sends them
+func (h *integrationHarness) push(t *testing.T, flow FlowReference, records ...string) {
+	t.Helper()
+	resp, err := http.Post("http://"+h.ingestAddr+"/"+flow.URL(), "application/x-ndjson", strings.NewReader(strings.Join(records, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("pushing records: got status %d", resp.StatusCode)
+	}
+}
+
+func TestIntegrationDeliveryAndRBAC(t *testing.T) {
+	alice := authv1.UserInfo{Username: "system:serviceaccount:default:alice", Groups: []string{"system:serviceaccounts"}}
+	bob := authv1.UserInfo{Username: "system:serviceaccount:default:bob", Groups: []string{"system:serviceaccounts"}}
+	h := startIntegrationHarness(t, map[string]authv1.UserInfo{"alice-token": alice, "bob-token": bob})
+	flow, err := ParseFlowReference("flow/default/all", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conn, resp, err := h.connect(flow, "mallory-token"); err == nil {
+		conn.Close()
+		t.Error("listener with an unknown token connected")
+	} else if resp == nil || resp.StatusCode < http.StatusBadRequest {
+		t.Errorf("listener with an unknown token: got %v, want an error response", err)
+	}
+
+	aliceConn, _, err := h.connect(flow, "alice-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aliceConn.Close()
+	bobConn, _, err := h.connect(flow, "bob-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bobConn.Close()
+	waitForListeners(t, h.registry, flow, 2)
+
+	visible := `{"message":"for alice","kubernetes":{"namespace_name":"default","pod_name":"web","labels":{"rbac/default_alice":"allow","rbac/policy":"deny"}}}`
+	public := `{"message":"for everyone","kubernetes":{"namespace_name":"default","pod_name":"api","labels":{"rbac/group.system_serviceaccounts":"allow"}}}`
+	h.push(t, flow, visible, public)
+
+	for _, tc := range []struct {
+		name string
+		conn *websocket.Conn
+		want []string
+	}{
+		{name: "alice", conn: aliceConn, want: []string{"for alice", "for everyone"}},
+		{name: "bob", conn: bobConn, want: []string{"Permission denied to access web logs for " + bob.Username, "for everyone"}},
+	} {
+		for _, want := range tc.want {
+			got := readRecordMessage(t, tc.conn)
+			if got != want {
+				t.Errorf("%s received %q, want %q", tc.name, got, want)
+			}
+		}
+	}
+}
+
+// readRecordMessage reads the next record sent to the listener and returns its message, or its error if it was redacted
+func readRecordMessage(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatalf("%s: %v", data, err)
+	}
+	if rec.Error != "" {
+		return rec.Error
+	}
+	return rec.Message
+}
+
+// testTLSConfigs returns the TLS config of a server with a certificate for 127.0.0.1 and that of its clients
+func testTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	caCert, caKey, err := tlstools.GenerateSelfSignedCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tlstools.GenerateTLSCert(caCert, caKey, big.NewInt(1), nil, []net.IP{net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, &tls.Config{RootCAs: roots}
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func waitForServer(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server at %s did not start: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListenerProbesWithoutClientCertificate(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	// the server's own CA stands in for that of listener certificates, the probe sends none anyway
+	serverTLS.ClientCAs = clientTLS.RootCAs
+	serverTLS.ClientAuth = tls.VerifyClientCertIfGiven
+	addr := freeAddr(t)
+	stop := NewWaitableLatch()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Listen(addr, serverTLS, NewFlowRegistry(testMetrics()), testLogs(), testMetrics(), NewHandleableLatch(stop.Chan()), nil, ClientCertificateAuthenticator{}, allowAuthorizer{}, nil, ListenerOptions{})
+	}()
+	t.Cleanup(func() {
+		stop.Close()
+		<-done
+	})
+	waitForServer(t, addr)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	for path, want := range map[string]int{
+		ReadinessCheckEndpoint: http.StatusOK,
+		HealthCheckEndpoint:    http.StatusOK,
+		"/flow/default/all":    http.StatusUnauthorized,
+	} {
+		resp, err := client.Get("https://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: got status %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// KafkaFlowHeader is the message header that can hold the reference of the flow a Kafka message belongs to
+const KafkaFlowHeader = "log-socket-flow"
+
+// KafkaOptions holds the settings of the Kafka record source
+type KafkaOptions struct {
+	Brokers []string
+	Topic   string
+	// GroupID is the consumer group used to track offsets
+	GroupID string
+	// Flow is the flow of messages without a flow header
+	Flow FlowReference
+	// TLSConfig enables TLS for broker connections
+	TLSConfig *tls.Config
+	// SASLMechanism is one of plain, scram-sha-256 or scram-sha-512, SASL is disabled if empty
+	SASLMechanism string
+	Username      string
+	Password      string
+	// DeadLetters receives the messages that are not valid records, nil disables dead letters
+	DeadLetters *DeadLetters
+}
+
+func (o KafkaOptions) saslMechanism() (sasl.Mechanism, error) {
+	switch o.SASLMechanism {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{Username: o.Username, Password: o.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, o.Username, o.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, o.Username, o.Password)
+	default:
+		return nil, fmt.Errorf("unsupported SASL mechanism %q", o.SASLMechanism)
+	}
+}
+
+// ConsumeKafka feeds the JSON records of a Kafka topic into records until stopSignal fires
+func ConsumeKafka(records RecordSink, logs log.Sink, metrics IngestMetrics, stopSignal Handleable, opts KafkaOptions) {
+	logs = log.WithFields(logs, log.Fields{"task": "kafka consumption", "topic": opts.Topic})
+
+	mechanism, err := opts.saslMechanism()
+	if err != nil {
+		log.Event(logs, "invalid Kafka SASL configuration", log.Error(err))
+		return
+	}
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: opts.Brokers,
+		Topic:   opts.Topic,
+		GroupID: opts.GroupID,
+		Dialer: &kafka.Dialer{
+			Timeout:       10 * time.Second,
+			DualStack:     true,
+			TLS:           opts.TLSConfig,
+			SASLMechanism: mechanism,
+		},
+	})
+	defer reader.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if stopSignal != nil {
+		stopSignal.HandleWith(cancel)
+	}
+
+	for {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				log.Event(logs, "an error occurred while reading Kafka message", log.Error(err))
+			}
+			return
+		}
+
+		flow := opts.Flow
+		for _, h := range msg.Headers {
+			if h.Key == KafkaFlowHeader {
+				if flow, err = parseRecordFlow(string(h.Value)); err != nil {
+					log.Event(logs, "Kafka message has an invalid flow header", log.V(1), log.Error(err), log.Fields{"partition": msg.Partition, "offset": msg.Offset})
+				}
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+
+		rec := Record{
+			RawData:    msg.Value,
+			Flow:       flow,
+			ReceivedAt: time.Now(),
+		}
+		metrics.LogRecordReceived(ReceiverKafka, rec)
+		if rec.Meta, err = ParseRecordMeta(msg.Value); err != nil {
+			log.Event(logs, "failed to parse log data", log.V(1), log.Error(err), log.Fields{"partition": msg.Partition, "offset": msg.Offset})
+			metrics.IngestParseFailed(ReceiverKafka)
+			opts.DeadLetters.Reject(ReceiverKafka, flow, msg.Value, DeadLetterUnparsable, err)
+			continue
+		}
+		if opts.DeadLetters.Unattributed(ReceiverKafka, rec) {
+			continue
+		}
+		log.Event(logs, "ingested log record from Kafka", log.V(1), log.Fields{"record": rec})
+		records.Push(rec)
+	}
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// LeaderElectionOptions holds the settings of electing the replica that reconciles logging resources
+type LeaderElectionOptions struct {
+	// Namespace and Name identify the lease the replicas compete for
+	Namespace string
+	Name      string
+	// Identity is the name of this replica
+	Identity string
+	// OnStartedLeading is called when this replica becomes the leader
+	OnStartedLeading func()
+}
+
+// LeaderElector tells whether this replica is the leader, which is the only one reconciling logging resources
+type LeaderElector struct {
+	leading uint32
+}
+
+func (e *LeaderElector) IsLeader() bool {
+	return atomic.LoadUint32(&e.leading) != 0
+}
+
+// RunLeaderElection competes for leadership until the stop signal is closed, re-joining the election whenever leadership is lost
+func RunLeaderElection(cfg *rest.Config, opts LeaderElectionOptions, logs log.Sink, stopSignal <-chan struct{}) (*LeaderElector, error) {
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock, opts.Namespace, opts.Name, clientset.CoreV1(), clientset.CoordinationV1(), resourcelock.ResourceLockConfig{
+		Identity: opts.Identity,
+	})
+	if err != nil {
+		return nil, err
+	}
+	logs = log.WithFields(logs, log.Fields{"task": "leader election", "identity": opts.Identity})
+
+	e := &LeaderElector{}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Name:            opts.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				log.Event(logs, "started leading")
+				atomic.StoreUint32(&e.leading, 1)
+				if opts.OnStartedLeading != nil {
+					opts.OnStartedLeading()
+				}
+			},
+			OnStoppedLeading: func() {
+				log.Event(logs, "stopped leading")
+				atomic.StoreUint32(&e.leading, 0)
+			},
+			OnNewLeader: func(identity string) {
+				log.Event(logs, "leader elected", log.V(1), log.Fields{"leader": identity})
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopSignal
+		cancel()
+	}()
+	go func() {
+		for ctx.Err() == nil {
+			elector.Run(ctx)
+		}
+	}()
+	return e, nil
+}
@@ -1,92 +1,709 @@
 package internal
 
 import (
+	"compress/flate"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/multierr"
+	"golang.org/x/time/rate"
 	authv1 "k8s.io/api/authentication/v1"
 
 	"github.com/banzaicloud/log-socket/log"
 )
 
 func Listen(addr string, tlsConfig *tls.Config, reg ListenerRegistry, logs log.Sink, metrics ListenMetrics,
-	stopSignal Handleable, terminationSignal Handleable, authenticator Authenticator) {
-	upgrader := websocket.Upgrader{}
+	stopSignal Handleable, terminationSignal Handleable, authenticator Authenticator, authorizer Authorizer, history RecordHistory, opts ListenerOptions) {
+	upgrader := websocket.Upgrader{
+		EnableCompression: opts.Compression,
+		HandshakeTimeout:  opts.HandshakeTimeout,
+		Subprotocols:      []string{WebSocketSubprotocol},
+		CheckOrigin:       opts.Origins.allowed,
+	}
+	admission := opts.Admission
+	if admission == nil {
+		admission = NewListenerAdmission(opts, metrics)
+	}
+	connLimiter, quota := admission.connLimiter, admission.quota
+	var active activeListeners
+	var limits listenerLimits
+	limits.set(opts)
+	var shardProxy *httputil.ReverseProxy
+	if opts.Shards != nil {
+		shardProxy = newShardProxy(opts.ShardReplica, opts.ShardProxyTLS, logs)
+	}
+	var ui http.Handler
+	if opts.UI {
+		ui = newUIHandler()
+	}
+	var ready readiness
+	if checker, ok := authenticator.(ReadinessChecker); ok {
+		ready.checkers = append(ready.checkers, checker)
+	}
 	server := &http.Server{
 		Addr: addr,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serveHealth(w, r, &ready, logs, metrics) {
+				return
+			}
+			// client certificates are verified during the handshake if present, but probes are allowed without one
+			if tlsConfig != nil && tlsConfig.ClientCAs != nil && (r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+				log.Event(logs, "listener request without client certificate", log.V(1), log.Fields{"remoteAddr": r.RemoteAddr})
+				metrics.ListenerRejected(FlowReference{}, authv1.UserInfo{})
+				http.Error(w, "missing client certificate", http.StatusUnauthorized)
+				return
+			}
+			if serveUI(w, r, ui) {
+				return
+			}
+			if serveCORS(w, r, opts.Origins, logs) {
+				return
+			}
+			if serveAdmin(w, r, opts.Admin, &active, opts.LogLevel, authenticator, nil, logs) {
+				return
+			}
+			if serveCapabilities(w, r, opts, &active, authenticator, authorizer, logs) {
+				return
+			}
+			if serveSubscriptions(w, r, opts, authenticator, authorizer, logs) {
+				return
+			}
+			if serveFlows(w, r, opts.Flows, authenticator, authorizer, opts.Tenancy, logs) {
+				return
+			}
+			if serveTicket(w, r, authenticator, opts.Tenancy, logs) {
+				return
+			}
+
+			reqID := requestID(w, r)
+			logs := withRequestID(logs, reqID)
+			if serveClusters(w, r, opts.Clusters, authenticator, opts.Tenancy, logs) {
+				return
+			}
 			log.Event(logs, "new listener connection request", log.V(2), log.Fields{"request": r})
 
-			flow, err := ExtractFlow(r)
+			original := r
+			sse := isSSERequest(r)
+			if sse {
+				r = sseRequest(r)
+			} else {
+				r = withLastSequenceHeader(r)
+			}
+			connCounter := countingConnFrom(r.Context())
+			if opts.HTTP2 && isExtendedConnect(r) {
+				var h2Conn *h2StreamConn
+				w, r, h2Conn = acceptExtendedConnect(w, r)
+				// the stream is closed when the handler returns
+				defer h2Conn.wait()
+				connCounter = h2Conn.counter
+			}
+
+			// listeners with a capability are identified as the capability, the filters it restricts records to replacing those the listener requested
+			var capability CapabilityInfo
+			var capabilityIssuer authv1.UserInfo
+			var err error
+			if token := r.URL.Query().Get(CapabilityParam); token != "" && opts.Capabilities != nil {
+				if capability, capabilityIssuer, err = opts.Capabilities.Verify(token, time.Now()); err != nil {
+					log.Event(logs, "invalid capability", log.V(1), log.Error(err), log.Fields{"capability": capability.ID})
+					metrics.ListenerRejected(FlowReference{}, authv1.UserInfo{})
+					http.Error(w, err.Error(), http.StatusForbidden)
+					return
+				}
+				r = capabilityRequest(r, capability)
+			}
+
+			var selector *LabelSelector
+			var flows []FlowReference
+			flowAuthorizer := authorizer
+			if capability.ID != "" {
+				flowAuthorizer = capabilityAuthorizer{Authorizer: authorizer, Capabilities: opts.Capabilities, Capability: capability, Issuer: capabilityIssuer}
+			}
+			if r.URL.Path == SelectEndpoint && opts.Selectors != nil {
+				var sel LabelSelector
+				if sel, err = ParseLabelSelector(r.URL.Query()); err == nil {
+					selector, flows = &sel, []FlowReference{sel.Flow()}
+				}
+			} else if r.URL.Path == DeadLetterEndpoint && opts.DeadLetters && opts.Admin != nil {
+				// dead letters are tailed by admins, whatever the records of flows they may access
+				flows, flowAuthorizer = []FlowReference{DeadLetterFlow(opts.ControlNamespace)}, deadLetterAuthorizer{Admin: opts.Admin}
+			} else {
+				flows, err = ExtractFlows(r, opts.ControlNamespace)
+			}
+			if err == nil && capability.ID != "" && (len(flows) != 1 || flows[0].URL() != capability.Flow) {
+				err = fmt.Errorf("the capability only grants access to %s", capability.Flow)
+			}
+			if err == nil {
+				err = checkSelectors(selector, flows...)
+			}
+			if err == nil {
+				err = checkOutputs(opts.Outputs, flows...)
+			}
 			if err != nil {
-				log.Event(logs, "failed to extract flow from request", log.V(1), log.Error(err), log.Fields{"request": r})
+				log.Event(logs, "failed to extract flows from request", log.V(1), log.Error(err), log.Fields{"request": r})
+				metrics.ListenerRejected(FlowReference{}, authv1.UserInfo{})
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if shardProxy != nil && r.Header.Get(ShardProxiedHeader) == "" {
+				owner, err := shardOwner(opts.Shards, flows)
+				if err != nil {
+					log.Event(logs, "flows of request are served by different replicas", log.V(1), log.Fields{"request": r})
+					metrics.ListenerRejected(FlowReference{}, authv1.UserInfo{})
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if _, ok := authenticator.(CertificateAuthenticator); ok && owner != "" {
+					// client certificates cannot be presented by the proxy
+					metrics.ListenerRejected(flows[0], authv1.UserInfo{})
+					http.Error(w, fmt.Sprintf("the flows are served by the replica at %s", owner), http.StatusMisdirectedRequest)
+					return
+				}
+				if owner != "" {
+					log.Event(logs, "proxying listener to the replica owning its flows", log.V(2), log.Fields{"request": r, "replica": owner})
+					if sse {
+						// the event stream is forwarded verbatim, its prefix and Last-Event-ID included
+						r = original
+					}
+					proxyToShard(shardProxy, w, r, owner)
+					return
+				}
+			}
+			// rejections are reported for the first requested flow
+			var flow FlowReference
+			if len(flows) > 0 {
+				flow = flows[0]
+			}
+			multiplexed := len(flows) != 1 || r.URL.Query().Get(MultiplexParam) == "true"
+
+			filter, err := ParseRecordFilter(r.URL.Query())
+			if err != nil {
+				log.Event(logs, "failed to parse record filter from request", log.V(1), log.Error(err), log.Fields{"request": r})
 				metrics.ListenerRejected(flow, authv1.UserInfo{})
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
+			filter.Selector = selector
 
-			authToken := r.Header.Get(AuthHeaderKey)
-			if authToken == "" {
-				log.Event(logs, "no authentication token in request headers", log.V(1), log.Fields{"headers": r.Header})
+			selection, err := ParseFieldSelection(r.URL.Query())
+			if err != nil {
+				log.Event(logs, "failed to parse field selection from request", log.V(1), log.Error(err), log.Fields{"request": r})
 				metrics.ListenerRejected(flow, authv1.UserInfo{})
-				http.Error(w, "missing authentication token", http.StatusForbidden)
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			usrInfo, err := authenticator.Authenticate(authToken)
+			replayReq, err := ParseReplayRequest(r.URL.Query(), time.Now())
 			if err != nil {
-				log.Event(logs, "authentication failed", log.V(1), log.Error(err), log.Fields{"token": authToken})
-				metrics.ListenerRejected(flow, usrInfo)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				log.Event(logs, "failed to parse replay request", log.V(1), log.Error(err), log.Fields{"request": r})
+				metrics.ListenerRejected(flow, authv1.UserInfo{})
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var persistent *persistentSubscription
+			if name := r.URL.Query().Get(SubscriptionParam); name != "" {
+				if opts.Subscriptions != nil {
+					persistent = opts.Subscriptions.lookup(name)
+				}
+				if persistent == nil {
+					log.Event(logs, "persistent subscription not found", log.V(1), log.Fields{"request": r, "subscription": name})
+					metrics.ListenerRejected(flow, authv1.UserInfo{})
+					http.Error(w, fmt.Sprintf("subscription %s not found", name), http.StatusNotFound)
+					return
+				}
+				if len(flows) != 1 || flows[0] != persistent.Flow() {
+					metrics.ListenerRejected(flow, authv1.UserInfo{})
+					http.Error(w, fmt.Sprintf("subscription %s captures %s", name, persistent.Flow().URL()), http.StatusBadRequest)
+					return
+				}
+			}
+
+			encoder, err := NewEncoder(ExtractEncoding(r))
+			if err != nil {
+				log.Event(logs, "unsupported encoding requested", log.V(1), log.Error(err), log.Fields{"request": r})
+				metrics.ListenerRejected(flow, authv1.UserInfo{})
+				http.Error(w, err.Error(), http.StatusNotAcceptable)
+				return
+			}
+			tmpl, err := ParseTemplate(r.URL.Query())
+			if err != nil {
+				log.Event(logs, "invalid template requested", log.V(1), log.Error(err), log.Fields{"request": r})
+				metrics.ListenerRejected(flow, authv1.UserInfo{})
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if tmpl != nil {
+				encoder = tmpl
+			}
+			if sse && binaryEncoding(encoder) {
+				log.Event(logs, "binary encoding requested for event stream", log.V(1), log.Fields{"request": r})
+				metrics.ListenerRejected(flow, authv1.UserInfo{})
+				http.Error(w, "event streams only support text encodings", http.StatusNotAcceptable)
+				return
+			}
+			sampling, err := ParseSubscriptionSampling(r.URL.Query())
+			if err == nil && sampling.Enabled() && r.URL.Query().Get(AckParam) != "" {
+				err = errors.New("sampled streams cannot acknowledge records")
+			}
+			if err == nil && r.URL.Query().Get(TemplateParam) != "" && r.URL.Query().Get(AckParam) != "" {
+				err = errors.New("templated streams cannot acknowledge records, since rendered records carry no sequence numbers")
+			}
+			if err != nil {
+				log.Event(logs, "invalid sampling requested", log.V(1), log.Error(err), log.Fields{"request": r})
+				metrics.ListenerRejected(flow, authv1.UserInfo{})
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ackConsumer := r.URL.Query().Get(AckParam)
+			if ackConsumer != "" {
+				if err := checkAckRequest(opts.Acks, encoder, sse, multiplexed); err != nil {
+					log.Event(logs, "invalid acknowledgement request", log.V(1), log.Error(err), log.Fields{"request": r})
+					metrics.ListenerRejected(flow, authv1.UserInfo{})
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if multiplexed {
+				encoder = MultiplexedEncoder(encoder)
+			}
+
+			batchOpts, err := ParseBatchOptions(r.URL.Query())
+			if err == nil {
+				err = batchOpts.validFor(encoder)
+			}
+			if err == nil && sse && batchOpts.Mode == BatchLengthPrefixed {
+				err = fmt.Errorf("event streams do not support %s batches", BatchLengthPrefixed)
+			}
+			if err != nil {
+				log.Event(logs, "invalid batch options requested", log.V(1), log.Error(err), log.Fields{"request": r})
+				metrics.ListenerRejected(flow, authv1.UserInfo{})
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			wsConn, err := upgrader.Upgrade(w, r, nil)
+			sessionDuration, err := parseSessionDuration(r.URL.Query(), opts)
 			if err != nil {
-				log.Event(logs, "failed to upgrade connection", log.V(1), log.Error(err))
+				log.Event(logs, "invalid session duration requested", log.V(1), log.Error(err), log.Fields{"request": r})
+				metrics.ListenerRejected(flow, authv1.UserInfo{})
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			statsInterval, err := parseStatsInterval(r.URL.Query())
+			if err != nil {
+				log.Event(logs, "invalid statistics interval requested", log.V(1), log.Error(err), log.Fields{"request": r})
+				metrics.ListenerRejected(flow, authv1.UserInfo{})
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			var usrInfo authv1.UserInfo
+			var creds requestCredentials
+			if capability.ID != "" {
+				usrInfo = capabilityUser(capability, capabilityIssuer)
+				// sessions of capability listeners end when the capability expires
+				if d := time.Until(capability.ExpiresAt); sessionDuration <= 0 || d < sessionDuration {
+					sessionDuration = d
+				}
+			} else {
+				var ok bool
+				if usrInfo, creds, ok = authenticateRequest(w, r, authenticator, opts.Tenancy, logs); !ok {
+					metrics.ListenerRejected(flow, usrInfo)
+					return
+				}
+				// sessions of listeners whose credentials are not re-authenticated end when the credentials expire
+				if d := time.Until(creds.expiresAt); !creds.expiresAt.IsZero() && (sessionDuration <= 0 || d < sessionDuration) {
+					// a zero duration would mean an unlimited session
+					sessionDuration = d
+					if sessionDuration <= 0 {
+						sessionDuration = time.Nanosecond
+					}
+				}
+			}
+
+			if connLimiter != nil {
+				if ok, retryAfter := connLimiter.Reserve(usrInfo.Username); !ok {
+					log.Event(logs, "user exceeded connection rate limit", log.V(1), log.Fields{"user": usrInfo, "retryAfter": retryAfter})
+					metrics.ListenerRejected(flow, usrInfo)
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+					http.Error(w, "too many connection attempts", http.StatusTooManyRequests)
+					return
+				}
+			}
+
+			for _, flow := range flows {
+				allowed, err := flowAuthorizer.AuthorizeFlow(usrInfo, flow)
+				if err != nil {
+					log.Event(logs, "authorization failed", log.V(1), log.Error(err), log.Fields{"user": usrInfo, "flow": flow})
+					metrics.ListenerRejected(flow, usrInfo)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if !allowed {
+					log.Event(logs, "user is not allowed to tail flow", log.V(1), log.Fields{"user": usrInfo, "flow": flow})
+					metrics.ListenerRejected(flow, usrInfo)
+					http.Error(w, fmt.Sprintf("permission denied to tail %s", flow.URL()), http.StatusForbidden)
+					return
+				}
+			}
+
+			if selector != nil {
+				if err := opts.Selectors.EnsureSelectorFlow(r.Context(), *selector); err != nil {
+					log.Event(logs, "failed to create flow of label selector", log.Error(err), log.Fields{"user": usrInfo, "flow": flow})
+					metrics.ListenerRejected(flow, usrInfo)
+					http.Error(w, "failed to create flow of label selector", http.StatusInternalServerError)
+					return
+				}
+			}
+
+			// the reservation of the consumer is released if the connection is not established
+			releaseAcks := func() {}
+			if ackConsumer != "" {
+				keys := ackKeys(usrInfo, ackConsumer, flows)
+				if err := opts.Acks.Reserve(keys...); err != nil {
+					log.Event(logs, "acknowledging consumer rejected", log.V(1), log.Error(err), log.Fields{"user": usrInfo, "consumer": ackConsumer})
+					metrics.ListenerRejected(flow, usrInfo)
+					http.Error(w, err.Error(), http.StatusTooManyRequests)
+					return
+				}
+				releaseAcks = func() { opts.Acks.Release(keys...) }
+			}
+
+			if quota != nil && !quota.Acquire(usrInfo) {
+				log.Event(logs, "connection quota exceeded", log.V(1), log.Fields{"user": usrInfo})
 				metrics.ListenerRejected(flow, usrInfo)
-				// cannot reply with an error here since the connection has been "hijacked"
+				releaseAcks()
+				w.Header().Set("Retry-After", strconv.Itoa(int(opts.quotaRetryAfter().Seconds())))
+				http.Error(w, "too many concurrent connections", http.StatusTooManyRequests)
 				return
 			}
 
-			log.Event(logs, "successful websocket upgrade", log.V(2), log.Fields{"request": r, "wsConn": wsConn})
+			var conn listenerConn
+			var events *sseConn
+			var wsConn *websocket.Conn
+			if sse {
+				if events, err = acceptSSE(w, r); err != nil {
+					log.Event(logs, "failed to start event stream", log.V(1), log.Error(err))
+					metrics.ListenerRejected(flow, usrInfo)
+					releaseAcks()
+					if quota != nil {
+						quota.Release(usrInfo)
+					}
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				// the response is written until the handler returns
+				defer events.wait()
+				conn = events
+			} else {
+				wsConn, err = upgrader.Upgrade(w, r, http.Header{RequestIDHeader: {reqID}})
+				if err != nil {
+					log.Event(logs, "failed to upgrade connection", log.V(1), log.Error(err))
+					if isTimeout(err) {
+						metrics.DeadlineExceeded(flow, DeadlineHandshake)
+					}
+					metrics.ListenerRejected(flow, usrInfo)
+					releaseAcks()
+					if quota != nil {
+						quota.Release(usrInfo)
+					}
+					// cannot reply with an error here since the connection has been "hijacked"
+					return
+				}
 
-			metrics.ListenerAccepted(flow, usrInfo)
+				log.Event(logs, "successful websocket upgrade", log.V(2), log.Fields{"request": r, "wsConn": wsConn})
+
+				if opts.Compression {
+					if err := wsConn.SetCompressionLevel(opts.CompressionLevel); err != nil {
+						log.Event(logs, "invalid compression level", log.V(1), log.Error(err), log.Fields{"level": opts.CompressionLevel})
+					}
+				}
+				conn = wsConn
+			}
 
 			l := &listener{
-				conn:    wsConn,
-				flow:    flow,
-				logs:    logs,
-				metrics: metrics,
-				reg:     reg,
-				usrInfo: usrInfo,
-			}
-			reg.Register(l)
+				ackConsumer:   ackConsumer,
+				authenticator: authenticator,
+				authorizer:    flowAuthorizer,
+				capability:    capability.ID,
+				credentials:   creds,
+				closeRequests: make(chan closeRequest, 1),
+				conn:          conn,
+				connectedAt:   time.Now(),
+				connCounter:   connCounter,
+				controls:      make(chan ControlMessage, listenerControlQueueSize),
+				done:          NewWaitableLatch(),
+				encoder:       encoder,
+				filter:        filter,
+				flows:         make(map[FlowReference]bool),
+				id:            newListenerID(),
+				limiter:       limits.recordLimiter(),
+				logs:          logs,
+				metrics:       metrics,
+				multiplexed:   multiplexed,
+				opts:          opts,
+				policy:        opts.BackpressurePolicy,
+				pongs:         make(chan struct{}, 1),
+				queue:         make(chan Record, opts.bufferSize()),
+				reg:           reg,
+				remoteAddr:    r.RemoteAddr,
+				clientAddr:    opts.TrustedProxies.ClientAddr(r),
+				replayedUpTo:  make(map[FlowReference]uint64),
+				requestID:     reqID,
+				selection:     selection,
+				statsInterval: statsInterval,
+				usrInfo:       usrInfo,
+			}
+			if batchOpts.Enabled() {
+				l.batch = &recordBatch{opts: batchOpts}
+			}
+			if sessionDuration > 0 {
+				l.expiresAt = l.connectedAt.Add(sessionDuration)
+			}
+			if l.policy == BackpressureSample {
+				l.sampler = newAdaptiveSampler()
+			}
+			if sampling.Enabled() {
+				l.requestedSampler = newSubscriptionSampler(sampling)
+			}
+			l.markActive()
+			active.add(l)
+			go func() {
+				l.done.Wait()
+				active.remove(l)
+				if quota != nil {
+					quota.Release(usrInfo)
+				}
+			}()
+			pong := func() {
+				select {
+				case l.pongs <- struct{}{}:
+				default:
+				}
+			}
+			if wsConn != nil {
+				wsConn.SetCloseHandler(func(code int, text string) error {
+					log.Event(logs, "websocket connection closed", log.V(1), log.Fields{"code": code, "text": text, "listener": l})
+					return nil
+				})
+				wsConn.SetPongHandler(func(string) error {
+					pong()
+					return nil
+				})
+			} else {
+				events.onPong = pong
+			}
+			// the end of the records delivered again to consumers acknowledging records is signaled like that of replays
+			l.replayRequested = !replayReq.Empty() && history != nil || ackConsumer != "" || persistent != nil
+			for _, flow := range flows {
+				l.subscribe(flow)
+				req := replayReq
+				if after, ok := replayReq.resumeFrom(flow); ok {
+					req.After = after
+					if persistent == nil {
+						if gap, ok := resumeGap(history, flow, after); ok {
+							l.gaps = append(l.gaps, gap)
+						}
+					}
+				}
+				if ackConsumer != "" {
+					// unacknowledged records are delivered again, followed by the retained records dispatched since the last delivery
+					var redelivered uint64
+					if req, redelivered = l.resumeAcked(flow, req); redelivered > 0 {
+						l.replayedUpTo[flow] = redelivered
+					}
+				}
+				// the history is queried after subscribing so that records dispatched in the meantime are either replayed or delivered live
+				var records []Record
+				if persistent != nil {
+					// the records captured by the persistent subscription replace the retained ones
+					records = persistent.Records(flow, req)
+				} else if !req.Empty() && history != nil {
+					records = history.Records(flow, req)
+				}
+				if n := len(records); n > 0 {
+					l.replay = append(l.replay, records...)
+					l.replayedUpTo[flow] = records[n-1].Sequence
+				}
+			}
+			if sampling.Enabled() {
+				l.sendControl(sampling.notification())
+			}
+			l.audit(AuditEventConnected, flows)
 			go l.readLoop()
-			wsConn.SetCloseHandler(func(code int, text string) error {
-				log.Event(logs, "websocket connection closed", log.V(1), log.Fields{"code": code, "text": text, "listener": l})
-				reg.Unregister(l)
-				return nil
-			})
+			go l.writeLoop()
+			if opts.PingInterval > 0 {
+				go l.pingLoop(opts.PingInterval, opts.pongTimeout(), opts.maxMissedPongs())
+			}
+			if opts.ReauthorizationInterval > 0 {
+				go l.reauthorizeLoop(opts.ReauthorizationInterval)
+			}
+			if !l.expiresAt.IsZero() {
+				go l.sessionLoop(opts.SessionExpiryWarnings)
+			}
+			if opts.IdleTimeout > 0 {
+				go l.idleLoop(opts.IdleTimeout)
+			}
 
-			log.Event(logs, "listener connected", log.Fields{"listener": l})
+			log.Event(logs, "listener connected", log.Fields{"listener": l, "multiplexed": multiplexed, "compressed": compressionOffered(r), "sse": sse})
 		}),
-		TLSConfig: tlsConfig,
+		// the headers of handshake requests are read within the handshake timeout, the handshake response is written within it by the upgrader
+		ReadHeaderTimeout: opts.HandshakeTimeout,
+		TLSConfig:         tlsConfig,
+		ConnContext:       withCountingConn,
+	}
+	if !opts.HTTP2 {
+		// websocket upgrades require HTTP/1.1 unless extended CONNECT is enabled
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	if opts.LimitUpdates != nil {
+		go func() {
+			for update := range opts.LimitUpdates {
+				limits.set(update)
+				quota.SetLimits(update.MaxConnections, update.MaxUserConnections)
+				for _, l := range active.list() {
+					limits.apply(l.limiter)
+				}
+				log.Event(logs, "listener limits updated", log.Fields{"recordRate": update.RecordRate, "recordBurst": update.recordBurst(), "maxConnections": update.MaxConnections, "maxUserConnections": update.MaxUserConnections})
+			}
+		}()
+	}
+
+	var shutdownWG sync.WaitGroup
+	if stopSignal != nil {
+		ctx := context.Background()
+
+		if terminationSignal != nil {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithCancel(context.Background())
+			terminationSignal.HandleWith(cancel)
+			terminationSignal.HandleWith(func() {
+				for _, l := range active.list() {
+					l.disconnect()
+				}
+			})
+		}
+
+		stopSignal.HandleWith(func() {
+			shutdownWG.Add(1)
+			defer shutdownWG.Done()
+			ready.shutdown()
+			// hijacked websocket connections are not closed by the server, so listeners are notified one by one
+			for _, l := range active.list() {
+				l.closeWith(websocket.CloseGoingAway, "server is shutting down")
+			}
+			if err := server.Shutdown(ctx); err != nil {
+				log.Event(logs, "error during websocket listener server shutdown", log.Error(err))
+			}
+		})
 	}
 
-	if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Event(logs, "websocket listener server failed to listen", log.Error(err), log.Fields{"addr": addr})
+		return
+	}
+	if err := server.ServeTLS(countingListener{ln}, "", ""); err != nil && err != http.ErrServerClosed {
 		log.Event(logs, "websocket listener server returned an error", log.Error(err))
 	}
+	shutdownWG.Wait()
+}
+
+// compressionOffered reports whether the listener offered permessage-deflate, in which case the upgrader negotiated it if enabled
+func compressionOffered(r *http.Request) bool {
+	for _, ext := range r.Header.Values("Sec-WebSocket-Extensions") {
+		if strings.Contains(ext, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// listenerLimits holds the record rate limit of listeners, which can be changed while the server is running
+type listenerLimits struct {
+	mutex sync.Mutex
+	opts  ListenerOptions
+}
+
+func (l *listenerLimits) set(opts ListenerOptions) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.opts = opts
+}
+
+func (l *listenerLimits) recordLimiter() *rate.Limiter {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.opts.recordLimiter()
+}
+
+// apply changes the limit of a connected listener's limiter, listeners connected without a rate limit stay unlimited
+func (l *listenerLimits) apply(limiter *rate.Limiter) {
+	if limiter == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.opts.RecordRate <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	limiter.SetBurst(l.opts.recordBurst())
+	limiter.SetLimit(rate.Limit(l.opts.RecordRate))
+}
+
+// activeListeners is the set of connected listeners of a server
+type activeListeners struct {
+	listeners map[*listener]struct{}
+	mutex     sync.Mutex
+}
+
+func (a *activeListeners) add(l *listener) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.listeners == nil {
+		a.listeners = make(map[*listener]struct{})
+	}
+	a.listeners[l] = struct{}{}
+}
+
+func (a *activeListeners) remove(l *listener) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.listeners, l)
+}
+
+func (a *activeListeners) list() []*listener {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	res := make([]*listener, 0, len(a.listeners))
+	for l := range a.listeners {
+		res = append(res, l)
+	}
+	return res
 }
 
 type ListenMetrics interface {
+	HealthMetrics
 	ListenerAccepted(flow FlowReference, user authv1.UserInfo)
 	ListenerRejected(flow FlowReference, user authv1.UserInfo)
+	QuotaMetrics
 	listenerMetrics
 }
 
@@ -95,39 +712,381 @@ type ListenerRegistry interface {
 	Unregister(Listener)
 }
 
+// requestCredentials are the credentials a request was authenticated with, which listeners validate again periodically
+type requestCredentials struct {
+	// token is empty if the request was authenticated with a client certificate or a token that cannot be re-authenticated, i.e. a signed query token expiring at expiresAt
+	token     string
+	cert      *x509.Certificate
+	expiresAt time.Time
+	// impersonation is set if the authenticated user impersonates another one
+	impersonation *impersonation
+}
+
+// impersonation is the authenticated user and the user they impersonate as requested
+type impersonation struct {
+	user   authv1.UserInfo
+	target authv1.UserInfo
+}
+
+// authenticateRequest authenticates the user making the request with its client certificate or token and assigns the user to a tenant
+// The request is rejected with an error response if it fails
+func authenticateRequest(w http.ResponseWriter, r *http.Request, authenticator Authenticator, tenancy Tenancy, logs log.Sink) (usrInfo authv1.UserInfo, creds requestCredentials, ok bool) {
+	var err error
+	if certAuthenticator, isCert := authenticator.(CertificateAuthenticator); isCert {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			log.Event(logs, "no client certificate in request", log.V(1), log.Fields{"request": r})
+			http.Error(w, "missing client certificate", http.StatusForbidden)
+			return
+		}
+		creds.cert = r.TLS.PeerCertificates[0]
+		usrInfo, err = certAuthenticator.AuthenticateCertificate(creds.cert)
+		if err != nil {
+			log.Event(logs, "authentication failed", log.V(1), log.Error(err), log.Fields{"subject": creds.cert.Subject})
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	} else {
+		var source TokenSource
+		var authToken string
+		authToken, source, err = requestToken(r, authenticator)
+		if err != nil {
+			log.Event(logs, "failed to redeem ticket", log.V(1), log.Error(err))
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if authToken == "" {
+			log.Event(logs, "no authentication token in request", log.V(1), log.Fields{"headers": r.Header})
+			http.Error(w, "missing authentication token", http.StatusForbidden)
+			return
+		}
+
+		usrInfo, creds.expiresAt, err = authenticateToken(authenticator, authToken, source)
+		if err != nil {
+			log.Event(logs, "authentication failed", log.V(1), log.Error(err), log.Fields{"token": authToken, "source": source})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// signed query tokens are short-lived, they are verified when connecting and sessions end when they expire
+		if source != TokenSourceQuery {
+			creds.token = authToken
+		}
+	}
+
+	target, impersonating, err := requestImpersonation(r)
+	if err == nil && impersonating {
+		authUser := usrInfo
+		if usrInfo, err = impersonate(authenticator, usrInfo, target); err == nil {
+			log.Event(logs, "user impersonates another user", log.V(1), log.Fields{"user": authUser, "impersonated": usrInfo})
+			creds.impersonation = &impersonation{user: authUser, target: target}
+		}
+	}
+	if err != nil {
+		log.Event(logs, "impersonation failed", log.V(1), log.Error(err), log.Fields{"user": usrInfo})
+		status := http.StatusInternalServerError
+		if errors.Is(err, errImpersonationDisabled) || errors.Is(err, errImpersonationForbidden) || !impersonating {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if tenancy != nil {
+		tenant, found := tenancy.Tenant(usrInfo)
+		if !found {
+			log.Event(logs, "user belongs to no tenant", log.V(1), log.Fields{"user": usrInfo})
+			http.Error(w, "user belongs to no tenant", http.StatusForbidden)
+			return
+		}
+		usrInfo = withTenant(usrInfo, tenant)
+	}
+	return usrInfo, creds, true
+}
+
 type Listener interface {
 	Send(Record)
 	Flow() FlowReference
 	User() authv1.UserInfo
 }
 
+// ListenerOptions holds the settings applied to each accepted listener
+type ListenerOptions struct {
+	// ControlNamespace is the namespace of cluster flows referenced without a namespace
+	ControlNamespace string
+	// BufferSize is the number of records that can be queued for a listener before the backpressure policy kicks in
+	BufferSize int
+	// BackpressurePolicy determines what happens when a listener's buffer is full
+	BackpressurePolicy BackpressurePolicy
+	// PingInterval is the time between keepalive pings, zero disables keepalive
+	PingInterval time.Duration
+	// PongTimeout is how long to wait for a pong after sending a ping, it cannot exceed PingInterval
+	PongTimeout time.Duration
+	// MaxMissedPongs is the number of consecutive missed pongs after which the listener is considered dead
+	MaxMissedPongs int
+	// RecordRate is the maximum number of records per second delivered to a listener, zero means unlimited
+	RecordRate float64
+	// RecordBurst is the number of records that can be delivered at once above RecordRate
+	RecordBurst int
+	// ConnectionRate is the maximum number of connection attempts per second for each user, zero means unlimited
+	ConnectionRate float64
+	// ConnectionBurst is the number of connection attempts a user can make at once above ConnectionRate
+	ConnectionBurst int
+	// ReauthorizationInterval is the time between re-validating the credentials and permissions of listeners, zero disables re-validation
+	ReauthorizationInterval time.Duration
+	// Audit receives events of listeners accessing flows, nil disables auditing
+	Audit AuditSink
+	// Compression enables permessage-deflate for listeners that offer it
+	Compression bool
+	// CompressionLevel is the flate compression level of frames sent to listeners that negotiated compression
+	CompressionLevel int
+	// HTTP2 enables HTTP/2 and websockets over HTTP/2 streams (RFC 8441), which requires the GODEBUG=http2xconnect=1 environment variable
+	HTTP2 bool
+	// MaxConnections is the maximum number of concurrent listener connections, zero means unlimited
+	MaxConnections int
+	// MaxUserConnections is the maximum number of concurrent connections of each user, zero means unlimited
+	MaxUserConnections int
+	// QuotaRetryAfter is the delay suggested to listeners rejected because a connection quota is exhausted
+	QuotaRetryAfter time.Duration
+	// Tenancy assigns listeners to tenants, listeners that belong to no tenant are rejected, nil disables multi-tenancy
+	Tenancy Tenancy
+	// Admission holds the connection rate limit and quotas shared with other servers of listeners, Listen creates its own from the options if it is nil
+	Admission *ListenerAdmission
+	// LimitUpdates delivers options changed while the server is running, their record rate limits and connection quotas replace the current ones
+	LimitUpdates <-chan ListenerOptions
+	// UI enables the web UI served under UIPathPrefix
+	UI bool
+	// Admin authorizes requests of the admin API, nil disables the API
+	Admin AdminAuthorizer
+	// LogLevel lets admins change the verbosity of the logs on AdminLogEndpoint, nil disables the endpoint
+	LogLevel LogLevel
+	// Flows lists the flows of the cluster on the flows endpoint, filtered by the permissions of the user, nil disables the endpoint
+	Flows FlowLister
+	// Outputs routes the records of flows to the listeners of the outputs they reference, nil disables subscribing to outputs
+	Outputs OutputRouter
+	// Selectors provides the flows of the label selectors listeners connect to SelectEndpoint with, nil disables label selector subscriptions
+	Selectors SelectorFlows
+	// Shards assigns flows to replicas in sharding mode, listeners of flows owned by other replicas are proxied to them, nil disables sharding
+	Shards ShardRouter
+	// ShardReplica is the name of this replica, sent to the replicas listeners are proxied to
+	ShardReplica string
+	// ShardProxyTLS is the client configuration of connections to other replicas, nil means they are made without TLS
+	ShardProxyTLS *tls.Config
+	// DeadLetters enables tailing the dead-letter flow on DeadLetterEndpoint, which requires Admin
+	DeadLetters bool
+	// Acks retains the records delivered to listeners connecting with AckParam until they acknowledge them, nil disables acknowledgements
+	Acks *AckStore
+	// SessionDuration is how long listeners stay connected unless they request a different duration with DurationParam, zero means MaxSessionDuration
+	SessionDuration time.Duration
+	// MaxSessionDuration is the longest duration listeners can request, zero means unlimited
+	MaxSessionDuration time.Duration
+	// SessionExpiryWarnings are how long before their session expires listeners are warned
+	SessionExpiryWarnings []time.Duration
+	// WriteTimeout is how long writing a frame to a listener may take before it is disconnected, zero means unlimited
+	WriteTimeout time.Duration
+	// HandshakeTimeout is how long reading the headers of a connection request and completing the websocket handshake may take, zero means unlimited
+	HandshakeTimeout time.Duration
+	// IdleTimeout is how long a listener may stay connected without records delivered to it or messages received from it, zero means unlimited
+	IdleTimeout time.Duration
+	// TrustedProxies are the proxies whose forwarding headers tell the address of listeners, see TrustedProxies.ClientAddr
+	TrustedProxies TrustedProxies
+	// Origins decides which web pages browsers may connect from, only pages served by the service are allowed by default
+	Origins OriginPolicy
+	// Subscriptions are the persistent subscriptions created on AdminSubscriptionsEndpoint, which requires Admin, nil disables persistent subscriptions
+	Subscriptions *PersistentSubscriptions
+	// Capabilities mints capability URLs on AdminCapabilitiesEndpoint and verifies those listeners connect with, which requires Admin, nil disables capability URLs
+	Capabilities *Capabilities
+	// Clusters are the remote clusters the requests under ClusterPathPrefix are forwarded to, empty disables aggregation
+	Clusters RemoteClusters
+}
+
+const (
+	DefaultListenerBufferSize      = 64
+	DefaultPingInterval            = 30 * time.Second
+	DefaultPongTimeout             = 10 * time.Second
+	DefaultMaxMissedPongs          = 3
+	DefaultReauthorizationInterval = 5 * time.Minute
+	DefaultCompressionLevel        = flate.BestSpeed
+
+	listenerControlQueueSize   = 8
+	rateLimitNotificationDelay = time.Second
+)
+
+func (o ListenerOptions) bufferSize() int {
+	if o.BufferSize <= 0 {
+		return DefaultListenerBufferSize
+	}
+	return o.BufferSize
+}
+
+func (o ListenerOptions) recordLimiter() *rate.Limiter {
+	if o.RecordRate <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(o.RecordRate), o.recordBurst())
+}
+
+func (o ListenerOptions) recordBurst() int {
+	if o.RecordBurst <= 0 {
+		return int(math.Ceil(o.RecordRate))
+	}
+	return o.RecordBurst
+}
+
+func (o ListenerOptions) quotaRetryAfter() time.Duration {
+	if o.QuotaRetryAfter < time.Second {
+		return DefaultQuotaRetryAfter
+	}
+	return o.QuotaRetryAfter
+}
+
+func (o ListenerOptions) connectionBurst() int {
+	if o.ConnectionBurst <= 0 {
+		return 1
+	}
+	return o.ConnectionBurst
+}
+
+func (o ListenerOptions) pongTimeout() time.Duration {
+	if o.PongTimeout <= 0 || o.PongTimeout > o.PingInterval {
+		return o.PingInterval
+	}
+	return o.PongTimeout
+}
+
+func (o ListenerOptions) maxMissedPongs() int {
+	if o.MaxMissedPongs <= 0 {
+		return DefaultMaxMissedPongs
+	}
+	return o.MaxMissedPongs
+}
+
+type BackpressurePolicy string
+
+const (
+	BackpressureDropOldest BackpressurePolicy = "drop-oldest"
+	BackpressureDropNewest BackpressurePolicy = "drop-newest"
+	BackpressureDisconnect BackpressurePolicy = "disconnect"
+)
+
+func ParseBackpressurePolicy(s string) (BackpressurePolicy, error) {
+	switch p := BackpressurePolicy(s); p {
+	case BackpressureDropOldest, BackpressureDropNewest, BackpressureDisconnect, BackpressureSample:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid backpressure policy %q", s)
+	}
+}
+
+// listener represents a websocket connection, it is registered in the listener registry once for each flow it is subscribed to
 type listener struct {
-	conn    *websocket.Conn
-	flow    FlowReference
-	logs    log.Sink
-	metrics listenerMetrics
-	reg     ListenerRegistry
-	usrInfo authv1.UserInfo
+	// ackConsumer names the consumer the listener acknowledges records for, records are not retained for acknowledgement if empty
+	ackConsumer   string
+	authenticator Authenticator
+	authorizer    Authorizer
+	// batch collects records to write as a single frame, it is nil unless the listener requested batching
+	batch *recordBatch
+	// credentials are those the listener authenticated with, kept for re-validation
+	credentials requestCredentials
+	// closing is set once the connection is being closed, no more records are queued afterwards
+	closing       uint32
+	closeRequests chan closeRequest
+	conn          listenerConn
+	connectedAt   time.Time
+	// connCounter measures the bytes written to the underlying connection, it is nil if unavailable
+	connCounter *countingConn
+	controls    chan ControlMessage
+	// delivered, filtered and redacted count the records sent to, filtered out for and redacted for the listener
+	delivered uint64
+	done      *WaitableLatch
+	// dropped counts the records dropped because the listener's buffer was full
+	dropped uint64
+	encoder Encoder
+	// expiresAt is when the session of the listener expires, zero if it is unlimited
+	expiresAt time.Time
+	filter    RecordFilter
+	filtered  uint64
+	flows     map[FlowReference]bool
+	// id identifies the listener in the admin API
+	id string
+	// lastActive is when a record was last delivered to or a message received from the listener, in Unix nanoseconds
+	lastActive int64
+	limiter    *rate.Limiter
+	logs       log.Sink
+	metrics    ListenMetrics
+	// multiplexed listeners can subscribe to several flows and receive records wrapped with their flow reference
+	multiplexed bool
+	mutex       sync.Mutex
+	opts        ListenerOptions
+	policy      BackpressurePolicy
+	pongs       chan struct{}
+	queue       chan Record
+	// rateLimited is the number of records dropped by the rate limiter since the listener was last notified
+	rateLimited uint64
+	redacted    uint64
+	reg         ListenerRegistry
+	// remoteAddr is the address the connection comes from and clientAddr the address of the listener behind trusted proxies
+	remoteAddr string
+	clientAddr string
+	// requestID correlates the log and audit events of the connection
+	requestID string
+	// capability is the ID of the capability URL the listener connected with, if any
+	capability string
+	// sampler thins out the records of the listener under the sample backpressure policy, it is nil under other policies
+	sampler *adaptiveSampler
+	// requestedSampler delivers the sample of records requested by the listener, it is nil if the listener requested all records
+	requestedSampler *subscriptionSampler
+	// replay holds the records to send before live ones, live records up to replayedUpTo are skipped as they have been replayed
+	replay       []Record
+	replayedUpTo map[FlowReference]uint64
+	// gaps are the gap control messages of the flows the listener cannot resume without missing records, they are sent before replayed records
+	gaps []ControlMessage
+	// replayRequested makes the listener send a replayed control message once the replayed records have been delivered
+	replayRequested bool
+	// selection, if set, replaces the data of delivered records with the selected fields
+	selection FieldSelection
+	// statsInterval is the interval of the stats messages requested by the listener, zero if it did not request them
+	statsInterval time.Duration
+	usrInfo       authv1.UserInfo
+}
+
+// listenerConn is the connection records are delivered over, a websocket connection or an event stream
+type listenerConn interface {
+	Close() error
+	NextWriter(messageType int) (io.WriteCloser, error)
+	ReadMessage() (messageType int, p []byte, err error)
+	SetWriteDeadline(t time.Time) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	WriteMessage(messageType int, data []byte) error
+}
+
+// subscription is the registered listener of a single flow of a connection
+type subscription struct {
+	*listener
+	flow FlowReference
+}
+
+func (s subscription) Flow() FlowReference {
+	return s.flow
 }
 
 type listenerMetrics interface {
+	DeadlineMetrics
+	FrameWritten(l Listener, r Record, size int, wireSize int)
+	ListenerTimedOut(l Listener)
+	LogRecordDropped(l Listener, r Record)
+	LogRecordRateLimited(l Listener, r Record)
 	LogRecordRedacted(l Listener, r Record)
 	LogRecordTransmitted(l Listener, r Record)
 }
 
-func (l listener) Equals(o listener) bool {
+func (l *listener) Equals(o *listener) bool {
 	return l.conn == o.conn
 }
 
-func (l listener) Flow() FlowReference {
-	return l.flow
-}
-
-func (l listener) Format(f fmt.State, c rune) {
+func (l *listener) Format(f fmt.State, c rune) {
 	type listener struct {
-		Conn *websocket.Conn
-		Flow FlowReference
-		User authv1.UserInfo
+		Conn  listenerConn
+		Flows []FlowReference
+		User  authv1.UserInfo
 	}
 	flag := ""
 	switch {
@@ -137,60 +1096,532 @@ func (l listener) Format(f fmt.State, c rune) {
 		flag = "+"
 	}
 	fmt.Fprintf(f, fmt.Sprintf("%%%s%c", flag, c), listener{
-		Conn: l.conn,
-		Flow: l.flow,
-		User: l.usrInfo,
+		Conn:  l.conn,
+		Flows: l.subscribedFlows(),
+		User:  l.usrInfo,
 	})
 }
 
+func (l *listener) subscribedFlows() []FlowReference {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	res := make([]FlowReference, 0, len(l.flows))
+	for flow := range l.flows {
+		res = append(res, flow)
+	}
+	return res
+}
+
+// subscribe registers the listener for the flow, authorization has to be checked by the caller
+func (l *listener) subscribe(flow FlowReference) {
+	l.mutex.Lock()
+	if l.flows == nil || l.flows[flow] { // disconnected or already subscribed
+		l.mutex.Unlock()
+		return
+	}
+	l.flows[flow] = true
+	l.mutex.Unlock()
+
+	l.metrics.ListenerAccepted(flow, l.usrInfo)
+	l.reg.Register(subscription{l, flow})
+	log.Event(l.logs, "listener subscribed to flow", log.Fields{"listener": l, "flow": flow})
+}
+
+// withdraw closes the connection with the code, or unsubscribes multiplexed listeners from the flow, it returns false if the listener is being disconnected
+func (l *listener) withdraw(flow FlowReference, code int, msg string) bool {
+	if !l.multiplexed {
+		l.closeWith(code, msg)
+		return false
+	}
+	l.unsubscribe(flow)
+	l.audit(AuditEventUnsubscribed, []FlowReference{flow})
+	l.sendControl(ControlMessage{Control: ControlUnsubscribed, Message: msg, Flow: flow.URL(), Code: code})
+	return true
+}
+
+func (l *listener) unsubscribe(flow FlowReference) {
+	l.mutex.Lock()
+	if !l.flows[flow] {
+		l.mutex.Unlock()
+		return
+	}
+	delete(l.flows, flow)
+	l.mutex.Unlock()
+
+	l.reg.Unregister(subscription{l, flow})
+	log.Event(l.logs, "listener unsubscribed from flow", log.Fields{"listener": l, "flow": flow})
+}
+
+// Send queues the record for delivery if it matches the listener's filter to the listener without blocking on the connection
 func (l *listener) Send(r Record) {
-	log.Event(l.logs, "processing log record", log.V(2), log.Fields{"listener": l, "record": r})
+	if atomic.LoadUint32(&l.closing) != 0 {
+		return
+	}
 
-	rules, err := loadRBACRules(r)
-	if err != nil {
-		log.Event(l.logs, "an error occurred while loading RBAC rules from record", log.V(1), log.Fields{"record": r})
+	if !l.filter.Matches(r) {
+		log.Event(l.logs, "log record does not match listener filter", log.V(2), log.Fields{"listener": l, "record": r})
+		atomic.AddUint64(&l.filtered, 1)
+		return
+	}
+
+	if l.requestedSampler != nil && !l.requestedSampler.keep(r) {
+		log.Event(l.logs, "log record not part of the requested sample", log.V(2), log.Fields{"listener": l, "record": r})
+		return
+	}
+
+	if l.sampler != nil && !l.sampler.keep(r) {
+		log.Event(l.logs, "log record skipped by sampling", log.V(2), log.Fields{"listener": l, "record": r})
+		return
+	}
+
+	if l.limiter != nil && !l.limiter.Allow() {
+		log.Event(l.logs, "listener exceeded record rate limit", log.V(2), log.Fields{"listener": l, "record": r})
+		l.metrics.LogRecordRateLimited(subscription{l, r.Flow}, r)
+		atomic.AddUint64(&l.rateLimited, 1)
+		return
+	}
+
+	select {
+	case l.queue <- r:
+		return
+	default:
+	}
+
+	log.Event(l.logs, "listener buffer is full", log.V(1), log.Fields{"listener": l, "policy": l.policy})
+
+	switch l.policy {
+	case BackpressureDropNewest:
+		l.drop(r)
+	case BackpressureDisconnect:
+		l.drop(r)
+		l.closeWith(CloseSlowConsumer, "listener could not keep up with records")
+	default: // drop oldest, also while the sampling rate adapts
+		if l.sampler != nil {
+			if rate := l.sampler.overflowed(time.Now()); rate > 0 {
+				log.Event(l.logs, "sampling records of slow listener", log.V(1), log.Fields{"listener": l, "sampleRate": rate})
+				l.sendControl(ControlMessage{Control: ControlSampling, Message: "the listener cannot keep up, only some records are delivered apart from errors", SampleRate: rate})
+			}
+		}
+		select {
+		case old := <-l.queue:
+			l.drop(old)
+		default:
+		}
+		select {
+		case l.queue <- r:
+		default:
+			l.drop(r)
+		}
+	}
+}
+
+func (l *listener) drop(r Record) {
+	atomic.AddUint64(&l.dropped, 1)
+	l.metrics.LogRecordDropped(subscription{l, r.Flow}, r)
+}
+
+// writeLoop delivers queued records to the websocket connection until the listener is done
+func (l *listener) writeLoop() {
+	var rateLimitTicks <-chan time.Time
+	if l.limiter != nil {
+		ticker := time.NewTicker(rateLimitNotificationDelay)
+		defer ticker.Stop()
+		rateLimitTicks = ticker.C
+	}
+
+	var samplingTicks <-chan time.Time
+	if l.sampler != nil {
+		ticker := time.NewTicker(samplingAdjustInterval)
+		defer ticker.Stop()
+		samplingTicks = ticker.C
+	}
+
+	var batchTicks <-chan time.Time
+	if l.batch != nil {
+		ticker := time.NewTicker(l.batch.opts.Interval)
+		defer ticker.Stop()
+		batchTicks = ticker.C
 	}
 
-	data := r.RawData
-	if !rules.canView(l.usrInfo) {
-		log.Event(l.logs, "listener does not have permission to view log record", log.V(1), log.Fields{"listener": l, "record": r, "rules": rules})
-		l.metrics.LogRecordRedacted(l, r)
+	var statsTicks <-chan time.Time
+	if l.statsInterval > 0 {
+		ticker := time.NewTicker(l.statsInterval)
+		defer ticker.Stop()
+		statsTicks = ticker.C
+	}
+	var lag time.Duration
+
+	for _, msg := range l.gaps {
+		if err := l.writeControl(msg); err != nil {
+			log.Event(l.logs, "an error occurred while writing to websocket connection", log.V(1), log.Error(err), log.Fields{"listener": l})
+			l.disconnect()
+			return
+		}
+	}
+	l.gaps = nil
+
+	var replayed uint64
+	for _, r := range l.replay {
+		if !l.filter.Matches(r) {
+			atomic.AddUint64(&l.filtered, 1)
+			continue
+		}
+		if l.requestedSampler != nil && !l.requestedSampler.keep(r) {
+			continue
+		}
+		if err := l.write(r); err != nil {
+			l.disconnect()
+			return
+		}
+		replayed++
+	}
+	l.replay = nil
+	if err := l.flush(); err != nil {
+		l.disconnect()
+		return
+	}
+	if l.replayRequested {
+		if err := l.writeControl(ControlMessage{Control: ControlReplayed, Message: "retained records have been replayed", Records: replayed}); err != nil {
+			log.Event(l.logs, "an error occurred while writing to websocket connection", log.V(1), log.Error(err), log.Fields{"listener": l})
+			l.disconnect()
+			return
+		}
+	}
 
-		data = []byte(fmt.Sprintf(`{"error": "Permission denied to access %s logs for %s"}`, r.Data.Kubernetes.PodName, l.usrInfo.Username))
+	for {
+		var err error
+		select {
+		case <-l.done.Chan():
+			return
+		case r := <-l.queue:
+			if r.Sequence > l.replayedUpTo[r.Flow] {
+				err = l.write(r)
+				lag = time.Since(r.ReceivedAt)
+			}
+		case msg := <-l.controls:
+			// control messages are not reordered with the records sent before them
+			if err = l.flush(); err == nil {
+				err = l.writeControl(msg)
+			}
+		case req := <-l.closeRequests:
+			if l.flush() == nil {
+				l.writeClose(req)
+			}
+			return
+		case <-batchTicks:
+			err = l.flush()
+		case now := <-samplingTicks:
+			l.sample(now)
+		case <-statsTicks:
+			if err = l.flush(); err == nil {
+				err = l.writeControl(l.statsMessage(lag))
+			}
+		case <-rateLimitTicks:
+			if cnt := atomic.SwapUint64(&l.rateLimited, 0); cnt > 0 {
+				if err = l.flush(); err == nil {
+					err = l.writeControl(ControlMessage{
+						Control: ControlRateLimited,
+						Message: "records were dropped because the delivery rate limit was exceeded",
+						Records: cnt,
+					})
+				}
+			}
+		}
+		if err != nil {
+			log.Event(l.logs, "an error occurred while writing to websocket connection", log.V(1), log.Error(err), log.Fields{"listener": l})
+			l.disconnect()
+			return
+		}
+	}
+}
+
+func (l *listener) write(r Record) error {
+	log.Event(l.logs, "processing log record", log.V(2), log.Fields{"listener": l, "record": r})
+	if l.ackConsumer != "" {
+		l.opts.Acks.Delivered(l.ackKey(r.Flow), r)
+	}
+	r, span := StartRecordSpan(r, "write", attribute.String("user", l.usrInfo.Username), attribute.String("request.id", l.requestID))
+	defer span.End()
+
+	if !l.authorizer.AuthorizeRecord(l.usrInfo, r) {
+		log.Event(l.logs, "listener does not have permission to view log record", log.V(1), log.Fields{"listener": l, "record": r})
+		l.metrics.LogRecordRedacted(subscription{l, r.Flow}, r)
+		atomic.AddUint64(&l.redacted, 1)
+
+		r = redactedRecord(r, l.usrInfo)
 	} else {
-		l.metrics.LogRecordTransmitted(l, r)
+		l.metrics.LogRecordTransmitted(subscription{l, r.Flow}, r)
+		if l.selection != nil {
+			var err error
+			if r, err = l.selection.Apply(r); err != nil {
+				log.Event(l.logs, "an error occurred while selecting fields of log record", log.V(1), log.Error(err), log.Fields{"listener": l, "record": r})
+				return nil
+			}
+		}
+	}
+
+	data, err := encodeShared(l.encoder, r)
+	if err != nil {
+		log.Event(l.logs, "an error occurred while encoding log record", log.V(1), log.Error(err), log.Fields{"listener": l, "record": r})
+		return nil
+	}
+
+	if l.batch != nil {
+		log.Event(l.logs, "adding log record to batch", log.V(2), log.Fields{"listener": l, "record": r})
+		l.batch.add(r, data)
+		if l.batch.full() {
+			return l.flush()
+		}
+		return nil
 	}
 
 	log.Event(l.logs, "sending log record to listener", log.V(1), log.Fields{"listener": l, "record": r})
+	if events, ok := l.conn.(*sseConn); ok && !l.multiplexed {
+		// event sources resume single flows from the last event id
+		events.setEventID(r.Sequence)
+	}
+	return l.writeFrame(r, data, l.encoder.MessageType(), 1)
+}
+
+// flush writes the batched records, if any, as a single frame
+func (l *listener) flush() error {
+	if l.batch == nil || l.batch.records == 0 {
+		return nil
+	}
+	defer l.batch.reset()
+	log.Event(l.logs, "sending batch of log records to listener", log.V(1), log.Fields{"listener": l, "records": l.batch.records})
+	return l.writeFrame(l.batch.first, l.batch.frame(), l.batch.messageType(), l.batch.records)
+}
+
+// writeFrame writes the payload of records as a single frame, the frame is reported to metrics with the specified record
+func (l *listener) writeFrame(r Record, data []byte, messageType int, records int) error {
+	var written uint64
+	if l.connCounter != nil {
+		written = l.connCounter.Written()
+	}
 
-	wc, err := l.conn.NextWriter(websocket.BinaryMessage)
+	if err := l.setWriteDeadline(); err != nil {
+		log.Event(l.logs, "an error occurred while setting write deadline of websocket connection", log.V(1), log.Error(err))
+		return err
+	}
+
+	wc, err := l.conn.NextWriter(messageType)
 	if err != nil {
 		log.Event(l.logs, "an error occurred while getting next writer for websocket connection", log.V(1), log.Error(err))
-		goto unregister
+		l.writeFailed(err)
+		return err
 	}
 
 	if _, err := wc.Write(data); err != nil {
 		log.Event(l.logs, "an error occurred while writing record data to websocket connection", log.V(1), log.Error(err))
-		goto unregister
+		l.writeFailed(err)
+		return err
 	}
 
 	if err := wc.Close(); err != nil {
 		log.Event(l.logs, "an error occurred while flushing frame to websocket connection", log.V(1), log.Error(err))
-		goto unregister
+		l.writeFailed(err)
+		return err
+	}
+	l.markActive()
+
+	// the wire size is approximate, it includes TLS overhead and control frames written concurrently
+	wireSize := -1
+	if l.connCounter != nil {
+		wireSize = int(l.connCounter.Written() - written)
 	}
+	l.metrics.FrameWritten(subscription{l, r.Flow}, r, len(data), wireSize)
+	atomic.AddUint64(&l.delivered, uint64(records))
 
+	return nil
+}
+
+// redactedRecord replaces the record's content with an error message while keeping its source information
+func redactedRecord(r Record, user authv1.UserInfo) (res Record) {
+	msg := fmt.Sprintf("Permission denied to access %s logs for %s", r.Meta.Pod, user.Username)
+	res.RawData, _ = json.Marshal(map[string]string{"error": msg})
+	res.Meta.Namespace = r.Meta.Namespace
+	res.Meta.Pod = r.Meta.Pod
+	res.Meta.Container = r.Meta.Container
+	res.Meta.Message = msg
+	res.Flow = r.Flow
+	res.ReceivedAt = r.ReceivedAt
+	res.Sequence = r.Sequence
 	return
+}
+
+// disconnect unregisters all subscriptions of the listener and closes its connection, which also terminates the read loop
+func (l *listener) disconnect() {
+	l.done.Close()
+
+	l.mutex.Lock()
+	flows := l.flows
+	l.flows = nil
+	l.mutex.Unlock()
+
+	for flow := range flows {
+		l.reg.Unregister(subscription{l, flow})
+	}
+	if flows != nil { // only audited on the first call
+		res := make([]FlowReference, 0, len(flows))
+		for flow := range flows {
+			res = append(res, flow)
+		}
+		l.audit(AuditEventDisconnected, res)
+	}
+	if err := l.conn.Close(); err != nil {
+		log.Event(l.logs, "an error occurred while closing websocket connection", log.V(1), log.Error(err))
+	}
+}
 
-unregister:
-	go l.reg.Unregister(l)
+func (l *listener) audit(typ AuditEventType, flows []FlowReference) {
+	if l.opts.Audit == nil {
+		return
+	}
+	l.opts.Audit.Audit(AuditEvent{
+		Type:             typ,
+		Time:             time.Now(),
+		User:             l.usrInfo.Username,
+		Groups:           l.usrInfo.Groups,
+		Tenant:           UserTenant(l.usrInfo),
+		ClientAddr:       l.clientAddr,
+		RequestID:        l.requestID,
+		Capability:       l.capability,
+		Flows:            flows,
+		ConnectedAt:      l.connectedAt,
+		RecordsDelivered: atomic.LoadUint64(&l.delivered),
+		RecordsFiltered:  atomic.LoadUint64(&l.filtered),
+		RecordsRedacted:  atomic.LoadUint64(&l.redacted),
+	})
 }
 
 func (l *listener) User() authv1.UserInfo {
 	return l.usrInfo
 }
 
-// readLoop reads the websocket connection so we handle close messages
+// pingLoop periodically pings the listener and disconnects it when it fails to answer maxMissed pings in a row
+func (l *listener) pingLoop(interval time.Duration, timeout time.Duration, maxMissed int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-l.done.Chan():
+			return
+		case <-ticker.C:
+		}
+
+		// discard pongs that arrived too late for the previous ping
+		select {
+		case <-l.pongs:
+		default:
+		}
+
+		if err := l.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout)); err != nil {
+			log.Event(l.logs, "an error occurred while sending ping to listener", log.V(1), log.Error(err), log.Fields{"listener": l})
+			l.disconnect()
+			return
+		}
+
+		timer := time.NewTimer(timeout)
+		select {
+		case <-l.done.Chan():
+			timer.Stop()
+			return
+		case <-l.pongs:
+			timer.Stop()
+			missed = 0
+		case <-timer.C:
+			missed++
+			log.Event(l.logs, "listener missed pong", log.V(1), log.Fields{"listener": l, "missed": missed})
+			if missed >= maxMissed {
+				log.Event(l.logs, "listener is not responding to pings, disconnecting", log.Fields{"listener": l})
+				for _, flow := range l.subscribedFlows() {
+					l.metrics.ListenerTimedOut(subscription{l, flow})
+				}
+				l.closeWith(CloseTimeout, "listener is not responding to pings")
+				return
+			}
+		}
+	}
+}
+
+// reauthorizeLoop periodically re-validates the listener's credentials and permissions
+// Listeners with invalid credentials are disconnected, multiplexed listeners are unsubscribed from flows they are no longer permitted to tail
+func (l *listener) reauthorizeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done.Chan():
+			return
+		case <-ticker.C:
+		}
+		if !l.reauthorize() {
+			return
+		}
+	}
+}
+
+// reauthorize returns false if the listener is being disconnected
+func (l *listener) reauthorize() bool {
+	err := reauthenticate(l.authenticator, l.credentials)
+	if errors.Is(err, ErrInvalidCredentials) {
+		log.Event(l.logs, "listener credentials are not valid anymore, disconnecting", log.Error(err), log.Fields{"listener": l})
+		l.closeWith(CloseUnauthorized, err.Error())
+		return false
+	}
+	if errors.Is(err, errImpersonationDisabled) || errors.Is(err, errImpersonationForbidden) {
+		log.Event(l.logs, "listener may not impersonate its user anymore, disconnecting", log.Error(err), log.Fields{"listener": l})
+		l.closeWith(CloseForbidden, err.Error())
+		return false
+	}
+	if err != nil {
+		// the backend might be temporarily unavailable, so the listener is given the benefit of the doubt until the next check
+		log.Event(l.logs, "an error occurred while re-authenticating listener", log.V(1), log.Error(err), log.Fields{"listener": l})
+		return true
+	}
+
+	for _, flow := range l.subscribedFlows() {
+		allowed, err := l.authorizer.AuthorizeFlow(l.usrInfo, flow)
+		if err != nil {
+			log.Event(l.logs, "an error occurred while re-authorizing listener", log.V(1), log.Error(err), log.Fields{"listener": l, "flow": flow})
+			continue
+		}
+		if allowed {
+			continue
+		}
+		log.Event(l.logs, "listener is not allowed to tail flow anymore", log.Fields{"listener": l, "flow": flow})
+		if !l.withdraw(flow, CloseForbidden, fmt.Sprintf("permission to tail %s has been withdrawn", flow.URL())) {
+			return false
+		}
+	}
+	return true
+}
+
+// reauthenticate validates the credentials a listener connected with again, it returns ErrInvalidCredentials if they are not valid anymore
+// Impersonation is authorized again too, errImpersonationForbidden or errImpersonationDisabled is returned if it is not allowed anymore
+func reauthenticate(authenticator Authenticator, creds requestCredentials) (err error) {
+	var usrInfo authv1.UserInfo
+	if certAuthenticator, ok := authenticator.(CertificateAuthenticator); ok && creds.cert != nil {
+		usrInfo, err = certAuthenticator.AuthenticateCertificate(creds.cert)
+	} else if creds.token != "" {
+		usrInfo, err = authenticator.Authenticate(creds.token)
+	} else if creds.impersonation != nil {
+		usrInfo = creds.impersonation.user
+	}
+	if err != nil || creds.impersonation == nil {
+		return err
+	}
+	_, err = impersonate(authenticator, usrInfo, creds.impersonation.target)
+	return err
+}
+
+// readLoop reads the websocket connection so we handle control messages, the listener is disconnected when reading fails
 func (l *listener) readLoop() {
+	defer l.disconnect()
 	for {
 		typ, dat, err := l.conn.ReadMessage()
 		log.Event(l.logs, "read message from listener", log.V(2), log.Fields{"type": typ, "data": dat, "error": err})
@@ -198,24 +1629,122 @@ func (l *listener) readLoop() {
 			log.Event(l.logs, "an error occurred while reading websocket connection", log.V(1), log.Error(err))
 			return
 		}
-		if typ == websocket.CloseMessage {
+		switch typ {
+		case websocket.CloseMessage:
 			return
+		case websocket.TextMessage:
+			l.markActive()
+			l.handleClientMessage(dat)
 		}
 	}
 }
 
-func ExtractFlow(req *http.Request) (res FlowReference, err error) {
-	if elts := strings.Split(strings.Trim(req.URL.Path, "/"), "/"); len(elts) == 3 {
-		res.Kind, res.Namespace, res.Name = FlowKind(elts[0]), elts[1], elts[2]
+// ClientMessage is sent by multiplexed listeners to change their subscriptions
+type ClientMessage struct {
+	Action ClientAction `json:"action"`
+	// Flow is the flow reference in kind/namespace/name form
+	Flow string `json:"flow"`
+	// Sequence is the sequence number up to which records are acknowledged, for ack messages
+	Sequence uint64 `json:"sequence,omitempty"`
+}
+
+type ClientAction string
+
+const (
+	ClientActionSubscribe   ClientAction = "subscribe"
+	ClientActionUnsubscribe ClientAction = "unsubscribe"
+
+	MultiplexParam = "multiplex"
+)
+
+func (l *listener) handleClientMessage(data []byte) {
+	var msg ClientMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		l.sendControl(ControlMessage{Control: ControlError, Message: "invalid message: " + err.Error()})
 		return
 	}
-	return res, errors.New("URL path is not a valid flow reference")
+	if msg.Action == ClientActionAck {
+		l.handleAck(msg)
+		return
+	}
+	if !l.multiplexed {
+		l.sendControl(ControlMessage{Control: ControlError, Message: "subscriptions can only be changed on multiplexed connections"})
+		return
+	}
+	flow, err := ParseFlowReference(msg.Flow, l.opts.ControlNamespace)
+	if err == nil && msg.Action == ClientActionSubscribe {
+		err = checkOutputs(l.opts.Outputs, flow)
+	}
+	if err == nil {
+		err = checkSelectors(nil, flow)
+	}
+	if err != nil {
+		l.sendControl(ControlMessage{Control: ControlError, Message: err.Error(), Flow: msg.Flow})
+		return
+	}
+
+	switch msg.Action {
+	case ClientActionSubscribe:
+		allowed, err := l.authorizer.AuthorizeFlow(l.usrInfo, flow)
+		if err != nil {
+			log.Event(l.logs, "authorization failed", log.V(1), log.Error(err), log.Fields{"user": l.usrInfo, "flow": flow})
+			l.metrics.ListenerRejected(flow, l.usrInfo)
+			l.sendControl(ControlMessage{Control: ControlError, Message: "authorization failed", Flow: flow.URL()})
+			return
+		}
+		if !allowed {
+			log.Event(l.logs, "user is not allowed to tail flow", log.V(1), log.Fields{"user": l.usrInfo, "flow": flow})
+			l.metrics.ListenerRejected(flow, l.usrInfo)
+			l.sendControl(ControlMessage{Control: ControlError, Message: "permission denied", Flow: flow.URL()})
+			return
+		}
+		if l.opts.Shards != nil {
+			if _, local := l.opts.Shards.Owner(flow); !local {
+				l.sendControl(ControlMessage{Control: ControlError, Message: "flow is served by another replica, open a separate connection for it", Flow: flow.URL()})
+				return
+			}
+		}
+		if l.ackConsumer != "" {
+			if err := l.opts.Acks.Reserve(l.ackKey(flow)); err != nil {
+				l.sendControl(ControlMessage{Control: ControlError, Message: err.Error(), Flow: flow.URL()})
+				return
+			}
+		}
+		l.subscribe(flow)
+		l.audit(AuditEventSubscribed, []FlowReference{flow})
+		l.sendControl(ControlMessage{Control: ControlSubscribed, Flow: flow.URL()})
+	case ClientActionUnsubscribe:
+		l.unsubscribe(flow)
+		l.audit(AuditEventUnsubscribed, []FlowReference{flow})
+		l.sendControl(ControlMessage{Control: ControlUnsubscribed, Flow: flow.URL()})
+	default:
+		l.sendControl(ControlMessage{Control: ControlError, Message: fmt.Sprintf("unknown action %q", msg.Action)})
+	}
+}
+
+// ExtractFlows extracts the comma-separated list of flow references from the request's URL path
+// Cluster flows without a namespace are looked up in controlNamespace, an empty path means no flows
+func ExtractFlows(req *http.Request, controlNamespace string) (res []FlowReference, err error) {
+	p := strings.Trim(req.URL.Path, "/")
+	if p == "" {
+		return nil, nil
+	}
+	for _, ref := range strings.Split(p, ",") {
+		flow, err := ParseFlowReference(ref, controlNamespace)
+		if err != nil {
+			return nil, err
+		}
+		if !hasItem(res, flow) {
+			res = append(res, flow)
+		}
+	}
+	return
 }
 
 func loadRBACRules(r Record) (res rbacRules, err error) {
 	res = make(rbacRules)
 loop:
-	for k, v := range r.Data.Kubernetes.Labels {
+	for k, v := range r.Meta.Labels {
 		const keyPrefix = "rbac/"
 		if strings.HasPrefix(k, keyPrefix) {
 			p := policy(v)
@@ -242,12 +1771,35 @@ func (rs rbacRules) canView(userInfo authv1.UserInfo) bool {
 	if p, ok := rs[key]; ok { // user has custom policy
 		return p == policyAllow
 	}
+	// rules of the user's groups and service account namespace apply next, a denial overriding permissions
+	var matched, denied bool
+	for _, key := range rbacGroupKeys(userInfo) {
+		if p, ok := rs[key]; ok {
+			matched = true
+			denied = denied || p == policyDeny
+		}
+	}
+	if matched {
+		return !denied
+	}
 	if p, ok := rs["policy"]; ok { // user has no custom policy, try using default policy
 		return p == policyAllow
 	}
 	return false // default policy is deny
 }
 
+// rbacGroupKeys returns the label keys of the user's groups (group.<group>) and, for service accounts, of their namespace (ns.<namespace>), colons replaced with underscores
+func rbacGroupKeys(userInfo authv1.UserInfo) []string {
+	keys := make([]string, 0, len(userInfo.Groups)+1)
+	for _, group := range userInfo.Groups {
+		keys = append(keys, "group."+strings.ReplaceAll(group, ":", "_"))
+	}
+	if namespace, _, ok := serviceAccountName(userInfo.Username); ok {
+		keys = append(keys, "ns."+namespace)
+	}
+	return keys
+}
+
 type policy string
 
 const policyAllow policy = "allow"
@@ -274,3 +1826,12 @@ func firstIndexOf[T comparable](slice []T, item T) int {
 func hasItem[T comparable](slice []T, item T) bool {
 	return firstIndexOf(slice, item) != -1
 }
+
+func hasAnyItem[T comparable](slice []T, items []T) bool {
+	for _, item := range items {
+		if hasItem(slice, item) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+var benchFlowsRequest = &http.Request{URL: &url.URL{Path: "/flow/default/all,clusterflow/all"}}
+
+func BenchmarkExtractFlows(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ExtractFlows(benchFlowsRequest, "logging"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestExtractFlowsAllocations(t *testing.T) {
+	skipUnderRace(t)
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = ExtractFlows(benchFlowsRequest, "logging")
+	})
+	if allocs > 5 {
+		t.Errorf("%v allocations, the budget is 5", allocs)
+	}
+}
+
+// impersonators allows the users it maps to impersonate the users they map to
+type impersonators map[string]string
+
+func (a impersonators) AuthorizeImpersonation(user authv1.UserInfo, target authv1.UserInfo) (bool, error) {
+	return a[user.Username] == target.Username, nil
+}
+
+func TestReauthenticate(t *testing.T) {
+	alice := authv1.UserInfo{Username: "alice"}
+	bob := authv1.UserInfo{Username: "bob"}
+	tokens := tokenAuthenticator{"alice-token": alice}
+	impersonation := &impersonation{user: alice, target: bob}
+	for name, tc := range map[string]struct {
+		authenticator Authenticator
+		creds         requestCredentials
+		err           error
+	}{
+		"valid token":                          {authenticator: tokens, creds: requestCredentials{token: "alice-token"}},
+		"revoked token":                        {authenticator: tokens, creds: requestCredentials{token: "revoked"}, err: ErrInvalidCredentials},
+		"allowed impersonation":                {authenticator: TokenPolicy{Authenticator: tokens, Impersonation: impersonators{"alice": "bob"}}, creds: requestCredentials{token: "alice-token", impersonation: impersonation}},
+		"revoked impersonation":                {authenticator: TokenPolicy{Authenticator: tokens, Impersonation: impersonators{}}, creds: requestCredentials{token: "alice-token", impersonation: impersonation}, err: errImpersonationForbidden},
+		"disabled impersonation":               {authenticator: tokens, creds: requestCredentials{token: "alice-token", impersonation: impersonation}, err: errImpersonationDisabled},
+		"revoked impersonation of query token": {authenticator: TokenPolicy{Authenticator: tokens, Impersonation: impersonators{}}, creds: requestCredentials{impersonation: impersonation}, err: errImpersonationForbidden},
+		"impersonation with revoked token":     {authenticator: TokenPolicy{Authenticator: tokens, Impersonation: impersonators{"alice": "bob"}}, creds: requestCredentials{token: "revoked", impersonation: impersonation}, err: ErrInvalidCredentials},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := reauthenticate(tc.authenticator, tc.creds); !errors.Is(err, tc.err) {
+				t.Errorf("got error %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
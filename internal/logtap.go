@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/banzaicloud/log-socket/log"
+	logsocketv1alpha1 "github.com/banzaicloud/log-socket/pkg/api/v1alpha1"
+)
+
+const DefaultLogTapsRefreshInterval = 30 * time.Second
+
+// logTap is a LogTap resource compiled for authorizing listeners
+type logTap struct {
+	name types.NamespacedName
+	// filter restricts the records of the flow the subjects receive
+	filter    RecordFilter
+	expiresAt time.Time
+	subjects  []rbacv1.Subject
+}
+
+func (t logTap) expired(now time.Time) bool {
+	return !t.expiresAt.IsZero() && !now.Before(t.expiresAt)
+}
+
+func (t logTap) grants(user authv1.UserInfo, now time.Time) bool {
+	if t.expired(now) {
+		return false
+	}
+	for _, s := range t.subjects {
+		switch s.Kind {
+		case rbacv1.UserKind:
+			if s.Name == user.Username {
+				return true
+			}
+		case rbacv1.GroupKind:
+			if hasItem(user.Groups, s.Name) {
+				return true
+			}
+		case rbacv1.ServiceAccountKind:
+			namespace := s.Namespace
+			if namespace == "" {
+				namespace = t.name.Namespace
+			}
+			if user.Username == "system:serviceaccount:"+namespace+":"+s.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compileLogTap returns the flow tapped by the resource and the compiled tap, ClusterFlows can only be tapped by resources in the control namespace
+func compileLogTap(tap logsocketv1alpha1.LogTap, controlNamespace string) (FlowReference, logTap, error) {
+	res := logTap{name: types.NamespacedName{Namespace: tap.Namespace, Name: tap.Name}, subjects: tap.Spec.Subjects}
+	flow := FlowReference{NamespacedName: types.NamespacedName{Namespace: tap.Namespace, Name: tap.Spec.Flow.Name}}
+	switch tap.Spec.Flow.Kind {
+	case "", logsocketv1alpha1.LogTapKindFlow:
+		flow.Kind = FKFlow
+	case logsocketv1alpha1.LogTapKindClusterFlow:
+		if tap.Namespace != controlNamespace {
+			return flow, res, fmt.Errorf("cluster flows can only be tapped from the control namespace %s", controlNamespace)
+		}
+		flow.Kind = FKClusterFlow
+	default:
+		return flow, res, fmt.Errorf("invalid flow kind %q", tap.Spec.Flow.Kind)
+	}
+	if flow.Name == "" {
+		return flow, res, errors.New("the flow name is required")
+	}
+	if len(tap.Spec.Subjects) == 0 {
+		return flow, res, errors.New("at least one subject is required")
+	}
+
+	filters := tap.Spec.Filters
+	filter, err := ParseRecordFilter(url.Values{
+		FilterParamContainerRegex: {filters.Container},
+		FilterParamLevel:          {filters.Level},
+		FilterParamNamespaceRegex: {filters.Namespace},
+		FilterParamPodRegex:       {filters.Pod},
+	})
+	if err != nil {
+		return flow, res, err
+	}
+	res.filter = filter
+	if tap.Spec.TTL != nil {
+		res.expiresAt = tap.CreationTimestamp.Add(tap.Spec.TTL.Duration)
+	}
+	return flow, res, nil
+}
+
+// NewKubernetesLogTaps returns the taps of the LogTap resources of the cluster, which are empty until refreshed
+func NewKubernetesLogTaps(c client.Client, controlNamespace string, logs log.Sink) *KubernetesLogTaps {
+	t := &KubernetesLogTaps{
+		client:           c,
+		controlNamespace: controlNamespace,
+		logs:             log.WithFields(logs, log.Fields{"task": "log taps"}),
+	}
+	t.taps.Store(map[FlowReference][]logTap{})
+	return t
+}
+
+// KubernetesLogTaps periodically lists the LogTap resources of the cluster and reports their phase and expiry in their status
+type KubernetesLogTaps struct {
+	client           client.Client
+	controlNamespace string
+	logs             log.Sink
+	taps             atomic.Value // map[FlowReference][]logTap
+}
+
+// granting returns the taps of the flow granting access to the user
+func (t *KubernetesLogTaps) granting(user authv1.UserInfo, flow FlowReference, now time.Time) (res []logTap) {
+	for _, tap := range t.taps.Load().(map[FlowReference][]logTap)[flow] {
+		if tap.grants(user, now) {
+			res = append(res, tap)
+		}
+	}
+	return
+}
+
+// Refresh lists the LogTap resources, compiles them and updates their status
+func (t *KubernetesLogTaps) Refresh(ctx context.Context) error {
+	var list logsocketv1alpha1.LogTapList
+	if err := t.client.List(ctx, &list); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	taps := make(map[FlowReference][]logTap)
+	for i := range list.Items {
+		item := &list.Items[i]
+		flow, tap, err := compileLogTap(*item, t.controlNamespace)
+		status := logsocketv1alpha1.LogTapStatus{Phase: logsocketv1alpha1.LogTapPhaseActive}
+		switch {
+		case err != nil:
+			status = logsocketv1alpha1.LogTapStatus{Phase: logsocketv1alpha1.LogTapPhaseInvalid, Message: err.Error()}
+		case tap.expired(now):
+			status.Phase = logsocketv1alpha1.LogTapPhaseExpired
+		}
+		if err == nil {
+			taps[flow] = append(taps[flow], tap)
+			if !tap.expiresAt.IsZero() {
+				status.ExpiresAt = &metav1.Time{Time: tap.expiresAt}
+			}
+		}
+		if !equalLogTapStatus(item.Status, status) {
+			item.Status = status
+			if err := t.client.Status().Update(ctx, item); err != nil {
+				log.Event(t.logs, "failed to update status of log tap", log.V(1), log.Error(err), log.Fields{"tap": tap.name})
+			} else {
+				log.Event(t.logs, "log tap status changed", log.Fields{"tap": tap.name, "flow": flow, "phase": status.Phase, "message": status.Message})
+			}
+		}
+	}
+	t.taps.Store(taps)
+	return nil
+}
+
+func equalLogTapStatus(a, b logsocketv1alpha1.LogTapStatus) bool {
+	if a.Phase != b.Phase || a.Message != b.Message || (a.ExpiresAt == nil) != (b.ExpiresAt == nil) {
+		return false
+	}
+	// the API server stores times with a precision of seconds
+	return a.ExpiresAt == nil || a.ExpiresAt.Unix() == b.ExpiresAt.Unix()
+}
+
+// Run refreshes the taps at the specified interval until the stop signal is closed
+func (t *KubernetesLogTaps) Run(interval time.Duration, stopSignal <-chan struct{}) {
+	if interval <= 0 {
+		interval = DefaultLogTapsRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopSignal:
+			return
+		case <-ticker.C:
+		}
+		if err := t.Refresh(context.Background()); err != nil {
+			log.Event(t.logs, "failed to refresh log taps", log.Error(err))
+		}
+	}
+}
+
+// TapAuthorizer lets the subjects of unexpired log taps tail the tapped flows, restricted to the records matching the taps' filters
+// Users not granted access by a tap are authorized by the wrapped authorizer
+type TapAuthorizer struct {
+	Authorizer
+	Taps *KubernetesLogTaps
+	Logs log.Sink
+}
+
+func (a TapAuthorizer) AuthorizeFlow(user authv1.UserInfo, flow FlowReference) (bool, error) {
+	if taps := a.Taps.granting(user, flow, time.Now()); len(taps) > 0 {
+		log.Event(a.Logs, "log tap grants access to flow", log.V(1), log.Fields{"user": user.Username, "flow": flow, "tap": taps[0].name})
+		return true, nil
+	}
+	return a.Authorizer.AuthorizeFlow(user, flow)
+}
+
+func (a TapAuthorizer) AuthorizeRecord(user authv1.UserInfo, r Record) bool {
+	taps := a.Taps.granting(user, r.Flow, time.Now())
+	if len(taps) == 0 {
+		return a.Authorizer.AuthorizeRecord(user, r)
+	}
+	for _, tap := range taps {
+		if tap.filter.Matches(r) {
+			return true
+		}
+	}
+	return false
+}
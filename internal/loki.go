@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const lokiPushPath = "/loki/api/v1/push"
+
+var lokiInvalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// NewLokiSink returns a sink pushing the records of the flow to the push API of Loki at the URL, e.g. loki://loki-gateway:3100 (loki+https for TLS)
+// The tenant query parameter sets the X-Scope-OrgID header, and labels lists the pod labels mapped to stream labels besides flow, namespace, pod, container and level
+func NewLokiSink(flow FlowReference, u *url.URL, logs log.Sink) (*LokiSink, error) {
+	query := u.Query()
+	opts, err := parsePushSinkOptions(query)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "http"
+	if u.Scheme == "loki+https" {
+		scheme = "https"
+	}
+	endpoint := url.URL{Scheme: scheme, Host: u.Host, Path: strings.TrimSuffix(u.Path, "/") + lokiPushPath}
+	s := &LokiSink{
+		client:   &http.Client{Timeout: pushSinkTimeout},
+		endpoint: endpoint.String(),
+		tenant:   query.Get("tenant"),
+		user:     u.User,
+	}
+	if labels := query.Get("labels"); labels != "" {
+		s.podLabels = strings.Split(labels, ",")
+	}
+	s.batchingSink = batchingSink{
+		flow: flow,
+		logs: logs,
+		opts: opts,
+		push: s.pushBatch,
+	}
+	s.start()
+	return s, nil
+}
+
+// LokiSink maps the metadata of records to labels of Loki streams, records are pushed as log lines of their streams
+type LokiSink struct {
+	batchingSink
+	client    *http.Client
+	endpoint  string
+	podLabels []string
+	tenant    string
+	user      *url.Userinfo
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// streamLabels returns the labels of the record's stream
+func (s *LokiSink) streamLabels(r Record) map[string]string {
+	labels := map[string]string{"flow": r.Flow.URL()}
+	for name, value := range map[string]string{
+		"namespace": r.Meta.Namespace,
+		"pod":       r.Meta.Pod,
+		"container": r.Meta.Container,
+		"level":     r.Meta.Severity.String(),
+	} {
+		if value != "" {
+			labels[name] = value
+		}
+	}
+	for _, name := range s.podLabels {
+		if value := r.Meta.Labels[name]; value != "" {
+			labels[lokiLabelName(name)] = value
+		}
+	}
+	return labels
+}
+
+// lokiLabelName replaces the characters of a pod label that are invalid in Loki label names with underscores
+func lokiLabelName(name string) string {
+	name = lokiInvalidLabelChars.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+func (s *LokiSink) pushBatch(batch []Record) error {
+	streams := make(map[string]*lokiStream)
+	var order []string
+	for _, r := range batch {
+		labels := s.streamLabels(r)
+		key, _ := json.Marshal(labels)
+		stream := streams[string(key)]
+		if stream == nil {
+			stream = &lokiStream{Stream: labels}
+			streams[string(key)] = stream
+			order = append(order, string(key))
+		}
+		ts := r.Time()
+		if ts.IsZero() {
+			ts = r.ReceivedAt
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(ts.UnixNano(), 10), string(r.RawData)})
+	}
+	body := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{Streams: make([]*lokiStream, 0, len(order))}
+	for _, key := range order {
+		body.Streams = append(body.Streams, streams[key])
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pushSinkTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", s.tenant)
+	}
+	if s.user != nil {
+		password, _ := s.user.Password()
+		req.SetBasicAuth(s.user.Username(), password)
+	}
+	return doPushRequest(s.client, req)
+}
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+var (
+	testMetricsOnce sync.Once
+	testMetricsInst *Metrics
+)
+
+// testMetrics returns the metrics shared by the tests, since metrics can only be registered once
+func testMetrics() *Metrics {
+	testMetricsOnce.Do(func() {
+		testMetricsInst = NewMetrics(testLogs())
+	})
+	return testMetricsInst
+}
+
+// skipUnderRace skips the tests of allocation budgets, which the allocations of the race detector would exceed
+func skipUnderRace(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are not representative under the race detector")
+	}
+}
+
+// testLogs returns the sink of the tests, which discards the logs unless the tests are run with -v
+func testLogs() log.Sink {
+	if testing.Verbose() {
+		return log.WithVerbosityFilter(log.NewWriterSink(os.Stderr), 0)
+	}
+	return log.NewWriterSink(io.Discard)
+}
+
+// tokenAuthenticator authenticates tokens as the users they map to
+type tokenAuthenticator map[string]authv1.UserInfo
+
+func (a tokenAuthenticator) Authenticate(token string) (authv1.UserInfo, error) {
+	usr, ok := a[token]
+	if !ok {
+		return authv1.UserInfo{}, fmt.Errorf("%w: unknown token", ErrInvalidCredentials)
+	}
+	return usr, nil
+}
+
+// allowAuthorizer allows users to tail every flow and read every record
+type allowAuthorizer struct{}
+
+func (allowAuthorizer) AuthorizeFlow(authv1.UserInfo, FlowReference) (bool, error) {
+	return true, nil
+}
+
+func (allowAuthorizer) AuthorizeRecord(authv1.UserInfo, Record) bool {
+	return true
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const DefaultMemoryCheckInterval = 5 * time.Second
+
+type MemoryGuardMetrics interface {
+	HeapLimitExceeded(heapBytes uint64, droppedRecords int)
+}
+
+// MemoryGuardOptions holds the settings of the memory guard
+type MemoryGuardOptions struct {
+	// MaxHeapBytes is the heap size above which retained records are dropped
+	MaxHeapBytes uint64
+	// Interval is the time between heap size checks
+	Interval time.Duration
+}
+
+func NewMemoryGuard(opts MemoryGuardOptions, replay *ReplayBuffer, logs log.Sink, metrics MemoryGuardMetrics) *MemoryGuard {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultMemoryCheckInterval
+	}
+	return &MemoryGuard{
+		logs:    log.WithFields(logs, log.Fields{"task": "memory guard"}),
+		metrics: metrics,
+		opts:    opts,
+		replay:  replay,
+	}
+}
+
+// MemoryGuard periodically checks the heap size and sheds the replay history while it exceeds the maximum, so that the service degrades instead of being killed for running out of memory
+type MemoryGuard struct {
+	logs    log.Sink
+	metrics MemoryGuardMetrics
+	opts    MemoryGuardOptions
+	replay  *ReplayBuffer
+}
+
+func (g *MemoryGuard) Run(stopSignal <-chan struct{}) {
+	ticker := time.NewTicker(g.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopSignal:
+			return
+		case <-ticker.C:
+			g.check()
+		}
+	}
+}
+
+func (g *MemoryGuard) check() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	if stats.HeapAlloc <= g.opts.MaxHeapBytes {
+		return
+	}
+	dropped := g.replay.Shrink()
+	// the dropped records are only released to the OS after a collection
+	debug.FreeOSMemory()
+	log.Event(g.logs, "heap size exceeds the maximum, dropped retained records", log.Fields{"heapBytes": stats.HeapAlloc, "maxHeapBytes": g.opts.MaxHeapBytes, "droppedRecords": dropped})
+	g.metrics.HeapLimitExceeded(stats.HeapAlloc, dropped)
+}
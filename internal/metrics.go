@@ -1,6 +1,9 @@
 package internal
 
 import (
+	"strconv"
+	"time"
+
 	"github.com/banzaicloud/log-socket/log"
 	"github.com/prometheus/client_golang/prometheus"
 	authv1 "k8s.io/api/authentication/v1"
@@ -13,13 +16,26 @@ const (
 	flowNameLabelName       = "name"
 	listenerStatusLabelName = "status"
 	listenerUserLabelName   = "user"
+	listenerTenantLabelName = "tenant"
+	cacheResultLabelName    = "result"
 	recordStatusLabelName   = "status"
+	rejectReasonLabelName   = "reason"
+	sizePolicyLabelName     = "policy"
+	redactionRuleLabelName  = "rule"
+	deadlineLabelName       = "deadline"
+	receiverLabelName       = "receiver"
+	quotaLabelName          = "quota"
+	responseCodeLabelName   = "code"
 )
 
 func NewMetrics(logs log.Sink) *Metrics {
 	return &Metrics{
 		logs: logs,
 
+		authenticationCache: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "authentication_cache_lookups",
+		}, []string{cacheResultLabelName})),
 		bytesReceived: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: metricNamespace,
 			Name:      "bytes_received",
@@ -27,59 +43,279 @@ func NewMetrics(logs log.Sink) *Metrics {
 		bytesSent: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: metricNamespace,
 			Name:      "bytes_sent",
-		}, []string{recordStatusLabelName, flowKindLabelName, flowNamespaceLabelName, flowNameLabelName, listenerUserLabelName})),
+		}, []string{recordStatusLabelName, flowKindLabelName, flowNamespaceLabelName, flowNameLabelName, listenerUserLabelName, listenerTenantLabelName})),
+		connectionQuota: registered(prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Name:      "connection_quota_utilization",
+			Help:      "Ratio of the concurrent listener connections to the maximum allowed.",
+		})),
 		currentListeners: registered(prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: metricNamespace,
 			Name:      "current_listeners",
 		})),
+		deadLetters: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "dead_letters",
+			Help:      "Number of ingested messages routed to the dead-letter flow, by receiver and reason.",
+		}, []string{receiverLabelName, rejectReasonLabelName})),
+		deadlinesExceeded: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "deadlines_exceeded",
+			Help:      "Number of listener connections that exceeded the write, handshake or idle deadline.",
+		}, []string{deadlineLabelName, flowKindLabelName, flowNamespaceLabelName, flowNameLabelName})),
+		deliveryLatency: registered(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricNamespace,
+			Name:      "record_delivery_latency_seconds",
+			Help:      "Time between ingesting a record and writing it to a listener's connection.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{flowKindLabelName, flowNamespaceLabelName, flowNameLabelName})),
 		errors: registered(prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: metricNamespace,
 			Name:      "errors",
 		})),
+		frameSize: registered(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricNamespace,
+			Name:      "frame_size_bytes",
+			Help:      "Size of websocket frames written to listeners.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+		}, []string{flowKindLabelName, flowNamespaceLabelName, flowNameLabelName})),
+		framePayloadBytes: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "frame_payload_bytes_total",
+			Help:      "Number of uncompressed payload bytes of websocket frames written to listeners.",
+		}, []string{flowKindLabelName, flowNamespaceLabelName, flowNameLabelName})),
+		frameWireBytes: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "frame_wire_bytes_total",
+			Help:      "Number of bytes written to listener connections for websocket frames, after compression and including framing overhead.",
+		}, []string{flowKindLabelName, flowNamespaceLabelName, flowNameLabelName})),
+		flowListeners: registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Name:      "flow_listeners",
+			Help:      "Number of listeners currently connected to a flow.",
+		}, []string{flowKindLabelName, flowNamespaceLabelName, flowNameLabelName})),
+		ingestParseFailures: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "ingest_parse_failures",
+			Help:      "Number of ingested messages that could not be parsed, by receiver.",
+		}, []string{receiverLabelName})),
+		ingestQueueBlocked: registered(prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "ingest_queue_blocked_seconds_total",
+			Help:      "Time receivers spent waiting for room in the full queue of ingested records.",
+		})),
+		ingestResponses: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "ingest_responses",
+			Help:      "Number of responses to HTTP ingest requests, by status code.",
+		}, []string{responseCodeLabelName})),
+		ingestRejected: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "ingest_requests_rejected",
+			Help:      "Number of ingest requests rejected because the forwarder could not be verified.",
+		}, []string{rejectReasonLabelName})),
 		healthChecks: registered(prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: metricNamespace,
 			Name:      "healthchecks",
 		})),
+		heapLimitExceeded: registered(prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "heap_limit_exceeded",
+			Help:      "Number of times the heap size was found above the maximum heap size.",
+		})),
+		replayRecordsShed: registered(prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "replay_records_shed",
+			Help:      "Number of retained records dropped from the replay buffer because the heap size exceeded the maximum.",
+		})),
 		listeners: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: metricNamespace,
 			Name:      "listeners",
-		}, []string{listenerStatusLabelName, flowKindLabelName, flowNamespaceLabelName, flowNameLabelName, listenerUserLabelName})),
+		}, []string{listenerStatusLabelName, flowKindLabelName, flowNamespaceLabelName, flowNameLabelName, listenerUserLabelName, listenerTenantLabelName})),
+		recordsClockSkewed: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "records_clock_skewed",
+			Help:      "Number of ingested records with a timestamp further from the time they were received than the maximum clock skew, by whether they were flagged or normalized.",
+		}, []string{sizePolicyLabelName, flowKindLabelName, flowNamespaceLabelName, flowNameLabelName})),
+		recordsDeduplicated: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "records_deduplicated",
+			Help:      "Number of ingested records suppressed as duplicates of records received shortly before.",
+		}, []string{flowKindLabelName, flowNamespaceLabelName, flowNameLabelName})),
+		recordsDropped: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "records_dropped",
+		}, []string{flowKindLabelName, flowNamespaceLabelName, flowNameLabelName, listenerUserLabelName, listenerTenantLabelName})),
+		recordsNotEnriched: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "records_not_enriched",
+			Help:      "Number of ingested records that could not be enriched because their pod was not found.",
+		}, []string{flowKindLabelName, flowNamespaceLabelName, flowNameLabelName})),
+		recordsOversized: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "records_oversized",
+			Help:      "Number of ingested records larger than the maximum record size, by whether they were truncated or dropped.",
+		}, []string{sizePolicyLabelName, flowKindLabelName, flowNamespaceLabelName, flowNameLabelName})),
+		redactions: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "redactions",
+			Help:      "Number of values masked in ingested records, by redaction rule.",
+		}, []string{redactionRuleLabelName, flowKindLabelName, flowNamespaceLabelName, flowNameLabelName})),
+		recordsRateLimited: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "records_rate_limited",
+		}, []string{flowKindLabelName, flowNamespaceLabelName, flowNameLabelName, listenerUserLabelName, listenerTenantLabelName})),
 		recordsReceived: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: metricNamespace,
 			Name:      "records_received",
-		}, []string{flowKindLabelName, flowNamespaceLabelName, flowNameLabelName})),
+		}, []string{receiverLabelName, flowKindLabelName, flowNamespaceLabelName, flowNameLabelName})),
 		recordsSent: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: metricNamespace,
 			Name:      "records_sent",
-		}, []string{recordStatusLabelName, flowKindLabelName, flowNamespaceLabelName, flowNameLabelName, listenerUserLabelName})),
+		}, []string{recordStatusLabelName, flowKindLabelName, flowNamespaceLabelName, flowNameLabelName, listenerUserLabelName, listenerTenantLabelName})),
+		recordsThrottled: registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "records_throttled",
+			Help:      "Number of records not delivered because they exceeded the throughput quota of their namespace or flow.",
+		}, []string{quotaLabelName, flowKindLabelName, flowNamespaceLabelName, flowNameLabelName})),
+		userConnectionQuota: registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricNamespace,
+			Name:      "user_connection_quota_utilization",
+			Help:      "Ratio of the concurrent listener connections of a user to the maximum allowed.",
+		}, []string{listenerUserLabelName, listenerTenantLabelName})),
 	}
 }
 
 type Metrics struct {
 	logs log.Sink
 
-	bytesReceived    *prometheus.CounterVec
-	bytesSent        *prometheus.CounterVec
-	currentListeners prometheus.Gauge
-	errors           prometheus.Counter
-	healthChecks     prometheus.Counter
-	listeners        *prometheus.CounterVec
-	recordsReceived  *prometheus.CounterVec
-	recordsSent      *prometheus.CounterVec
+	authenticationCache *prometheus.CounterVec
+	bytesReceived       *prometheus.CounterVec
+	bytesSent           *prometheus.CounterVec
+	connectionQuota     prometheus.Gauge
+	currentListeners    prometheus.Gauge
+	deadLetters         *prometheus.CounterVec
+	deadlinesExceeded   *prometheus.CounterVec
+	deliveryLatency     *prometheus.HistogramVec
+	errors              prometheus.Counter
+	framePayloadBytes   *prometheus.CounterVec
+	frameSize           *prometheus.HistogramVec
+	frameWireBytes      *prometheus.CounterVec
+	flowListeners       *prometheus.GaugeVec
+	healthChecks        prometheus.Counter
+	heapLimitExceeded   prometheus.Counter
+	replayRecordsShed   prometheus.Counter
+	ingestParseFailures *prometheus.CounterVec
+	ingestQueueBlocked  prometheus.Counter
+	ingestRejected      *prometheus.CounterVec
+	ingestResponses     *prometheus.CounterVec
+	listeners           *prometheus.CounterVec
+	recordsClockSkewed  *prometheus.CounterVec
+	recordsDeduplicated *prometheus.CounterVec
+	recordsDropped      *prometheus.CounterVec
+	recordsNotEnriched  *prometheus.CounterVec
+	recordsOversized    *prometheus.CounterVec
+	redactions          *prometheus.CounterVec
+	recordsRateLimited  *prometheus.CounterVec
+	recordsReceived     *prometheus.CounterVec
+	recordsSent         *prometheus.CounterVec
+	recordsThrottled    *prometheus.CounterVec
+	userConnectionQuota *prometheus.GaugeVec
+}
+
+func (ms *Metrics) AuthenticationCacheHit() {
+	ms.authenticationCache.With(prometheus.Labels{cacheResultLabelName: "hit"}).Inc()
+}
+
+func (ms *Metrics) AuthenticationCacheMiss() {
+	ms.authenticationCache.With(prometheus.Labels{cacheResultLabelName: "miss"}).Inc()
+}
+
+func (ms *Metrics) ConnectionQuotaUtilization(ratio float64) {
+	ms.connectionQuota.Set(ratio)
+}
+
+func (ms *Metrics) UserConnectionQuotaUtilization(user authv1.UserInfo, ratio float64) {
+	labels := assembleLabels(prometheus.Labels{}, userLabels(user))
+	if ratio == 0 {
+		ms.userConnectionQuota.Delete(labels)
+		return
+	}
+	ms.userConnectionQuota.With(labels).Set(ratio)
 }
 
 func (ms *Metrics) CurrentListeners(cnt int) {
 	ms.currentListeners.Set(float64(cnt))
 }
 
+func (ms *Metrics) FlowListeners(flow FlowReference, cnt int) {
+	labels := assembleLabels(prometheus.Labels{}, flowLabels(flow))
+	if cnt == 0 {
+		ms.flowListeners.Delete(labels)
+		return
+	}
+	ms.flowListeners.With(labels).Set(float64(cnt))
+}
+
+func (ms *Metrics) DeadLetter(receiver string, reason string) {
+	ms.deadLetters.With(prometheus.Labels{receiverLabelName: receiver, rejectReasonLabelName: reason}).Inc()
+}
+
+func (ms *Metrics) DeadlineExceeded(flow FlowReference, deadline string) {
+	ms.deadlinesExceeded.With(assembleLabels(prometheus.Labels{deadlineLabelName: deadline}, flowLabels(flow))).Inc()
+}
+
 func (ms *Metrics) Error() {
 	ms.errors.Inc()
 }
 
+func (ms *Metrics) FrameWritten(l Listener, r Record, size int, wireSize int) {
+	labels := assembleLabels(prometheus.Labels{}, flowLabels(l.Flow()))
+	ms.frameSize.With(labels).Observe(float64(size))
+	ms.framePayloadBytes.With(labels).Add(float64(size))
+	if wireSize >= 0 {
+		ms.frameWireBytes.With(labels).Add(float64(wireSize))
+	}
+	if !r.ReceivedAt.IsZero() {
+		ms.deliveryLatency.With(labels).Observe(time.Since(r.ReceivedAt).Seconds())
+	}
+}
+
 func (ms *Metrics) HealthCheck() {
 	ms.healthChecks.Inc()
 }
 
+func (ms *Metrics) HeapLimitExceeded(heapBytes uint64, droppedRecords int) {
+	ms.heapLimitExceeded.Inc()
+	ms.replayRecordsShed.Add(float64(droppedRecords))
+}
+
+func (ms *Metrics) IngestParseFailed(receiver string) {
+	ms.ingestParseFailures.With(prometheus.Labels{receiverLabelName: receiver}).Inc()
+}
+
+func (ms *Metrics) IngestQueueBlocked(d time.Duration) {
+	ms.ingestQueueBlocked.Add(d.Seconds())
+}
+
+func (ms *Metrics) IngestQueue(depth func() int) {
+	registered(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "ingest_queue_depth",
+		Help:      "Number of ingested records waiting to be dispatched to listeners.",
+	}, func() float64 {
+		return float64(depth())
+	}))
+}
+
+func (ms *Metrics) IngestRejected(reason string) {
+	ms.ingestRejected.With(prometheus.Labels{rejectReasonLabelName: reason}).Inc()
+}
+
+func (ms *Metrics) IngestResponse(code int) {
+	ms.ingestResponses.With(prometheus.Labels{responseCodeLabelName: strconv.Itoa(code)}).Inc()
+}
+
 func (ms *Metrics) ListenerAccepted(flow FlowReference, user authv1.UserInfo) {
 	ms.listeners.With(assembleLabels(prometheus.Labels{listenerStatusLabelName: "accepted"}, flowLabels(flow), userLabels(user))).Inc()
 }
@@ -92,10 +328,46 @@ func (ms *Metrics) ListenerRemoved(l Listener) {
 	ms.listeners.With(assembleLabels(prometheus.Labels{listenerStatusLabelName: "removed"}, flowLabels(l.Flow()), userLabels(l.User()))).Inc()
 }
 
-func (ms *Metrics) LogRecordReceived(r Record) {
+func (ms *Metrics) ListenerTimedOut(l Listener) {
+	ms.listeners.With(assembleLabels(prometheus.Labels{listenerStatusLabelName: "timedout"}, flowLabels(l.Flow()), userLabels(l.User()))).Inc()
+}
+
+func (ms *Metrics) LogRecordReceived(receiver string, r Record) {
 	labels := assembleLabels(prometheus.Labels{}, flowLabels(r.Flow))
 	ms.bytesReceived.With(labels).Add(float64(len(r.RawData)))
-	ms.recordsReceived.With(labels).Inc()
+	ms.recordsReceived.With(assembleLabels(prometheus.Labels{receiverLabelName: receiver}, flowLabels(r.Flow))).Inc()
+}
+
+func (ms *Metrics) LogRecordThrottled(r Record, quota string) {
+	ms.recordsThrottled.With(assembleLabels(prometheus.Labels{quotaLabelName: quota}, flowLabels(r.Flow))).Inc()
+}
+
+func (ms *Metrics) LogRecordClockSkewed(r Record, policy ClockSkewPolicy) {
+	ms.recordsClockSkewed.With(assembleLabels(prometheus.Labels{sizePolicyLabelName: string(policy)}, flowLabels(r.Flow))).Inc()
+}
+
+func (ms *Metrics) LogRecordNotEnriched(r Record) {
+	ms.recordsNotEnriched.With(assembleLabels(prometheus.Labels{}, flowLabels(r.Flow))).Inc()
+}
+
+func (ms *Metrics) LogRecordDeduplicated(r Record) {
+	ms.recordsDeduplicated.With(assembleLabels(prometheus.Labels{}, flowLabels(r.Flow))).Inc()
+}
+
+func (ms *Metrics) LogRecordDropped(l Listener, r Record) {
+	ms.recordsDropped.With(assembleLabels(prometheus.Labels{}, flowLabels(l.Flow()), userLabels(l.User()))).Inc()
+}
+
+func (ms *Metrics) LogRecordOversized(r Record, policy RecordSizePolicy) {
+	ms.recordsOversized.With(assembleLabels(prometheus.Labels{sizePolicyLabelName: string(policy)}, flowLabels(r.Flow))).Inc()
+}
+
+func (ms *Metrics) LogRecordRedactions(r Record, rule string, count int) {
+	ms.redactions.With(assembleLabels(prometheus.Labels{redactionRuleLabelName: rule}, flowLabels(r.Flow))).Add(float64(count))
+}
+
+func (ms *Metrics) LogRecordRateLimited(l Listener, r Record) {
+	ms.recordsRateLimited.With(assembleLabels(prometheus.Labels{}, flowLabels(l.Flow()), userLabels(l.User()))).Inc()
 }
 
 func (ms *Metrics) LogRecordRedacted(l Listener, r Record) {
@@ -138,4 +410,5 @@ type userLabels authv1.UserInfo
 
 func (u userLabels) AddToLabels(labels prometheus.Labels) {
 	labels[listenerUserLabelName] = u.Username
+	labels[listenerTenantLabelName] = UserTenant(authv1.UserInfo(u))
 }
@@ -0,0 +1,422 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // register hash implementations used for JWT signature verification
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+const (
+	oidcClockSkew          = time.Minute
+	oidcMinRefreshInterval = time.Minute
+)
+
+type OIDCOptions struct {
+	// IssuerURL is the URL of the OpenID provider, it has to match the iss claim of tokens
+	IssuerURL string
+	// ClientID is the audience tokens have to be issued for
+	ClientID string
+	// UsernameClaim is the claim used as the user name, defaults to "sub"
+	UsernameClaim string
+	// UsernamePrefix is prepended to user names
+	UsernamePrefix string
+	// GroupsClaim is the claim used as the user's groups, defaults to "groups"
+	GroupsClaim string
+	// GroupsPrefix is prepended to group names
+	GroupsPrefix string
+	// HTTPClient is used to fetch the provider's configuration and keys, defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// NewOIDCAuthenticator returns an authenticator that validates JWTs issued by an OpenID provider
+// The provider's signing keys are discovered lazily and refreshed when a token is signed with an unknown key
+func NewOIDCAuthenticator(opts OIDCOptions) (*OIDCAuthenticator, error) {
+	if opts.IssuerURL == "" {
+		return nil, errors.New("OIDC issuer URL must be specified")
+	}
+	if opts.ClientID == "" {
+		return nil, errors.New("OIDC client ID must be specified")
+	}
+	if opts.UsernameClaim == "" {
+		opts.UsernameClaim = "sub"
+	}
+	if opts.GroupsClaim == "" {
+		opts.GroupsClaim = "groups"
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	return &OIDCAuthenticator{
+		opts: opts,
+	}, nil
+}
+
+type OIDCAuthenticator struct {
+	jwksURL     string
+	keys        map[string]crypto.PublicKey
+	lastRefresh time.Time
+	mutex       sync.Mutex
+	opts        OIDCOptions
+	refreshErr  error
+}
+
+func (a *OIDCAuthenticator) Authenticate(token string) (res authv1.UserInfo, err error) {
+	defer func() {
+		var unavailable oidcProviderError
+		if err != nil && !errors.As(err, &unavailable) {
+			err = fmt.Errorf("%w: %s", ErrInvalidCredentials, err)
+		}
+	}()
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return res, errors.New("token is not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err = decodeJWTSegment(parts[0], &header); err != nil {
+		return res, fmt.Errorf("invalid JWT header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return res, fmt.Errorf("invalid JWT signature: %w", err)
+	}
+
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return res, err
+	}
+	if err = verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return res, err
+	}
+
+	var claims map[string]interface{}
+	if err = decodeJWTSegment(parts[1], &claims); err != nil {
+		return res, fmt.Errorf("invalid JWT payload: %w", err)
+	}
+	if err = a.validateClaims(claims, time.Now()); err != nil {
+		return res, err
+	}
+
+	username, ok := claims[a.opts.UsernameClaim].(string)
+	if !ok || username == "" {
+		return res, fmt.Errorf("token has no %q claim", a.opts.UsernameClaim)
+	}
+	res.Username = a.opts.UsernamePrefix + username
+	if sub, ok := claims["sub"].(string); ok {
+		res.UID = sub
+	}
+	switch groups := claims[a.opts.GroupsClaim].(type) {
+	case string:
+		res.Groups = []string{a.opts.GroupsPrefix + groups}
+	case []interface{}:
+		for _, group := range groups {
+			if group, ok := group.(string); ok {
+				res.Groups = append(res.Groups, a.opts.GroupsPrefix+group)
+			}
+		}
+	}
+	return res, nil
+}
+
+// Ready reports whether the provider's signing keys could be fetched
+func (a *OIDCAuthenticator) Ready() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.keys == nil && time.Since(a.lastRefresh) >= oidcMinRefreshInterval {
+		a.refreshErr = a.refreshKeys()
+	}
+	return a.refreshErr
+}
+
+func (a *OIDCAuthenticator) validateClaims(claims map[string]interface{}, now time.Time) error {
+	if iss, _ := claims["iss"].(string); iss != a.opts.IssuerURL {
+		return fmt.Errorf("token issued by unexpected issuer %q", iss)
+	}
+
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud != a.opts.ClientID {
+			return errors.New("token is not issued for this client")
+		}
+	case []interface{}:
+		found := false
+		for _, v := range aud {
+			if v == a.opts.ClientID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("token is not issued for this client")
+		}
+	default:
+		return errors.New("token has no audience")
+	}
+
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.Add(-oidcClockSkew).After(exp) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(oidcClockSkew).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
+
+func numericClaim(claims map[string]interface{}, name string) (time.Time, bool) {
+	switch v := claims[name].(type) {
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(int64(f), 0), true
+	case float64:
+		return time.Unix(int64(v), 0), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// key returns the provider's signing key with the specified ID, refreshing the key set if the key is unknown
+func (a *OIDCAuthenticator) key(kid string) (crypto.PublicKey, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if key, ok := a.lookupKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(a.lastRefresh) < oidcMinRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if a.refreshErr = a.refreshKeys(); a.refreshErr != nil {
+		return nil, oidcProviderError{a.refreshErr}
+	}
+	if key, ok := a.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// oidcProviderError means that the provider could not be reached, so tokens could not be validated
+type oidcProviderError struct {
+	err error
+}
+
+func (e oidcProviderError) Error() string {
+	return "failed to refresh OIDC signing keys: " + e.err.Error()
+}
+
+func (e oidcProviderError) Unwrap() error {
+	return e.err
+}
+
+func (a *OIDCAuthenticator) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, true
+		}
+	}
+	key, ok := a.keys[kid]
+	return key, ok
+}
+
+func (a *OIDCAuthenticator) refreshKeys() error {
+	a.lastRefresh = time.Now()
+
+	if a.jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := a.getJSON(strings.TrimSuffix(a.opts.IssuerURL, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return err
+		}
+		if discovery.Issuer != a.opts.IssuerURL {
+			return fmt.Errorf("provider reports issuer %q instead of %q", discovery.Issuer, a.opts.IssuerURL)
+		}
+		if discovery.JWKSURI == "" {
+			return errors.New("provider configuration has no jwks_uri")
+		}
+		a.jwksURL = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := a.getJSON(a.jwksURL, &jwks); err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue // skip keys of unsupported types
+		}
+		keys[k.Kid] = key
+	}
+	a.keys = keys
+	return nil
+}
+
+func (a *OIDCAuthenticator) getJSON(url string, v interface{}) error {
+	resp, err := a.opts.HTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point of key is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// jwtCurves are the curves of the keys of the ECDSA signing algorithms, a signature of one algorithm must not be verified with the key of another curve
+var jwtCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed []byte, sig []byte) error {
+	hash, ok := jwtHashes[alg]
+	if !ok {
+		return fmt.Errorf("unsupported JWT signing algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return errors.New("JWT signing algorithm does not match key type")
+		}
+		if err := rsa.VerifyPKCS1v15(key, hash, digest, sig); err != nil {
+			return errors.New("invalid JWT signature")
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return errors.New("JWT signing algorithm does not match key type")
+		}
+		if jwtCurves[alg] != key.Curve.Params().Name {
+			return fmt.Errorf("JWT signing algorithm %s does not match key curve %s", alg, key.Curve.Params().Name)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid JWT signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid JWT signature")
+		}
+	default:
+		return errors.New("unsupported key type")
+	}
+	return nil
+}
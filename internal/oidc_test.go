@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+func TestVerifyJWTSignatureChecksCurve(t *testing.T) {
+	signed := []byte("header.payload")
+	sign := func(key *ecdsa.PrivateKey, hash crypto.Hash) []byte {
+		h := hash.New()
+		h.Write(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+		return sig
+	}
+
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := verifyJWTSignature("ES256", &p256.PublicKey, signed, sign(p256, crypto.SHA256)); err != nil {
+		t.Errorf("valid ES256 signature is rejected: %v", err)
+	}
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err := verifyJWTSignature("ES256", &p384.PublicKey, signed, sign(p384, crypto.SHA256)); err == nil {
+		t.Error("ES256 signature is verified with a P-384 key")
+	}
+	if err := verifyJWTSignature("ES384", &p384.PublicKey, signed, sign(p384, crypto.SHA384)); err != nil {
+		t.Errorf("valid ES384 signature is rejected: %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	DefaultOPATimeout  = time.Second
+	DefaultOPACacheTTL = 10 * time.Second
+
+	opaActionSubscribe = "subscribe"
+	opaActionRecord    = "record"
+)
+
+// OPAAuthorizerOptions holds the settings of deciding access with an Open Policy Agent server, e.g. a sidecar
+type OPAAuthorizerOptions struct {
+	// URL is the data API URL of the policy's boolean decision, e.g. http://localhost:8181/v1/data/logsocket/allow
+	URL string
+	// Timeout bounds each query of the policy
+	Timeout time.Duration
+	// CacheTTL is how long decisions are remembered for inputs that are the same, zero disables caching
+	CacheTTL time.Duration
+	// Records makes the policy decide on the records of each pod and container as well, not only on subscriptions
+	Records bool
+}
+
+// NewOPAAuthorizer returns an authorizer querying the policy at the URL of the options
+func NewOPAAuthorizer(opts OPAAuthorizerOptions, logs log.Sink) *OPAAuthorizer {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultOPATimeout
+	}
+	return &OPAAuthorizer{
+		client:    &http.Client{Timeout: opts.Timeout},
+		decisions: make(map[[sha256.Size]byte]opaDecision),
+		logs:      log.WithFields(logs, log.Fields{"task": "opa authorization"}),
+		opts:      opts,
+	}
+}
+
+// OPAAuthorizer decides access to flows, and optionally to records, by querying an Open Policy Agent policy with the user, the flow and the metadata of the record as input
+// Records are authorized on their metadata only, so that decisions can be cached per pod and container, and they are redacted if the policy cannot be queried
+type OPAAuthorizer struct {
+	client *http.Client
+	logs   log.Sink
+	opts   OPAAuthorizerOptions
+
+	mutex     sync.Mutex
+	decisions map[[sha256.Size]byte]opaDecision
+	lastSweep time.Time
+}
+
+type opaDecision struct {
+	allowed bool
+	expires time.Time
+}
+
+// opaInput is the input document of policy queries
+type opaInput struct {
+	// Action is subscribe when a listener connects and record for each record
+	Action string          `json:"action"`
+	User   authv1.UserInfo `json:"user"`
+	Flow   opaFlow         `json:"flow"`
+	Record *opaRecord      `json:"record,omitempty"`
+}
+
+type opaFlow struct {
+	Kind      FlowKind `json:"kind"`
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	// Reference is the reference of the flow in kind/namespace/name form
+	Reference string `json:"reference"`
+}
+
+type opaRecord struct {
+	Namespace string            `json:"namespace"`
+	Pod       string            `json:"pod"`
+	Container string            `json:"container"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Severity  string            `json:"severity,omitempty"`
+}
+
+func (a *OPAAuthorizer) AuthorizeFlow(user authv1.UserInfo, flow FlowReference) (bool, error) {
+	return a.decide(opaInput{Action: opaActionSubscribe, User: user, Flow: newOPAFlow(flow)})
+}
+
+func (a *OPAAuthorizer) AuthorizeRecord(user authv1.UserInfo, r Record) bool {
+	if !a.opts.Records {
+		return true
+	}
+	input := opaInput{
+		Action: opaActionRecord,
+		User:   user,
+		Flow:   newOPAFlow(r.Flow),
+		Record: &opaRecord{
+			Namespace: r.Meta.Namespace,
+			Pod:       r.Meta.Pod,
+			Container: r.Meta.Container,
+			Labels:    r.Meta.Labels,
+			Severity:  r.Meta.Severity.String(),
+		},
+	}
+	allowed, err := a.decide(input)
+	if err != nil {
+		log.Event(a.logs, "failed to query authorization policy, redacting record", log.V(1), log.Error(err), log.Fields{"user": user.Username, "record": r})
+		return false
+	}
+	return allowed
+}
+
+func newOPAFlow(flow FlowReference) opaFlow {
+	return opaFlow{Kind: flow.Kind, Namespace: flow.Namespace, Name: flow.Name, Reference: flow.URL()}
+}
+
+// decide returns the policy's decision on the input, from the cache if it was queried recently
+func (a *OPAAuthorizer) decide(input opaInput) (bool, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return false, err
+	}
+	key := sha256.Sum256(body)
+	now := time.Now()
+	if a.opts.CacheTTL > 0 {
+		a.mutex.Lock()
+		decision, ok := a.decisions[key]
+		a.mutex.Unlock()
+		if ok && now.Before(decision.expires) {
+			return decision.allowed, nil
+		}
+	}
+
+	allowed, err := a.query(body)
+	if err != nil {
+		return false, err
+	}
+	log.Event(a.logs, "authorization policy queried", log.V(2), log.Fields{"action": input.Action, "user": input.User.Username, "flow": input.Flow.Reference, "allowed": allowed})
+
+	if a.opts.CacheTTL > 0 {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		a.decisions[key] = opaDecision{allowed: allowed, expires: now.Add(a.opts.CacheTTL)}
+		if now.Sub(a.lastSweep) > a.opts.CacheTTL {
+			for key, decision := range a.decisions {
+				if !now.Before(decision.expires) {
+					delete(a.decisions, key)
+				}
+			}
+			a.lastSweep = now
+		}
+	}
+	return allowed, nil
+}
+
+// query posts the input document to the data API, an undefined decision denies access
+func (a *OPAAuthorizer) query(body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, fmt.Errorf("policy query failed: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var res struct {
+		Result *json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&res); err != nil {
+		return false, fmt.Errorf("invalid policy response: %w", err)
+	}
+	if res.Result == nil {
+		return false, nil
+	}
+	var allowed bool
+	if err := json.Unmarshal(*res.Result, &allowed); err != nil {
+		return false, errors.New("invalid policy response, the decision should be a boolean")
+	}
+	return allowed, nil
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const corsMaxAge = 10 * time.Minute
+
+// OriginPolicy decides which web pages browsers may connect to the service from, requests without an Origin header do not come from browsers and are always accepted
+// Pages served by the service itself are always allowed, others have to be listed in Allowed
+type OriginPolicy struct {
+	// Allowed are the origins of cross-origin requests accepted, e.g. https://dashboard.example.com
+	// A * stands for any subdomain, e.g. https://*.example.com, and a lone * allows any origin
+	Allowed []string
+}
+
+// allowed reports whether the request may be served given its origin
+func (p OriginPolicy) allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || sameOrigin(origin, r.Host) {
+		return true
+	}
+	for _, allowed := range p.Allowed {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(allowed, "*"); ok {
+			lower := strings.ToLower(origin)
+			if strings.HasPrefix(lower, strings.ToLower(prefix)) && strings.HasSuffix(lower, strings.ToLower(suffix)) && len(lower) > len(prefix)+len(suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sameOrigin(origin, host string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, host)
+}
+
+// serveCORS rejects requests of disallowed origins and answers CORS preflight requests, it reports whether the request was handled
+// Cross-origin requests that are allowed get the CORS headers letting browsers read their responses, e.g. event streams and tickets
+func serveCORS(w http.ResponseWriter, r *http.Request, policy OriginPolicy, logs log.Sink) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || sameOrigin(origin, r.Host) {
+		return false
+	}
+	if !policy.allowed(r) {
+		log.Event(logs, "rejecting request of disallowed origin", log.V(1), log.Fields{"origin": origin, "request": r})
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return true
+	}
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Add("Vary", "Origin")
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	h.Set("Access-Control-Allow-Methods", "GET, POST")
+	h.Set("Access-Control-Allow-Headers", strings.Join([]string{AuthHeaderKey, "Authorization", "Accept", "Last-Event-ID", LastSequenceHeader}, ", "))
+	h.Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	DefaultOTLPExportInterval = 30 * time.Second
+
+	otlpExportTimeout = 10 * time.Second
+	otlpScopeName     = "github.com/banzaicloud/log-socket"
+)
+
+// MetricsExporter pushes the collected metrics to a monitoring backend, in addition to serving them for scraping on MetricsEndpoint
+type MetricsExporter interface {
+	Run(stopSignal <-chan struct{})
+}
+
+// OTLPExporterOptions holds the settings of exporting metrics to an OpenTelemetry collector
+type OTLPExporterOptions struct {
+	// Endpoint is the URL metrics are posted to over OTLP/HTTP, e.g. http://otel-collector:4318/v1/metrics
+	Endpoint string
+	// Headers are added to export requests, e.g. for authentication
+	Headers map[string]string
+	// Interval is the time between exports
+	Interval time.Duration
+	// Attributes describe the exporting replica, such as service.name
+	Attributes map[string]string
+}
+
+func NewOTLPExporter(opts OTLPExporterOptions, gatherer prometheus.Gatherer, logs log.Sink) *OTLPExporter {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultOTLPExportInterval
+	}
+	return &OTLPExporter{
+		client:   &http.Client{Timeout: otlpExportTimeout},
+		gatherer: gatherer,
+		logs:     log.WithFields(logs, log.Fields{"task": "otlp export"}),
+		opts:     opts,
+		start:    time.Now(),
+	}
+}
+
+// OTLPExporter periodically exports the metrics collected for Prometheus to an OpenTelemetry collector as cumulative OTLP metrics
+type OTLPExporter struct {
+	client   *http.Client
+	gatherer prometheus.Gatherer
+	logs     log.Sink
+	opts     OTLPExporterOptions
+	start    time.Time
+}
+
+func (e *OTLPExporter) Run(stopSignal <-chan struct{}) {
+	ticker := time.NewTicker(e.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopSignal:
+			// the last values are exported before shutting down
+			e.export()
+			return
+		case <-ticker.C:
+			e.export()
+		}
+	}
+}
+
+func (e *OTLPExporter) export() {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		log.Event(e.logs, "failed to gather some metrics", log.V(1), log.Error(err))
+	}
+	req := &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{Attributes: otlpAttributes(e.opts.Attributes)},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: otlpScopeName},
+				Metrics: convertMetricFamilies(families, e.start, time.Now()),
+			}},
+		}},
+	}
+	body, err := proto.Marshal(req)
+	if err != nil {
+		log.Event(e.logs, "failed to marshal metrics", log.Error(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), otlpExportTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Event(e.logs, "failed to create export request", log.Error(err))
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	for name, value := range e.opts.Headers {
+		httpReq.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		log.Event(e.logs, "failed to export metrics", log.Error(err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		log.Event(e.logs, "metrics export rejected", log.Error(fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))))
+		return
+	}
+	log.Event(e.logs, "exported metrics", log.V(2), log.Fields{"families": len(families)})
+}
+
+// convertMetricFamilies converts Prometheus metrics to OTLP metrics, counters becoming monotonic sums and untyped metrics gauges
+func convertMetricFamilies(families []*dto.MetricFamily, start time.Time, now time.Time) []*metricspb.Metric {
+	startNano, nowNano := uint64(start.UnixNano()), uint64(now.UnixNano())
+	res := make([]*metricspb.Metric, 0, len(families))
+	for _, family := range families {
+		m := &metricspb.Metric{Name: family.GetName(), Description: family.GetHelp()}
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			sum := &metricspb.Sum{AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, IsMonotonic: true}
+			for _, metric := range family.Metric {
+				sum.DataPoints = append(sum.DataPoints, otlpNumber(metric, metric.GetCounter().GetValue(), startNano, nowNano))
+			}
+			m.Data = &metricspb.Metric_Sum{Sum: sum}
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			gauge := &metricspb.Gauge{}
+			for _, metric := range family.Metric {
+				value := metric.GetGauge().GetValue()
+				if family.GetType() == dto.MetricType_UNTYPED {
+					value = metric.GetUntyped().GetValue()
+				}
+				gauge.DataPoints = append(gauge.DataPoints, otlpNumber(metric, value, 0, nowNano))
+			}
+			m.Data = &metricspb.Metric_Gauge{Gauge: gauge}
+		case dto.MetricType_HISTOGRAM:
+			hist := &metricspb.Histogram{AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE}
+			for _, metric := range family.Metric {
+				hist.DataPoints = append(hist.DataPoints, otlpHistogram(metric, startNano, nowNano))
+			}
+			m.Data = &metricspb.Metric_Histogram{Histogram: hist}
+		case dto.MetricType_SUMMARY:
+			summary := &metricspb.Summary{}
+			for _, metric := range family.Metric {
+				s := metric.GetSummary()
+				dp := &metricspb.SummaryDataPoint{
+					Attributes:        otlpLabels(metric.Label),
+					StartTimeUnixNano: startNano,
+					TimeUnixNano:      nowNano,
+					Count:             s.GetSampleCount(),
+					Sum:               s.GetSampleSum(),
+				}
+				for _, q := range s.Quantile {
+					dp.QuantileValues = append(dp.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{Quantile: q.GetQuantile(), Value: q.GetValue()})
+				}
+				summary.DataPoints = append(summary.DataPoints, dp)
+			}
+			m.Data = &metricspb.Metric_Summary{Summary: summary}
+		default:
+			continue
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+func otlpNumber(metric *dto.Metric, value float64, startNano uint64, nowNano uint64) *metricspb.NumberDataPoint {
+	return &metricspb.NumberDataPoint{
+		Attributes:        otlpLabels(metric.Label),
+		StartTimeUnixNano: startNano,
+		TimeUnixNano:      nowNano,
+		Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+	}
+}
+
+// otlpHistogram converts the cumulative buckets of a Prometheus histogram to the per-bucket counts of OTLP, the +Inf bucket becoming the overflow bucket
+func otlpHistogram(metric *dto.Metric, startNano uint64, nowNano uint64) *metricspb.HistogramDataPoint {
+	h := metric.GetHistogram()
+	sum := h.GetSampleSum()
+	dp := &metricspb.HistogramDataPoint{
+		Attributes:        otlpLabels(metric.Label),
+		StartTimeUnixNano: startNano,
+		TimeUnixNano:      nowNano,
+		Count:             h.GetSampleCount(),
+		Sum:               &sum,
+	}
+	var below uint64
+	for _, b := range h.Bucket {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+		dp.ExplicitBounds = append(dp.ExplicitBounds, b.GetUpperBound())
+		dp.BucketCounts = append(dp.BucketCounts, b.GetCumulativeCount()-below)
+		below = b.GetCumulativeCount()
+	}
+	dp.BucketCounts = append(dp.BucketCounts, h.GetSampleCount()-below)
+	return dp
+}
+
+func otlpLabels(labels []*dto.LabelPair) []*commonpb.KeyValue {
+	res := make([]*commonpb.KeyValue, 0, len(labels))
+	for _, l := range labels {
+		res = append(res, otlpString(l.GetName(), l.GetValue()))
+	}
+	return res
+}
+
+func otlpAttributes(attrs map[string]string) []*commonpb.KeyValue {
+	res := make([]*commonpb.KeyValue, 0, len(attrs))
+	for _, name := range sortedKeys(attrs) {
+		res = append(res, otlpString(name, attrs[name]))
+	}
+	return res
+}
+
+func otlpString(key string, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
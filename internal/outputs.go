@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	loggingv1beta1 "github.com/banzaicloud/logging-operator/pkg/sdk/logging/api/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const DefaultOutputRoutesRefreshInterval = 30 * time.Second
+
+// OutputRouter tells which flows route records to which outputs, so that the listeners of an output receive the records of all the flows routing to it
+type OutputRouter interface {
+	// Flows returns the flows routing records to the output
+	Flows(output FlowReference) []FlowReference
+	// Outputs returns the outputs the flow routes records to
+	Outputs(flow FlowReference) []FlowReference
+}
+
+var errOutputsDisabled = errors.New("subscribing to outputs is not enabled")
+
+// checkOutputs fails if any of the flows is an output and subscribing to outputs is disabled or not possible
+func checkOutputs(router OutputRouter, flows ...FlowReference) error {
+	for _, flow := range flows {
+		if flow.Kind.IsOutput() && router == nil {
+			return fmt.Errorf("cannot subscribe to %s: %w", flow.URL(), errOutputsDisabled)
+		}
+	}
+	return nil
+}
+
+// parseRecordFlow parses the reference of the flow records are ingested for, which cannot be an output
+func parseRecordFlow(ref string) (FlowReference, error) {
+	flow, err := ParseFlowReference(ref, "")
+	if err == nil && flow.Kind.IsOutput() {
+		return flow, fmt.Errorf("records are ingested for flows, %s is an output", flow.URL())
+	}
+	return flow, err
+}
+
+// RoutedListeners returns the listeners of the flow and those of the outputs it routes records to
+func RoutedListeners(registry *FlowRegistry, router OutputRouter, flow FlowReference) []Listener {
+	listeners := registry.Listeners(flow)
+	if router == nil {
+		return listeners
+	}
+	outputs := router.Outputs(flow)
+	if len(outputs) == 0 {
+		return listeners
+	}
+	// the registry's slice must not be modified
+	res := append([]Listener(nil), listeners...)
+	for _, output := range outputs {
+		res = append(res, registry.Listeners(output)...)
+	}
+	return res
+}
+
+// TappedFlows returns the flows records have to be received from for the listened flows, replacing outputs with the flows routing to them
+func TappedFlows(flows []FlowReference, router OutputRouter) []FlowReference {
+	res := make([]FlowReference, 0, len(flows))
+	for _, flow := range flows {
+		if !flow.Kind.IsOutput() {
+			if !hasItem(res, flow) {
+				res = append(res, flow)
+			}
+			continue
+		}
+		if router == nil {
+			continue
+		}
+		for _, f := range router.Flows(flow) {
+			if !hasItem(res, f) {
+				res = append(res, f)
+			}
+		}
+	}
+	return res
+}
+
+// NewKubernetesOutputRoutes returns a router resolving the output references of the Flow and ClusterFlow resources of the cluster
+// Global output references of flows are resolved to cluster outputs in controlNamespace
+func NewKubernetesOutputRoutes(c client.Client, controlNamespace string, logs log.Sink) *KubernetesOutputRoutes {
+	r := &KubernetesOutputRoutes{
+		changes:          make(chan struct{}, 1),
+		client:           c,
+		controlNamespace: controlNamespace,
+		logs:             log.WithFields(logs, log.Fields{"task": "output routes"}),
+	}
+	r.routes.Store(outputRoutes{})
+	return r
+}
+
+// KubernetesOutputRoutes periodically lists the flows of the cluster to find out which outputs they route records to
+type KubernetesOutputRoutes struct {
+	changes          chan struct{}
+	client           client.Client
+	controlNamespace string
+	logs             log.Sink
+	routes           atomic.Value // outputRoutes
+}
+
+type outputRoutes struct {
+	flows   map[FlowReference][]FlowReference
+	outputs map[FlowReference][]FlowReference
+}
+
+func (r *KubernetesOutputRoutes) Flows(output FlowReference) []FlowReference {
+	return r.routes.Load().(outputRoutes).flows[output]
+}
+
+func (r *KubernetesOutputRoutes) Outputs(flow FlowReference) []FlowReference {
+	return r.routes.Load().(outputRoutes).outputs[flow]
+}
+
+// Changes returns a channel which receives a value whenever the routes have changed
+func (r *KubernetesOutputRoutes) Changes() <-chan struct{} {
+	return r.changes
+}
+
+// Refresh lists the flows and updates the routes
+func (r *KubernetesOutputRoutes) Refresh(ctx context.Context) error {
+	var flows loggingv1beta1.FlowList
+	if err := r.client.List(ctx, &flows); err != nil {
+		return err
+	}
+	var clusterFlows loggingv1beta1.ClusterFlowList
+	if err := r.client.List(ctx, &clusterFlows); err != nil {
+		return err
+	}
+
+	routes := outputRoutes{
+		flows:   make(map[FlowReference][]FlowReference),
+		outputs: make(map[FlowReference][]FlowReference),
+	}
+	add := func(flow FlowReference, kind FlowKind, namespace string, names ...[]string) {
+		for _, refs := range names {
+			for _, name := range refs {
+				output := FlowReference{NamespacedName: types.NamespacedName{Namespace: namespace, Name: name}, Kind: kind}
+				if namespace == "" || hasItem(routes.outputs[flow], output) {
+					continue
+				}
+				routes.outputs[flow] = append(routes.outputs[flow], output)
+				routes.flows[output] = append(routes.flows[output], flow)
+			}
+		}
+	}
+	for _, f := range flows.Items {
+		flow := FlowReference{NamespacedName: types.NamespacedName{Namespace: f.Namespace, Name: f.Name}, Kind: FKFlow}
+		add(flow, FKOutput, f.Namespace, f.Spec.LocalOutputRefs, f.Spec.OutputRefs)
+		add(flow, FKClusterOutput, r.controlNamespace, f.Spec.GlobalOutputRefs)
+	}
+	for _, f := range clusterFlows.Items {
+		flow := FlowReference{NamespacedName: types.NamespacedName{Namespace: f.Namespace, Name: f.Name}, Kind: FKClusterFlow}
+		add(flow, FKClusterOutput, f.Namespace, f.Spec.GlobalOutputRefs, f.Spec.OutputRefs)
+	}
+
+	if old := r.routes.Load().(outputRoutes); reflect.DeepEqual(old.flows, routes.flows) {
+		return nil
+	}
+	r.routes.Store(routes)
+	log.Event(r.logs, "output routes changed", log.V(1), log.Fields{"outputs": len(routes.flows)})
+	select {
+	case r.changes <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run refreshes the routes at the specified interval until the stop signal is closed
+func (r *KubernetesOutputRoutes) Run(interval time.Duration, stopSignal <-chan struct{}) {
+	if interval <= 0 {
+		interval = DefaultOutputRoutesRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopSignal:
+			return
+		case <-ticker.C:
+		}
+		if err := r.Refresh(context.Background()); err != nil {
+			log.Event(r.logs, "failed to refresh output routes", log.Error(err))
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// ServeProfiling serves the pprof endpoints under /debug/pprof/ on addr, which should only be reachable from inside the cluster
+func ServeProfiling(addr string, logs log.Sink, stopSignal Handleable) {
+	logs = log.WithFields(logs, log.Fields{"task": "profiling"})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	if stopSignal != nil {
+		stopSignal.HandleWith(func() {
+			if err := server.Close(); err != nil {
+				log.Event(logs, "error during profiling server shutdown", log.Error(err))
+			}
+		})
+	}
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Event(logs, "profiling server ListenAndServe returned an error", log.Error(err))
+	}
+}
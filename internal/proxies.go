@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies are the networks of the proxies whose X-Forwarded-For and X-Real-IP headers tell the address of clients
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses CIDRs (e.g. 10.0.0.0/8) and single addresses of trusted proxies
+func ParseTrustedProxies(specs []string) (res TrustedProxies, err error) {
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", spec)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy network %q: %w", spec, err)
+		}
+		res = append(res, network)
+	}
+	return res, nil
+}
+
+func (p TrustedProxies) trusted(addr string) bool {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAddr returns the address of the client of the request, which is the remote address unless the request comes from a trusted proxy
+// The X-Forwarded-For header is read from right to left up to the first address that is not a trusted proxy, so clients cannot spoof their address by sending the header themselves
+// X-Real-IP is used if the request has no X-Forwarded-For header
+func (p TrustedProxies) ClientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if len(p) == 0 || !p.trusted(host) {
+		return r.RemoteAddr
+	}
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		addrs := strings.Split(strings.Join(forwarded, ","), ",")
+		client := host
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(addrs[i])
+			if net.ParseIP(addr) == nil {
+				break
+			}
+			client = addr
+			if !p.trusted(addr) {
+				break
+			}
+		}
+		return client
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return r.RemoteAddr
+}
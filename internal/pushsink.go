@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	DefaultPushSinkBatchSize = 1000
+	DefaultPushSinkBatchWait = time.Second
+
+	pushSinkTimeout     = 30 * time.Second
+	pushSinkMinBackoff  = 500 * time.Millisecond
+	pushSinkMaxBackoff  = 30 * time.Second
+	pushSinkMaxAttempts = 6
+)
+
+// pushSinkOptions holds the batching settings of sinks pushing records to an HTTP API, set with the batchSize and batchWait query parameters of their URL
+type pushSinkOptions struct {
+	// BatchSize is the number of records after which a batch is pushed
+	BatchSize int
+	// BatchWait is the time after which a batch is pushed regardless of its size
+	BatchWait time.Duration
+}
+
+func parsePushSinkOptions(query url.Values) (res pushSinkOptions, err error) {
+	res = pushSinkOptions{BatchSize: DefaultPushSinkBatchSize, BatchWait: DefaultPushSinkBatchWait}
+	if size := query.Get("batchSize"); size != "" {
+		if res.BatchSize, err = strconv.Atoi(size); err != nil || res.BatchSize <= 0 {
+			return res, fmt.Errorf("invalid batchSize %q", size)
+		}
+	}
+	if wait := query.Get("batchWait"); wait != "" {
+		if res.BatchWait, err = time.ParseDuration(wait); err != nil || res.BatchWait <= 0 {
+			return res, fmt.Errorf("invalid batchWait %q", wait)
+		}
+	}
+	return res, nil
+}
+
+// errPermanentPush marks push errors that retrying cannot fix, such as rejected requests
+var errPermanentPush = errors.New("push rejected")
+
+// batchingSink implements the parts shared by sinks pushing batches of records to an HTTP API
+// Records are queued without blocking the fan-out, they are dropped while the queue is full, and failed pushes are retried with exponential backoff
+type batchingSink struct {
+	flow FlowReference
+	logs log.Sink
+	opts pushSinkOptions
+	// push sends a batch, it is called from a single goroutine
+	push func(batch []Record) error
+
+	mutex   sync.RWMutex
+	closed  bool
+	queue   chan Record
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	dropped uint64
+}
+
+func (s *batchingSink) start() {
+	s.queue = make(chan Record, 4*s.opts.BatchSize)
+	s.stop = make(chan struct{})
+	s.wg.Add(1)
+	go s.run()
+}
+
+func (s *batchingSink) Flow() FlowReference {
+	return s.flow
+}
+
+func (s *batchingSink) User() authv1.UserInfo {
+	return sinkUser
+}
+
+func (s *batchingSink) Send(r Record) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- r:
+	default:
+		if dropped := atomic.AddUint64(&s.dropped, 1); dropped%uint64(s.opts.BatchSize) == 1 {
+			log.Event(s.logs, "sink cannot keep up, dropping records", log.Fields{"dropped": dropped})
+		}
+	}
+}
+
+func (s *batchingSink) run() {
+	defer s.wg.Done()
+	batch := make([]Record, 0, s.opts.BatchSize)
+	timer := time.NewTimer(s.opts.BatchWait)
+	defer timer.Stop()
+	flush := func() {
+		if len(batch) > 0 {
+			s.pushWithRetries(batch)
+			batch = make([]Record, 0, s.opts.BatchSize)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(s.opts.BatchWait)
+	}
+	for {
+		select {
+		case r, ok := <-s.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if batch = append(batch, r); len(batch) >= s.opts.BatchSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// pushWithRetries pushes the batch until it succeeds, the error is permanent or the attempts run out, retries are given up once the sink is closed
+func (s *batchingSink) pushWithRetries(batch []Record) {
+	backoff := pushSinkMinBackoff
+	for attempt := 1; ; attempt++ {
+		err := s.push(batch)
+		if err == nil {
+			log.Event(s.logs, "pushed records", log.V(2), log.Fields{"records": len(batch)})
+			return
+		}
+		if errors.Is(err, errPermanentPush) || attempt == pushSinkMaxAttempts {
+			log.Event(s.logs, "failed to push records, dropping them", log.Error(err), log.Fields{"records": len(batch), "attempts": attempt})
+			return
+		}
+		log.Event(s.logs, "failed to push records, retrying", log.V(1), log.Error(err), log.Fields{"records": len(batch), "backoff": backoff})
+		select {
+		case <-time.After(backoff):
+		case <-s.stop:
+			log.Event(s.logs, "failed to push records before closing, dropping them", log.Error(err), log.Fields{"records": len(batch)})
+			return
+		}
+		if backoff *= 2; backoff > pushSinkMaxBackoff {
+			backoff = pushSinkMaxBackoff
+		}
+	}
+}
+
+// Close pushes the queued records and stops the sink
+func (s *batchingSink) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	close(s.queue)
+	s.mutex.Unlock()
+	close(s.stop)
+	s.wg.Wait()
+	return nil
+}
+
+// doPushRequest sends a push request, client errors other than throttling are permanent
+func doPushRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+		return nil
+	}
+	return pushResponseError(resp)
+}
+
+// pushResponseError returns the error of a failed push response
+func pushResponseError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err := fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %s", errPermanentPush, err)
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+// DefaultQuotaRetryAfter is the delay suggested to listeners rejected because a connection quota is exhausted
+const DefaultQuotaRetryAfter = 30 * time.Second
+
+// NewConnectionQuota returns a quota limiting the number of concurrent connections, zero limits mean unlimited
+func NewConnectionQuota(maxConnections, maxUserConnections int, metrics QuotaMetrics) *ConnectionQuota {
+	return &ConnectionQuota{
+		maxConnections:     maxConnections,
+		maxUserConnections: maxUserConnections,
+		metrics:            metrics,
+		users:              make(map[string]int),
+	}
+}
+
+// ConnectionQuota keeps track of the concurrent connections of listeners, globally and for each user
+type ConnectionQuota struct {
+	connections        int
+	maxConnections     int
+	maxUserConnections int
+	metrics            QuotaMetrics
+	mutex              sync.Mutex
+	users              map[string]int
+}
+
+type QuotaMetrics interface {
+	ConnectionQuotaUtilization(ratio float64)
+	UserConnectionQuotaUtilization(user authv1.UserInfo, ratio float64)
+}
+
+// Acquire reserves a connection for the user, it returns false if this would exceed one of the quotas
+func (q *ConnectionQuota) Acquire(user authv1.UserInfo) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.maxConnections > 0 && q.connections >= q.maxConnections {
+		return false
+	}
+	if q.maxUserConnections > 0 && q.users[user.Username] >= q.maxUserConnections {
+		return false
+	}
+	q.connections++
+	q.users[user.Username]++
+	q.report(user)
+	return true
+}
+
+// SetLimits changes the limits of the quota, connections exceeding the new limits are not closed
+func (q *ConnectionQuota) SetLimits(maxConnections, maxUserConnections int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.maxConnections = maxConnections
+	q.maxUserConnections = maxUserConnections
+}
+
+// Release frees a connection reserved by Acquire
+func (q *ConnectionQuota) Release(user authv1.UserInfo) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.connections--
+	if q.users[user.Username]--; q.users[user.Username] <= 0 {
+		delete(q.users, user.Username)
+	}
+	q.report(user)
+}
+
+func (q *ConnectionQuota) report(user authv1.UserInfo) {
+	if q.metrics == nil {
+		return
+	}
+	if q.maxConnections > 0 {
+		q.metrics.ConnectionQuotaUtilization(float64(q.connections) / float64(q.maxConnections))
+	}
+	if q.maxUserConnections > 0 {
+		q.metrics.UserConnectionQuotaUtilization(user, float64(q.users[user.Username])/float64(q.maxUserConnections))
+	}
+}
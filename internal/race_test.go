@@ -0,0 +1,6 @@
+//go:build race
+
+package internal
+
+// raceEnabled tells that the tests run with the race detector, which allocates in instrumented code
+const raceEnabled = true
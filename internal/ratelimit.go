@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const userRateLimiterIdleTimeout = 10 * time.Minute
+
+// NewUserRateLimiter returns a rate limiter keeping a separate token bucket for each user
+func NewUserRateLimiter(limit rate.Limit, burst int) *UserRateLimiter {
+	return &UserRateLimiter{
+		burst:    burst,
+		limit:    limit,
+		limiters: make(map[string]*userLimiter),
+	}
+}
+
+type UserRateLimiter struct {
+	burst     int
+	lastSweep time.Time
+	limit     rate.Limit
+	limiters  map[string]*userLimiter
+	mutex     sync.Mutex
+}
+
+type userLimiter struct {
+	*rate.Limiter
+	lastUsed time.Time
+}
+
+// Reserve takes a token from the user's bucket if one is available, otherwise it returns how long the user has to wait for the next one
+func (u *UserRateLimiter) Reserve(user string) (ok bool, retryAfter time.Duration) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(u.lastSweep) > userRateLimiterIdleTimeout {
+		u.sweep(now)
+	}
+
+	l, found := u.limiters[user]
+	if !found {
+		l = &userLimiter{Limiter: rate.NewLimiter(u.limit, u.burst)}
+		u.limiters[user] = l
+	}
+	l.lastUsed = now
+
+	res := l.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// sweep removes the limiters of users who have been idle long enough for their buckets to be full again
+func (u *UserRateLimiter) sweep(now time.Time) {
+	idleTimeout := userRateLimiterIdleTimeout
+	if refill := time.Duration(float64(u.burst) / float64(u.limit) * float64(time.Second)); refill > idleTimeout {
+		idleTimeout = refill
+	}
+	for user, l := range u.limiters {
+		if now.Sub(l.lastUsed) > idleTimeout {
+			delete(u.limiters, user)
+		}
+	}
+	u.lastSweep = now
+}
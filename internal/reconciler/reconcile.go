@@ -3,9 +3,12 @@ package reconciler
 import (
 	"context"
 	"errors"
+	"net"
 	"path"
+	"strconv"
 	"strings"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -13,9 +16,12 @@ import (
 
 	"github.com/banzaicloud/log-socket/internal"
 	loggingv1beta1 "github.com/banzaicloud/logging-operator/pkg/sdk/logging/api/v1beta1"
+	"github.com/banzaicloud/logging-operator/pkg/sdk/logging/model/common"
 	"github.com/banzaicloud/logging-operator/pkg/sdk/logging/model/output"
 	"github.com/banzaicloud/operator-tools/pkg/reconciler"
+	"github.com/banzaicloud/operator-tools/pkg/secret"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/retry"
 )
 
 func New(ingestAddr string, client client.Client) *Reconciler {
@@ -25,6 +31,15 @@ func New(ingestAddr string, client client.Client) *Reconciler {
 type Reconciler struct {
 	Client     client.Client
 	IngestAddr string
+	// ClientCertSecret is the name of the secret (with tls.crt and tls.key keys) outputs authenticate to the ingest server with
+	// The secret has to exist in the namespace of each output, no client certificate is used if empty
+	ClientCertSecret string
+	// ForwardAddr is the host:port of the service's forward protocol receiver, outputs use the forward protocol instead of HTTP if set
+	ForwardAddr string
+	// ForwardSharedKey is the shared key outputs authenticate to the forward protocol receiver with
+	ForwardSharedKey string
+	// ControlNamespace is the namespace of the cluster flows generated for label selectors and of their outputs
+	ControlNamespace string
 }
 
 type UpdateReference func(refs []string) []string
@@ -71,10 +86,14 @@ func (r *Reconciler) Reconcile(ctx context.Context, event internal.ReconcileEven
 
 	result := reconciler.CombinedResult{}
 	for _, req := range event.Requests {
-		outputName := types.NamespacedName{Namespace: req.Namespace, Name: generateOutputName(req.Name)}
+		outputName := types.NamespacedName{Namespace: r.tappedFlow(req).Namespace, Name: generateOutputName(req.Name)}
 		if _, ok := outputMap[outputName]; !ok {
 			res, err := r.EnsureOutput(ctx, req)
 			result.Combine(&res, err)
+		} else {
+			// the flow may have lost the reference to the existing output, e.g. when it was re-applied by a GitOps tool
+			res, err := r.ReconcileFlow(ctx, r.tappedFlow(req), OutputReference(outputName.Name).Add)
+			result.Combine(&res, err)
 		}
 		delete(outputMap, outputName)
 	}
@@ -100,18 +119,32 @@ func (r *Reconciler) RemoveOutput(ctx context.Context, obj client.Object) (res c
 		return
 	}
 
-	err = r.Client.Delete(ctx, obj)
+	if err = r.Client.Delete(ctx, obj); err != nil {
+		return
+	}
+
+	if _, ok := obj.(*loggingv1beta1.ClusterOutput); ok && strings.HasPrefix(flowName, internal.SelectorFlowPrefix) {
+		// the cluster flow was generated for a label selector which has no listeners anymore
+		err = client.IgnoreNotFound(r.Client.Delete(ctx, &loggingv1beta1.ClusterFlow{ObjectMeta: metav1.ObjectMeta{Namespace: obj.GetNamespace(), Name: flowName}}))
+	}
 
 	return
 }
 
 func (r *Reconciler) EnsureOutput(ctx context.Context, flowRef internal.FlowReference) (res ctrl.Result, err error) {
 	var obj client.Object
-	meta := r.OutputObjectMeta(types.NamespacedName{Namespace: flowRef.Namespace, Name: generateOutputName(flowRef.Name)}, flowRef.Name)
-	spec := loggingv1beta1.OutputSpec{
-		HTTPOutput: r.HTTPOuput(flowRef),
+	tapped := r.tappedFlow(flowRef)
+	meta := r.OutputObjectMeta(types.NamespacedName{Namespace: tapped.Namespace, Name: generateOutputName(flowRef.Name)}, flowRef.Name)
+	var spec loggingv1beta1.OutputSpec
+	if r.ForwardAddr != "" {
+		spec.ForwardOutput, err = r.ForwardOutput(flowRef)
+		if err != nil {
+			return
+		}
+	} else {
+		spec.HTTPOutput = r.HTTPOuput(flowRef)
 	}
-	switch flowRef.Kind {
+	switch tapped.Kind {
 	case internal.FKClusterFlow:
 		obj = &loggingv1beta1.ClusterOutput{
 			ObjectMeta: meta,
@@ -131,11 +164,19 @@ func (r *Reconciler) EnsureOutput(ctx context.Context, flowRef internal.FlowRefe
 		return
 	}
 
-	res, err = r.ReconcileFlow(ctx, flowRef, OutputReference(obj.GetName()).Add)
+	res, err = r.ReconcileFlow(ctx, tapped, OutputReference(obj.GetName()).Add)
 
 	return
 }
 
+// tappedFlow returns the flow the output of the referenced flow is added to, the records of which are still ingested for the referenced flow
+func (r *Reconciler) tappedFlow(flowRef internal.FlowReference) internal.FlowReference {
+	if flowRef.Kind == internal.FKSelector {
+		return internal.SelectorClusterFlow(flowRef, r.ControlNamespace)
+	}
+	return flowRef
+}
+
 func (r *Reconciler) OutputObjectMeta(key types.NamespacedName, flowName string) metav1.ObjectMeta {
 	return metav1.ObjectMeta{
 		Namespace:   key.Namespace,
@@ -147,7 +188,7 @@ func (r *Reconciler) OutputObjectMeta(key types.NamespacedName, flowName string)
 
 func (r *Reconciler) HTTPOuput(flowRef internal.FlowReference) *output.HTTPOutputConfig {
 	path.Join()
-	return &output.HTTPOutputConfig{
+	cfg := &output.HTTPOutputConfig{
 		Endpoint: strings.TrimRight(r.IngestAddr, "/") + "/" + flowRef.URL(),
 		Format: &output.Format{
 			Type: "json",
@@ -159,34 +200,103 @@ func (r *Reconciler) HTTPOuput(flowRef internal.FlowReference) *output.HTTPOutpu
 			OverflowAction:   "drop_oldest_chunk",
 		},
 	}
+	if r.ClientCertSecret != "" {
+		cfg.TlsClientCertPath = r.secretMount(corev1.TLSCertKey)
+		cfg.TlsPrivateKeyPath = r.secretMount(corev1.TLSPrivateKeyKey)
+		// the ingest server's certificate is self-signed
+		cfg.TlsVerifyMode = "none"
+	}
+	return cfg
 }
 
+// ForwardOutput returns the config of an output forwarding the flow's records to the forward protocol receiver
+// The receiver identifies the flow by the user name sent during the handshake
+func (r *Reconciler) ForwardOutput(flowRef internal.FlowReference) (*output.ForwardOutput, error) {
+	host, portStr, err := net.SplitHostPort(r.ForwardAddr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &output.ForwardOutput{
+		FluentdServers: []output.FluentdServer{
+			{
+				Host:     host,
+				Port:     port,
+				Username: &secret.Secret{Value: flowRef.URL()},
+				// the receiver only verifies the shared key, but user authentication requires a password
+				Password: &secret.Secret{Value: "-"},
+			},
+		},
+		RequireAckResponse: true,
+		Buffer: &output.Buffer{
+			Type:           "memory",
+			FlushMode:      "immediate",
+			OverflowAction: "drop_oldest_chunk",
+		},
+	}
+	if r.ForwardSharedKey != "" {
+		cfg.Security = &common.Security{
+			SelfHostname: "log-socket-output",
+			SharedKey:    r.ForwardSharedKey,
+			UserAuth:     true,
+		}
+	}
+	return cfg, nil
+}
+
+func (r *Reconciler) secretMount(key string) *secret.Secret {
+	return &secret.Secret{
+		MountFrom: &secret.ValueFrom{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: r.ClientCertSecret},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+// ReconcileFlow updates the output references of the flow, the flow is only written if they change and the update is retried on conflicts with other writers
 func (r *Reconciler) ReconcileFlow(ctx context.Context, ref internal.FlowReference, updater UpdateReference) (res ctrl.Result, err error) {
 	if updater == nil {
 		return res, errors.New("no update function added")
 	}
-	switch ref.Kind {
-	case internal.FKClusterFlow:
-		var clusterFlow loggingv1beta1.ClusterFlow
-		if err = r.Client.Get(ctx, ref.NamespacedName, &clusterFlow); err != nil {
-			return
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var obj client.Object
+		var refs *[]string
+		switch ref.Kind {
+		case internal.FKClusterFlow:
+			clusterFlow := &loggingv1beta1.ClusterFlow{}
+			obj, refs = clusterFlow, &clusterFlow.Spec.GlobalOutputRefs
+		default:
+			flow := &loggingv1beta1.Flow{}
+			obj, refs = flow, &flow.Spec.LocalOutputRefs
 		}
-		clusterFlow.Spec.GlobalOutputRefs = updater(clusterFlow.Spec.GlobalOutputRefs)
-		if err = r.Client.Update(ctx, &clusterFlow); err != nil {
-			return
+		if err := r.Client.Get(ctx, ref.NamespacedName, obj); err != nil {
+			return err
 		}
-		return
-	default:
-		var flow loggingv1beta1.Flow
-		if err = r.Client.Get(ctx, ref.NamespacedName, &flow); err != nil {
-			return
+		// the updater may modify the references in place
+		current := append([]string(nil), *refs...)
+		if *refs = updater(*refs); equalRefs(current, *refs) {
+			return nil
 		}
-		flow.Spec.LocalOutputRefs = updater(flow.Spec.LocalOutputRefs)
-		if err = r.Client.Update(ctx, &flow); err != nil {
-			return
+		return r.Client.Update(ctx, obj)
+	})
+	return
+}
+
+func equalRefs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
-		return
 	}
+	return true
 }
 
 func generateOutputName(name string) string {
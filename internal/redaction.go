@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	// RedactionMask replaces the redacted values and matches
+	RedactionMask = "[REDACTED]"
+
+	RedactionRuleField RedactionRuleKind = "field"
+	RedactionRuleRegex RedactionRuleKind = "regex"
+)
+
+// RedactionRuleKind tells how a redaction rule selects what it masks
+type RedactionRuleKind string
+
+// RedactionRule masks a field of records selected by a jq-like path, or the matches of a regular expression in all string values of records
+type RedactionRule struct {
+	// Name identifies the rule in metrics
+	Name string
+	Kind RedactionRuleKind
+	path []pathElement
+	re   *regexp.Regexp
+}
+
+// ParseRedactionRule parses a rule of the form name:field:path or name:regex:expression, e.g. token:field:.kubernetes.annotations.token or password:regex:password=\S+
+func ParseRedactionRule(spec string) (res RedactionRule, err error) {
+	elts := strings.SplitN(spec, ":", 3)
+	if len(elts) != 3 || elts[0] == "" || elts[2] == "" {
+		return res, fmt.Errorf("invalid redaction rule %q, expected name:field:path or name:regex:expression", spec)
+	}
+	res.Name, res.Kind = elts[0], RedactionRuleKind(elts[1])
+	switch res.Kind {
+	case RedactionRuleField:
+		res.path, err = parsePath(elts[2])
+	case RedactionRuleRegex:
+		res.re, err = regexp.Compile(elts[2])
+	default:
+		err = fmt.Errorf("unknown kind %q", elts[1])
+	}
+	if err != nil {
+		return res, fmt.Errorf("invalid redaction rule %s: %w", res.Name, err)
+	}
+	return res, nil
+}
+
+// RedactionMetrics counts the values masked by each redaction rule
+type RedactionMetrics interface {
+	LogRecordRedactions(r Record, rule string, count int)
+}
+
+// Redact masks the parts of ingested records matched by the rules before pushing them to records, so that no listener, sink or replay buffer receives them
+// Records that are not JSON objects are only redacted by regex rules, records that had something masked are re-encoded with their keys sorted
+func Redact(records RecordSink, rules []RedactionRule, logs log.Sink, metrics RedactionMetrics) RecordSink {
+	return redactor{
+		logs:    logs,
+		metrics: metrics,
+		records: records,
+		rules:   rules,
+	}
+}
+
+type redactor struct {
+	logs    log.Sink
+	metrics RedactionMetrics
+	records RecordSink
+	rules   []RedactionRule
+}
+
+func (d redactor) Push(r Record) {
+	d.records.Push(d.redact(r))
+}
+
+func (d redactor) redact(r Record) Record {
+	decoder := json.NewDecoder(bytes.NewReader(r.RawData))
+	decoder.UseNumber()
+	var data interface{}
+	if err := decoder.Decode(&data); err != nil {
+		return d.redactText(r)
+	}
+
+	redacted := false
+	for _, rule := range d.rules {
+		var count int
+		if rule.Kind == RedactionRuleField {
+			count = maskPath(data, rule.path)
+		} else {
+			data, count = maskMatches(data, rule.re)
+		}
+		if count > 0 {
+			redacted = true
+			d.metrics.LogRecordRedactions(r, rule.Name, count)
+		}
+	}
+	if !redacted {
+		return r
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(data); err != nil {
+		log.Event(d.logs, "failed to encode redacted record, dropping its data", log.Error(err), log.Fields{"flow": r.Flow})
+		buf.Reset()
+		buf.WriteString("{}")
+	}
+	return withData(r, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// redactText applies the regex rules to records that are not valid JSON
+func (d redactor) redactText(r Record) Record {
+	data := r.RawData
+	for _, rule := range d.rules {
+		if rule.Kind != RedactionRuleRegex {
+			continue
+		}
+		if count := len(rule.re.FindAllIndex(data, -1)); count > 0 {
+			data = rule.re.ReplaceAllLiteral(data, []byte(RedactionMask))
+			d.metrics.LogRecordRedactions(r, rule.Name, count)
+		}
+	}
+	if bytes.Equal(data, r.RawData) {
+		return r
+	}
+	return withData(r, data)
+}
+
+// withData replaces the data of the record, parsing its metadata again
+func withData(r Record, data []byte) Record {
+	r.RawData = data
+	r.frames = nil
+	if meta, err := ParseRecordMeta(data); err == nil {
+		r.Meta = meta
+	} else {
+		r.Meta = RecordMeta{}
+	}
+	return r
+}
+
+// maskPath replaces the value at the path with the mask, it returns the number of values masked
+func maskPath(data interface{}, path []pathElement) int {
+	for i, elt := range path {
+		last := i == len(path)-1
+		if elt.key != "" {
+			obj, ok := data.(map[string]interface{})
+			if !ok {
+				return 0
+			}
+			if _, ok := obj[elt.key]; !ok {
+				return 0
+			}
+			if last {
+				obj[elt.key] = RedactionMask
+				return 1
+			}
+			data = obj[elt.key]
+		} else {
+			arr, ok := data.([]interface{})
+			if !ok || elt.index >= len(arr) {
+				return 0
+			}
+			if last {
+				arr[elt.index] = RedactionMask
+				return 1
+			}
+			data = arr[elt.index]
+		}
+	}
+	return 0
+}
+
+// maskMatches replaces the matches of the expression in all string values, object keys are left alone
+func maskMatches(data interface{}, re *regexp.Regexp) (interface{}, int) {
+	switch v := data.(type) {
+	case string:
+		count := len(re.FindAllStringIndex(v, -1))
+		if count == 0 {
+			return v, 0
+		}
+		return re.ReplaceAllLiteralString(v, RedactionMask), count
+	case map[string]interface{}:
+		total := 0
+		for key, value := range v {
+			var count int
+			v[key], count = maskMatches(value, re)
+			total += count
+		}
+		return v, total
+	case []interface{}:
+		total := 0
+		for i, value := range v {
+			var count int
+			v[i], count = maskMatches(value, re)
+			total += count
+		}
+		return v, total
+	default:
+		return data, 0
+	}
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/banzaicloud/log-socket/pkg/slice"
+)
+
+// FlowRegistry keeps track of listeners indexed by the flow they listen to
+// The index is replaced on every change (copy-on-write), so looking up listeners never blocks on registrations
+type FlowRegistry struct {
+	changes chan struct{}
+	count   int
+	index   atomic.Value // flowIndex
+	metrics RegistryMetrics
+	mutex   sync.Mutex
+}
+
+type flowIndex map[FlowReference][]Listener
+
+type RegistryMetrics interface {
+	CurrentListeners(cnt int)
+	FlowListeners(flow FlowReference, cnt int)
+	ListenerRemoved(l Listener)
+}
+
+func NewFlowRegistry(metrics RegistryMetrics) *FlowRegistry {
+	r := &FlowRegistry{
+		changes: make(chan struct{}, 1),
+		metrics: metrics,
+	}
+	r.index.Store(flowIndex{})
+	return r
+}
+
+// Changes returns a channel which receives a value whenever the set of listened flows has changed
+// Consecutive changes are coalesced, so receivers should always query the current state using Flows
+func (r *FlowRegistry) Changes() <-chan struct{} {
+	return r.changes
+}
+
+// Flows returns the flows that have at least one listener
+func (r *FlowRegistry) Flows() []FlowReference {
+	idx := r.load()
+	res := make([]FlowReference, 0, len(idx))
+	for flow := range idx {
+		res = append(res, flow)
+	}
+	return res
+}
+
+// Listeners returns the listeners of the specified flow, the returned slice must not be modified
+func (r *FlowRegistry) Listeners(flow FlowReference) []Listener {
+	return r.load()[flow]
+}
+
+func (r *FlowRegistry) Register(l Listener) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	old := r.load()
+	flow := l.Flow()
+	for _, item := range old[flow] {
+		if item == l {
+			return
+		}
+	}
+
+	idx := old.clone()
+	listeners := make([]Listener, 0, len(old[flow])+1)
+	idx[flow] = append(append(listeners, old[flow]...), l)
+	r.store(idx, r.count+1)
+	r.metrics.FlowListeners(flow, len(idx[flow]))
+
+	if len(old[flow]) == 0 {
+		r.notify()
+	}
+}
+
+func (r *FlowRegistry) Unregister(l Listener) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	old := r.load()
+	flow := l.Flow()
+	listeners := append([]Listener(nil), old[flow]...)
+	slice.RemoveFunc(&listeners, func(item Listener) bool {
+		return item == l
+	})
+	if len(listeners) == len(old[flow]) {
+		return
+	}
+
+	idx := old.clone()
+	if len(listeners) == 0 {
+		delete(idx, flow)
+	} else {
+		idx[flow] = listeners
+	}
+	r.store(idx, r.count-1)
+	r.metrics.ListenerRemoved(l)
+	r.metrics.FlowListeners(flow, len(listeners))
+
+	if len(listeners) == 0 {
+		r.notify()
+	}
+}
+
+func (r *FlowRegistry) load() flowIndex {
+	return r.index.Load().(flowIndex)
+}
+
+func (r *FlowRegistry) store(idx flowIndex, count int) {
+	r.index.Store(idx)
+	r.count = count
+	r.metrics.CurrentListeners(count)
+}
+
+func (r *FlowRegistry) notify() {
+	select {
+	case r.changes <- struct{}{}:
+	default:
+	}
+}
+
+func (idx flowIndex) clone() flowIndex {
+	res := make(flowIndex, len(idx))
+	for flow, listeners := range idx {
+		res[flow] = listeners
+	}
+	return res
+}
@@ -0,0 +1,346 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ReplayParamAfter = "after"
+	ReplayParamSince = "since"
+	ReplayParamTail  = "tail"
+	// ReplayParamLastSequence resumes the stream of a reconnecting listener after the last sequence number it received, either one for all flows or a comma separated list of <flow>=<sequence> pairs
+	// Unlike after, it makes the service send a gap control message for each flow whose records following that sequence number are not retained anymore
+	ReplayParamLastSequence = "lastSequence"
+	// LastSequenceHeader is the header counterpart of ReplayParamLastSequence, for the websocket clients that can set headers
+	LastSequenceHeader = "Last-Sequence"
+
+	DefaultReplayPruneInterval = time.Minute
+)
+
+// ReplayRequest describes the recent records a listener wants to receive before live records
+type ReplayRequest struct {
+	// Tail is the maximum number of records to replay
+	Tail int
+	// Since is the time after which replayed records were received
+	Since time.Time
+	// After is the sequence number after which records are replayed, clients resuming a stream set it to the last sequence number they received
+	After uint64
+	// Resume holds the last sequence numbers a reconnecting listener received by flow reference, that of the empty reference applying to all flows
+	Resume map[string]uint64
+}
+
+func (r ReplayRequest) Empty() bool {
+	return r.Tail == 0 && r.Since.IsZero() && r.After == 0 && len(r.Resume) == 0
+}
+
+// resumeFrom returns the last sequence number of the flow the listener received if it is resuming the flow
+func (r ReplayRequest) resumeFrom(flow FlowReference) (uint64, bool) {
+	if seq, ok := r.Resume[flow.URL()]; ok {
+		return seq, true
+	}
+	seq, ok := r.Resume[""]
+	return seq, ok
+}
+
+// ParseReplayRequest parses the tail (number of records), since (duration or RFC 3339 timestamp), after (sequence number) and lastSequence query parameters
+func ParseReplayRequest(query url.Values, now time.Time) (res ReplayRequest, err error) {
+	if after := query.Get(ReplayParamAfter); after != "" {
+		if res.After, err = strconv.ParseUint(after, 10, 64); err != nil {
+			return res, fmt.Errorf("invalid %s parameter %q", ReplayParamAfter, after)
+		}
+	}
+	if last := query.Get(ReplayParamLastSequence); last != "" {
+		if query.Get(ReplayParamAfter) != "" {
+			return res, fmt.Errorf("the %s and %s parameters cannot be combined", ReplayParamAfter, ReplayParamLastSequence)
+		}
+		if res.Resume, err = parseLastSequences(last); err != nil {
+			return res, err
+		}
+	}
+	if tail := query.Get(ReplayParamTail); tail != "" {
+		if res.Tail, err = strconv.Atoi(tail); err != nil || res.Tail < 0 {
+			return res, fmt.Errorf("invalid %s parameter %q", ReplayParamTail, tail)
+		}
+	}
+	if since := query.Get(ReplayParamSince); since != "" {
+		if d, perr := time.ParseDuration(since); perr == nil {
+			res.Since = now.Add(-d)
+		} else if res.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return res, fmt.Errorf("invalid %s parameter %q, expected a duration or an RFC 3339 timestamp", ReplayParamSince, since)
+		}
+	}
+	return
+}
+
+func parseLastSequences(value string) (map[string]uint64, error) {
+	res := make(map[string]uint64)
+	for _, item := range strings.Split(value, ",") {
+		ref, seq, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			ref, seq = "", ref
+		} else if _, err := ParseFlowReference(ref, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s parameter %q: %w", ReplayParamLastSequence, value, err)
+		}
+		n, err := strconv.ParseUint(seq, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s parameter %q", ReplayParamLastSequence, value)
+		}
+		res[ref] = n
+	}
+	return res, nil
+}
+
+// withLastSequenceHeader turns the LastSequenceHeader of a reconnecting listener into a lastSequence parameter, unless the request sets either replay parameter
+func withLastSequenceHeader(r *http.Request) *http.Request {
+	last := r.Header.Get(LastSequenceHeader)
+	query := r.URL.Query()
+	if last == "" || query.Get(ReplayParamAfter) != "" || query.Get(ReplayParamLastSequence) != "" {
+		return r
+	}
+	req := r.Clone(r.Context())
+	query.Set(ReplayParamLastSequence, last)
+	req.URL.RawQuery = query.Encode()
+	return req
+}
+
+// NewReplayBuffer returns a buffer that retains the last size records of each flow for at most maxAge (zero means no age limit)
+func NewReplayBuffer(size int, maxAge time.Duration) *ReplayBuffer {
+	return &ReplayBuffer{
+		flows:  make(map[FlowReference]*flowReplay),
+		maxAge: maxAge,
+		size:   size,
+	}
+}
+
+// ReplayBuffer keeps recent records of each flow so that new listeners can receive them before live records
+// It also assigns the per-flow sequence numbers listeners use to tell replayed and live records apart
+type ReplayBuffer struct {
+	// disk persists the retained records if not nil
+	disk   *replayDisk
+	flows  map[FlowReference]*flowReplay
+	maxAge time.Duration
+	mutex  sync.Mutex
+	size   int
+}
+
+type flowReplay struct {
+	lastSequence uint64
+	// lastPushed is when the last record of the flow was pushed
+	lastPushed time.Time
+	ring       []Record
+	start      int
+	count      int
+}
+
+// Push assigns the next sequence number of the record's flow to the record, stores it and returns it ready to be shared by listeners
+func (b *ReplayBuffer) Push(r Record) Record {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	f := b.flowReplay(r.Flow)
+	f.lastSequence++
+	f.lastPushed = time.Now()
+	r.Sequence = f.lastSequence
+	r = shareEncodings(r)
+
+	if b.size <= 0 {
+		return r
+	}
+	b.store(f, r)
+	if b.disk != nil {
+		b.disk.append(r)
+	}
+	return r
+}
+
+// Close releases the files of persisted records
+func (b *ReplayBuffer) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.disk != nil {
+		b.disk.close()
+	}
+}
+
+func (b *ReplayBuffer) flowReplay(flow FlowReference) *flowReplay {
+	f := b.flows[flow]
+	if f == nil {
+		f = &flowReplay{}
+		b.flows[flow] = f
+	}
+	return f
+}
+
+// store retains the record, evicting the oldest record of the flow if its ring is full
+func (b *ReplayBuffer) store(f *flowReplay, r Record) {
+	if f.ring == nil {
+		f.ring = make([]Record, b.size)
+	}
+	if f.count == len(f.ring) {
+		f.ring[f.start] = Record{}
+		f.start = (f.start + 1) % len(f.ring)
+		f.count--
+	}
+	f.ring[(f.start+f.count)%len(f.ring)] = r
+	f.count++
+	b.expire(f, time.Now())
+}
+
+// Records returns the flow's retained records selected by the request, oldest first
+func (b *ReplayBuffer) Records(flow FlowReference, req ReplayRequest) []Record {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	f := b.flows[flow]
+	if f == nil {
+		return nil
+	}
+	b.expire(f, time.Now())
+
+	first := 0
+	for first < f.count && (f.at(first).ReceivedAt.Before(req.Since) || f.at(first).Sequence <= req.After) {
+		first++
+	}
+	if n := f.count - first; req.Tail > 0 && n > req.Tail {
+		first += n - req.Tail
+	}
+
+	res := make([]Record, 0, f.count-first)
+	for i := first; i < f.count; i++ {
+		res = append(res, f.at(i))
+	}
+	return res
+}
+
+// LastSequence returns the sequence number of the flow's latest record
+func (b *ReplayBuffer) LastSequence(flow FlowReference) uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if f := b.flows[flow]; f != nil {
+		return f.lastSequence
+	}
+	return 0
+}
+
+// ResumeGap returns the number of records of the flow that followed the sequence number after and are not retained anymore
+// A listener resuming after a sequence number the flow has not reached yet, e.g. one received before the service restarted without persisted records, missed an unknown number of records, which is reported as reset
+func (b *ReplayBuffer) ResumeGap(flow FlowReference, after uint64) (missed uint64, reset bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	f := b.flows[flow]
+	if f == nil {
+		return 0, after > 0
+	}
+	if after > f.lastSequence {
+		return 0, true
+	}
+	b.expire(f, time.Now())
+	oldest := f.lastSequence + 1
+	if f.count > 0 {
+		oldest = f.at(0).Sequence
+	}
+	if oldest > after+1 {
+		return oldest - after - 1, false
+	}
+	return 0, false
+}
+
+// Shrink drops the older half of the retained records of each flow to relieve memory pressure, it returns the number of records dropped
+// Persisted records are kept, so they are restored on the next start
+func (b *ReplayBuffer) Shrink() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	dropped := 0
+	for _, f := range b.flows {
+		for n := (f.count + 1) / 2; n > 0; n-- {
+			f.ring[f.start] = Record{}
+			f.start = (f.start + 1) % len(f.ring)
+			f.count--
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// Prune forgets the flows without listeners that retain no records and had none pushed for the maximum age, so that flows that stopped receiving records do not accumulate
+// The sequence numbers of forgotten flows start over, listeners resuming them after a sequence number are notified of a gap
+// Flows whose records are persisted are only forgotten if records have an age limit, their persisted records having aged out too
+func (b *ReplayBuffer) Prune(listened func(FlowReference) bool) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	pruned := 0
+	for flow, f := range b.flows {
+		b.expire(f, now)
+		if f.count > 0 || now.Sub(f.lastPushed) <= b.maxAge || b.disk != nil && b.maxAge <= 0 || listened(flow) {
+			continue
+		}
+		if b.disk != nil {
+			b.disk.forget(flow)
+		}
+		delete(b.flows, flow)
+		pruned++
+	}
+	return pruned
+}
+
+// RunPruning prunes the buffer every interval until the stop signal, listened tells whether a flow has listeners
+func (b *ReplayBuffer) RunPruning(interval time.Duration, listened func(FlowReference) bool, stopSignal <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopSignal:
+			return
+		case <-ticker.C:
+			b.Prune(listened)
+		}
+	}
+}
+
+func (b *ReplayBuffer) expire(f *flowReplay, now time.Time) {
+	if b.maxAge <= 0 {
+		return
+	}
+	for f.count > 0 && now.Sub(f.at(0).ReceivedAt) > b.maxAge {
+		f.ring[f.start] = Record{}
+		f.start = (f.start + 1) % len(f.ring)
+		f.count--
+	}
+}
+
+func (f *flowReplay) at(i int) Record {
+	return f.ring[(f.start+i)%len(f.ring)]
+}
+
+// resumeGaps is implemented by histories reporting the records listeners resuming a flow missed
+type resumeGaps interface {
+	ResumeGap(flow FlowReference, after uint64) (missed uint64, reset bool)
+}
+
+// resumeGap returns the gap control message of a listener resuming the flow after the sequence number, if it missed records
+func resumeGap(history RecordHistory, flow FlowReference, after uint64) (ControlMessage, bool) {
+	gaps, ok := history.(resumeGaps)
+	if !ok {
+		return ControlMessage{}, false
+	}
+	missed, reset := gaps.ResumeGap(flow, after)
+	switch {
+	case reset:
+		return ControlMessage{Control: ControlGap, Flow: flow.URL(), Message: fmt.Sprintf("sequence number %d is unknown, records may have been missed since the service restarted", after)}, true
+	case missed > 0:
+		return ControlMessage{Control: ControlGap, Flow: flow.URL(), Records: missed, Message: fmt.Sprintf("%d records following sequence number %d are not retained anymore", missed, after)}, true
+	}
+	return ControlMessage{}, false
+}
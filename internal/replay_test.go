@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+func TestReplayBufferPrunesAgedOutFlows(t *testing.T) {
+	const maxAge = 20 * time.Millisecond
+	b := NewReplayBuffer(10, maxAge)
+	if err := b.Persist(t.TempDir(), 0, log.WithVerbosityFilter(log.NewWriterSink(io.Discard), 0)); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	idle, _ := ParseFlowReference("flow/default/idle", "")
+	listened, _ := ParseFlowReference("flow/default/listened", "")
+	selector := LabelSelector{Namespace: "default", Labels: map[string]string{"app": "checkout"}}.Flow()
+	for _, flow := range []FlowReference{idle, listened, selector} {
+		b.Push(Record{Flow: flow, RawData: []byte(`{"message":"hello"}`), ReceivedAt: time.Now()})
+	}
+	hasListeners := func(flow FlowReference) bool { return flow == listened }
+
+	if n := b.Prune(hasListeners); n != 0 {
+		t.Fatalf("%d flows retaining records were pruned", n)
+	}
+	time.Sleep(2 * maxAge)
+	if n := b.Prune(hasListeners); n != 2 {
+		t.Fatalf("%d flows were pruned instead of the idle and selector flows", n)
+	}
+	if len(b.flows) != 1 || b.LastSequence(listened) != 1 {
+		t.Fatal("the flow with listeners was pruned")
+	}
+	if _, err := os.Stat(b.disk.flowDir(idle)); !os.IsNotExist(err) {
+		t.Errorf("the persisted records of a pruned flow are kept: %v", err)
+	}
+	if missed, reset := b.ResumeGap(idle, 1); missed != 0 || !reset {
+		t.Error("resuming a pruned flow is not reported as a reset")
+	}
+	if r := b.Push(Record{Flow: idle, RawData: []byte(`{}`), ReceivedAt: time.Now()}); r.Sequence != 1 {
+		t.Errorf("the sequence numbers of a pruned flow continue at %d", r.Sequence)
+	}
+}
@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	DefaultReplayDiskMaxBytes = 64 << 20
+
+	replaySegmentSuffix = ".ndjson"
+	// replaySegmentsPerFlow is the number of segments the records of a flow are split into, the oldest being removed as a whole
+	replaySegmentsPerFlow = 4
+)
+
+// replayDisk persists the records of a replay buffer as segment files of newline-delimited JSON entries, one directory per flow
+type replayDisk struct {
+	dir      string
+	flows    map[FlowReference]*flowSegments
+	logs     log.Sink
+	maxAge   time.Duration
+	maxBytes int64
+}
+
+type flowSegments struct {
+	// segments are the paths of the flow's segment files, oldest first, the last one being appended to
+	segments []string
+	sizes    []int64
+	file     *os.File
+}
+
+type replayDiskEntry struct {
+	Sequence    uint64          `json:"sequence"`
+	ReceivedAt  time.Time       `json:"receivedAt"`
+	EventTime   time.Time       `json:"eventTime,omitempty"`
+	ClockSkewed bool            `json:"clockSkewed,omitempty"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// Persist stores the records of the buffer in dir, keeping at most maxBytes of records of each flow, and restores the records stored by a previous run
+// It has to be called before the buffer is used, the sequence numbers of restored flows continue where they left off
+func (b *ReplayBuffer) Persist(dir string, maxBytes int64, logs log.Sink) error {
+	if b.size <= 0 {
+		return errors.New("records cannot be persisted without a replay buffer")
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultReplayDiskMaxBytes
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	d := &replayDisk{
+		dir:      dir,
+		flows:    make(map[FlowReference]*flowSegments),
+		logs:     log.WithFields(logs, log.Fields{"task": "replay persistence"}),
+		maxAge:   b.maxAge,
+		maxBytes: maxBytes,
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		flow, err := ParseFlowReference(strings.ReplaceAll(e.Name(), "_", "/"), "")
+		if err != nil {
+			log.Event(d.logs, "ignoring unknown directory", log.V(1), log.Fields{"dir": e.Name()})
+			continue
+		}
+		if err := d.restore(b, flow); err != nil {
+			return fmt.Errorf("failed to restore records of %s: %w", flow.URL(), err)
+		}
+	}
+	b.disk = d
+	return nil
+}
+
+// restore loads the flow's segments, records older than the buffer's age limit are skipped
+func (d *replayDisk) restore(b *ReplayBuffer, flow FlowReference) error {
+	fs := &flowSegments{}
+	paths, err := filepath.Glob(filepath.Join(d.flowDir(flow), "*"+replaySegmentSuffix))
+	if err != nil {
+		return err
+	}
+	// segments are named after the sequence number of their first record, zero-padded
+	sort.Strings(paths)
+	now := time.Now()
+	restored := 0
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		fs.segments = append(fs.segments, p)
+		fs.sizes = append(fs.sizes, info.Size())
+		if err := d.readSegment(p, func(e replayDiskEntry) {
+			f := b.flowReplay(flow)
+			if e.Sequence > f.lastSequence {
+				f.lastSequence = e.Sequence
+			}
+			if e.ReceivedAt.After(f.lastPushed) {
+				f.lastPushed = e.ReceivedAt
+			}
+			if d.maxAge > 0 && now.Sub(e.ReceivedAt) > d.maxAge {
+				return
+			}
+			r := Record{RawData: e.Data, Flow: flow, ReceivedAt: e.ReceivedAt, EventTime: e.EventTime, ClockSkewed: e.ClockSkewed, Sequence: e.Sequence}
+			meta, err := ParseRecordMeta(r.RawData)
+			if err != nil {
+				return
+			}
+			r.Meta = meta
+			b.store(f, shareEncodings(r))
+			restored++
+		}); err != nil {
+			return err
+		}
+	}
+	d.flows[flow] = fs
+	log.Event(d.logs, "restored replay records", log.V(1), log.Fields{"flow": flow, "records": restored, "segments": len(fs.segments)})
+	return nil
+}
+
+func (d *replayDisk) readSegment(path string, fn func(replayDiskEntry)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var e replayDiskEntry
+		// the last entry might have been cut short by a crash
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Event(d.logs, "skipping corrupt replay entry", log.V(1), log.Error(err), log.Fields{"segment": path})
+			continue
+		}
+		fn(e)
+	}
+	return scanner.Err()
+}
+
+func (d *replayDisk) flowDir(flow FlowReference) string {
+	return filepath.Join(d.dir, strings.ReplaceAll(flow.URL(), "/", "_"))
+}
+
+// append writes the record to the current segment of its flow, starting a new segment and removing the oldest ones when the flow's segments grow too large
+func (d *replayDisk) append(r Record) {
+	line, err := json.Marshal(replayDiskEntry{Sequence: r.Sequence, ReceivedAt: r.ReceivedAt, EventTime: r.EventTime, ClockSkewed: r.ClockSkewed, Data: r.RawData})
+	if err != nil {
+		log.Event(d.logs, "failed to marshal replay entry", log.Error(err))
+		return
+	}
+	line = append(line, '\n')
+
+	fs := d.flows[r.Flow]
+	if fs == nil {
+		fs = &flowSegments{}
+		d.flows[r.Flow] = fs
+	}
+	last := len(fs.segments) - 1
+	if fs.file == nil || fs.sizes[last] >= d.maxBytes/replaySegmentsPerFlow {
+		if err := d.roll(r.Flow, fs, r.Sequence); err != nil {
+			log.Event(d.logs, "failed to start replay segment", log.Error(err), log.Fields{"flow": r.Flow})
+			return
+		}
+		last = len(fs.segments) - 1
+	}
+	n, err := fs.file.Write(line)
+	fs.sizes[last] += int64(n)
+	if err != nil {
+		log.Event(d.logs, "failed to write replay entry", log.Error(err), log.Fields{"flow": r.Flow})
+	}
+}
+
+// forget removes the segments of the flow, so that it starts with new sequence numbers
+func (d *replayDisk) forget(flow FlowReference) {
+	if fs := d.flows[flow]; fs != nil && fs.file != nil {
+		fs.file.Close()
+	}
+	delete(d.flows, flow)
+	if err := os.RemoveAll(d.flowDir(flow)); err != nil {
+		log.Event(d.logs, "failed to remove replay segments", log.Error(err), log.Fields{"flow": flow})
+	}
+}
+
+// roll starts a new segment for the flow and removes the segments exceeding the size limit
+func (d *replayDisk) roll(flow FlowReference, fs *flowSegments, seq uint64) error {
+	if fs.file != nil {
+		fs.file.Close()
+		fs.file = nil
+	}
+	dir := d.flowDir(flow)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%020d%s", seq, replaySegmentSuffix))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	fs.file = file
+	fs.segments = append(fs.segments, path)
+	fs.sizes = append(fs.sizes, 0)
+
+	var total int64
+	for _, size := range fs.sizes {
+		total += size
+	}
+	for len(fs.segments) > 1 && (total > d.maxBytes || d.expired(fs.segments[0])) {
+		if err := os.Remove(fs.segments[0]); err != nil && !os.IsNotExist(err) {
+			log.Event(d.logs, "failed to remove replay segment", log.Error(err), log.Fields{"segment": fs.segments[0]})
+		}
+		total -= fs.sizes[0]
+		fs.segments, fs.sizes = fs.segments[1:], fs.sizes[1:]
+	}
+	return nil
+}
+
+// expired reports whether the segment was last written before the buffer's age limit
+func (d *replayDisk) expired(path string) bool {
+	if d.maxAge <= 0 {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && time.Since(info.ModTime()) > d.maxAge
+}
+
+func (d *replayDisk) close() {
+	for _, fs := range d.flows {
+		if fs.file != nil {
+			fs.file.Close()
+			fs.file = nil
+		}
+	}
+}
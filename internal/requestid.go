@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	// RequestIDHeader carries the ID correlating the log events and audit events of an ingest request or listener connection, it is echoed in responses
+	RequestIDHeader = "X-Request-ID"
+
+	maxRequestIDLength = 128
+)
+
+// requestID returns the ID of the request, which is that of its RequestIDHeader if it is valid or a random one otherwise
+// The ID is set on the request, so that it is forwarded along with the request, and on the response
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		id = newListenerID()
+		r.Header.Set(RequestIDHeader, id)
+	}
+	w.Header().Set(RequestIDHeader, id)
+	return id
+}
+
+// validRequestID reports whether the ID is short and made of printable ASCII characters, so that it can be logged as it is
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID adds the request ID to the fields of log events
+func withRequestID(logs log.Sink, id string) log.Sink {
+	return log.WithFields(logs, log.Fields{"requestID": id})
+}
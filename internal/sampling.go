@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// BackpressureSample keeps delivering a growing fraction of the records of listeners whose buffer overflows, records of error levels are always delivered
+	BackpressureSample BackpressurePolicy = "sample"
+
+	// samplingAdjustInterval is the minimum time between changes of the sampling rate, so that it follows persistent rather than momentary congestion
+	samplingAdjustInterval = time.Second
+	maxSamplingRate        = 1024
+
+	// SampleParam requests a sample of the records, either a probability of delivering each record (e.g. 0.1) or one in N records (e.g. 1/10)
+	SampleParam = "sample"
+)
+
+// SubscriptionSampling is the sampling of its records requested by a listener, records of error levels are always delivered
+type SubscriptionSampling struct {
+	// Probability is the probability of delivering each record, if set
+	Probability float64
+	// Every delivers one in Every records, if set
+	Every uint64
+}
+
+// ParseSubscriptionSampling parses the sample query parameter
+func ParseSubscriptionSampling(query url.Values) (res SubscriptionSampling, err error) {
+	spec := query.Get(SampleParam)
+	if spec == "" {
+		return res, nil
+	}
+	if one, every, ok := strings.Cut(spec, "/"); ok {
+		if res.Every, err = strconv.ParseUint(every, 10, 64); one != "1" || err != nil || res.Every == 0 {
+			return res, fmt.Errorf("invalid %s parameter %q, expected a probability or 1/N", SampleParam, spec)
+		}
+		return res, nil
+	}
+	if res.Probability, err = strconv.ParseFloat(spec, 64); err != nil || res.Probability <= 0 || res.Probability > 1 {
+		return res, fmt.Errorf("invalid %s parameter %q, the probability has to be in (0, 1]", SampleParam, spec)
+	}
+	return res, nil
+}
+
+// Enabled reports whether some records are left out
+func (s SubscriptionSampling) Enabled() bool {
+	return s.Every > 1 || s.Probability > 0 && s.Probability < 1
+}
+
+// notification returns the message telling the listener that its stream is sampled
+func (s SubscriptionSampling) notification() ControlMessage {
+	if s.Every > 1 {
+		return ControlMessage{Control: ControlSampled, Message: fmt.Sprintf("one in %d records is delivered apart from errors, as requested", s.Every), SampleRate: s.Every}
+	}
+	return ControlMessage{Control: ControlSampled, Message: fmt.Sprintf("records are delivered with probability %g apart from errors, as requested", s.Probability), Probability: s.Probability}
+}
+
+// subscriptionSampler applies the sampling requested by a listener
+type subscriptionSampler struct {
+	mutex    sync.Mutex
+	count    uint64
+	random   *rand.Rand
+	sampling SubscriptionSampling
+}
+
+func newSubscriptionSampler(sampling SubscriptionSampling) *subscriptionSampler {
+	return &subscriptionSampler{
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		sampling: sampling,
+	}
+}
+
+// keep reports whether the record is part of the sample
+func (s *subscriptionSampler) keep(r Record) bool {
+	if isErrorLevel(r.Meta.Level) {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.sampling.Every > 1 {
+		s.count++
+		return s.count%s.sampling.Every == 1
+	}
+	return s.random.Float64() < s.sampling.Probability
+}
+
+// adaptiveSampler keeps one in rate records of a slow listener, doubling rate while its buffer keeps overflowing and halving it once the listener has caught up
+type adaptiveSampler struct {
+	mutex sync.Mutex
+	// rate is 1 while every record is delivered
+	rate  uint64
+	count uint64
+	// changedAt is the time rate was last changed
+	changedAt time.Time
+	// skipped counts the records skipped since sampling started
+	skipped uint64
+}
+
+func newAdaptiveSampler() *adaptiveSampler {
+	return &adaptiveSampler{rate: 1}
+}
+
+// keep reports whether the record is delivered at the current rate
+func (s *adaptiveSampler) keep(r Record) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.rate == 1 || isErrorLevel(r.Meta.Level) {
+		return true
+	}
+	s.count++
+	if s.count%s.rate == 0 {
+		return true
+	}
+	s.skipped++
+	return false
+}
+
+// overflowed doubles the rate if it has not been changed recently, it returns the new rate or zero if it was not changed
+func (s *adaptiveSampler) overflowed(now time.Time) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.rate >= maxSamplingRate || now.Sub(s.changedAt) < samplingAdjustInterval {
+		return 0
+	}
+	s.rate *= 2
+	s.changedAt = now
+	return s.rate
+}
+
+// caughtUp halves the rate if it has not been changed recently, it returns the new rate and the number of records skipped while sampling once full delivery is restored, or a zero rate if it was not changed
+func (s *adaptiveSampler) caughtUp(now time.Time) (rate uint64, skipped uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.rate == 1 || now.Sub(s.changedAt) < samplingAdjustInterval {
+		return 0, 0
+	}
+	s.rate /= 2
+	s.changedAt = now
+	if s.rate == 1 {
+		skipped, s.skipped = s.skipped, 0
+	}
+	return s.rate, skipped
+}
+
+// isErrorLevel reports whether the level is that of errors or worse, including syslog severities
+func isErrorLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case "error", "err", "fatal", "panic", "critical", "crit", "alert", "emerg", "emergency":
+		return true
+	}
+	return false
+}
+
+// sample adapts the sampling rate of the listener to how far its buffer is filled, notifying it of changes
+func (l *listener) sample(now time.Time) {
+	if len(l.queue) > cap(l.queue)/4 {
+		return
+	}
+	rate, skipped := l.sampler.caughtUp(now)
+	switch {
+	case rate == 1:
+		l.sendControl(ControlMessage{Control: ControlSamplingEnded, Message: "all records are delivered again", Records: skipped})
+	case rate > 1:
+		l.sendControl(ControlMessage{Control: ControlSampling, Message: "the listener is catching up, more records are delivered", SampleRate: rate})
+	}
+}
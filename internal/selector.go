@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strconv"
+
+	loggingv1beta1 "github.com/banzaicloud/logging-operator/pkg/sdk/logging/api/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// SelectEndpoint streams the records of the pods matching a label selector, e.g. /select?namespace=prod&labels=app%3Dcheckout
+	SelectEndpoint = "/select"
+
+	SelectParamLabels = "labels"
+
+	// SelectorFlowPrefix is the name prefix of the cluster flows generated for label selectors
+	SelectorFlowPrefix = "log-socket-select-"
+)
+
+// LabelSelector selects the records of the pods in a namespace having all of the labels
+type LabelSelector struct {
+	Namespace string
+	Labels    map[string]string
+}
+
+// ParseLabelSelector parses the selector of a connection request to SelectEndpoint from the namespace and labels query parameters
+func ParseLabelSelector(query url.Values) (res LabelSelector, err error) {
+	res.Namespace = query.Get(FilterParamNamespace)
+	if res.Namespace == "" {
+		return res, errors.New("the namespace parameter is required for label selectors")
+	}
+	if errs := validation.IsDNS1123Label(res.Namespace); len(errs) > 0 {
+		return res, fmt.Errorf("invalid namespace %q: %s", res.Namespace, errs[0])
+	}
+	if query.Get(SelectParamLabels) == "" {
+		return res, errors.New("the labels parameter is required for label selectors")
+	}
+	selected, err := labels.ConvertSelectorToLabelsMap(query.Get(SelectParamLabels))
+	if err != nil {
+		return res, fmt.Errorf("invalid labels: %w", err)
+	}
+	res.Labels = selected
+	return
+}
+
+// Flow returns the reference listeners of the selector subscribe to, the name of which identifies the selector
+func (s LabelSelector) Flow() FlowReference {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s.Namespace))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(labels.Set(s.Labels).String()))
+	return FlowReference{
+		NamespacedName: types.NamespacedName{Namespace: s.Namespace, Name: SelectorFlowPrefix + strconv.FormatUint(h.Sum64(), 16)},
+		Kind:           FKSelector,
+	}
+}
+
+// Matches reports whether the record was produced by a pod the selector selects
+func (s LabelSelector) Matches(r Record) bool {
+	if r.Meta.Namespace != s.Namespace {
+		return false
+	}
+	for k, v := range s.Labels {
+		if value, ok := r.Meta.Labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSelectors rejects the selector flows other than the one of the connection's label selector, records of which would not be restricted to the selected pods
+func checkSelectors(selector *LabelSelector, flows ...FlowReference) error {
+	for _, flow := range flows {
+		if flow.Kind == FKSelector && (selector == nil || flow != selector.Flow()) {
+			return fmt.Errorf("cannot subscribe to %s, label selectors are listened to by connecting to %s", flow.URL(), SelectEndpoint)
+		}
+	}
+	return nil
+}
+
+// SelectorClusterFlow returns the reference of the cluster flow generated for the selector flow
+func SelectorClusterFlow(flow FlowReference, controlNamespace string) FlowReference {
+	return FlowReference{
+		NamespacedName: types.NamespacedName{Namespace: controlNamespace, Name: flow.Name},
+		Kind:           FKClusterFlow,
+	}
+}
+
+// SelectorFlows provides the flows selecting the records of label selectors
+type SelectorFlows interface {
+	// EnsureSelectorFlow makes sure the records of the selector are routed to the listeners of its flow
+	EnsureSelectorFlow(ctx context.Context, sel LabelSelector) error
+}
+
+// KubernetesSelectorFlows generates a cluster flow in the control namespace for each label selector
+// The reconciler taps the cluster flow like any other, and deletes it along with its output once the selector has no listeners
+type KubernetesSelectorFlows struct {
+	Client           client.Client
+	ControlNamespace string
+}
+
+func (f KubernetesSelectorFlows) EnsureSelectorFlow(ctx context.Context, sel LabelSelector) error {
+	ref := SelectorClusterFlow(sel.Flow(), f.ControlNamespace)
+	flow := loggingv1beta1.ClusterFlow{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: ref.Namespace,
+			Name:      ref.Name,
+			Labels:    DefLabel,
+		},
+		Spec: loggingv1beta1.ClusterFlowSpec{
+			Match: []loggingv1beta1.ClusterMatch{{
+				ClusterSelect: &loggingv1beta1.ClusterSelect{
+					Namespaces: []string{sel.Namespace},
+					Labels:     sel.Labels,
+				},
+			}},
+		},
+	}
+	if err := f.Client.Create(ctx, &flow); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
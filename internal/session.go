@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	// DurationParam requests a session shorter than the default, e.g. ?duration=30m, after which the connection is closed with CloseSessionExpired
+	DurationParam = "duration"
+)
+
+// DefaultSessionExpiryWarnings are how long before their session expires listeners are warned with ControlSessionExpiring messages
+var DefaultSessionExpiryWarnings = []time.Duration{5 * time.Minute, time.Minute}
+
+// parseSessionDuration returns the duration of the session requested by the duration query parameter, zero means unlimited
+// Sessions last for the default duration unless requested otherwise, and never longer than the maximum
+func parseSessionDuration(query url.Values, opts ListenerOptions) (time.Duration, error) {
+	max := opts.MaxSessionDuration
+	requested := query.Get(DurationParam)
+	if requested == "" {
+		if d := opts.SessionDuration; d > 0 && (max <= 0 || d < max) {
+			return d, nil
+		}
+		return max, nil
+	}
+	d, err := time.ParseDuration(requested)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s parameter %q", DurationParam, requested)
+	}
+	if max > 0 && d > max {
+		return 0, fmt.Errorf("sessions cannot last longer than %s", max)
+	}
+	return d, nil
+}
+
+// sessionLoop warns the listener before its session expires and closes its connection once it has
+func (l *listener) sessionLoop(warnings []time.Duration) {
+	warnings = append([]time.Duration(nil), warnings...)
+	sort.Slice(warnings, func(i, j int) bool { return warnings[i] > warnings[j] })
+	for _, warning := range warnings {
+		at := l.expiresAt.Add(-warning)
+		if warning <= 0 || !at.After(l.connectedAt) {
+			continue
+		}
+		if !l.sleepUntil(at) {
+			return
+		}
+		expiresAt := l.expiresAt
+		l.sendControl(ControlMessage{
+			Control:   ControlSessionExpiring,
+			Message:   fmt.Sprintf("session expires in %s, reconnect to renew it", warning),
+			ExpiresAt: &expiresAt,
+		})
+	}
+	if !l.sleepUntil(l.expiresAt) {
+		return
+	}
+	log.Event(l.logs, "listener session expired, disconnecting", log.V(1), log.Fields{"listener": l, "expiresAt": l.expiresAt})
+	l.closeWith(CloseSessionExpired, "session expired")
+}
+
+// sleepUntil returns false if the listener is disconnected before the time
+func (l *listener) sleepUntil(t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-l.done.Chan():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
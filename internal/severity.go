@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FilterParamMinLevel selects the records of at least the severity, e.g. warn, whatever the format of their level
+const FilterParamMinLevel = "minLevel"
+
+// Severity is the normalized level of a record, severities compare in order of importance
+type Severity uint8
+
+const (
+	// SeverityUnknown is the severity of records without a recognized level
+	SeverityUnknown Severity = iota
+	SeverityTrace
+	SeverityDebug
+	SeverityInfo
+	SeverityWarn
+	SeverityError
+	SeverityFatal
+)
+
+var severityNames = []string{"", "trace", "debug", "info", "warn", "error", "fatal"}
+
+// severityAliases are the level names in use by logging libraries and syslog, matched case-insensitively
+var severityAliases = map[string]Severity{
+	"trace": SeverityTrace, "trc": SeverityTrace, "finest": SeverityTrace,
+	"debug": SeverityDebug, "dbg": SeverityDebug, "fine": SeverityDebug, "d": SeverityDebug,
+	"info": SeverityInfo, "information": SeverityInfo, "informational": SeverityInfo, "inf": SeverityInfo, "notice": SeverityInfo, "i": SeverityInfo,
+	"warn": SeverityWarn, "warning": SeverityWarn, "wrn": SeverityWarn, "w": SeverityWarn,
+	"error": SeverityError, "err": SeverityError, "severe": SeverityError, "e": SeverityError,
+	"fatal": SeverityFatal, "critical": SeverityFatal, "crit": SeverityFatal, "alert": SeverityFatal, "emerg": SeverityFatal, "emergency": SeverityFatal, "panic": SeverityFatal, "f": SeverityFatal,
+}
+
+func (s Severity) String() string {
+	if int(s) < len(severityNames) {
+		return severityNames[s]
+	}
+	return ""
+}
+
+// ParseSeverity parses a level name (e.g. WARNING), a syslog severity number (0 to 7) or a bunyan/pino level number (10 to 60)
+// It returns SeverityUnknown if the level is not recognized
+func ParseSeverity(level string) Severity {
+	level = strings.TrimSpace(level)
+	if s, ok := severityAliases[strings.ToLower(level)]; ok {
+		return s
+	}
+	n, err := strconv.Atoi(level)
+	switch {
+	case err != nil || n < 0:
+		return SeverityUnknown
+	case n < len(syslogSeverities):
+		return syslogSeverity(n)
+	case n >= 10 && n < 70:
+		return Severity(n / 10)
+	}
+	return SeverityUnknown
+}
+
+// syslogSeverity normalizes a syslog severity number
+func syslogSeverity(n int) Severity {
+	switch {
+	case n <= 2:
+		return SeverityFatal
+	case n == 3:
+		return SeverityError
+	case n == 4:
+		return SeverityWarn
+	case n <= 6:
+		return SeverityInfo
+	default:
+		return SeverityDebug
+	}
+}
+
+// ParseMinSeverity parses the minLevel query parameter
+func ParseMinSeverity(level string) (Severity, error) {
+	if level == "" {
+		return SeverityUnknown, nil
+	}
+	s := ParseSeverity(level)
+	if s == SeverityUnknown {
+		return s, fmt.Errorf("invalid %s parameter %q, expected one of %s", FilterParamMinLevel, level, strings.Join(severityNames[1:], ", "))
+	}
+	return s, nil
+}
+
+// deriveSeverity normalizes the level of a record from its level or severity field, or the severity part of its syslog PRI
+func deriveSeverity(level string, severity json.RawMessage, pri json.RawMessage) Severity {
+	if s := ParseSeverity(level); s != SeverityUnknown {
+		return s
+	}
+	if s := ParseSeverity(jsonText(severity)); s != SeverityUnknown {
+		return s
+	}
+	// the PRI is the facility times 8 plus the severity
+	if n, err := strconv.Atoi(jsonText(pri)); err == nil && n >= 0 {
+		return syslogSeverity(n % 8)
+	}
+	return SeverityUnknown
+}
+
+// jsonText returns a JSON string or the text of another JSON value, or an empty string if it is null or missing
+func jsonText(data json.RawMessage) string {
+	if len(data) == 0 || string(data) == "null" {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		return s
+	}
+	return string(data)
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// ShardProxiedHeader marks listener requests proxied by another replica, which are served regardless of flow ownership to avoid proxy loops
+const ShardProxiedHeader = "X-Log-Socket-Shard-Proxied"
+
+// ShardRouter tells which replica serves the listeners of a flow in sharding mode
+type ShardRouter interface {
+	// Owner returns the listener address of the replica owning the flow and whether it is this replica
+	Owner(flow FlowReference) (addr string, local bool)
+}
+
+var errShardMixedOwners = errors.New("the requested flows are served by different replicas, open a connection for each of them")
+
+// shardOwner returns the address of the replica serving all the flows, or an empty address if it is this replica
+func shardOwner(router ShardRouter, flows []FlowReference) (string, error) {
+	var owner string
+	for i, flow := range flows {
+		addr, local := router.Owner(flow)
+		if local {
+			addr = ""
+		}
+		if i > 0 && addr != owner {
+			return "", errShardMixedOwners
+		}
+		owner = addr
+	}
+	return owner, nil
+}
+
+// newShardProxy returns a reverse proxy forwarding listener requests, websocket upgrades included, to the replicas owning their flows
+func newShardProxy(replica string, tlsConfig *tls.Config, logs log.Sink) *httputil.ReverseProxy {
+	scheme := "http"
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		scheme = "https"
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = scheme
+			r.URL.Host = r.Host
+			r.Header.Set(ShardProxiedHeader, replica)
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Event(logs, "failed to proxy listener to the replica owning its flows", log.Error(err), log.Fields{"replica": r.URL.Host})
+			http.Error(w, fmt.Sprintf("failed to reach the replica serving the flows: %s", err), http.StatusBadGateway)
+		},
+	}
+}
+
+// proxyToShard forwards the request to the replica at addr
+func proxyToShard(proxy *httputil.ReverseProxy, w http.ResponseWriter, r *http.Request, addr string) {
+	req := r.Clone(r.Context())
+	req.URL = &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+	req.Host = addr
+	req.RequestURI = ""
+	// the origin has been checked by this replica, and would not match the address of the other one
+	req.Header.Del("Origin")
+	proxy.ServeHTTP(w, req)
+}
+
+// CloseMovedListeners closes the connections of listeners subscribed to flows no longer owned by this replica, so that they reconnect to their new owner
+func CloseMovedListeners(registry *FlowRegistry, router ShardRouter) {
+	for _, flow := range registry.Flows() {
+		if _, local := router.Owner(flow); local {
+			continue
+		}
+		for _, l := range registry.Listeners(flow) {
+			if s, ok := l.(subscription); ok {
+				s.closeWith(CloseMoved, fmt.Sprintf("%s is now served by another replica", flow.URL()))
+			}
+		}
+	}
+}
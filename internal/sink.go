@@ -0,0 +1,312 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// Sink persists the records of a flow, it is registered in the listener registry like a listener that never disconnects
+type Sink interface {
+	Listener
+	Close() error
+}
+
+// SinkOptions holds the settings common to all sinks
+type SinkOptions struct {
+	// MaxSize is the number of bytes after which a file is rotated or an object is uploaded
+	MaxSize int
+	// MaxAge is the time after which a file is rotated or an object is uploaded, regardless of its size
+	MaxAge time.Duration
+}
+
+const (
+	DefaultSinkMaxSize = 64 << 20
+	DefaultSinkMaxAge  = time.Hour
+)
+
+func (o SinkOptions) maxSize() int {
+	if o.MaxSize <= 0 {
+		return DefaultSinkMaxSize
+	}
+	return o.MaxSize
+}
+
+func (o SinkOptions) maxAge() time.Duration {
+	if o.MaxAge <= 0 {
+		return DefaultSinkMaxAge
+	}
+	return o.MaxAge
+}
+
+// sinkUser is the user sinks are reported as in metrics
+var sinkUser = authv1.UserInfo{Username: "system:log-socket:sink"}
+
+// NewSink creates a sink of the flow from a URL, supported schemes are file (e.g. file:///var/log/flow.log), s3 (e.g. s3://bucket/prefix), loki (e.g. loki://loki-gateway:3100), elasticsearch or opensearch (e.g. elasticsearch://elasticsearch:9200) and webhook (e.g. webhook+https://bot.example.com/logs)
+func NewSink(flow FlowReference, rawURL string, opts SinkOptions, s3 S3Options, logs log.Sink) (Sink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	logs = log.WithFields(logs, log.Fields{"task": "sink", "flow": flow, "sink": redactSinkURL(u)})
+	switch u.Scheme {
+	case "file":
+		return NewFileSink(flow, u.Path, opts, logs)
+	case "s3":
+		client, err := NewS3Client(s3)
+		if err != nil {
+			return nil, err
+		}
+		return NewObjectStorageSink(flow, client, u.Host, strings.TrimPrefix(u.Path, "/"), opts, logs), nil
+	case "loki", "loki+https":
+		return NewLokiSink(flow, u, logs)
+	case "elasticsearch", "elasticsearch+https", "opensearch", "opensearch+https":
+		return NewElasticsearchSink(flow, u, logs)
+	case "webhook", "webhook+https":
+		return NewWebhookSink(flow, u, logs)
+	default:
+		return nil, fmt.Errorf("unsupported sink scheme %q", u.Scheme)
+	}
+}
+
+// sinkSecretParams are the query parameters of sink URLs holding credentials
+var sinkSecretParams = []string{"apiKey"}
+
+// redactSinkURL returns the URL with its password and credentials in its query replaced, so that it can be logged
+func redactSinkURL(u *url.URL) string {
+	res := *u
+	query := res.Query()
+	for _, name := range sinkSecretParams {
+		if query.Get(name) != "" {
+			query.Set(name, "xxxxx")
+			res.RawQuery = query.Encode()
+		}
+	}
+	return res.Redacted()
+}
+
+// ParseSinkSpec parses sink specifications in flowref=url form
+func ParseSinkSpec(spec string, controlNamespace string) (FlowReference, string, error) {
+	ref, rawURL, ok := strings.Cut(spec, "=")
+	if !ok {
+		return FlowReference{}, "", fmt.Errorf("sink %q is not in flowref=url form", spec)
+	}
+	flow, err := ParseFlowReference(ref, controlNamespace)
+	return flow, rawURL, err
+}
+
+// rotatingSink implements the parts shared by sinks that collect records into chunks that are completed by size or age
+type rotatingSink struct {
+	done    chan struct{}
+	flow    FlowReference
+	logs    log.Sink
+	mutex   sync.Mutex
+	opts    SinkOptions
+	rotate  func() error // called with mutex held
+	started time.Time
+	wg      sync.WaitGroup
+	write   func(data []byte) (int, error) // called with mutex held
+	written int
+}
+
+func (s *rotatingSink) start() {
+	s.done = make(chan struct{})
+	s.started = time.Now()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.opts.maxAge() / 10)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			s.mutex.Lock()
+			if s.written > 0 && time.Since(s.started) >= s.opts.maxAge() {
+				s.doRotate()
+			}
+			s.mutex.Unlock()
+		}
+	}()
+}
+
+func (s *rotatingSink) Flow() FlowReference {
+	return s.flow
+}
+
+func (s *rotatingSink) User() authv1.UserInfo {
+	return sinkUser
+}
+
+func (s *rotatingSink) Send(r Record) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n, err := s.write(append(r.RawData[:len(r.RawData):len(r.RawData)], '\n'))
+	s.written += n
+	if err != nil {
+		log.Event(s.logs, "an error occurred while writing record to sink", log.Error(err))
+	}
+	if s.written >= s.opts.maxSize() {
+		s.doRotate()
+	}
+}
+
+func (s *rotatingSink) doRotate() {
+	if err := s.rotate(); err != nil {
+		log.Event(s.logs, "an error occurred while rotating sink", log.Error(err))
+	}
+	s.written = 0
+	s.started = time.Now()
+}
+
+func (s *rotatingSink) stop() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+// NewFileSink returns a sink that appends records to a local file as newline delimited JSON
+// Full files are renamed by appending the time of rotation to their name
+func NewFileSink(flow FlowReference, filePath string, opts SinkOptions, logs log.Sink) (*FileSink, error) {
+	s := &FileSink{
+		path: filePath,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	s.rotatingSink = rotatingSink{
+		flow:   flow,
+		logs:   logs,
+		opts:   opts,
+		rotate: s.rotateFile,
+		write:  s.writer.Write,
+	}
+	s.start()
+	return s, nil
+}
+
+type FileSink struct {
+	rotatingSink
+	file   *os.File
+	path   string
+	writer *bufio.Writer
+}
+
+func (s *FileSink) open() (err error) {
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	if s.writer == nil {
+		s.writer = bufio.NewWriter(s.file)
+	} else {
+		s.writer.Reset(s.file)
+	}
+	return
+}
+
+func (s *FileSink) rotateFile() error {
+	if err := s.closeFile(); err != nil {
+		return err
+	}
+	if err := os.Rename(s.path, s.path+"."+time.Now().UTC().Format("20060102T150405Z")); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileSink) closeFile() error {
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
+
+func (s *FileSink) Close() error {
+	s.stop()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closeFile()
+}
+
+// NewObjectStorageSink returns a sink that uploads chunks of newline delimited JSON records to an S3 compatible bucket
+// Objects are named <prefix>/<kind>/<namespace>/<name>/<start of chunk>.ndjson
+func NewObjectStorageSink(flow FlowReference, client *S3Client, bucket string, prefix string, opts SinkOptions, logs log.Sink) *ObjectStorageSink {
+	s := &ObjectStorageSink{
+		bucket:  bucket,
+		client:  client,
+		prefix:  prefix,
+		uploads: make(chan objectUpload, 4),
+	}
+	s.rotatingSink = rotatingSink{
+		flow:   flow,
+		logs:   logs,
+		opts:   opts,
+		rotate: s.upload,
+		write:  s.buf.Write,
+	}
+	s.uploaderDone.Add(1)
+	go s.uploader()
+	s.start()
+	return s
+}
+
+type ObjectStorageSink struct {
+	rotatingSink
+	buf          bytes.Buffer
+	bucket       string
+	client       *S3Client
+	prefix       string
+	uploaderDone sync.WaitGroup
+	uploads      chan objectUpload
+}
+
+type objectUpload struct {
+	data []byte
+	key  string
+}
+
+func (s *ObjectStorageSink) upload() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	key := path.Join(s.prefix, string(s.flow.Kind), s.flow.Namespace, s.flow.Name, s.started.UTC().Format("20060102T150405.000000000Z")+".ndjson")
+	data := append([]byte(nil), s.buf.Bytes()...)
+	s.buf.Reset()
+	// uploads happen in the background, but records are held back from the fan-out while the upload queue is full
+	s.uploads <- objectUpload{data: data, key: key}
+	return nil
+}
+
+func (s *ObjectStorageSink) uploader() {
+	defer s.uploaderDone.Done()
+	for u := range s.uploads {
+		if err := s.client.PutObject(s.bucket, u.key, u.data); err != nil {
+			log.Event(s.logs, "an error occurred while uploading records", log.Error(err), log.Fields{"bucket": s.bucket, "key": u.key})
+			continue
+		}
+		log.Event(s.logs, "uploaded records", log.V(1), log.Fields{"bucket": s.bucket, "key": u.key, "size": len(u.data)})
+	}
+}
+
+func (s *ObjectStorageSink) Close() error {
+	s.stop()
+	s.mutex.Lock()
+	err := s.upload()
+	s.mutex.Unlock()
+	close(s.uploads)
+	s.uploaderDone.Wait()
+	return err
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	DefaultMaxRecordSize      = 1 << 20
+	DefaultMaxIngestBodySize  = 64 << 20
+	recordTruncatedMarkerSize = len(" [truncated 0000000000 bytes]")
+)
+
+// RecordSizePolicy determines what happens to records larger than the maximum record size
+type RecordSizePolicy string
+
+const (
+	// RecordSizeTruncate shortens the message of oversized records, marking it as truncated
+	RecordSizeTruncate RecordSizePolicy = "truncate"
+	// RecordSizeDrop discards oversized records
+	RecordSizeDrop RecordSizePolicy = "drop"
+)
+
+func ParseRecordSizePolicy(s string) (RecordSizePolicy, error) {
+	switch p := RecordSizePolicy(s); p {
+	case RecordSizeTruncate, RecordSizeDrop:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid record size policy %q", s)
+	}
+}
+
+type RecordSizeMetrics interface {
+	LogRecordOversized(r Record, policy RecordSizePolicy)
+}
+
+// LimitRecordSize returns a sink applying the policy to records larger than maxSize bytes before pushing them to records
+// Records that cannot be truncated enough, e.g. because their size is not due to their message, are dropped
+func LimitRecordSize(records RecordSink, maxSize int, policy RecordSizePolicy, logs log.Sink, metrics RecordSizeMetrics) RecordSink {
+	return recordSizeLimiter{
+		logs:    logs,
+		maxSize: maxSize,
+		metrics: metrics,
+		policy:  policy,
+		records: records,
+	}
+}
+
+type recordSizeLimiter struct {
+	logs    log.Sink
+	maxSize int
+	metrics RecordSizeMetrics
+	policy  RecordSizePolicy
+	records RecordSink
+}
+
+func (l recordSizeLimiter) Push(r Record) {
+	if len(r.RawData) <= l.maxSize {
+		l.records.Push(r)
+		return
+	}
+	if l.policy == RecordSizeTruncate {
+		if truncated, ok := truncateRecord(r, l.maxSize); ok {
+			log.Event(l.logs, "truncated oversized record", log.V(1), log.Fields{"flow": r.Flow, "size": len(r.RawData), "maxSize": l.maxSize})
+			l.metrics.LogRecordOversized(r, RecordSizeTruncate)
+			l.records.Push(truncated)
+			return
+		}
+	}
+	log.Event(l.logs, "dropped oversized record", log.V(1), log.Fields{"flow": r.Flow, "size": len(r.RawData), "maxSize": l.maxSize})
+	l.metrics.LogRecordOversized(r, RecordSizeDrop)
+}
+
+// truncateRecord shortens the message or log field of the record so that its data fits maxSize, appending a marker with the number of bytes removed
+func truncateRecord(r Record, maxSize int) (Record, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(r.RawData, &fields); err != nil {
+		return r, false
+	}
+	key := "message"
+	if _, ok := fields[key]; !ok {
+		key = "log"
+	}
+	var msg string
+	if err := json.Unmarshal(fields[key], &msg); err != nil {
+		return r, false
+	}
+
+	// the share of the message kept is estimated from its encoded size, if escaping makes it longer than expected more is removed
+	encodedSize := len(fields[key])
+	budget := maxSize - (len(r.RawData) - encodedSize) - recordTruncatedMarkerSize
+	for attempt := 0; attempt < 3; attempt++ {
+		keep := len(msg) * budget / encodedSize
+		if keep <= 0 {
+			return r, false
+		}
+		for keep > 0 && !utf8.RuneStart(msg[keep]) {
+			keep--
+		}
+		value, err := json.Marshal(fmt.Sprintf("%s [truncated %d bytes]", msg[:keep], len(msg)-keep))
+		if err != nil {
+			return r, false
+		}
+		fields[key] = value
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return r, false
+		}
+		if len(data) <= maxSize {
+			meta, err := ParseRecordMeta(data)
+			if err != nil {
+				return r, false
+			}
+			r.RawData, r.Meta = data, meta
+			return r, true
+		}
+		budget -= len(data) - maxSize
+	}
+	return r, false
+}
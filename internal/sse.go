@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// SSEPathPrefix is the path prefix of the server-sent events endpoint, it is followed by the same flow references as websocket requests
+	SSEPathPrefix = "/sse/"
+
+	sseEventClose   = "close"
+	sseEventControl = "control"
+	sseEventRecord  = "record"
+)
+
+var errSSEStreamClosed = errors.New("event stream closed")
+
+// isSSERequest reports whether the request is made to the server-sent events endpoint
+func isSSERequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, SSEPathPrefix)
+}
+
+// sseRequest strips the endpoint's prefix from the path of the request and turns the Last-Event-ID header sent by reconnecting event sources into a lastSequence parameter
+func sseRequest(r *http.Request) *http.Request {
+	req := r.Clone(r.Context())
+	req.URL.Path = "/" + strings.TrimPrefix(r.URL.Path, SSEPathPrefix)
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		query := req.URL.Query()
+		if query.Get(ReplayParamAfter) == "" && query.Get(ReplayParamLastSequence) == "" {
+			query.Set(ReplayParamLastSequence, id)
+			req.URL.RawQuery = query.Encode()
+		}
+	}
+	return req
+}
+
+// acceptSSE starts an event stream in response to the request, the handler has to wait for the returned connection to be closed before returning
+func acceptSSE(w http.ResponseWriter, r *http.Request) (*sseConn, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("streaming is not supported by the connection")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &sseConn{
+		closed:  make(chan struct{}),
+		ctx:     r.Context().Done(),
+		flusher: flusher,
+		w:       w,
+	}, nil
+}
+
+// sseConn delivers the frames of a listener as server-sent events
+// Pings are sent as comments, which are considered answered once written since event sources cannot reply
+type sseConn struct {
+	closeOnce sync.Once
+	closed    chan struct{}
+	ctx       <-chan struct{}
+	flusher   http.Flusher
+	// eventID is the id of the next record event, the sequence number of the record
+	eventID  uint64
+	mutex    sync.Mutex
+	onPong   func()
+	released bool
+	w        http.ResponseWriter
+}
+
+// setEventID sets the id of the next record event
+func (c *sseConn) setEventID(id uint64) {
+	c.mutex.Lock()
+	c.eventID = id
+	c.mutex.Unlock()
+}
+
+func (c *sseConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &sseWriter{conn: c}, nil
+}
+
+type sseWriter struct {
+	bytes.Buffer
+	conn *sseConn
+}
+
+func (w *sseWriter) Close() error {
+	w.conn.mutex.Lock()
+	defer w.conn.mutex.Unlock()
+	id := ""
+	if w.conn.eventID > 0 {
+		id = strconv.FormatUint(w.conn.eventID, 10)
+		w.conn.eventID = 0
+	}
+	return w.conn.writeEvent(sseEventRecord, id, w.Bytes())
+}
+
+func (c *sseConn) WriteMessage(messageType int, data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.writeEvent(sseEventControl, "", data)
+}
+
+func (c *sseConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.setWriteDeadline(deadline); err != nil {
+		return err
+	}
+	switch messageType {
+	case websocket.PingMessage:
+		if err := c.write([]byte(":ping\n\n")); err != nil {
+			return err
+		}
+		if c.onPong != nil {
+			c.onPong()
+		}
+		return nil
+	case websocket.CloseMessage:
+		var msg struct {
+			Code   int    `json:"code"`
+			Reason string `json:"reason,omitempty"`
+		}
+		if len(data) >= 2 {
+			msg.Code = int(data[0])<<8 | int(data[1])
+			msg.Reason = string(data[2:])
+		}
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return c.writeEvent(sseEventClose, "", payload)
+	}
+	return nil
+}
+
+// writeEvent writes an event, data spanning several lines is sent as several data fields which event sources join with newlines
+func (c *sseConn) writeEvent(event string, id string, data []byte) error {
+	var buf bytes.Buffer
+	buf.WriteString("event: " + event + "\n")
+	if id != "" {
+		buf.WriteString("id: " + id + "\n")
+	}
+	for _, line := range bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(bytes.TrimSuffix(line, []byte("\r")))
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return c.write(buf.Bytes())
+}
+
+func (c *sseConn) write(data []byte) error {
+	if c.released {
+		return errSSEStreamClosed
+	}
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// ReadMessage blocks until the connection is closed or the client goes away, since event streams are one-way
+func (c *sseConn) ReadMessage() (int, []byte, error) {
+	select {
+	case <-c.closed:
+	case <-c.ctx:
+	}
+	return 0, nil, io.EOF
+}
+
+func (c *sseConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.setWriteDeadline(t)
+}
+
+func (c *sseConn) setWriteDeadline(t time.Time) error {
+	if d, ok := c.w.(deadliner); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+func (c *sseConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+// wait blocks until the connection is closed, after which the response writer must not be used anymore
+func (c *sseConn) wait() {
+	<-c.closed
+	c.mutex.Lock()
+	c.released = true
+	c.mutex.Unlock()
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// StatsParam requests ControlStats messages at the interval, e.g. ?stats=10s
+	StatsParam = "stats"
+
+	minStatsInterval = time.Second
+)
+
+// parseStatsInterval returns the interval of the statistics requested by the stats query parameter, zero if they are not requested
+func parseStatsInterval(query url.Values) (time.Duration, error) {
+	requested := query.Get(StatsParam)
+	if requested == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(requested)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s parameter %q", StatsParam, requested)
+	}
+	if d < minStatsInterval {
+		return 0, fmt.Errorf("statistics cannot be sent more often than every %s", minStatsInterval)
+	}
+	return d, nil
+}
+
+// statsMessage returns the statistics of the listener's connection, lag is how long the last live record written waited since it was received
+func (l *listener) statsMessage(lag time.Duration) ControlMessage {
+	return ControlMessage{
+		Control:          ControlStats,
+		RecordsDelivered: atomic.LoadUint64(&l.delivered),
+		RecordsFiltered:  atomic.LoadUint64(&l.filtered),
+		RecordsRedacted:  atomic.LoadUint64(&l.redacted),
+		RecordsDropped:   atomic.LoadUint64(&l.dropped),
+		RecordsQueued:    len(l.queue),
+		LagMillis:        lag.Milliseconds(),
+	}
+}
@@ -0,0 +1,319 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	// AdminSubscriptionsEndpoint creates persistent subscriptions on POST requests and lists them on GET requests, subscriptions are deleted by deleting AdminSubscriptionsEndpoint/<name>
+	AdminSubscriptionsEndpoint = "/admin/subscriptions"
+	// SubscriptionParam names the persistent subscription whose captured records a listener receives before live records
+	SubscriptionParam = "subscription"
+
+	DefaultSubscriptionTTL        = time.Hour
+	DefaultSubscriptionMaxTTL     = 24 * time.Hour
+	DefaultSubscriptionMaxRecords = 10000
+)
+
+var errSubscriptionExists = errors.New("a subscription of this name already exists")
+
+var subscriptionNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]{0,61}[a-z0-9])?$`)
+
+// persistentSubscriptionUser is the user persistent subscriptions are reported as in metrics
+var persistentSubscriptionUser = authv1.UserInfo{Username: "system:log-socket:subscription"}
+
+// SubscriptionRequest is the body of requests creating persistent subscriptions
+type SubscriptionRequest struct {
+	Name string `json:"name"`
+	// Flow is the reference of the captured flow in kind/namespace/name form
+	Flow string `json:"flow"`
+	// TTL is how long records are captured, e.g. 2h, DefaultSubscriptionTTL if empty
+	TTL string `json:"ttl,omitempty"`
+}
+
+// SubscriptionInfo describes a persistent subscription in responses of the admin API
+type SubscriptionInfo struct {
+	Name      string    `json:"name"`
+	Flow      string    `json:"flow"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// RecordsCaptured is the number of records retained for listeners to receive
+	RecordsCaptured int `json:"recordsCaptured"`
+	// RecordsDropped is the number of the oldest records evicted because the subscription was full
+	RecordsDropped uint64 `json:"recordsDropped"`
+}
+
+// NewPersistentSubscriptions returns the persistent subscriptions of the registry, each keeping at most maxRecords records
+func NewPersistentSubscriptions(registry ListenerRegistry, maxTTL time.Duration, maxRecords int) *PersistentSubscriptions {
+	if maxTTL <= 0 {
+		maxTTL = DefaultSubscriptionMaxTTL
+	}
+	if maxRecords <= 0 {
+		maxRecords = DefaultSubscriptionMaxRecords
+	}
+	return &PersistentSubscriptions{
+		registry:      registry,
+		maxTTL:        maxTTL,
+		maxRecords:    maxRecords,
+		subscriptions: make(map[string]*persistentSubscription),
+	}
+}
+
+// PersistentSubscriptions capture the records of flows before anyone listens to them, e.g. around a deployment
+// A subscription is registered like a listener that never disconnects, so the records of its flow are routed to the service as soon as it is created
+// Listeners connecting with SubscriptionParam receive the records it captured since its creation, then live records
+type PersistentSubscriptions struct {
+	registry   ListenerRegistry
+	maxTTL     time.Duration
+	maxRecords int
+
+	mutex         sync.Mutex
+	subscriptions map[string]*persistentSubscription
+}
+
+// Create registers a subscription of the user, it fails if a subscription of the same name exists
+func (s *PersistentSubscriptions) Create(req SubscriptionRequest, user authv1.UserInfo, now time.Time) (SubscriptionInfo, error) {
+	if !subscriptionNamePattern.MatchString(req.Name) {
+		return SubscriptionInfo{}, fmt.Errorf("invalid subscription name %q, expected a DNS subdomain", req.Name)
+	}
+	flow, err := ParseFlowReference(req.Flow, "")
+	if err != nil {
+		return SubscriptionInfo{}, err
+	}
+	ttl := DefaultSubscriptionTTL
+	if req.TTL != "" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			return SubscriptionInfo{}, fmt.Errorf("invalid ttl %q", req.TTL)
+		}
+	}
+	if ttl > s.maxTTL {
+		return SubscriptionInfo{}, fmt.Errorf("subscriptions cannot last longer than %s", s.maxTTL)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.subscriptions[req.Name]; ok {
+		return SubscriptionInfo{}, errSubscriptionExists
+	}
+	sub := &persistentSubscription{
+		name:      req.Name,
+		flow:      flow,
+		createdBy: user.Username,
+		createdAt: now,
+		expiresAt: now.Add(ttl),
+		size:      s.maxRecords,
+	}
+	sub.expiry = time.AfterFunc(ttl, func() {
+		s.remove(sub)
+	})
+	s.subscriptions[req.Name] = sub
+	s.registry.Register(sub)
+	return sub.info(), nil
+}
+
+// Delete unregisters the subscription and discards its records, it reports whether the subscription existed
+func (s *PersistentSubscriptions) Delete(name string) bool {
+	s.mutex.Lock()
+	sub := s.subscriptions[name]
+	s.mutex.Unlock()
+	if sub == nil {
+		return false
+	}
+	sub.expiry.Stop()
+	return s.remove(sub)
+}
+
+func (s *PersistentSubscriptions) remove(sub *persistentSubscription) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.subscriptions[sub.name] != sub {
+		return false
+	}
+	delete(s.subscriptions, sub.name)
+	s.registry.Unregister(sub)
+	return true
+}
+
+// lookup returns the subscription of the name, nil if it does not exist or has expired
+func (s *PersistentSubscriptions) lookup(name string) *persistentSubscription {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.subscriptions[name]
+}
+
+// List returns the subscriptions in order of creation
+func (s *PersistentSubscriptions) List() []SubscriptionInfo {
+	s.mutex.Lock()
+	res := make([]SubscriptionInfo, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		res = append(res, sub.info())
+	}
+	s.mutex.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.Before(res[j].CreatedAt)
+	})
+	return res
+}
+
+// persistentSubscription retains the records of its flow in a ring, evicting the oldest ones once it is full
+type persistentSubscription struct {
+	name      string
+	flow      FlowReference
+	createdBy string
+	createdAt time.Time
+	expiresAt time.Time
+	expiry    *time.Timer
+
+	mutex sync.Mutex
+	// ring grows up to size records
+	ring    []Record
+	size    int
+	start   int
+	dropped uint64
+}
+
+func (s *persistentSubscription) Flow() FlowReference {
+	return s.flow
+}
+
+func (s *persistentSubscription) User() authv1.UserInfo {
+	return persistentSubscriptionUser
+}
+
+func (s *persistentSubscription) Send(r Record) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.ring) < s.size {
+		s.ring = append(s.ring, r)
+		return
+	}
+	s.ring[s.start] = r
+	s.start = (s.start + 1) % len(s.ring)
+	s.dropped++
+}
+
+// Records returns the captured records of the request, all of them if the request is empty
+func (s *persistentSubscription) Records(flow FlowReference, req ReplayRequest) []Record {
+	if flow != s.flow {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	res := make([]Record, 0, len(s.ring))
+	for i := range s.ring {
+		r := s.ring[(s.start+i)%len(s.ring)]
+		if r.Sequence <= req.After || (!req.Since.IsZero() && r.ReceivedAt.Before(req.Since)) {
+			continue
+		}
+		res = append(res, r)
+	}
+	if req.Tail > 0 && len(res) > req.Tail {
+		res = res[len(res)-req.Tail:]
+	}
+	return res
+}
+
+func (s *persistentSubscription) info() SubscriptionInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return SubscriptionInfo{
+		Name:            s.name,
+		Flow:            s.flow.URL(),
+		CreatedBy:       s.createdBy,
+		CreatedAt:       s.createdAt,
+		ExpiresAt:       s.expiresAt,
+		RecordsCaptured: len(s.ring),
+		RecordsDropped:  s.dropped,
+	}
+}
+
+// serveSubscriptions responds to requests of the subscriptions admin endpoint, it reports whether the request was handled
+// Admins may only create subscriptions of the flows they may tail themselves
+func serveSubscriptions(w http.ResponseWriter, r *http.Request, opts ListenerOptions, authenticator Authenticator, authorizer Authorizer, logs log.Sink) bool {
+	if opts.Admin == nil || opts.Subscriptions == nil {
+		return false
+	}
+	if r.URL.Path != AdminSubscriptionsEndpoint && !strings.HasPrefix(r.URL.Path, AdminSubscriptionsEndpoint+"/") {
+		return false
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, AdminSubscriptionsEndpoint), "/")
+	switch {
+	case (r.Method == http.MethodGet || r.Method == http.MethodPost) && name == "":
+	case r.Method == http.MethodDelete && name != "":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+
+	usrInfo, ok := authorizeAdminRequest(w, r, opts.Admin, AdminSubscriptionsEndpoint, authenticator, opts.Tenancy, logs)
+	if !ok {
+		return true
+	}
+
+	var res interface{}
+	switch r.Method {
+	case http.MethodDelete:
+		if !opts.Subscriptions.Delete(name) {
+			http.Error(w, "subscription not found", http.StatusNotFound)
+			return true
+		}
+		log.Event(logs, "subscription deleted on admin request", log.Fields{"subscription": name, "admin": usrInfo.Username})
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	case http.MethodPost:
+		var req SubscriptionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return true
+		}
+		flow, err := ParseFlowReference(req.Flow, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return true
+		}
+		allowed, err := authorizer.AuthorizeFlow(usrInfo, flow)
+		if err != nil {
+			log.Event(logs, "authorization failed", log.V(1), log.Error(err), log.Fields{"user": usrInfo, "flow": flow})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return true
+		}
+		if !allowed {
+			http.Error(w, fmt.Sprintf("permission denied to tail %s", flow.URL()), http.StatusForbidden)
+			return true
+		}
+		info, err := opts.Subscriptions.Create(req, usrInfo, time.Now())
+		if err == errSubscriptionExists {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return true
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return true
+		}
+		log.Event(logs, "subscription created on admin request", log.Fields{"subscription": info.Name, "flow": info.Flow, "expiresAt": info.ExpiresAt, "admin": usrInfo.Username})
+		res = info
+	default:
+		res = opts.Subscriptions.List()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusCreated)
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Event(logs, "failed to write admin response", log.V(1), log.Error(err))
+	}
+	return true
+}
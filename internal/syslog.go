@@ -0,0 +1,342 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// SyslogOptions holds the settings of a syslog receiver
+type SyslogOptions struct {
+	// Network is either udp or tcp
+	Network string
+	// TLSConfig enables TLS for tcp receivers
+	TLSConfig *tls.Config
+	// Flow is the flow received messages are routed to
+	Flow FlowReference
+	// DeadLetters receives the messages that cannot be parsed, nil disables dead letters
+	DeadLetters *DeadLetters
+}
+
+const maxSyslogMessageSize = 64 << 10
+
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// SyslogMessage is the parsed form of an RFC 5424 or RFC 3164 message
+type SyslogMessage struct {
+	Facility       string                       `json:"facility"`
+	Severity       string                       `json:"severity"`
+	Timestamp      *time.Time                   `json:"timestamp,omitempty"`
+	Hostname       string                       `json:"hostname,omitempty"`
+	AppName        string                       `json:"appname,omitempty"`
+	ProcID         string                       `json:"procid,omitempty"`
+	MsgID          string                       `json:"msgid,omitempty"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+	Message        string                       `json:"-"`
+}
+
+// IngestSyslog receives syslog messages and routes them as records to the flow specified in opts
+func IngestSyslog(addr string, records RecordSink, logs log.Sink, metrics IngestMetrics, stopSignal Handleable, opts SyslogOptions) {
+	logs = log.WithFields(logs, log.Fields{"task": "syslog ingestion", "network": opts.Network})
+
+	ingest := func(data []byte) {
+		msg, err := ParseSyslogMessage(string(data))
+		if err != nil {
+			log.Event(logs, "failed to parse syslog message", log.V(1), log.Error(err), log.Fields{"data": string(data)})
+			metrics.IngestParseFailed(ReceiverSyslog)
+			opts.DeadLetters.Reject(ReceiverSyslog, opts.Flow, data, DeadLetterUnparsable, err)
+			return
+		}
+		rec, err := syslogRecord(msg, opts.Flow)
+		if err != nil {
+			log.Event(logs, "failed to convert syslog message to record", log.V(1), log.Error(err))
+			metrics.IngestParseFailed(ReceiverSyslog)
+			opts.DeadLetters.Reject(ReceiverSyslog, opts.Flow, data, DeadLetterUnparsable, err)
+			return
+		}
+		metrics.LogRecordReceived(ReceiverSyslog, rec)
+		log.Event(logs, "ingested log record via syslog", log.V(1), log.Fields{"record": rec})
+		records.Push(rec)
+	}
+
+	switch opts.Network {
+	case "udp":
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			log.Event(logs, "syslog receiver failed to listen", log.Error(err), log.Fields{"addr": addr})
+			return
+		}
+		if stopSignal != nil {
+			stopSignal.HandleWith(func() {
+				conn.Close()
+			})
+		}
+		buf := make([]byte, maxSyslogMessageSize)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Event(logs, "syslog receiver failed to read datagram", log.Error(err))
+				}
+				return
+			}
+			ingest(buf[:n])
+		}
+	case "tcp":
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Event(logs, "syslog receiver failed to listen", log.Error(err), log.Fields{"addr": addr})
+			return
+		}
+		if opts.TLSConfig != nil {
+			ln = tls.NewListener(ln, opts.TLSConfig)
+		}
+		var conns sync.Map
+		if stopSignal != nil {
+			stopSignal.HandleWith(func() {
+				ln.Close()
+				conns.Range(func(conn, _ interface{}) bool {
+					conn.(net.Conn).Close()
+					return true
+				})
+			})
+		}
+		var wg sync.WaitGroup
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Event(logs, "syslog receiver failed to accept connection", log.Error(err))
+				}
+				break
+			}
+			conns.Store(conn, nil)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conns.Delete(conn)
+				defer conn.Close()
+				if err := readSyslogFrames(bufio.NewReaderSize(conn, maxSyslogMessageSize), ingest); err != nil && !errors.Is(err, net.ErrClosed) {
+					log.Event(logs, "failed to read syslog stream", log.V(1), log.Error(err), log.Fields{"remoteAddr": conn.RemoteAddr().String()})
+				}
+			}()
+		}
+		wg.Wait()
+	default:
+		log.Event(logs, "unsupported syslog network", log.Fields{"network": opts.Network})
+	}
+}
+
+// readSyslogFrames splits a syslog stream into messages framed by octet counting (RFC 6587) or terminated by newlines
+func readSyslogFrames(r *bufio.Reader, fn func([]byte)) error {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if b[0] >= '1' && b[0] <= '9' {
+			lenStr, err := r.ReadString(' ')
+			if err != nil {
+				return err
+			}
+			n, err := strconv.Atoi(strings.TrimSuffix(lenStr, " "))
+			if err != nil || n > maxSyslogMessageSize {
+				return fmt.Errorf("invalid syslog frame length %q", lenStr)
+			}
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return err
+			}
+			fn(buf)
+			continue
+		}
+		// the reader is sized to hold the longest message, so a full buffer means the message is too long
+		line, err := r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return fmt.Errorf("syslog message exceeds %d bytes", maxSyslogMessageSize)
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line := strings.TrimRight(string(line), "\r\n"); line != "" {
+			fn([]byte(line))
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func syslogRecord(msg SyslogMessage, flow FlowReference) (rec Record, err error) {
+	rec.RawData, err = json.Marshal(struct {
+		Message string        `json:"message"`
+		Level   string        `json:"level"`
+		Syslog  SyslogMessage `json:"syslog"`
+	}{
+		Message: msg.Message,
+		Level:   msg.Severity,
+		Syslog:  msg,
+	})
+	if err != nil {
+		return
+	}
+	rec.Meta.Message = msg.Message
+	rec.Meta.Level = msg.Severity
+	rec.Meta.Severity = ParseSeverity(msg.Severity)
+	rec.Flow = flow
+	rec.ReceivedAt = time.Now()
+	return
+}
+
+// ParseSyslogMessage parses RFC 5424 messages and, on a best-effort basis, RFC 3164 messages
+func ParseSyslogMessage(s string) (msg SyslogMessage, err error) {
+	if !strings.HasPrefix(s, "<") {
+		return msg, errors.New("message has no priority")
+	}
+	end := strings.IndexByte(s, '>')
+	if end < 2 || end > 4 {
+		return msg, errors.New("message has an invalid priority")
+	}
+	// the priority is 1 to 3 digits, Atoi alone would also accept signs
+	for _, c := range s[1:end] {
+		if c < '0' || c > '9' {
+			return msg, errors.New("message has an invalid priority")
+		}
+	}
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return msg, errors.New("message has an invalid priority")
+	}
+	msg.Facility = syslogFacilities[pri/8]
+	msg.Severity = syslogSeverities[pri%8]
+	s = s[end+1:]
+
+	if strings.HasPrefix(s, "1 ") {
+		return parseRFC5424(msg, s[2:])
+	}
+	return parseRFC3164(msg, s), nil
+}
+
+func parseRFC5424(msg SyslogMessage, s string) (SyslogMessage, error) {
+	fields := strings.SplitN(s, " ", 6)
+	if len(fields) < 6 {
+		return msg, errors.New("RFC 5424 message header is incomplete")
+	}
+	if fields[0] != "-" {
+		ts, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return msg, fmt.Errorf("invalid RFC 5424 timestamp: %w", err)
+		}
+		msg.Timestamp = &ts
+	}
+	msg.Hostname = nilValue(fields[1])
+	msg.AppName = nilValue(fields[2])
+	msg.ProcID = nilValue(fields[3])
+	msg.MsgID = nilValue(fields[4])
+
+	rest := fields[5]
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else {
+		var err error
+		if msg.StructuredData, rest, err = parseStructuredData(rest); err != nil {
+			return msg, err
+		}
+	}
+	rest = strings.TrimPrefix(rest, " ")
+	msg.Message = strings.TrimPrefix(rest, "\ufeff") // byte order mark
+	return msg, nil
+}
+
+func parseStructuredData(s string) (map[string]map[string]string, string, error) {
+	res := make(map[string]map[string]string)
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+		idEnd := strings.IndexAny(s, " ]")
+		if idEnd < 0 {
+			return nil, s, errors.New("unterminated structured data element")
+		}
+		params := make(map[string]string)
+		res[s[:idEnd]] = params
+		s = s[idEnd:]
+		for strings.HasPrefix(s, " ") {
+			s = s[1:]
+			eq := strings.Index(s, "=\"")
+			if eq < 0 {
+				return nil, s, errors.New("invalid structured data parameter")
+			}
+			name := s[:eq]
+			s = s[eq+2:]
+			var value strings.Builder
+			i := 0
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, s, errors.New("unterminated structured data parameter value")
+			}
+			params[name] = value.String()
+			s = s[i+1:]
+		}
+		if !strings.HasPrefix(s, "]") {
+			return nil, s, errors.New("unterminated structured data element")
+		}
+		s = s[1:]
+	}
+	return res, s, nil
+}
+
+func parseRFC3164(msg SyslogMessage, s string) SyslogMessage {
+	const stampLen = len(time.Stamp)
+	if len(s) > stampLen {
+		if ts, err := time.Parse(time.Stamp, s[:stampLen]); err == nil {
+			now := time.Now()
+			ts = ts.AddDate(now.Year(), 0, 0)
+			msg.Timestamp = &ts
+			s = strings.TrimPrefix(s[stampLen:], " ")
+			if sp := strings.IndexByte(s, ' '); sp > 0 {
+				msg.Hostname, s = s[:sp], s[sp+1:]
+			}
+		}
+	}
+	// the tag is terminated by a colon, optionally preceded by the process ID in brackets
+	if colon := strings.Index(s, ": "); colon > 0 && !strings.ContainsAny(s[:colon], " ") {
+		tag := s[:colon]
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			msg.ProcID = tag[open+1 : len(tag)-1]
+			tag = tag[:open]
+		}
+		msg.AppName = tag
+		s = s[colon+2:]
+	}
+	msg.Message = s
+	return msg
+}
+
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// TemplateParam is a Go text/template the records of a listener are rendered with, e.g. {{.kubernetes.pod_name}} {{.message}}
+	TemplateParam = "template"
+
+	maxTemplateLength = 4 << 10
+	// maxTemplateOutput bounds the frame a template renders for a record, so that loops cannot blow it up
+	maxTemplateOutput = 64 << 10
+)
+
+var errTemplateOutputTooLarge = errors.New("rendered record too large")
+
+// templateFuncs are the functions available to templates besides the builtin ones
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"default": func(def interface{}, v interface{}) interface{} {
+		if v == nil || v == "" {
+			return def
+		}
+		return v
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+}
+
+// ParseTemplate parses the template query parameter of a listener connection request, it returns nil if the parameter is not set
+func ParseTemplate(query url.Values) (*TemplateEncoder, error) {
+	text := query.Get(TemplateParam)
+	if text == "" {
+		return nil, nil
+	}
+	if len(text) > maxTemplateLength {
+		return nil, fmt.Errorf("%s parameter is longer than %d bytes", TemplateParam, maxTemplateLength)
+	}
+	if enc := Encoding(query.Get(EncodingParam)); enc != "" && enc != EncodingMessage {
+		return nil, fmt.Errorf("the %s parameter cannot be combined with the %s encoding", TemplateParam, enc)
+	}
+	tmpl, err := template.New(TemplateParam).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s parameter: %w", TemplateParam, err)
+	}
+	if err := checkTemplateCost(tmpl); err != nil {
+		return nil, fmt.Errorf("invalid %s parameter: %w", TemplateParam, err)
+	}
+	return &TemplateEncoder{template: tmpl}, nil
+}
+
+// checkTemplateCost rejects the actions that would let the time it takes to render a record grow beyond linear in its size, since the output limit does not bound loops that render nothing
+// Ranges cannot be nested nor loop over constants, and templates cannot be defined or invoked, which would allow recursion
+func checkTemplateCost(tmpl *template.Template) error {
+	if len(tmpl.Templates()) > 1 {
+		return errors.New("templates cannot be defined")
+	}
+	return checkTemplateNode(tmpl.Tree.Root, false)
+}
+
+func checkTemplateNode(node parse.Node, inRange bool) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := checkTemplateNode(child, inRange); err != nil {
+				return err
+			}
+		}
+	case *parse.IfNode:
+		return checkTemplateBranch(&n.BranchNode, inRange)
+	case *parse.WithNode:
+		return checkTemplateBranch(&n.BranchNode, inRange)
+	case *parse.RangeNode:
+		if inRange {
+			return errors.New("ranges cannot be nested")
+		}
+		for _, cmd := range n.Pipe.Cmds {
+			for _, arg := range cmd.Args {
+				if _, ok := arg.(*parse.NumberNode); ok {
+					return errors.New("ranges cannot loop over numbers")
+				}
+			}
+		}
+		return checkTemplateBranch(&n.BranchNode, true)
+	case *parse.TemplateNode:
+		return errors.New("templates cannot be invoked")
+	}
+	return nil
+}
+
+func checkTemplateBranch(n *parse.BranchNode, inRange bool) error {
+	if err := checkTemplateNode(n.List, inRange); err != nil {
+		return err
+	}
+	return checkTemplateNode(n.ElseList, inRange)
+}
+
+// TemplateEncoder sends records rendered with a Go text/template as text messages
+// The template is executed with the fields of JSON records, records of other types are available as .message, and missing fields render as empty strings
+type TemplateEncoder struct {
+	template *template.Template
+}
+
+func (e *TemplateEncoder) Encode(r Record) ([]byte, error) {
+	var data interface{}
+	if err := json.Unmarshal(r.RawData, &data); err != nil {
+		data = map[string]interface{}{"message": string(r.RawData)}
+	} else if _, ok := data.(map[string]interface{}); !ok {
+		data = map[string]interface{}{"message": data}
+	}
+	out := limitedBuffer{max: maxTemplateOutput}
+	if err := e.template.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	// fields missing from maps render as <no value> whatever the missingkey option
+	return bytes.ReplaceAll(out.buf.Bytes(), []byte("<no value>"), nil), nil
+}
+
+func (e *TemplateEncoder) MessageType() int {
+	return websocket.TextMessage
+}
+
+// limitedBuffer fails writes beyond max bytes
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > b.max {
+		return 0, errTemplateOutputTooLarge
+	}
+	return b.buf.Write(p)
+}
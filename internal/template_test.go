@@ -0,0 +1,27 @@
+package internal
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseTemplateRejectsCostlyActions(t *testing.T) {
+	tests := []struct {
+		template string
+		valid    bool
+	}{
+		{`{{.kubernetes.pod_name}} {{.message}}`, true},
+		{`{{range .items}}{{if .ok}}{{.name}}{{end}}{{end}}`, true},
+		{`{{range .items}}{{.}}{{else}}{{range .other}}{{.}}{{end}}{{end}}`, false},
+		{`{{range .items}}{{with .sub}}{{range .}}{{end}}{{end}}{{end}}`, false},
+		{`{{range 1000000000}}{{end}}`, false},
+		{`{{define "loop"}}{{template "loop" .}}{{end}}{{template "loop" .}}`, false},
+		{`{{block "b" .}}{{.message}}{{end}}`, false},
+	}
+	for _, test := range tests {
+		_, err := ParseTemplate(url.Values{TemplateParam: {test.template}})
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("template %s is valid: %t, error: %v", test.template, valid, err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	authv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	TenancyModeNone   TenancyMode = "none"
+	TenancyModeRBAC   TenancyMode = "rbac"
+	TenancyModeStatic TenancyMode = "static"
+
+	// TenantExtraKey is the key of the user info extra field holding the tenant assigned to the listener
+	TenantExtraKey = "log-socket.banzaicloud.io/tenant"
+
+	serviceAccountUsernamePrefix = "system:serviceaccount:"
+)
+
+type TenancyMode string
+
+func ParseTenancyMode(s string) (TenancyMode, error) {
+	switch m := TenancyMode(s); m {
+	case TenancyModeNone, TenancyModeRBAC, TenancyModeStatic:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid tenancy mode %q", s)
+	}
+}
+
+// Tenancy assigns listeners to tenants and confines them to the namespaces of their tenant
+type Tenancy interface {
+	// Tenant returns the tenant of the user, users that belong to no tenant are rejected
+	Tenant(user authv1.UserInfo) (string, bool)
+	// PermitsFlow reports whether the flow belongs to the namespaces of the user's tenant
+	PermitsFlow(tenant string, user authv1.UserInfo, flow FlowReference) (bool, error)
+}
+
+// UserTenant returns the tenant assigned to the user, if any
+func UserTenant(user authv1.UserInfo) string {
+	if v := user.Extra[TenantExtraKey]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func withTenant(user authv1.UserInfo, tenant string) authv1.UserInfo {
+	extra := make(map[string]authv1.ExtraValue, len(user.Extra)+1)
+	for k, v := range user.Extra {
+		extra[k] = v
+	}
+	extra[TenantExtraKey] = authv1.ExtraValue{tenant}
+	user.Extra = extra
+	return user
+}
+
+// authzExtra converts the extra fields of the user for access reviews, leaving out the tenant which is not known to the API server
+func authzExtra(user authv1.UserInfo) map[string]authzv1.ExtraValue {
+	extra := make(map[string]authzv1.ExtraValue, len(user.Extra))
+	for k, v := range user.Extra {
+		if k != TenantExtraKey {
+			extra[k] = authzv1.ExtraValue(v)
+		}
+	}
+	return extra
+}
+
+// TenantAuthorizer rejects flows outside the namespaces of the user's tenant before consulting the wrapped authorizer
+type TenantAuthorizer struct {
+	Authorizer
+	Tenancy Tenancy
+}
+
+func (a TenantAuthorizer) AuthorizeFlow(user authv1.UserInfo, flow FlowReference) (bool, error) {
+	if ok, err := a.Tenancy.PermitsFlow(UserTenant(user), user, flow); err != nil || !ok {
+		return false, err
+	}
+	return a.Authorizer.AuthorizeFlow(user, flow)
+}
+
+// TenantSpec describes a tenant of a static tenancy
+type TenantSpec struct {
+	Name string `json:"name"`
+	// Users and Groups select the members of the tenant
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// Namespaces are the namespaces (or glob patterns of namespaces) the flows of which members of the tenant can tail
+	Namespaces []string `json:"namespaces"`
+}
+
+// LoadStaticTenancy reads a YAML or JSON file holding a list of tenants
+func LoadStaticTenancy(fileName string) (StaticTenancy, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var res StaticTenancy
+	if err := yaml.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file %s: %w", fileName, err)
+	}
+	for _, t := range res {
+		if t.Name == "" {
+			return nil, fmt.Errorf("tenants file %s has a tenant without a name", fileName)
+		}
+		for _, pattern := range t.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("tenant %s has an invalid namespace pattern %q: %w", t.Name, pattern, err)
+			}
+		}
+	}
+	return res, nil
+}
+
+// StaticTenancy assigns users to the first tenant listing them or one of their groups
+type StaticTenancy []TenantSpec
+
+func (t StaticTenancy) Tenant(user authv1.UserInfo) (string, bool) {
+	for _, spec := range t {
+		for _, u := range spec.Users {
+			if u == user.Username {
+				return spec.Name, true
+			}
+		}
+		for _, g := range spec.Groups {
+			for _, ug := range user.Groups {
+				if g == ug {
+					return spec.Name, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+func (t StaticTenancy) PermitsFlow(tenant string, _ authv1.UserInfo, flow FlowReference) (bool, error) {
+	for _, spec := range t {
+		if spec.Name != tenant {
+			continue
+		}
+		for _, pattern := range spec.Namespaces {
+			if ok, _ := path.Match(pattern, flow.Namespace); ok {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// RBACTenancy derives tenants from the API server's RBAC: service accounts belong to the tenant named after their namespace, other users to a tenant of their own
+// Users can tail flows of the namespaces they may read pod logs in
+type RBACTenancy struct {
+	Client client.Client
+}
+
+func (t RBACTenancy) Tenant(user authv1.UserInfo) (string, bool) {
+	if strings.HasPrefix(user.Username, serviceAccountUsernamePrefix) {
+		if namespace, _, ok := strings.Cut(strings.TrimPrefix(user.Username, serviceAccountUsernamePrefix), ":"); ok {
+			return namespace, true
+		}
+	}
+	return user.Username, user.Username != ""
+}
+
+func (t RBACTenancy) PermitsFlow(_ string, user authv1.UserInfo, flow FlowReference) (bool, error) {
+	sar := authzv1.SubjectAccessReview{
+		Spec: authzv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &authzv1.ResourceAttributes{
+				Namespace:   flow.Namespace,
+				Verb:        "get",
+				Resource:    "pods",
+				Subresource: "log",
+			},
+			User:   user.Username,
+			Groups: user.Groups,
+			Extra:  authzExtra(user),
+			UID:    user.UID,
+		},
+	}
+	if err := t.Client.Create(context.Background(), &sar); err != nil {
+		return false, err
+	}
+	return sar.Status.Allowed, nil
+}
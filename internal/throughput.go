@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	DefaultThroughputSampleRate = 10
+
+	// throttledNotificationInterval is the minimum time between the notifications of a quota that keeps being exceeded
+	throttledNotificationInterval = time.Second
+	namespaceQuotaPrefix          = "namespace/"
+	anyNamespace                  = "*"
+)
+
+// ThroughputQuota limits the rate of the records delivered of a flow, or of the pods of a namespace whatever flow they are delivered for
+type ThroughputQuota struct {
+	// Flow is the limited flow, unless Namespace is set
+	Flow FlowReference
+	// Namespace is the limited namespace, anyNamespace limits each namespace separately
+	Namespace string
+	// Records and Bytes are the number of records and bytes per second, zero means unlimited
+	Records float64
+	Bytes   float64
+}
+
+// ParseThroughputQuota parses quotas of the form target=limit[,limit], where the target is namespace/<name>, namespace/* limiting each namespace, or a flow reference,
+// and limits are records (e.g. 1000/s) or bytes (e.g. 1MiB/s) per second, e.g. namespace/prod=1000/s,1MiB/s
+func ParseThroughputQuota(spec string, controlNamespace string) (res ThroughputQuota, err error) {
+	target, limits, ok := strings.Cut(spec, "=")
+	if !ok || limits == "" {
+		return res, fmt.Errorf("invalid throughput quota %q, expected target=limit[,limit]", spec)
+	}
+	if strings.HasPrefix(target, namespaceQuotaPrefix) {
+		if res.Namespace = strings.TrimPrefix(target, namespaceQuotaPrefix); res.Namespace == "" {
+			return res, fmt.Errorf("invalid throughput quota %q, namespace cannot be empty", spec)
+		}
+	} else if res.Flow, err = ParseFlowReference(target, controlNamespace); err != nil {
+		return res, fmt.Errorf("invalid throughput quota %q: %w", spec, err)
+	}
+	for _, limit := range strings.Split(limits, ",") {
+		if !strings.HasSuffix(limit, "/s") {
+			return res, fmt.Errorf("invalid throughput quota %q, limit %q is not per second", spec, limit)
+		}
+		amount := strings.TrimSuffix(limit, "/s")
+		if strings.HasSuffix(amount, "B") {
+			size := strings.TrimSuffix(amount, "B")
+			q, err := resource.ParseQuantity(size)
+			if err != nil || q.Sign() <= 0 {
+				return res, fmt.Errorf("invalid throughput quota %q, invalid number of bytes %q", spec, size)
+			}
+			res.Bytes = q.AsApproximateFloat64()
+		} else {
+			n, err := strconv.ParseFloat(amount, 64)
+			if err != nil || n <= 0 {
+				return res, fmt.Errorf("invalid throughput quota %q, invalid number of records %q", spec, amount)
+			}
+			res.Records = n
+		}
+	}
+	return res, nil
+}
+
+// key returns the key of the bucket the quota withdraws the record from, or false if the quota does not apply to the record
+func (q ThroughputQuota) key(r Record) (string, bool) {
+	if q.Namespace == "" {
+		return r.Flow.URL(), r.Flow == q.Flow
+	}
+	namespace := r.Meta.Namespace
+	if namespace == "" {
+		namespace = r.Flow.Namespace
+	}
+	return namespaceQuotaPrefix + namespace, q.Namespace == anyNamespace || q.Namespace == namespace
+}
+
+type ThroughputMetrics interface {
+	LogRecordThrottled(r Record, quota string)
+}
+
+// NewThroughputQuotas returns quotas delivering one in sampleRate records exceeding them, apart from those of error levels
+func NewThroughputQuotas(quotas []ThroughputQuota, sampleRate int, metrics ThroughputMetrics) *ThroughputQuotas {
+	if sampleRate <= 0 {
+		sampleRate = DefaultThroughputSampleRate
+	}
+	return &ThroughputQuotas{
+		buckets:    make(map[string]*throughputBucket),
+		metrics:    metrics,
+		quotas:     quotas,
+		sampleRate: uint64(sampleRate),
+	}
+}
+
+// ThroughputQuotas limits the rate of the records dispatched to listeners, so that chatty pods or flows do not hold up the streams of others
+type ThroughputQuotas struct {
+	mutex      sync.Mutex
+	buckets    map[string]*throughputBucket
+	metrics    ThroughputMetrics
+	quotas     []ThroughputQuota
+	sampleRate uint64
+}
+
+type throughputBucket struct {
+	records *rate.Limiter
+	bytes   *rate.Limiter
+	// exceeded counts the records over the quota, one in sampleRate of which is delivered
+	exceeded uint64
+	// throttled counts the records dropped since the listeners were last notified
+	throttled  uint64
+	notifiedAt time.Time
+}
+
+func newThroughputBucket(q ThroughputQuota) *throughputBucket {
+	b := &throughputBucket{}
+	if q.Records > 0 {
+		b.records = rate.NewLimiter(rate.Limit(q.Records), int(q.Records)+1)
+	}
+	if q.Bytes > 0 {
+		b.bytes = rate.NewLimiter(rate.Limit(q.Bytes), int(q.Bytes)+1)
+	}
+	return b
+}
+
+func (b *throughputBucket) allow(r Record, now time.Time) bool {
+	if b.records != nil && !b.records.AllowN(now, 1) {
+		return false
+	}
+	return b.bytes == nil || b.bytes.AllowN(now, len(r.RawData))
+}
+
+// Admit reports whether the record is delivered to listeners, along with the notification listeners of the record's flow are sent if one of its quotas is exceeded
+func (q *ThroughputQuotas) Admit(r Record, now time.Time) (bool, *ControlMessage) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	admitted := true
+	var notification *ControlMessage
+	for _, quota := range q.quotas {
+		key, ok := quota.key(r)
+		if !ok {
+			continue
+		}
+		b := q.buckets[key]
+		if b == nil {
+			b = newThroughputBucket(quota)
+			q.buckets[key] = b
+		}
+		if b.allow(r, now) {
+			continue
+		}
+		b.exceeded++
+		if b.exceeded%q.sampleRate == 0 || isErrorLevel(r.Meta.Level) {
+			continue
+		}
+		admitted = false
+		b.throttled++
+		q.metrics.LogRecordThrottled(r, key)
+		if notification == nil && now.Sub(b.notifiedAt) >= throttledNotificationInterval {
+			notification = &ControlMessage{
+				Control:    ControlThrottled,
+				Message:    fmt.Sprintf("%s exceeds its throughput quota, only one in %d records is delivered apart from errors", key, q.sampleRate),
+				Flow:       r.Flow.URL(),
+				Records:    b.throttled,
+				SampleRate: q.sampleRate,
+			}
+			b.notifiedAt, b.throttled = now, 0
+		}
+	}
+	return admitted, notification
+}
+
+// NotifyThrottled sends the notification of an exceeded quota to the listeners
+func NotifyThrottled(listeners []Listener, msg ControlMessage) {
+	for _, l := range listeners {
+		if s, ok := l.(subscription); ok {
+			s.sendControl(msg)
+		}
+	}
+}
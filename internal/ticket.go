@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	// TicketEndpoint exchanges the token of a POST request for a ticket, which authenticates a single connection request in the TicketParam query parameter
+	TicketEndpoint = "/ticket"
+	TicketParam    = "ticket"
+
+	DefaultTicketTTL = 30 * time.Second
+)
+
+// TicketInfo is the response of the ticket endpoint
+type TicketInfo struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// NewTickets returns a ticket issuer encrypting tickets with the key, replicas sharing the key redeem each other's tickets
+// A random key is generated if the key is empty, in which case tickets are only redeemed by the issuing replica
+func NewTickets(key []byte, ttl time.Duration) (*Tickets, error) {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	if ttl <= 0 {
+		ttl = DefaultTicketTTL
+	}
+	sum := sha256.Sum256(key)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Tickets{aead: aead, ttl: ttl, redeemed: make(map[string]time.Time)}, nil
+}
+
+// Tickets issues short-lived single-use tickets for tokens, tickets are the tokens and their expiry encrypted with AES-GCM so that tokens don't show up in URLs
+// Listeners connecting with a ticket are re-authenticated with the token it was issued for
+type Tickets struct {
+	aead cipher.AEAD
+	ttl  time.Duration
+
+	mutex sync.Mutex
+	// redeemed holds the nonces of redeemed tickets until they expire
+	redeemed map[string]time.Time
+}
+
+func (t *Tickets) Issue(token string, now time.Time) (TicketInfo, error) {
+	expiresAt := now.Add(t.ttl)
+	nonce := make([]byte, t.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return TicketInfo{}, err
+	}
+	var expiry [8]byte
+	binary.BigEndian.PutUint64(expiry[:], uint64(expiresAt.UnixNano()))
+	sealed := t.aead.Seal(nonce, nonce, append(expiry[:], token...), nil)
+	return TicketInfo{Ticket: base64.RawURLEncoding.EncodeToString(sealed), ExpiresAt: expiresAt}, nil
+}
+
+// Redeem returns the token of the ticket unless it is invalid, expired or already redeemed
+func (t *Tickets) Redeem(ticket string, now time.Time) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(ticket)
+	if err != nil || len(sealed) < t.aead.NonceSize() {
+		return "", invalidCredentials("malformed ticket")
+	}
+	nonce := sealed[:t.aead.NonceSize()]
+	plain, err := t.aead.Open(nil, nonce, sealed[len(nonce):], nil)
+	if err != nil || len(plain) < 8 {
+		return "", invalidCredentials("invalid ticket")
+	}
+	expiresAt := time.Unix(0, int64(binary.BigEndian.Uint64(plain[:8])))
+	if !now.Before(expiresAt) {
+		return "", invalidCredentials("ticket has expired")
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for n, exp := range t.redeemed {
+		if !now.Before(exp) {
+			delete(t.redeemed, n)
+		}
+	}
+	if _, ok := t.redeemed[string(nonce)]; ok {
+		return "", invalidCredentials("ticket has already been redeemed")
+	}
+	t.redeemed[string(nonce)] = expiresAt
+	return string(plain[8:]), nil
+}
+
+// serveTicket responds to requests of the ticket endpoint, it reports whether the request was handled
+func serveTicket(w http.ResponseWriter, r *http.Request, authenticator Authenticator, tenancy Tenancy, logs log.Sink) bool {
+	policy, ok := authenticator.(TokenPolicy)
+	if !ok || policy.Tickets == nil || r.URL.Path != TicketEndpoint {
+		return false
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+	if r.URL.Query().Get(TicketParam) != "" {
+		http.Error(w, "tickets cannot be exchanged for tickets", http.StatusBadRequest)
+		return true
+	}
+	usrInfo, creds, ok := authenticateRequest(w, r, authenticator, tenancy, logs)
+	if !ok {
+		return true
+	}
+	if creds.token == "" {
+		http.Error(w, "tickets are only issued for tokens that can be re-authenticated", http.StatusBadRequest)
+		return true
+	}
+
+	res, err := policy.Tickets.Issue(creds.token, time.Now())
+	if err != nil {
+		log.Event(logs, "failed to issue ticket", log.Error(err), log.Fields{"user": usrInfo})
+		http.Error(w, "failed to issue ticket", http.StatusInternalServerError)
+		return true
+	}
+	log.Event(logs, "issued ticket", log.V(1), log.Fields{"user": usrInfo, "expiresAt": res.ExpiresAt})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Event(logs, "failed to write ticket response", log.V(1), log.Error(err))
+	}
+	return true
+}
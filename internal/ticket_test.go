@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTickets(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tickets, err := NewTickets([]byte("key"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewTickets([]byte("other"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range map[string]struct {
+		tickets *Tickets
+		now     time.Time
+		// ticket changes the issued ticket before it is redeemed
+		ticket func(string) string
+		valid  bool
+	}{
+		"valid":                  {tickets: tickets, now: now, valid: true},
+		"valid until its expiry": {tickets: tickets, now: now.Add(time.Minute - time.Nanosecond), valid: true},
+		"expired":                {tickets: tickets, now: now.Add(time.Minute)},
+		"wrong key":              {tickets: other, now: now},
+		"tampered":               {tickets: tickets, now: now, ticket: tamperTicket},
+		"malformed":              {tickets: tickets, now: now, ticket: func(string) string { return "!" }},
+	} {
+		t.Run(name, func(t *testing.T) {
+			info, err := tickets.Issue("alice-token", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.ExpiresAt.Equal(now.Add(time.Minute)) {
+				t.Errorf("got expiry %v, want %v", info.ExpiresAt, now.Add(time.Minute))
+			}
+			ticket := info.Ticket
+			if tc.ticket != nil {
+				ticket = tc.ticket(ticket)
+			}
+			token, err := tc.tickets.Redeem(ticket, tc.now)
+			if !tc.valid {
+				if !errors.Is(err, ErrInvalidCredentials) {
+					t.Errorf("got token %q and error %v, want invalid credentials", token, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token != "alice-token" {
+				t.Errorf("got token %q, want alice-token", token)
+			}
+			if _, err := tc.tickets.Redeem(ticket, tc.now); !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("redeemed the ticket twice, got error %v", err)
+			}
+		})
+	}
+}
+
+// tamperTicket flips a bit of the encrypted token of the ticket
+func tamperTicket(ticket string) string {
+	sealed, _ := base64.RawURLEncoding.DecodeString(ticket)
+	sealed[len(sealed)-1] ^= 1
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	DefaultWriteTimeout     = 10 * time.Second
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	// DeadlineWrite, DeadlineHandshake and DeadlineIdle tell which deadline a listener exceeded in metrics
+	DeadlineWrite     = "write"
+	DeadlineHandshake = "handshake"
+	DeadlineIdle      = "idle"
+)
+
+// DeadlineMetrics counts the listeners that exceeded a deadline
+type DeadlineMetrics interface {
+	DeadlineExceeded(flow FlowReference, deadline string)
+}
+
+// isTimeout reports whether the error is caused by an exceeded deadline
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// setWriteDeadline bounds the time the next write to the connection may block for, writes are unbounded if WriteTimeout is zero
+func (l *listener) setWriteDeadline() error {
+	if l.opts.WriteTimeout <= 0 {
+		return nil
+	}
+	return l.conn.SetWriteDeadline(time.Now().Add(l.opts.WriteTimeout))
+}
+
+// writeFailed reports the failed write to metrics if it exceeded its deadline
+func (l *listener) writeFailed(err error) {
+	if !isTimeout(err) {
+		return
+	}
+	log.Event(l.logs, "write to listener exceeded its deadline", log.V(1), log.Fields{"listener": l, "timeout": l.opts.WriteTimeout})
+	for _, flow := range l.subscribedFlows() {
+		l.metrics.DeadlineExceeded(flow, DeadlineWrite)
+	}
+}
+
+// markActive records that a frame has been exchanged with the listener, which is then not idle
+func (l *listener) markActive() {
+	atomic.StoreInt64(&l.lastActive, time.Now().UnixNano())
+}
+
+// idleLoop closes the connection once neither records nor messages have been exchanged with the listener for the timeout, keepalive pings do not count
+func (l *listener) idleLoop(timeout time.Duration) {
+	for {
+		lastActive := time.Unix(0, atomic.LoadInt64(&l.lastActive))
+		if idle := time.Since(lastActive); idle < timeout {
+			if !l.sleepUntil(lastActive.Add(timeout)) {
+				return
+			}
+			continue
+		}
+		log.Event(l.logs, "listener is idle, disconnecting", log.V(1), log.Fields{"listener": l, "timeout": timeout})
+		for _, flow := range l.subscribedFlows() {
+			l.metrics.DeadlineExceeded(flow, DeadlineIdle)
+		}
+		l.closeWith(CloseIdle, "listener has been idle for "+timeout.String())
+		return
+	}
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// DefaultCertificateReloadInterval is how often certificate files are checked for changes
+const DefaultCertificateReloadInterval = time.Minute
+
+// ParseTLSVersion parses TLS versions in 1.x form
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("invalid TLS version %q", s)
+	}
+}
+
+// ParseCipherSuites looks up cipher suites by their IANA names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+// TLS 1.3 cipher suites are not configurable and are rejected
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := make(map[string]*tls.CipherSuite)
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[s.Name] = s
+	}
+	var res []uint16
+	for _, name := range names {
+		s := suites[strings.TrimSpace(name)]
+		if s == nil {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if len(s.SupportedVersions) == 1 && s.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("cipher suite %s is a TLS 1.3 cipher suite, which cannot be configured", name)
+		}
+		res = append(res, s.ID)
+	}
+	return res, nil
+}
+
+// NewCertificateReloader loads a certificate and its key from PEM files
+func NewCertificateReloader(certFile, keyFile string, logs log.Sink) (*CertificateReloader, error) {
+	r := &CertificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logs:     log.WithFields(logs, log.Fields{"task": "certificate reloader", "cert": certFile}),
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// CertificateReloader serves a certificate read from files, reloading it when the files change, e.g. when the secret mounted with them is renewed
+type CertificateReloader struct {
+	cert     *tls.Certificate
+	certFile string
+	certPEM  []byte
+	keyFile  string
+	keyPEM   []byte
+	logs     log.Sink
+	mutex    sync.RWMutex
+}
+
+// GetCertificate can be used as the GetCertificate callback of TLS configurations
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+// Run checks the files for changes at the specified interval until the stop signal is closed
+// The previous certificate is kept if the new files cannot be loaded, e.g. because only one of them has been updated so far
+func (r *CertificateReloader) Run(interval time.Duration, stopSignal <-chan struct{}) {
+	if interval <= 0 {
+		interval = DefaultCertificateReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopSignal:
+			return
+		case <-ticker.C:
+		}
+		changed, err := r.reload()
+		if err != nil {
+			log.Event(r.logs, "failed to reload certificate", log.Error(err))
+			continue
+		}
+		if changed {
+			log.Event(r.logs, "certificate reloaded")
+		}
+	}
+}
+
+func (r *CertificateReloader) reload() (bool, error) {
+	certPEM, err := os.ReadFile(r.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := os.ReadFile(r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.mutex.RLock()
+	unchanged := bytes.Equal(certPEM, r.certPEM) && bytes.Equal(keyPEM, r.keyPEM)
+	r.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, err
+	}
+
+	r.mutex.Lock()
+	r.cert = &cert
+	r.certPEM = certPEM
+	r.keyPEM = keyPEM
+	r.mutex.Unlock()
+	return true, nil
+}
@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+const (
+	// TokenSourceHeader is the X-Authorization header
+	TokenSourceHeader TokenSource = "header"
+	// TokenSourceBearer is the standard Authorization header with the Bearer scheme
+	TokenSourceBearer TokenSource = "bearer"
+	// TokenSourceSubprotocol is a websocket subprotocol offered in the Sec-WebSocket-Protocol header, see TokenSubprotocolPrefix
+	TokenSourceSubprotocol TokenSource = "subprotocol"
+	// TokenSourceQuery is a short-lived token signed by QueryTokenSigner in the TokenQueryParam query parameter
+	TokenSourceQuery TokenSource = "query"
+	// TokenSourceTicket is a single-use ticket issued by the TicketEndpoint in the TicketParam query parameter
+	TokenSourceTicket TokenSource = "ticket"
+
+	// WebSocketSubprotocol is the subprotocol selected by the service, clients offering their token as a subprotocol have to offer it as well
+	WebSocketSubprotocol = "log-socket"
+	// TokenSubprotocolPrefix precedes the base64url-encoded token offered as a subprotocol, e.g. log-socket.bearer.ZXlKaGJH...
+	TokenSubprotocolPrefix = "log-socket.bearer."
+	TokenQueryParam        = "access_token"
+
+	DefaultQueryTokenMaxTTL = 5 * time.Minute
+)
+
+// DefaultTokenSources are the token sources accepted unless configured otherwise, signed query tokens have to be enabled explicitly
+var DefaultTokenSources = []TokenSource{TokenSourceHeader, TokenSourceBearer, TokenSourceSubprotocol, TokenSourceTicket}
+
+// TokenSource is a part of requests listeners can present their token in
+type TokenSource string
+
+func ParseTokenSource(s string) (TokenSource, error) {
+	switch src := TokenSource(s); src {
+	case TokenSourceHeader, TokenSourceBearer, TokenSourceSubprotocol, TokenSourceQuery, TokenSourceTicket:
+		return src, nil
+	default:
+		return "", fmt.Errorf("invalid token source %q", s)
+	}
+}
+
+// TokenPolicy decides where requests may carry the token verified by the wrapped authenticator
+// Requests are authenticated with the X-Authorization header only unless the authenticator is a TokenPolicy
+type TokenPolicy struct {
+	Authenticator
+	// Sources are looked up in order, the first one found in the request is used, DefaultTokenSources if empty
+	Sources []TokenSource
+	// QueryTokens verifies the tokens of TokenSourceQuery
+	QueryTokens *QueryTokenSigner
+	// Tickets issues and redeems the tickets of TokenSourceTicket, the ticket endpoint is disabled if nil
+	Tickets *Tickets
+	// Impersonation decides whether users may impersonate others with impersonation headers, impersonation is disabled if nil
+	Impersonation ImpersonationAuthorizer
+}
+
+func (p TokenPolicy) Ready() error {
+	if c, ok := p.Authenticator.(ReadinessChecker); ok {
+		return c.Ready()
+	}
+	return nil
+}
+
+// requestToken returns the token of the request and its source, or an empty token if the request carries none in an accepted source
+// Tickets are redeemed for the token they were issued for
+func requestToken(r *http.Request, authenticator Authenticator) (string, TokenSource, error) {
+	sources := []TokenSource{TokenSourceHeader}
+	var policy TokenPolicy
+	if p, ok := authenticator.(TokenPolicy); ok {
+		sources, policy = p.Sources, p
+		if len(sources) == 0 {
+			sources = DefaultTokenSources
+		}
+	}
+	for _, src := range sources {
+		var token string
+		switch src {
+		case TokenSourceHeader:
+			token = r.Header.Get(AuthHeaderKey)
+		case TokenSourceBearer:
+			if scheme, value, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+				token = strings.TrimSpace(value)
+			}
+		case TokenSourceSubprotocol:
+			for _, protocol := range websocket.Subprotocols(r) {
+				if encoded := strings.TrimPrefix(protocol, TokenSubprotocolPrefix); encoded != protocol {
+					if data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "=")); err == nil {
+						token = string(data)
+					}
+					break
+				}
+			}
+		case TokenSourceQuery:
+			if policy.QueryTokens != nil {
+				token = r.URL.Query().Get(TokenQueryParam)
+			}
+		case TokenSourceTicket:
+			if ticket := r.URL.Query().Get(TicketParam); ticket != "" && policy.Tickets != nil {
+				var err error
+				if token, err = policy.Tickets.Redeem(ticket, time.Now()); err != nil {
+					return "", src, err
+				}
+			}
+		}
+		if token != "" {
+			return token, src, nil
+		}
+	}
+	return "", "", nil
+}
+
+// QueryTokenSigner issues and verifies short-lived tokens signed with HMAC-SHA256, which identify a user without revealing their credentials in URLs
+// Tokens are the base64url-encoded JSON claims and signature joined by a dot, the claims holding the user info (sub, uid, groups, extra) and the expiry (exp, in Unix seconds)
+type QueryTokenSigner struct {
+	Key []byte
+	// MaxTTL is the longest lifetime tokens are accepted with
+	MaxTTL time.Duration
+}
+
+type queryTokenClaims struct {
+	Username string                       `json:"sub"`
+	UID      string                       `json:"uid,omitempty"`
+	Groups   []string                     `json:"groups,omitempty"`
+	Extra    map[string]authv1.ExtraValue `json:"extra,omitempty"`
+	Expiry   int64                        `json:"exp"`
+}
+
+func (s QueryTokenSigner) maxTTL() time.Duration {
+	if s.MaxTTL <= 0 {
+		return DefaultQueryTokenMaxTTL
+	}
+	return s.MaxTTL
+}
+
+// Sign issues a token of the user valid for ttl, which cannot be longer than MaxTTL
+func (s QueryTokenSigner) Sign(user authv1.UserInfo, ttl time.Duration, now time.Time) (string, error) {
+	if ttl <= 0 || ttl > s.maxTTL() {
+		return "", fmt.Errorf("token lifetime has to be positive and at most %s", s.maxTTL())
+	}
+	claims, err := json.Marshal(queryTokenClaims{
+		Username: user.Username,
+		UID:      user.UID,
+		Groups:   user.Groups,
+		Extra:    user.Extra,
+		Expiry:   now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(s.mac(payload)), nil
+}
+
+// Verify returns the user and expiry of a token issued by Sign if it is intact and not expired
+func (s QueryTokenSigner) Verify(token string, now time.Time) (res authv1.UserInfo, expiry time.Time, err error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return res, time.Time{}, invalidCredentials("malformed query token")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, s.mac(payload)) {
+		return res, time.Time{}, invalidCredentials("invalid query token signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return res, time.Time{}, invalidCredentials("malformed query token")
+	}
+	var claims queryTokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return res, time.Time{}, invalidCredentials("malformed query token claims")
+	}
+	expiry = time.Unix(claims.Expiry, 0)
+	switch {
+	case !now.Before(expiry):
+		return res, time.Time{}, invalidCredentials("query token has expired")
+	case expiry.Sub(now) > s.maxTTL():
+		return res, time.Time{}, invalidCredentials("query token is valid for longer than accepted")
+	case claims.Username == "":
+		return res, time.Time{}, invalidCredentials("query token has no subject")
+	}
+	return authv1.UserInfo{Username: claims.Username, UID: claims.UID, Groups: claims.Groups, Extra: claims.Extra}, expiry, nil
+}
+
+func (s QueryTokenSigner) mac(payload string) []byte {
+	h := hmac.New(sha256.New, s.Key)
+	_, _ = h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// authenticateToken verifies a token of the source, signed query tokens are verified by the policy's signer rather than the authenticator
+// The expiry is that of signed query tokens, which are not re-authenticated, and zero for other tokens
+func authenticateToken(authenticator Authenticator, token string, source TokenSource) (authv1.UserInfo, time.Time, error) {
+	if source == TokenSourceQuery {
+		p, ok := authenticator.(TokenPolicy)
+		if !ok || p.QueryTokens == nil {
+			return authv1.UserInfo{}, time.Time{}, errors.New("query tokens are not accepted")
+		}
+		return p.QueryTokens.Verify(token, time.Now())
+	}
+	usrInfo, err := authenticator.Authenticate(token)
+	return usrInfo, time.Time{}, err
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+// tamper replaces the subject in the claims of a signed token, keeping its signature
+func tamper(t *testing.T, token string, from string, to string) string {
+	payload, signature, _ := strings.Cut(token, ".")
+	claims, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(claims), from, to, 1)
+	if tampered == string(claims) {
+		t.Fatalf("%q not found in the claims %s", from, claims)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(tampered)) + "." + signature
+}
+
+func TestQueryTokenSigner(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	alice := authv1.UserInfo{Username: "alice", UID: "1", Groups: []string{"devs"}}
+	signer := QueryTokenSigner{Key: []byte("key"), MaxTTL: time.Hour}
+	token, err := signer.Sign(alice, time.Minute, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := QueryTokenSigner{Key: signer.Key, MaxTTL: 2 * time.Hour}.Sign(alice, 2*time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range map[string]struct {
+		signer QueryTokenSigner
+		token  string
+		now    time.Time
+		valid  bool
+	}{
+		"valid":                  {signer: signer, token: token, now: now, valid: true},
+		"valid until its expiry": {signer: signer, token: token, now: now.Add(time.Minute - time.Second), valid: true},
+		"expired":                {signer: signer, token: token, now: now.Add(time.Minute)},
+		"over the maximum ttl":   {signer: signer, token: long, now: now},
+		"tampered":               {signer: signer, token: tamper(t, token, `"alice"`, `"admin"`), now: now},
+		"wrong key":              {signer: QueryTokenSigner{Key: []byte("other"), MaxTTL: time.Hour}, token: token, now: now},
+		"malformed":              {signer: signer, token: "alice", now: now},
+	} {
+		t.Run(name, func(t *testing.T) {
+			usr, expiry, err := tc.signer.Verify(tc.token, tc.now)
+			if !tc.valid {
+				if !errors.Is(err, ErrInvalidCredentials) {
+					t.Errorf("got error %v, want invalid credentials", err)
+				}
+				if !expiry.IsZero() {
+					t.Errorf("got expiry %v of an invalid token", expiry)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usr.Username != alice.Username || usr.UID != alice.UID || len(usr.Groups) != 1 || usr.Groups[0] != "devs" {
+				t.Errorf("got user %+v, want %+v", usr, alice)
+			}
+			if !expiry.Equal(now.Add(time.Minute)) {
+				t.Errorf("got expiry %v, want %v", expiry, now.Add(time.Minute))
+			}
+		})
+	}
+}
+
+func TestQueryTokenSignerRejectsLongLifetimes(t *testing.T) {
+	signer := QueryTokenSigner{Key: []byte("key"), MaxTTL: time.Hour}
+	for _, ttl := range []time.Duration{0, -time.Minute, time.Hour + time.Second} {
+		if _, err := signer.Sign(authv1.UserInfo{Username: "alice"}, ttl, time.Now()); err == nil {
+			t.Errorf("signed a token valid for %s", ttl)
+		}
+	}
+}
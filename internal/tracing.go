@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"context"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const DefaultTracingSampleRatio = 0.01
+
+// tracer records the spans of the record path, it does nothing unless tracing is set up with NewTracerProvider
+var tracer = otel.Tracer(otlpScopeName)
+
+// TracingOptions holds the settings of exporting spans to an OpenTelemetry collector
+type TracingOptions struct {
+	// Endpoint is the URL spans are posted to over OTLP/HTTP, e.g. http://otel-collector:4318/v1/traces
+	Endpoint string
+	// Headers are added to export requests, e.g. for authentication
+	Headers map[string]string
+	// SampleRatio is the ratio of ingest requests traced unless their trace context decides otherwise
+	SampleRatio float64
+	// Attributes describe the exporting replica, such as service.name
+	Attributes map[string]string
+}
+
+// NewTracerProvider sets up tracing of the record path, the returned provider has to be shut down to flush pending spans
+// The trace context of ingest requests is propagated with W3C Trace Context headers (traceparent)
+func NewTracerProvider(opts TracingOptions) (*sdktrace.TracerProvider, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	clientOpts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(endpoint.Host),
+		otlptracehttp.WithURLPath(endpoint.Path),
+		otlptracehttp.WithHeaders(opts.Headers),
+	}
+	if endpoint.Scheme != "https" {
+		clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make([]attribute.KeyValue, 0, len(opts.Attributes))
+	for _, name := range sortedKeys(opts.Attributes) {
+		attrs = append(attrs, attribute.String(name, opts.Attributes[name]))
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider, nil
+}
+
+func flowAttributes(flow FlowReference) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("flow.kind", string(flow.Kind)),
+		attribute.String("flow.namespace", flow.Namespace),
+		attribute.String("flow.name", flow.Name),
+	}
+}
+
+// StartRecordSpan starts a span of handling the record if the request it was ingested with is traced, the record carries the span to further steps
+func StartRecordSpan(r Record, name string, attrs ...attribute.KeyValue) (Record, trace.Span) {
+	if !r.trace.IsSampled() {
+		return r, trace.SpanFromContext(context.Background())
+	}
+	ctx := trace.ContextWithSpanContext(context.Background(), r.trace)
+	_, span := tracer.Start(ctx, name, trace.WithAttributes(append(flowAttributes(r.Flow), attrs...)...))
+	r.trace = span.SpanContext()
+	return r, span
+}
+
+// injectTrace returns the traceparent header of the record's trace context, if it is traced
+func injectTrace(r Record) string {
+	if !r.trace.IsSampled() {
+		return ""
+	}
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(trace.ContextWithSpanContext(context.Background(), r.trace), carrier)
+	return carrier.Get("traceparent")
+}
+
+// extractTrace parses a traceparent header
+func extractTrace(traceparent string) trace.SpanContext {
+	if traceparent == "" {
+		return trace.SpanContext{}
+	}
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier{"traceparent": traceparent})
+	return trace.SpanContextFromContext(ctx)
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const SelectParam = "select"
+
+// FieldSelection is a transform that replaces the data of records with an object of selected fields
+// It is parsed from a comma-separated list of jq-like paths (e.g. .message,.kubernetes.pod_name,.kubernetes.labels.app), each optionally preceded by the name of the output field (e.g. pod=.kubernetes.pod_name)
+type FieldSelection []selectedField
+
+type selectedField struct {
+	name string
+	path []pathElement
+}
+
+// pathElement is either an object key or, if key is empty, an array index
+type pathElement struct {
+	key   string
+	index int
+}
+
+// ParseFieldSelection parses the select query parameter of a listener connection request, it returns nil if the parameter is not set
+func ParseFieldSelection(query url.Values) (FieldSelection, error) {
+	expr := query.Get(SelectParam)
+	if expr == "" {
+		return nil, nil
+	}
+	var res FieldSelection
+	for _, item := range strings.Split(expr, ",") {
+		item = strings.TrimSpace(item)
+		name, pathExpr, renamed := strings.Cut(item, "=")
+		if !renamed {
+			pathExpr = item
+			name = strings.TrimPrefix(item, ".")
+		}
+		path, err := parsePath(pathExpr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s parameter: %w", SelectParam, err)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("invalid %s parameter: %q has no field name", SelectParam, item)
+		}
+		res = append(res, selectedField{name: name, path: path})
+	}
+	return res, nil
+}
+
+// parsePath parses paths like .kubernetes.labels.app or .items[0].name
+func parsePath(expr string) (res []pathElement, err error) {
+	if !strings.HasPrefix(expr, ".") {
+		return nil, fmt.Errorf("path %q does not start with a dot", expr)
+	}
+	for _, segment := range strings.Split(expr[1:], ".") {
+		key := segment
+		var indices []int
+		if open := strings.IndexByte(segment, '['); open >= 0 {
+			key = segment[:open]
+			for rest := segment[open:]; rest != ""; {
+				end := strings.IndexByte(rest, ']')
+				if !strings.HasPrefix(rest, "[") || end < 0 {
+					return nil, fmt.Errorf("path %q has an invalid index", expr)
+				}
+				idx, err := strconv.Atoi(rest[1:end])
+				if err != nil || idx < 0 {
+					return nil, fmt.Errorf("path %q has an invalid index", expr)
+				}
+				indices = append(indices, idx)
+				rest = rest[end+1:]
+			}
+		}
+		if key == "" && len(indices) == 0 {
+			return nil, fmt.Errorf("path %q has an empty segment", expr)
+		}
+		if key != "" {
+			res = append(res, pathElement{key: key})
+		}
+		for _, idx := range indices {
+			res = append(res, pathElement{index: idx})
+		}
+	}
+	return res, nil
+}
+
+// Apply returns the record with its data replaced by the selected fields, fields missing from the record are omitted
+func (s FieldSelection) Apply(r Record) (Record, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, field := range s {
+		value, ok := lookupPath(r.RawData, field.path)
+		if !ok {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(field.name)
+		if err != nil {
+			return r, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	r.RawData = buf.Bytes()
+	r.frames = nil
+	return r, nil
+}
+
+func lookupPath(data json.RawMessage, path []pathElement) (json.RawMessage, bool) {
+	for _, elt := range path {
+		if elt.key != "" {
+			var obj map[string]json.RawMessage
+			if json.Unmarshal(data, &obj) != nil {
+				return nil, false
+			}
+			var ok bool
+			if data, ok = obj[elt.key]; !ok {
+				return nil, false
+			}
+		} else {
+			var arr []json.RawMessage
+			if json.Unmarshal(data, &arr) != nil || elt.index >= len(arr) {
+				return nil, false
+			}
+			data = arr[elt.index]
+		}
+	}
+	return data, true
+}
@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// UIPathPrefix is the path prefix of the embedded web UI
+const UIPathPrefix = "/ui/"
+
+//go:embed ui
+var uiFiles embed.FS
+
+// newUIHandler serves the web UI, which authenticates its requests to the flows and server-sent events endpoints with the token entered by the user
+func newUIHandler() http.Handler {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix(UIPathPrefix, http.FileServer(http.FS(files)))
+}
+
+// serveUI responds to requests of the web UI, it reports whether the request was handled
+func serveUI(w http.ResponseWriter, r *http.Request, ui http.Handler) bool {
+	if ui == nil {
+		return false
+	}
+	if r.URL.Path == strings.TrimSuffix(UIPathPrefix, "/") {
+		http.Redirect(w, r, UIPathPrefix, http.StatusMovedPermanently)
+		return true
+	}
+	if !strings.HasPrefix(r.URL.Path, UIPathPrefix) {
+		return false
+	}
+	ui.ServeHTTP(w, r)
+	return true
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	// WebhookSignatureHeader carries the hex-encoded HMAC-SHA256 of the timestamp, a dot and the body of webhook requests, in sha256=<signature> form
+	WebhookSignatureHeader = "X-Log-Socket-Signature"
+	// WebhookTimestampHeader is the Unix time a webhook request was signed at, receivers should reject old ones to prevent replays
+	WebhookTimestampHeader = "X-Log-Socket-Timestamp"
+	// WebhookDeliveryHeader identifies a batch, it is the same for the retries of a batch so that receivers can drop duplicates
+	WebhookDeliveryHeader = "X-Log-Socket-Delivery"
+)
+
+// NewWebhookSink returns a sink posting batches of the records of the flow to the URL, e.g. webhook+https://bot.example.com/logs (webhook for plain HTTP)
+// The secretFile query parameter is the file holding the HMAC key requests are signed with, requests are not signed if it is empty
+func NewWebhookSink(flow FlowReference, u *url.URL, logs log.Sink) (*WebhookSink, error) {
+	query := u.Query()
+	opts, err := parsePushSinkOptions(query)
+	if err != nil {
+		return nil, err
+	}
+	s := &WebhookSink{
+		client: &http.Client{Timeout: pushSinkTimeout},
+	}
+	if file := query.Get("secretFile"); file != "" {
+		if s.secret, err = os.ReadFile(file); err != nil {
+			return nil, err
+		}
+		if s.secret = bytes.TrimSpace(s.secret); len(s.secret) == 0 {
+			return nil, fmt.Errorf("webhook secret file %s is empty", file)
+		}
+	}
+	// the remaining query parameters belong to the webhook
+	for _, name := range []string{"secretFile", "batchSize", "batchWait"} {
+		query.Del(name)
+	}
+	endpoint := *u
+	endpoint.Scheme = "http"
+	if u.Scheme == "webhook+https" {
+		endpoint.Scheme = "https"
+	}
+	endpoint.RawQuery = query.Encode()
+	s.endpoint = endpoint.String()
+	s.batchingSink = batchingSink{
+		flow: flow,
+		logs: logs,
+		opts: opts,
+		push: s.pushBatch,
+	}
+	s.start()
+	return s, nil
+}
+
+// WebhookSink posts batches of records as {"flow": ..., "records": [...]} JSON objects, signing them with an HMAC key shared with the receiver
+type WebhookSink struct {
+	batchingSink
+	client   *http.Client
+	endpoint string
+	secret   []byte
+}
+
+type webhookBatch struct {
+	// Flow is the reference of the flow of the records in kind/namespace/name form
+	Flow    string            `json:"flow"`
+	Records []json.RawMessage `json:"records"`
+}
+
+// webhookSignature returns the signature of a request with the body signed at the time
+func webhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDeliveryID derives the ID of a batch from the records it starts and ends with
+func webhookDeliveryID(batch []Record) string {
+	id := sha256.Sum256([]byte(elasticsearchID(batch[0]) + "/" + elasticsearchID(batch[len(batch)-1]) + "/" + strconv.Itoa(len(batch))))
+	return hex.EncodeToString(id[:16])
+}
+
+func (s *WebhookSink) pushBatch(batch []Record) error {
+	body := webhookBatch{Flow: s.flow.URL(), Records: make([]json.RawMessage, 0, len(batch))}
+	for _, r := range batch {
+		if json.Valid(r.RawData) {
+			body.Records = append(body.Records, r.RawData)
+			continue
+		}
+		data, _ := json.Marshal(string(r.RawData))
+		body.Records = append(body.Records, data)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pushSinkTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookDeliveryHeader, webhookDeliveryID(batch))
+	if len(s.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, timestamp)
+		req.Header.Set(WebhookSignatureHeader, webhookSignature(s.secret, timestamp, data))
+	}
+	return doPushRequest(s.client, req)
+}
@@ -0,0 +1,61 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/siliconbrain/gologlite/log"
+)
+
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{
+		writer: w,
+	}
+}
+
+// JSONSink writes events as JSON objects, one per line, with their time and message under the time and msg keys
+type JSONSink struct {
+	writer io.Writer
+	mutex  sync.Mutex
+}
+
+func (t *JSONSink) Record(message string, fields log.FieldSet) {
+	event := make(map[string]interface{})
+	if fields != nil {
+		fields.ForEachField(func(name string, value interface{}) bool {
+			event[name] = jsonValue(value)
+			return false
+		})
+	}
+	event["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	event["msg"] = message
+	data, err := json.Marshal(event)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{"time": event["time"], "msg": message, "error": err.Error()})
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, _ = t.writer.Write(append(data, '\n'))
+}
+
+// jsonValue returns a value that marshals to JSON, values that do not are formatted like by WriterSink
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case json.Marshaler:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	}
+	if _, err := json.Marshal(value); err != nil {
+		return fmt.Sprintf("%+v", value)
+	}
+	return value
+}
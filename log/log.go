@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/siliconbrain/gologlite/log"
@@ -85,16 +86,26 @@ func empty(fields log.FieldSet) bool {
 	return !hasElem
 }
 
-func WithVerbosityFilter(logs Sink, verbosity int) Sink {
+func WithVerbosityFilter(logs Sink, verbosity int) *VerbosityFilterSink {
 	return &VerbosityFilterSink{
 		logs:      logs,
-		verbosity: verbosity,
+		verbosity: int32(verbosity),
 	}
 }
 
 type VerbosityFilterSink struct {
 	logs      Sink
-	verbosity int
+	verbosity int32
+}
+
+// Verbosity returns the verbosity of the events currently recorded
+func (s *VerbosityFilterSink) Verbosity() int {
+	return int(atomic.LoadInt32(&s.verbosity))
+}
+
+// SetVerbosity changes the verbosity of the events recorded from now on
+func (s *VerbosityFilterSink) SetVerbosity(verbosity int) {
+	atomic.StoreInt32(&s.verbosity, int32(verbosity))
 }
 
 func (s *VerbosityFilterSink) Record(message string, fields log.FieldSet) {
@@ -104,7 +115,7 @@ func (s *VerbosityFilterSink) Record(message string, fields log.FieldSet) {
 			verbosity = v
 		}
 	}
-	if verbosity <= s.verbosity {
+	if verbosity <= int(atomic.LoadInt32(&s.verbosity)) {
 		s.logs.Record(message, fields)
 	}
 }
@@ -0,0 +1,67 @@
+package log
+
+import (
+	"sync"
+	"time"
+
+	"github.com/siliconbrain/gologlite/log"
+)
+
+const suppressedFieldKey = "suppressed"
+
+// WithSampling limits events reporting an error to burst events of the same message per period, so that e.g. failing writes of every record do not flood the logs
+// The number of events suppressed is added to the next recorded event of the message, events without an error are always recorded
+func WithSampling(logs Sink, period time.Duration, burst int) *SamplingSink {
+	return &SamplingSink{
+		burst:    burst,
+		logs:     logs,
+		messages: make(map[string]*sampledMessage),
+		period:   period,
+	}
+}
+
+type SamplingSink struct {
+	burst    int
+	logs     Sink
+	messages map[string]*sampledMessage
+	mutex    sync.Mutex
+	period   time.Duration
+}
+
+type sampledMessage struct {
+	count      int
+	start      time.Time
+	suppressed int
+}
+
+func (s *SamplingSink) Record(message string, fields log.FieldSet) {
+	if _, found := log.LookupFieldByName(fields, "error"); !found {
+		s.logs.Record(message, fields)
+		return
+	}
+
+	s.mutex.Lock()
+	now := time.Now()
+	m := s.messages[message]
+	if m == nil {
+		m = &sampledMessage{start: now}
+		s.messages[message] = m
+	}
+	if now.Sub(m.start) >= s.period {
+		m.start, m.count = now, 0
+	}
+	m.count++
+	if m.count > s.burst {
+		m.suppressed++
+		s.mutex.Unlock()
+		return
+	}
+	suppressed := m.suppressed
+	m.suppressed = 0
+	s.mutex.Unlock()
+
+	if suppressed > 0 {
+		fields = log.CollapseFieldSets(fields, Fields{suppressedFieldKey: suppressed})
+	}
+	s.logs.Record(message, fields)
+}
@@ -0,0 +1,5 @@
+// Package logsocket holds the messages and the gRPC client and server of the LogSocket service defined in logsocket.proto
+// Clients in other languages can generate theirs from the same file, e.g. Java classes are generated in the io.banzaicloud.logsocket package
+package logsocket
+
+//go:generate protoc -I ../../.. --go_out=../../.. --go_opt=paths=source_relative --go-grpc_out=../../.. --go-grpc_opt=paths=source_relative pkg/api/logsocket/logsocket.proto
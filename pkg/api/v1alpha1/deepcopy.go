@@ -0,0 +1,72 @@
+package v1alpha1
+
+import (
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func (in *LogTap) DeepCopyInto(out *LogTap) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+func (in *LogTap) DeepCopy() *LogTap {
+	if in == nil {
+		return nil
+	}
+	out := new(LogTap)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *LogTap) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *LogTapSpec) DeepCopyInto(out *LogTapSpec) {
+	*out = *in
+	if in.TTL != nil {
+		out.TTL = new(metav1.Duration)
+		*out.TTL = *in.TTL
+	}
+	if in.Subjects != nil {
+		out.Subjects = make([]rbacv1.Subject, len(in.Subjects))
+		copy(out.Subjects, in.Subjects)
+	}
+}
+
+func (in *LogTapStatus) DeepCopyInto(out *LogTapStatus) {
+	*out = *in
+	if in.ExpiresAt != nil {
+		out.ExpiresAt = in.ExpiresAt.DeepCopy()
+	}
+}
+
+func (in *LogTapList) DeepCopyInto(out *LogTapList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]LogTap, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+func (in *LogTapList) DeepCopy() *LogTapList {
+	if in == nil {
+		return nil
+	}
+	out := new(LogTapList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *LogTapList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
@@ -0,0 +1,77 @@
+// Package v1alpha1 holds the resources of the logsocket.banzaicloud.io API group
+package v1alpha1
+
+import (
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+const (
+	LogTapKindFlow        = "Flow"
+	LogTapKindClusterFlow = "ClusterFlow"
+
+	LogTapPhaseActive  = "Active"
+	LogTapPhaseExpired = "Expired"
+	LogTapPhaseInvalid = "Invalid"
+)
+
+var (
+	GroupVersion = schema.GroupVersion{Group: "logsocket.banzaicloud.io", Version: "v1alpha1"}
+
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+	AddToScheme   = SchemeBuilder.AddToScheme
+)
+
+func init() {
+	SchemeBuilder.Register(&LogTap{}, &LogTapList{})
+}
+
+// LogTap pre-approves its subjects to tail a flow in its namespace, or a cluster flow if it is in the control namespace, until it expires
+type LogTap struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   LogTapSpec   `json:"spec"`
+	Status LogTapStatus `json:"status,omitempty"`
+}
+
+type LogTapSpec struct {
+	Flow LogTapFlowReference `json:"flow"`
+	// Filters restrict the records the subjects receive, with the semantics of the filter query parameters of connection requests
+	Filters LogTapFilters `json:"filters,omitempty"`
+	// TTL is how long the tap grants access after its creation, it never expires if not set
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+	// Subjects are the users, groups and service accounts allowed to tail the flow
+	Subjects []rbacv1.Subject `json:"subjects"`
+}
+
+// LogTapFlowReference names a flow in the namespace of the tap
+type LogTapFlowReference struct {
+	// Kind is either Flow or ClusterFlow, Flow if empty
+	Kind string `json:"kind,omitempty"`
+	Name string `json:"name"`
+}
+
+// LogTapFilters are regular expressions which have to match the whole value of record fields, empty expressions match everything
+type LogTapFilters struct {
+	Container string `json:"container,omitempty"`
+	Level     string `json:"level,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+}
+
+type LogTapStatus struct {
+	// Phase is Active, Expired or Invalid
+	Phase     string       `json:"phase,omitempty"`
+	Message   string       `json:"message,omitempty"`
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+}
+
+type LogTapList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []LogTap `json:"items"`
+}
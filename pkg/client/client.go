@@ -0,0 +1,286 @@
+// Package client streams records of flows from the log-socket service and transparently resumes streams after disconnections
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	pathpkg "path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	DefaultBufferSize = 100
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = 30 * time.Second
+
+	// authHeaderKey and the query parameters below are defined by the service, its close codes are generated from the protocol spec
+	authHeaderKey = "X-Authorization"
+)
+
+// Record is a record of a flow received from the service
+type Record struct {
+	// Flow is the reference of the record's flow in kind/namespace/name form
+	Flow string
+	// Sequence is the position of the record in its flow
+	Sequence uint64
+	// Time is when the record was produced and ReceivedAt is when the service ingested it, zero if unknown
+	Time       time.Time
+	ReceivedAt time.Time
+	// ClockSkewed tells that the record's timestamp was too far from the time it was ingested
+	ClockSkewed bool
+	// Data is the record as received by the service
+	Data json.RawMessage
+}
+
+// Options holds the settings of a stream
+type Options struct {
+	// Addr is the URL (e.g. wss://log-socket.example.com) or host:port of the service's listener endpoint
+	Addr string
+	// Token is the token the listener is authenticated with
+	Token string
+	// Header holds additional headers sent when connecting, e.g. credentials of a proxy
+	Header http.Header
+	// TLSConfig is used to connect to the service, it can also hold the client certificate the listener is authenticated with
+	TLSConfig *tls.Config
+	// Query holds additional query parameters, e.g. record filters
+	Query url.Values
+	// Tail and Since request retained records when first connecting, reconnections resume after the last received record instead
+	Tail  int
+	Since string
+	// MinBackoff and MaxBackoff bound the exponentially increasing delay between reconnection attempts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// BufferSize is the capacity of the returned channel
+	BufferSize int
+	Logs       log.Sink
+}
+
+// Stream connects to the service and returns a channel of the flow's records
+// Connections lost because of network errors, service restarts or slow consumption are re-established, resuming after the last received record as long as it is retained by the service
+// The channel is closed when the context is done or the service permanently rejects the listener, e.g. because its credentials are invalid, an administrator disconnected it or the flow has been deleted
+func Stream(ctx context.Context, flowRef string, opts Options) (<-chan Record, error) {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultBufferSize
+	}
+	if opts.Logs == nil {
+		opts.Logs = log.NewWriterSink(nopWriter{})
+	}
+
+	s := &stream{
+		flowRef: strings.Trim(flowRef, "/"),
+		logs:    log.WithFields(opts.Logs, log.Fields{"flow": flowRef}),
+		opts:    opts,
+		records: make(chan Record, opts.BufferSize),
+	}
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	go s.run(ctx, conn)
+	return s.records, nil
+}
+
+type stream struct {
+	flowRef string
+	// lastSequence is the sequence number of the last received record, zero if none has been received yet
+	lastSequence uint64
+	logs         log.Sink
+	opts         Options
+	records      chan Record
+}
+
+func (s *stream) run(ctx context.Context, conn *websocket.Conn) {
+	defer close(s.records)
+
+	for {
+		err := s.receive(ctx, conn)
+		if ctx.Err() != nil {
+			return
+		}
+		if permanent(err) {
+			log.Event(s.logs, "service rejected listener", log.Error(err))
+			return
+		}
+		log.Event(s.logs, "connection lost, reconnecting", log.V(1), log.Error(err), log.Fields{"lastSequence": s.lastSequence})
+
+		backoff := s.opts.MinBackoff
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if conn, err = s.dial(ctx); err == nil {
+				break
+			}
+			if permanent(err) {
+				log.Event(s.logs, "service rejected listener", log.Error(err))
+				return
+			}
+			log.Event(s.logs, "failed to reconnect", log.V(1), log.Error(err), log.Fields{"backoff": backoff})
+			if backoff *= 2; backoff > s.opts.MaxBackoff {
+				backoff = s.opts.MaxBackoff
+			}
+		}
+		log.Event(s.logs, "reconnected", log.V(1), log.Fields{"lastSequence": s.lastSequence})
+	}
+}
+
+func (s *stream) dial(ctx context.Context) (*websocket.Conn, error) {
+	addr := s.opts.Addr
+	if !strings.Contains(addr, "://") {
+		addr = "wss://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = pathpkg.Join(u.Path, s.flowRef)
+
+	query := make(url.Values)
+	for key, values := range s.opts.Query {
+		query[key] = values
+	}
+	// multiplexed streams wrap records with their flow reference and sequence number
+	query.Set("multiplex", "true")
+	if s.lastSequence > 0 {
+		query.Set("after", strconv.FormatUint(s.lastSequence, 10))
+	} else {
+		if s.opts.Tail > 0 {
+			query.Set("tail", strconv.Itoa(s.opts.Tail))
+		}
+		if s.opts.Since != "" {
+			query.Set("since", s.opts.Since)
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	header := make(http.Header)
+	for key, values := range s.opts.Header {
+		header[key] = values
+	}
+	if s.opts.Token != "" {
+		header.Set(authHeaderKey, s.opts.Token)
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	dialer.TLSClientConfig = s.opts.TLSConfig
+
+	conn, resp, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil && resp != nil {
+		return nil, &HandshakeError{StatusCode: resp.StatusCode, Err: err}
+	}
+	return conn, err
+}
+
+// receive pushes records received over the connection until it fails or the context is done
+func (s *stream) receive(ctx context.Context, conn *websocket.Conn) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			conn.Close()
+		case <-done:
+			conn.Close()
+		}
+	}()
+
+	for {
+		msgTyp, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if msgTyp == websocket.TextMessage {
+			// text messages of raw multiplexed streams are control messages
+			log.Event(s.logs, "received control message", log.V(1), log.Fields{"message": string(data)})
+			continue
+		}
+
+		var envelope struct {
+			Flow        string          `json:"flow"`
+			Sequence    uint64          `json:"sequence"`
+			Time        time.Time       `json:"time"`
+			ReceivedAt  time.Time       `json:"receivedAt"`
+			ClockSkewed bool            `json:"clockSkewed"`
+			Record      json.RawMessage `json:"record"`
+		}
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			log.Event(s.logs, "failed to parse record envelope", log.V(1), log.Error(err))
+			continue
+		}
+		if envelope.Sequence > 0 {
+			s.lastSequence = envelope.Sequence
+		}
+		select {
+		case s.records <- Record{
+			Flow:        envelope.Flow,
+			Sequence:    envelope.Sequence,
+			Time:        envelope.Time,
+			ReceivedAt:  envelope.ReceivedAt,
+			ClockSkewed: envelope.ClockSkewed,
+			Data:        envelope.Record,
+		}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// HandshakeError is returned when the service refuses the websocket connection
+type HandshakeError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("websocket handshake failed with status %d: %s", e.StatusCode, e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// permanent reports whether reconnecting after the error is futile
+func permanent(err error) bool {
+	var handshakeErr *HandshakeError
+	if errors.As(err, &handshakeErr) {
+		switch handshakeErr.StatusCode {
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusNotAcceptable:
+			return true
+		}
+		return false
+	}
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		// close codes unknown to the spec, e.g. of abnormal closures, are treated as network errors
+		reconnect, ok := closeCodeReconnect[closeErr.Code]
+		return ok && !reconnect
+	}
+	return false
+}
+
+type nopWriter struct{}
+
+func (nopWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
@@ -0,0 +1,286 @@
+// Package msgpack implements the subset of MessagePack needed to speak the Fluentd forward protocol
+package msgpack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Ext is an extension value that has no native representation
+type Ext struct {
+	Type int8
+	Data []byte
+}
+
+// maxLength bounds the length of strings, binaries, arrays and maps so that malformed input cannot exhaust memory
+const maxLength = 64 << 20
+
+// maxDepth bounds the nesting of arrays and maps so that malformed input cannot exhaust the stack
+const maxDepth = 100
+
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// Decoder reads MessagePack values from a stream
+// Values are decoded as nil, bool, int64, uint64, float64, string, []byte, Ext, []interface{} or map[interface{}]interface{}
+type Decoder struct {
+	r *bufio.Reader
+}
+
+// Buffered reports whether there is buffered input that has not been decoded yet
+func (d *Decoder) Buffered() bool {
+	return d.r.Buffered() > 0
+}
+
+func (d *Decoder) Decode() (interface{}, error) {
+	return d.decode(0)
+}
+
+// decode reads a value nested in depth arrays or maps
+func (d *Decoder) decode(depth int) (interface{}, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xf0 == 0x80:
+		return d.decodeMap(int(b&0x0f), depth)
+	case b&0xf0 == 0x90:
+		return d.decodeArray(int(b&0x0f), depth)
+	case b&0xe0 == 0xa0:
+		return d.decodeString(int(b & 0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readLength(b - 0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return d.readBytes(n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.readLength(b - 0xc7)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(n)
+	case 0xca:
+		v, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.readUint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.readUint(1 << (b - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if v <= math.MaxInt64 {
+			return int64(v), nil
+		}
+		return v, nil
+	case 0xd0:
+		v, err := d.readUint(1)
+		return int64(int8(v)), err
+	case 0xd1:
+		v, err := d.readUint(2)
+		return int64(int16(v)), err
+	case 0xd2:
+		v, err := d.readUint(4)
+		return int64(int32(v)), err
+	case 0xd3:
+		v, err := d.readUint(8)
+		return int64(v), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.decodeExt(1 << (b - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readLength(b - 0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(n)
+	case 0xdc, 0xdd:
+		n, err := d.readLength(b - 0xdc + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.readLength(b - 0xde + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n, depth)
+	default:
+		return nil, fmt.Errorf("invalid MessagePack type byte 0x%02x", b)
+	}
+}
+
+// readLength reads a length field of 1, 2 or 4 bytes, selected by sizeClass 0, 1 or 2
+func (d *Decoder) readLength(sizeClass byte) (int, error) {
+	v, err := d.readUint(1 << sizeClass)
+	if err != nil {
+		return 0, err
+	}
+	if v > maxLength {
+		return 0, errors.New("MessagePack value is too long")
+	}
+	return int(v), nil
+}
+
+func (d *Decoder) readUint(size int) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(d.r, buf[8-size:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func (d *Decoder) readBytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(d.r, buf)
+	return buf, err
+}
+
+func (d *Decoder) decodeString(n int) (interface{}, error) {
+	buf, err := d.readBytes(n)
+	return string(buf), err
+}
+
+func (d *Decoder) decodeExt(n int) (interface{}, error) {
+	typ, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.readBytes(n)
+	return Ext{Type: int8(typ), Data: data}, err
+}
+
+func (d *Decoder) decodeArray(n int, depth int) (interface{}, error) {
+	if depth >= maxDepth {
+		return nil, errors.New("MessagePack value is nested too deeply")
+	}
+	res := make([]interface{}, 0, minInt(n, 1024))
+	for i := 0; i < n; i++ {
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+func (d *Decoder) decodeMap(n int, depth int) (interface{}, error) {
+	if depth >= maxDepth {
+		return nil, errors.New("MessagePack value is nested too deeply")
+	}
+	res := make(map[interface{}]interface{}, minInt(n, 1024))
+	for i := 0; i < n; i++ {
+		k, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		switch k.(type) {
+		case []interface{}, map[interface{}]interface{}, []byte, Ext:
+			return nil, errors.New("unsupported MessagePack map key type")
+		}
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		res[k] = v
+	}
+	return res, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func AppendArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 0x0f:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return appendUint16(append(b, 0xdc), uint16(n))
+	default:
+		return appendUint32(append(b, 0xdd), uint32(n))
+	}
+}
+
+func AppendMapHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 0x0f:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return appendUint16(append(b, 0xde), uint16(n))
+	default:
+		return appendUint32(append(b, 0xdf), uint32(n))
+	}
+}
+
+func AppendString(b []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n <= 0x1f:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = appendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = appendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func AppendBytes(b []byte, data []byte) []byte {
+	n := len(data)
+	switch {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = appendUint16(append(b, 0xc5), uint16(n))
+	default:
+		b = appendUint32(append(b, 0xc6), uint32(n))
+	}
+	return append(b, data...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func AppendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xc3)
+	}
+	return append(b, 0xc2)
+}